@@ -0,0 +1,177 @@
+// Package auth implements credentials for the various remote endpoints that Please talks to,
+// i.e. the remote execution & asset servers, the HTTP cache and remote_file downloads.
+//
+// Two mechanisms are supported, either or both of which can be configured: TLS client
+// certificates (and a custom CA to verify the server against), and tokens obtained from a
+// credential helper command, which are refreshed before they expire.
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+var log = logging.MustGetLogger("auth")
+
+// Credentials holds the credentials that we present to remote servers.
+type Credentials struct {
+	tlsConfig  *tls.Config
+	tokens     *TokenSource
+	tokenHosts map[string]bool
+}
+
+// New creates a new set of credentials.
+// certFile and keyFile are a client certificate & its private key, caCertFile is a set of
+// additional CA certificates to trust, tokenCommand is a credential helper to invoke to get
+// tokens and tokenHosts are hosts (beyond those explicitly passed to Transport) that the
+// tokens can be sent to. Any of them can be empty.
+func New(certFile, keyFile, caCertFile, tokenCommand string, tokenHosts []string) (*Credentials, error) {
+	creds := &Credentials{tokenHosts: map[string]bool{}}
+	if certFile != "" || keyFile != "" || caCertFile != "" {
+		config, err := newTLSConfig(certFile, keyFile, caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		creds.tlsConfig = config
+	}
+	if tokenCommand != "" {
+		tokens, err := NewTokenSource(tokenCommand)
+		if err != nil {
+			return nil, err
+		}
+		creds.tokens = tokens
+	}
+	for _, host := range tokenHosts {
+		creds.tokenHosts[host] = true
+	}
+	return creds, nil
+}
+
+// configCredentials is the memoised result of FromConfig.
+var configCredentials struct {
+	creds *Credentials
+	err   error
+	once  sync.Once
+}
+
+// FromConfig returns the credentials described by the [Auth] section of the given config.
+// The result is shared between all callers so the credential helper is only invoked once
+// per token, regardless of how many things need it.
+func FromConfig(config *core.Configuration) (*Credentials, error) {
+	configCredentials.once.Do(func() {
+		configCredentials.creds, configCredentials.err = New(config.Auth.CertFile, config.Auth.KeyFile, config.Auth.CACertFile, config.Auth.TokenCommand, config.Auth.TokenHosts)
+	})
+	return configCredentials.creds, configCredentials.err
+}
+
+// newTLSConfig creates a TLS config with the given client certificate & CA.
+func newTLSConfig(certFile, keyFile, caCertFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("Must set both a certificate and a key file for TLS client authentication")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load TLS client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caCertFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			log.Warning("Failed to load system certificate pool: %s", err)
+			pool = x509.NewCertPool()
+		}
+		b, err := ioutil.ReadFile(caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA certificate: %s", err)
+		} else if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No valid certificates found in %s", caCertFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// TLSConfig returns the TLS config to use when connecting to servers, or nil if there are no
+// custom TLS settings (in which case the default settings should be used).
+// The returned config is a copy and can be modified by the caller.
+func (creds *Credentials) TLSConfig() *tls.Config {
+	if creds.tlsConfig == nil {
+		return nil
+	}
+	return creds.tlsConfig.Clone()
+}
+
+// HasToken returns true if these credentials include a token.
+func (creds *Credentials) HasToken() bool {
+	return creds.tokens != nil
+}
+
+// Token returns the current token, fetching a new one if it has expired.
+// It returns an empty string if there is no token helper configured.
+func (creds *Credentials) Token() (string, error) {
+	if creds.tokens == nil {
+		return "", nil
+	}
+	return creds.tokens.Token()
+}
+
+// Transport returns an http.RoundTripper that presents these credentials.
+// The base transport is used to make requests and can be nil to use the default.
+// Tokens are only attached to requests to the given hosts or any of the configured
+// token hosts, so we don't leak them to arbitrary servers.
+func (creds *Credentials) Transport(base *http.Transport, hosts ...string) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	transport := base.Clone()
+	if creds.tlsConfig != nil {
+		transport.TLSClientConfig = creds.TLSConfig()
+	}
+	if creds.tokens == nil {
+		return transport
+	}
+	tokenHosts := make(map[string]bool, len(creds.tokenHosts)+len(hosts))
+	for host := range creds.tokenHosts {
+		tokenHosts[host] = true
+	}
+	for _, host := range hosts {
+		tokenHosts[host] = true
+	}
+	return &tokenTransport{
+		base:   transport,
+		tokens: creds.tokens,
+		hosts:  tokenHosts,
+	}
+}
+
+// A tokenTransport is an http.RoundTripper that adds a bearer token to outgoing requests.
+type tokenTransport struct {
+	base   http.RoundTripper
+	tokens *TokenSource
+	hosts  map[string]bool
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.hosts[req.URL.Hostname()] && !t.hosts[req.URL.Host] {
+		return t.base.RoundTrip(req)
+	}
+	token, err := t.tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+	// RoundTrippers must not modify the original request.
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
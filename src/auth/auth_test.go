@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlainToken(t *testing.T) {
+	token, expiry, err := parseToken([]byte("abcdef\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "abcdef", token)
+	assert.True(t, expiry.IsZero())
+}
+
+func TestParseJSONToken(t *testing.T) {
+	token, expiry, err := parseToken([]byte(`{"token": "abcdef", "expiry": "2020-05-01T12:00:00Z"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "abcdef", token)
+	assert.Equal(t, time.Date(2020, time.May, 1, 12, 0, 0, 0, time.UTC), expiry)
+}
+
+func TestParseEmptyToken(t *testing.T) {
+	_, _, err := parseToken([]byte("\n"))
+	assert.Error(t, err)
+	_, _, err = parseToken([]byte(`{"expiry": "2020-05-01T12:00:00Z"}`))
+	assert.Error(t, err)
+}
+
+func TestTokenRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "token.json")
+	writeToken := func(contents string) {
+		require.NoError(t, ioutil.WriteFile(filename, []byte(contents), 0644))
+	}
+	now := time.Date(2020, time.May, 1, 11, 0, 0, 0, time.UTC)
+	ts, err := NewTokenSource("cat " + filename)
+	require.NoError(t, err)
+	ts.now = func() time.Time { return now }
+
+	writeToken(`{"token": "token1", "expiry": "2020-05-01T12:00:00Z"}`)
+	token, err := ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token1", token)
+
+	// Should not re-run the helper since the token is still valid.
+	writeToken(`{"token": "token2", "expiry": "2020-05-01T13:00:00Z"}`)
+	token, err = ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token1", token)
+
+	// Now it's close enough to expiry that it should get a new one.
+	now = time.Date(2020, time.May, 1, 11, 59, 30, 0, time.UTC)
+	token, err = ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token2", token)
+}
+
+func TestTokenCommandFails(t *testing.T) {
+	ts, err := NewTokenSource("false")
+	require.NoError(t, err)
+	_, err = ts.Token()
+	assert.Error(t, err)
+}
+
+func TestTransportOnlySendsTokenToHosts(t *testing.T) {
+	var auth string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	require.NoError(t, err)
+
+	creds, err := New("", "", "", "echo abcdef", nil)
+	require.NoError(t, err)
+	assert.Nil(t, creds.TLSConfig())
+	assert.True(t, creds.HasToken())
+
+	client := &http.Client{Transport: creds.Transport(nil)}
+	_, err = client.Get(s.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "", auth)
+
+	client = &http.Client{Transport: creds.Transport(nil, u.Hostname())}
+	_, err = client.Get(s.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer abcdef", auth)
+}
+
+func TestIncompleteClientCertificate(t *testing.T) {
+	_, err := New("cert.pem", "", "", "", nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/shlex"
+)
+
+// refreshWindow is how long before a token's expiry that we fetch a new one.
+// This gives some leeway for clock skew and requests that take a while to arrive.
+const refreshWindow = 1 * time.Minute
+
+// commandTimeout is the maximum time we allow a credential helper to run for.
+const commandTimeout = 1 * time.Minute
+
+// A TokenSource provides tokens by invoking a credential helper command.
+// The command should print either just the token to stdout, or a JSON object like
+//
+//	{"token": "abc", "expiry": "2020-05-01T12:00:00Z"}
+//
+// in which case the token is cached until shortly before it expires.
+// Tokens without an expiry are assumed to be valid for the lifetime of the process.
+type TokenSource struct {
+	command []string
+	token   string
+	expiry  time.Time
+	mutex   sync.Mutex
+	// now is a hook for testing.
+	now func() time.Time
+}
+
+// A helperResponse is the JSON form of the output of a credential helper.
+type helperResponse struct {
+	Token  string    `json:"token"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// NewTokenSource creates a new TokenSource invoking the given command.
+func NewTokenSource(command string) (*TokenSource, error) {
+	cmd, err := shlex.Split(command)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token command: %s", err)
+	} else if len(cmd) == 0 {
+		return nil, fmt.Errorf("Empty token command")
+	}
+	return &TokenSource{command: cmd, now: time.Now}, nil
+}
+
+// Token returns the current token, re-invoking the helper if it has expired or is about to.
+func (ts *TokenSource) Token() (string, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if ts.token != "" && (ts.expiry.IsZero() || ts.now().Add(refreshWindow).Before(ts.expiry)) {
+		return ts.token, nil
+	}
+	token, expiry, err := ts.fetch()
+	if err != nil {
+		return "", err
+	}
+	ts.token = token
+	ts.expiry = expiry
+	return token, nil
+}
+
+// fetch invokes the credential helper and parses its output.
+func (ts *TokenSource) fetch() (string, time.Time, error) {
+	log.Debug("Fetching new token from %s", ts.command[0])
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ts.command[0], ts.command[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Failed to run token command: %s\n%s", err, stderr.String())
+	}
+	return parseToken(out)
+}
+
+// parseToken parses the output of a credential helper.
+func parseToken(out []byte) (string, time.Time, error) {
+	out = bytes.TrimSpace(out)
+	if !bytes.HasPrefix(out, []byte("{")) {
+		if len(out) == 0 {
+			return "", time.Time{}, fmt.Errorf("Token command didn't output a token")
+		}
+		return string(out), time.Time{}, nil
+	}
+	resp := helperResponse{}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return "", time.Time{}, fmt.Errorf("Failed to decode output of token command: %s", err)
+	} else if resp.Token = strings.TrimSpace(resp.Token); resp.Token == "" {
+		return "", time.Time{}, fmt.Errorf("Token command didn't output a token")
+	}
+	return resp.Token, resp.Expiry, nil
+}
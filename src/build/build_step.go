@@ -23,8 +23,11 @@ import (
 
 	"github.com/google/shlex"
 	"github.com/hashicorp/go-multierror"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"gopkg.in/op/go-logging.v1"
 
+	"github.com/thought-machine/please/src/auth"
 	"github.com/thought-machine/please/src/core"
 	"github.com/thought-machine/please/src/fs"
 	"github.com/thought-machine/please/src/worker"
@@ -38,6 +41,7 @@ var errStop = fmt.Errorf("stopping build")
 // httpClient is the shared http client that we use for fetching remote files.
 var httpClient http.Client
 var httpClientOnce sync.Once
+var httpClientErr error // Set if we fail to set up the client (e.g. invalid credentials)
 
 var magicSourcesWorkerKey = "WORKER"
 
@@ -179,6 +183,10 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget, runR
 			return err
 		}
 	} else {
+		// Anything built locally has its outputs in plz-out, so any record of them being remote is stale.
+		if err := os.RemoveAll(target.RemoteOutputsFile()); err != nil {
+			return err
+		}
 		// Ensure we have downloaded any previous dependencies if that's relevant.
 		if err := downloadInputsIfNeeded(tid, state, target); err != nil {
 			return err
@@ -980,19 +988,35 @@ func linkIfNotExists(src, dest string, f linkFunc) {
 // This is a builtin for better efficiency and more control over the whole process.
 func fetchRemoteFile(state *core.BuildState, target *core.BuildTarget) error {
 	httpClientOnce.Do(func() {
+		var transport *http.Transport
 		if state.Config.Build.HTTPProxy != "" {
-			httpClient.Transport = &http.Transport{
+			transport = &http.Transport{
 				Proxy: http.ProxyURL(state.Config.Build.HTTPProxy.AsURL()),
 			}
 		}
-
+		creds, err := auth.FromConfig(state.Config)
+		if err != nil {
+			httpClientErr = err
+			return
+		}
+		httpClient.Transport = creds.Transport(transport)
 		httpClient.Timeout = time.Duration(state.Config.Build.Timeout)
 	})
-	if err := prepareDirectory(target.OutDir(), false); err != nil {
+	if httpClientErr != nil {
+		return httpClientErr
+	} else if err := prepareDirectory(target.OutDir(), false); err != nil {
 		return err
 	} else if err := prepareDirectory(target.TmpDir(), false); err != nil {
 		return err
 	}
+	if state.RemoteClient != nil && !hasFileURLs(target) {
+		// Go via the remote asset server so we don't need to reach the internet ourselves.
+		// This is either the main remote server or a separate asset server, if one is configured.
+		if err := state.RemoteClient.Fetch(target); status.Code(err) != codes.Unimplemented {
+			return err
+		}
+		log.Debug("No remote asset server available to fetch %s, will download it directly", target)
+	}
 	var err error
 	for _, src := range target.Sources {
 		if e := fetchOneRemoteFile(state, target, src.String()); e != nil {
@@ -1004,6 +1028,17 @@ func fetchRemoteFile(state *core.BuildState, target *core.BuildTarget) error {
 	return err
 }
 
+// hasFileURLs returns true if any of the URLs of a remote_file target refer to local files.
+// These can't be fetched remotely.
+func hasFileURLs(target *core.BuildTarget) bool {
+	for _, src := range target.Sources {
+		if strings.HasPrefix(src.String(), "file://") {
+			return true
+		}
+	}
+	return false
+}
+
 func fetchOneRemoteFile(state *core.BuildState, target *core.BuildTarget, url string) error {
 	env := core.BuildEnvironment(state, target, path.Join(core.RepoRoot, target.TmpDir()))
 	url = os.Expand(url, env.ReplaceEnvironment)
@@ -13,6 +13,8 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
@@ -22,6 +24,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"gopkg.in/op/go-logging.v1"
 
 	"github.com/thought-machine/please/src/core"
@@ -397,6 +401,54 @@ func TestFetchLocalRemoteFileCannotBeWithinRepo(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestFetchRemoteFileViaAssetServer(t *testing.T) {
+	state, target := newState("//package4:target3")
+	target.AddSource(core.URLLabel("https://example.com/remote_file.txt"))
+	target.AddOutput("remote_file.txt")
+	client := &fakeFetchClient{}
+	state.RemoteClient = client
+	assert.NoError(t, fetchRemoteFile(state, target))
+	assert.True(t, client.Fetched)
+}
+
+func TestFetchRemoteFileWithoutAssetServer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("abc"))
+	}))
+	defer srv.Close()
+	for name, remote := range map[string]bool{
+		"NoRemote":      false,
+		"Unimplemented": true,
+	} {
+		t.Run(name, func(t *testing.T) {
+			state, target := newState("//package4:target4_" + name)
+			target.AddSource(core.URLLabel(srv.URL + "/remote_file.txt"))
+			target.AddOutput("remote_file.txt")
+			client := &fakeFetchClient{Err: status.Error(codes.Unimplemented, "no asset API here")}
+			if remote {
+				state.RemoteClient = client
+			}
+			require.NoError(t, fetchRemoteFile(state, target))
+			assert.Equal(t, remote, client.Fetched)
+			b, err := ioutil.ReadFile(path.Join(target.TmpDir(), "remote_file.txt"))
+			assert.NoError(t, err)
+			assert.Equal(t, "abc", string(b))
+		})
+	}
+}
+
+// fakeFetchClient is a fake remote client that only implements Fetch.
+type fakeFetchClient struct {
+	core.RemoteClient
+	Err     error
+	Fetched bool
+}
+
+func (c *fakeFetchClient) Fetch(target *core.BuildTarget) error {
+	c.Fetched = true
+	return c.Err
+}
+
 func TestBuildMetadatafileIsCreated(t *testing.T) {
 	stdOut := "wibble wibble wibble"
 
@@ -423,6 +475,17 @@ func TestBuildMetadatafileIsCreated(t *testing.T) {
 	assert.Equal(t, stdOut, string(md.Stdout))
 }
 
+func TestLocalBuildRemovesRemoteOutputsRecord(t *testing.T) {
+	state, target := newState("//package1:lazy_remote")
+	target.AddOutput("file1")
+	require.NoError(t, os.MkdirAll(target.OutDir(), core.DirPermissions))
+	require.NoError(t, ioutil.WriteFile(target.RemoteOutputsFile(), []byte("file1 abc/3\n"), 0644))
+	err := buildTarget(1, state, target, false)
+	require.NoError(t, err)
+	assert.True(t, fs.FileExists(filepath.Join(target.OutDir(), "file1")))
+	assert.False(t, core.PathExists(target.RemoteOutputsFile()))
+}
+
 func newState(label string) (*core.BuildState, *core.BuildTarget) {
 	config, _ := core.ReadConfigFiles(nil, nil)
 	state := core.NewBuildState(config)
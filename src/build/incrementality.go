@@ -238,6 +238,9 @@ func ruleHash(state *core.BuildState, target *core.BuildTarget, runtime bool) []
 			h.Write([]byte(datum.String()))
 		}
 		hashOptionalBool(h, target.TestSandbox)
+		for _, service := range target.TestServices {
+			h.Write([]byte(service.String()))
+		}
 	}
 
 	hashBool(h, target.NeedsTransitiveDependencies)
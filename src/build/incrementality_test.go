@@ -59,6 +59,7 @@ var KnownFields = map[string]bool{
 	"Data":              true,
 	"namedData":         true,
 	"TestSandbox":       true,
+	"TestServices":      true,
 	"ContainerSettings": true,
 
 	// These would ideally not contribute to the hash, but we need that at present
@@ -85,6 +86,7 @@ var KnownFields = map[string]bool{
 	"PassUnsafeEnv":       true,
 	"NeededForSubinclude": true,
 	"RuleMetadata":        true, // This is only accessible through the build language at parse time
+	"ProviderData":        true, // Similarly only accessible through the build language
 
 	// Used to save the rule hash rather than actually being hashed itself.
 	"RuleHash": true,
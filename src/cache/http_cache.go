@@ -17,6 +17,7 @@ import (
 
 	"github.com/hashicorp/go-retryablehttp"
 
+	"github.com/thought-machine/please/src/auth"
 	"github.com/thought-machine/please/src/core"
 	"github.com/thought-machine/please/src/fs"
 )
@@ -206,12 +207,17 @@ func (cache *httpCache) CleanAll() {
 func (cache *httpCache) Shutdown() {}
 
 func newHTTPCache(config *core.Configuration) *httpCache {
+	creds, err := auth.FromConfig(config)
+	if err != nil {
+		log.Fatalf("Failed to set up credentials for the HTTP cache: %s", err)
+	}
 	return &httpCache{
 		url:      config.Cache.HTTPURL.String(),
 		writable: config.Cache.HTTPWriteable,
 		client: &retryablehttp.Client{
 			HTTPClient: &http.Client{
-				Timeout: time.Duration(config.Cache.HTTPTimeout),
+				Timeout:   time.Duration(config.Cache.HTTPTimeout),
+				Transport: creds.Transport(nil, config.Cache.HTTPURL.AsURL().Hostname()),
 			},
 			Logger:       &utils.HTTPLogWrapper{Logger: log},
 			RetryWaitMin: 1 * time.Second,
@@ -134,7 +134,7 @@ func TestEnvironment(state *BuildState, target *BuildTarget, testDir string) Bui
 		"TEST_DIR="+testDir,
 		"TMP_DIR="+testDir,
 		"TMPDIR="+testDir,
-		"TEST_ARGS="+strings.Join(state.TestArgs, ","),
+		"TEST_ARGS="+strings.Join(state.TestArgsFor(target.Label), ","),
 		"RESULTS_FILE="+resultsFile,
 		// We shouldn't really have specific things like this here, but it really is just easier to set it.
 		"GTEST_OUTPUT=xml:"+resultsFile,
@@ -48,6 +48,10 @@ const CoverageFile = "test.coverage"
 // execution API requires that we specify which is which.
 const TestResultsDirLabel = "test_results_dir"
 
+// TestSelectionLabel is a known label that indicates that the test accepts the names of test
+// cases to run as arguments, so we can rerun just the ones that failed when it's flaky.
+const TestSelectionLabel = "test_selection"
+
 // tempOutputSuffix is the suffix we attach to temporary outputs to avoid name clashes.
 const tempOutputSuffix = ".out"
 
@@ -195,12 +199,17 @@ type BuildTarget struct {
 	// Extra output files from the test.
 	// These are in addition to the usual test.results output file.
 	TestOutputs []string `name:"test_outputs"`
+	// Services (binary targets) that are started before the test runs and stopped afterwards.
+	TestServices []BuildLabel `name:"test_services"`
 	// OutputDirectories are the directories that outputs can be produced into which will be added to the root of the
 	// output for the rule. For example if an output directory "foo" contains "bar.txt" the rule will have the output
 	// "bar.txt"
 	OutputDirectories []OutputDirectory `name:"output_dirs"`
 	// RuleMetadata is the metadata attached to this build rule. It can be accessed through the "get_rule_metadata" BIF.
 	RuleMetadata interface{} `name:"config"`
+	// ProviderData are named structs attached to this build rule for dependent rules to consume.
+	// They can be accessed through the "get_provider" BIF.
+	ProviderData map[string]interface{} `name:"provider_data"`
 	// EntryPoints represent named binaries within the rules output that can be targeted via //package:rule|entry_point_name
 	EntryPoints map[string]string `name:"entry_points"`
 }
@@ -382,6 +391,12 @@ func (target *BuildTarget) CoverageFile() string {
 	return path.Join(target.OutDir(), ".test_coverage_"+target.Label.Name)
 }
 
+// RemoteOutputsFile returns the file that records the digests of outputs for this target
+// when it was built remotely and they were not downloaded.
+func (target *BuildTarget) RemoteOutputsFile() string {
+	return path.Join(target.OutDir(), ".remote_outputs_"+target.Label.Name)
+}
+
 // AddTestResults adds results to the target
 func (target *BuildTarget) AddTestResults(results TestSuite) {
 	target.resultsMux.Lock()
@@ -395,6 +410,13 @@ func (target *BuildTarget) AddTestResults(results TestSuite) {
 	target.Results.Collapse(results)
 }
 
+// UpdateTestResults calls the given function to modify the results of this target while holding its lock.
+func (target *BuildTarget) UpdateTestResults(f func(results *TestSuite)) {
+	target.resultsMux.Lock()
+	defer target.resultsMux.Unlock()
+	f(&target.Results)
+}
+
 // StartTestSuite sets the initial properties on the result test suite
 func (target *BuildTarget) StartTestSuite() {
 	target.resultsMux.Lock()
@@ -1384,6 +1406,38 @@ func (target *BuildTarget) AddOptionalOutput(output string) {
 	target.OptionalOutputs = target.insert(target.OptionalOutputs, output)
 }
 
+// AddTestService adds a new service to be started alongside this target's test.
+// The service's log is recorded as one of the test's outputs.
+func (target *BuildTarget) AddTestService(label BuildLabel) {
+	target.TestServices = append(target.TestServices, label)
+	target.AddDependency(label)
+	target.AddTestOutput(target.TestServiceLogFile(label))
+}
+
+// TestServiceLogFile returns the file that one of this target's test services logs to,
+// relative to its test directory.
+func (target *BuildTarget) TestServiceLogFile(service BuildLabel) string {
+	return path.Join(target.Label.Name+".test_services", TestServiceName(service)+".log")
+}
+
+// TestServiceName returns a name for a test service that is unique to its label and is safe
+// to use in filenames and environment variables.
+func TestServiceName(service BuildLabel) string {
+	name := service.PackageName + "_" + service.Name
+	if service.PackageName == "" {
+		name = service.Name
+	}
+	if service.Subrepo != "" {
+		name = service.Subrepo + "_" + name
+	}
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
 // AddTestOutput adds a new test output to the target if it's not already there.
 func (target *BuildTarget) AddTestOutput(output string) {
 	target.TestOutputs = target.insert(target.TestOutputs, output)
@@ -0,0 +1,224 @@
+package core
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+)
+
+func init() {
+	// These are the implementations of BuildInput, which gob needs to know about.
+	gob.Register(BuildLabel{})
+	gob.Register(FileLabel{})
+	gob.Register(SubrepoFileLabel{})
+	gob.Register(SystemFileLabel{})
+	gob.Register(SystemPathLabel{})
+	gob.Register(AnnotatedOutputLabel{})
+	gob.Register(URLLabel(""))
+}
+
+// An encodedTarget is the serialisable form of a BuildTarget, as used for the parse cache.
+// It contains only the things defined when the target is created; anything that relates to
+// building it (state, test results etc) or that can't be serialised (Subrepo, pre/post build
+// functions) is not included.
+type encodedTarget struct {
+	Label                       BuildLabel
+	Dependencies                []encodedDependency
+	Visibility                  []BuildLabel
+	Sources                     []BuildInput
+	NamedSources                map[string][]BuildInput
+	Data                        []BuildInput
+	NamedData                   map[string][]BuildInput
+	Outputs                     []string
+	NamedOutputs                map[string][]string
+	OptionalOutputs             []string
+	Labels                      []string
+	Command                     string
+	Commands                    map[string]string
+	TestCommand                 string
+	TestCommands                map[string]string
+	IsBinary                    bool
+	IsTest                      bool
+	TestOnly                    bool
+	Sandbox                     bool
+	TestSandbox                 bool
+	NoTestOutput                bool
+	NeedsTransitiveDependencies bool
+	OutputIsComplete            bool
+	Stamp                       bool
+	Local                       bool
+	ExitOnError                 bool
+	IsFilegroup                 bool
+	IsRemoteFile                bool
+	ShowProgress                bool
+	BuildingDescription         string
+	Hashes                      []string
+	Licences                    []string
+	Secrets                     []string
+	NamedSecrets                map[string][]string
+	Requires                    []string
+	Provides                    map[string]BuildLabel
+	Tools                       []BuildInput
+	TestTools                   []BuildInput
+	NamedTools                  map[string][]BuildInput
+	NamedTestTools              map[string][]BuildInput
+	PassEnv                     *[]string
+	PassUnsafeEnv               *[]string
+	Flakiness                   int
+	BuildTimeout                time.Duration
+	TestTimeout                 time.Duration
+	TestOutputs                 []string
+	TestServices                []BuildLabel
+	OutputDirectories           []OutputDirectory
+	RuleMetadata                interface{}
+	ProviderData                map[string]interface{}
+	EntryPoints                 map[string]string
+}
+
+// An encodedDependency is the serialisable form of a depInfo.
+type encodedDependency struct {
+	Declared                         BuildLabel
+	Exported, Internal, Source, Data bool
+}
+
+// GobEncode implements the gob.GobEncoder interface.
+// Pre- and post-build functions aren't encoded since they're code in the interpreter; whoever
+// decodes the target is responsible for reattaching them.
+func (target *BuildTarget) GobEncode() ([]byte, error) {
+	e := encodedTarget{
+		Label:                       target.Label,
+		Dependencies:                make([]encodedDependency, len(target.dependencies)),
+		Visibility:                  target.Visibility,
+		Sources:                     target.Sources,
+		NamedSources:                target.NamedSources,
+		Data:                        target.Data,
+		NamedData:                   target.namedData,
+		Outputs:                     target.outputs,
+		NamedOutputs:                target.namedOutputs,
+		OptionalOutputs:             target.OptionalOutputs,
+		Labels:                      target.Labels,
+		Command:                     target.Command,
+		Commands:                    target.Commands,
+		TestCommand:                 target.TestCommand,
+		TestCommands:                target.TestCommands,
+		IsBinary:                    target.IsBinary,
+		IsTest:                      target.IsTest,
+		TestOnly:                    target.TestOnly,
+		Sandbox:                     target.Sandbox,
+		TestSandbox:                 target.TestSandbox,
+		NoTestOutput:                target.NoTestOutput,
+		NeedsTransitiveDependencies: target.NeedsTransitiveDependencies,
+		OutputIsComplete:            target.OutputIsComplete,
+		Stamp:                       target.Stamp,
+		Local:                       target.Local,
+		ExitOnError:                 target.ExitOnError,
+		IsFilegroup:                 target.IsFilegroup,
+		IsRemoteFile:                target.IsRemoteFile,
+		ShowProgress:                target.ShowProgress,
+		BuildingDescription:         target.BuildingDescription,
+		Hashes:                      target.Hashes,
+		Licences:                    target.Licences,
+		Secrets:                     target.Secrets,
+		NamedSecrets:                target.NamedSecrets,
+		Requires:                    target.Requires,
+		Provides:                    target.Provides,
+		Tools:                       target.Tools,
+		TestTools:                   target.testTools,
+		NamedTools:                  target.namedTools,
+		NamedTestTools:              target.namedTestTools,
+		PassEnv:                     target.PassEnv,
+		PassUnsafeEnv:               target.PassUnsafeEnv,
+		Flakiness:                   target.Flakiness,
+		BuildTimeout:                target.BuildTimeout,
+		TestTimeout:                 target.TestTimeout,
+		TestOutputs:                 target.TestOutputs,
+		TestServices:                target.TestServices,
+		OutputDirectories:           target.OutputDirectories,
+		RuleMetadata:                target.RuleMetadata,
+		ProviderData:                target.ProviderData,
+		EntryPoints:                 target.EntryPoints,
+	}
+	for i, dep := range target.dependencies {
+		e.Dependencies[i] = encodedDependency{
+			Declared: dep.declared,
+			Exported: dep.exported,
+			Internal: dep.internal,
+			Source:   dep.source,
+			Data:     dep.data,
+		}
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&e)
+	return buf.Bytes(), err
+}
+
+// GobDecode implements the gob.GobDecoder interface.
+// The decoded target is inactive and has no Subrepo set; the caller should set that if appropriate.
+func (target *BuildTarget) GobDecode(b []byte) error {
+	e := encodedTarget{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&e); err != nil {
+		return err
+	}
+	target.Label = e.Label
+	target.state = int32(Inactive)
+	target.dependencies = make([]depInfo, len(e.Dependencies))
+	for i, dep := range e.Dependencies {
+		target.dependencies[i] = depInfo{
+			declared: dep.Declared,
+			exported: dep.Exported,
+			internal: dep.Internal,
+			source:   dep.Source,
+			data:     dep.Data,
+		}
+	}
+	target.Visibility = e.Visibility
+	target.Sources = e.Sources
+	target.NamedSources = e.NamedSources
+	target.Data = e.Data
+	target.namedData = e.NamedData
+	target.outputs = e.Outputs
+	target.namedOutputs = e.NamedOutputs
+	target.OptionalOutputs = e.OptionalOutputs
+	target.Labels = e.Labels
+	target.Command = e.Command
+	target.Commands = e.Commands
+	target.TestCommand = e.TestCommand
+	target.TestCommands = e.TestCommands
+	target.IsBinary = e.IsBinary
+	target.IsTest = e.IsTest
+	target.TestOnly = e.TestOnly
+	target.Sandbox = e.Sandbox
+	target.TestSandbox = e.TestSandbox
+	target.NoTestOutput = e.NoTestOutput
+	target.NeedsTransitiveDependencies = e.NeedsTransitiveDependencies
+	target.OutputIsComplete = e.OutputIsComplete
+	target.Stamp = e.Stamp
+	target.Local = e.Local
+	target.ExitOnError = e.ExitOnError
+	target.IsFilegroup = e.IsFilegroup
+	target.IsRemoteFile = e.IsRemoteFile
+	target.ShowProgress = e.ShowProgress
+	target.BuildingDescription = e.BuildingDescription
+	target.Hashes = e.Hashes
+	target.Licences = e.Licences
+	target.Secrets = e.Secrets
+	target.NamedSecrets = e.NamedSecrets
+	target.Requires = e.Requires
+	target.Provides = e.Provides
+	target.Tools = e.Tools
+	target.testTools = e.TestTools
+	target.namedTools = e.NamedTools
+	target.namedTestTools = e.NamedTestTools
+	target.PassEnv = e.PassEnv
+	target.PassUnsafeEnv = e.PassUnsafeEnv
+	target.Flakiness = e.Flakiness
+	target.BuildTimeout = e.BuildTimeout
+	target.TestTimeout = e.TestTimeout
+	target.TestOutputs = e.TestOutputs
+	target.TestServices = e.TestServices
+	target.OutputDirectories = e.OutputDirectories
+	target.RuleMetadata = e.RuleMetadata
+	target.ProviderData = e.ProviderData
+	target.EntryPoints = e.EntryPoints
+	return nil
+}
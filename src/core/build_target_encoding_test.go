@@ -0,0 +1,97 @@
+package core
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// notEncoded are the fields of BuildTarget that deliberately aren't part of its encoded form.
+var notEncoded = map[string]bool{
+	"Subrepo":             true,
+	"state":               true,
+	"NeededForSubinclude": true,
+	"AddedPostBuild":      true,
+	"Progress":            true,
+	"Results":             true,
+	"completedRuns":       true,
+	"resultsMux":          true,
+	"PreBuildFunction":    true,
+	"PostBuildFunction":   true,
+	"RuleHash":            true,
+}
+
+func TestAllFieldsEncoded(t *testing.T) {
+	encoded := map[string]bool{}
+	et := reflect.TypeOf(encodedTarget{})
+	for i := 0; i < et.NumField(); i++ {
+		encoded[strings.ToLower(et.Field(i).Name)] = true
+	}
+	bt := reflect.TypeOf(BuildTarget{})
+	for i := 0; i < bt.NumField(); i++ {
+		name := bt.Field(i).Name
+		assert.True(t, notEncoded[name] || encoded[strings.ToLower(name)], "Field %s of BuildTarget is not encoded; add it to encodedTarget or notEncoded", name)
+	}
+}
+
+func TestEncodeTarget(t *testing.T) {
+	target := NewBuildTarget(ParseBuildLabel("//src/core:core", ""))
+	target.AddSource(FileLabel{File: "core.go", Package: "src/core"})
+	target.AddNamedSource("go", ParseBuildLabel("//src/core:version", ""))
+	target.AddOutput("core.a")
+	target.AddNamedOutput("hdrs", "core.h")
+	target.AddMaybeExportedDependency(ParseBuildLabel("//src/fs:fs", ""), true, false, false)
+	target.AddDatum(SystemPathLabel{Name: "go", Path: []string{"/usr/bin"}})
+	target.AddTool(URLLabel("https://example.com/tool"))
+	target.AddNamedTestTool("gcc", AnnotatedOutputLabel{BuildLabel: ParseBuildLabel("//tools:gcc", ""), Annotation: "gcc"})
+	target.Command = "go tool compile"
+	target.Labels = []string{"go"}
+	target.IsBinary = true
+	target.BuildTimeout = 10 * time.Second
+	target.Visibility = []BuildLabel{WholeGraph[0]}
+
+	var buf bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&buf).Encode(target))
+	decoded := &BuildTarget{}
+	require.NoError(t, gob.NewDecoder(&buf).Decode(decoded))
+
+	assert.Equal(t, target.Label, decoded.Label)
+	assert.Equal(t, Inactive, decoded.State())
+	assert.Equal(t, target.Sources, decoded.Sources)
+	assert.Equal(t, target.NamedSources, decoded.NamedSources)
+	assert.Equal(t, target.DeclaredOutputs(), decoded.DeclaredOutputs())
+	assert.Equal(t, target.DeclaredNamedOutputs(), decoded.DeclaredNamedOutputs())
+	assert.Equal(t, target.DeclaredDependencies(), decoded.DeclaredDependencies())
+	assert.Equal(t, target.ExportedDependencies(), decoded.ExportedDependencies())
+	assert.Equal(t, target.Data, decoded.Data)
+	assert.Equal(t, target.Tools, decoded.Tools)
+	assert.Equal(t, target.namedTestTools, decoded.namedTestTools)
+	assert.Equal(t, target.Command, decoded.Command)
+	assert.Equal(t, target.Labels, decoded.Labels)
+	assert.True(t, decoded.IsBinary)
+	assert.Equal(t, target.BuildTimeout, decoded.BuildTimeout)
+	assert.Equal(t, target.Visibility, decoded.Visibility)
+}
+
+type fakePreBuildFunction struct{}
+
+func (f fakePreBuildFunction) Call(target *BuildTarget) error { return nil }
+func (f fakePreBuildFunction) String() string                 { return "" }
+
+func TestEncodeTargetWithPreBuildFunction(t *testing.T) {
+	target := NewBuildTarget(ParseBuildLabel("//src/core:core", ""))
+	target.PreBuildFunction = fakePreBuildFunction{}
+	var buf bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&buf).Encode(target))
+	decoded := &BuildTarget{}
+	require.NoError(t, gob.NewDecoder(&buf).Decode(decoded))
+	// The function itself isn't encoded; it's up to the caller to reattach it.
+	assert.Nil(t, decoded.PreBuildFunction)
+	assert.Equal(t, target.Label, decoded.Label)
+}
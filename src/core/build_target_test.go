@@ -165,6 +165,23 @@ func TestAddOutputPanics(t *testing.T) {
 	assert.Panics(t, func() { target.AddNamedOutput("", "") })
 }
 
+func TestAddTestService(t *testing.T) {
+	target := makeTarget1("//src/test:client_test", "")
+	target.AddTestService(ParseBuildLabel("//src/a:db", ""))
+	target.AddTestService(ParseBuildLabel("//src/b:db", ""))
+	assert.Equal(t, []string{
+		"client_test.test_services/src_a_db.log",
+		"client_test.test_services/src_b_db.log",
+	}, target.TestOutputs)
+	assert.Equal(t, 2, len(target.DeclaredDependencies()))
+}
+
+func TestTestServiceName(t *testing.T) {
+	assert.Equal(t, "src_a_db", TestServiceName(ParseBuildLabel("//src/a:db", "")))
+	assert.Equal(t, "fake_server", TestServiceName(ParseBuildLabel("//:fake-server", "")))
+	assert.Equal(t, "pleasings_go_db", TestServiceName(ParseBuildLabel("@pleasings//go:db", "")))
+}
+
 func TestAddSource(t *testing.T) {
 	target := makeTarget1("//src/test/python:lib1", "")
 	target.AddSource(ParseBuildLabel("//src/test/python:lib2", ""))
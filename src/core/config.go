@@ -244,6 +244,9 @@ func DefaultConfiguration() *Configuration {
 	config.Parse.NumThreads = config.Please.NumThreads
 	config.Parse.BuiltinPleasings = true
 	config.Parse.GitFunctions = true
+	config.Parse.MaxCallDepth = 1000
+	config.Parse.MaxSteps = 10000000
+	config.Parse.MaxAllocation = 10000000
 	config.Build.Arch = cli.NewArch(runtime.GOOS, runtime.GOARCH)
 	config.Build.Lang = "en_GB.UTF-8" // Not the language of the UI, the language passed to rules.
 	config.Build.Nonce = "1402"       // Arbitrary nonce to invalidate config when needed.
@@ -261,6 +264,7 @@ func DefaultConfiguration() *Configuration {
 	config.Cache.HTTPRetry = 4
 	if dir, err := os.UserCacheDir(); err == nil {
 		config.Cache.Dir = path.Join(dir, "please")
+		config.Parse.SubincludeDir = path.Join(dir, "please_subincludes")
 	}
 	config.Cache.DirCacheHighWaterMark = 10 * cli.GiByte
 	config.Cache.DirCacheLowWaterMark = 8 * cli.GiByte
@@ -354,9 +358,15 @@ type Configuration struct {
 		PreloadBuildDefs []string `help:"Files to preload by the parser before loading any BUILD files.\nSince this is done before the first package is parsed they must be files in the repository, they cannot be subinclude() paths." example:"build_defs/go_bindata.build_defs"`
 		BuildDefsDir     []string `help:"Directory to look in when prompted for help topics that aren't known internally." example:"build_defs"`
 		// TODO(jpoole): Remove this in the v16 release
-		BuiltinPleasings bool `help:"Adds github.com/thought-machine/pleasings as a default subrepo named pleasings. This feature is deprecated and will be removed in the v16 release."`
-		NumThreads       int  `help:"Number of parallel parse operations to run.\nIs overridden by the --num_threads command line flag." example:"6"`
-		GitFunctions     bool `help:"Activates built-in functions git_branch, git_commit, git_show and git_state. If disabled they will not be usable at parse time."`
+		BuiltinPleasings bool   `help:"Adds github.com/thought-machine/pleasings as a default subrepo named pleasings. This feature is deprecated and will be removed in the v16 release."`
+		NumThreads       int    `help:"Number of parallel parse operations to run.\nIs overridden by the --num_threads command line flag." example:"6"`
+		GitFunctions     bool   `help:"Activates built-in functions git_branch, git_commit, git_show and git_state. If disabled they will not be usable at parse time."`
+		Cache            bool   `help:"Stores parsed packages in plz-out so that later invocations can load them without re-interpreting their BUILD files, as long as the BUILD file, its subincludes, glob results, files it read and config are unchanged."`
+		MaxCallDepth     int    `help:"Maximum depth of nested function calls allowed while parsing a BUILD file. Set to 0 to disable the limit." example:"1000"`
+		MaxSteps         int    `help:"Maximum number of steps (function calls and loop iterations) allowed while parsing a single package, including anything it subincludes. Set to 0 to disable the limit." example:"10000000"`
+		MaxAllocation    int    `help:"Maximum length of any single list or string created while parsing a BUILD file. Set to 0 to disable the limit." example:"10000000"`
+		SubincludeDir    string `help:"Directory in which files subincluded from URLs are stored, named by their hashes. It can be shared between repos.\nThe default is 'please_subincludes' under the user's cache dir (i.e. ~/.cache/please_subincludes, ~/Library/Caches/please_subincludes, etc). If that can't be determined or this is set to the empty string, they're stored in plz-out/subincludes instead." example:"~/.cache/please_subincludes"`
+		Offline          bool   `help:"Never downloads files subincluded from URLs; only those already in the subinclude dir can be used."`
 	} `help:"The [parse] section in the config contains settings specific to parsing files."`
 	Display struct {
 		UpdateTitle bool `help:"Updates the title bar of the shell window Please is running in as the build progresses. This isn't on by default because not everyone's shell is configured to reset it again after and we don't want to alter it forever."`
@@ -401,25 +411,36 @@ type Configuration struct {
 		Sandbox         bool         `help:"True to sandbox individual tests, which isolates them from network access, IPC and some aspects of the filesystem. Currently only works on Linux." var:"TEST_SANDBOX"`
 		DisableCoverage []string     `help:"Disables coverage for tests that have any of these labels spcified."`
 		Upload          cli.URL      `help:"URL to upload test results to (in XML format)"`
+		QuarantineFile  string       `help:"A file listing tests that are known to be flaky. Failures of these are reported separately and don't fail the build.\nEach line is either a test target (e.g. //src/core:core_test) or a test target followed by the name of a single test case in it. Lines beginning with # are ignored."`
 	} `help:"A config section describing settings related to testing in general."`
 	Remote struct {
-		URL           string       `help:"URL for the remote server."`
-		CASURL        string       `help:"URL for the CAS service, if it is different to the main one."`
-		AssetURL      string       `help:"URL for the remote asset server, if it is different to the main one."`
-		NumExecutors  int          `help:"Maximum number of remote executors to use simultaneously."`
-		Instance      string       `help:"Remote instance name to request; depending on the server this may be required."`
-		Name          string       `help:"A name for this worker instance. This is attached to artifacts uploaded to remote storage." example:"agent-001"`
-		DisplayURL    string       `help:"A URL to browse the remote server with (e.g. using buildbarn-browser). Only used when printing hashes."`
-		TokenFile     string       `help:"A file containing a token that is attached to outgoing RPCs to authenticate them. This is somewhat bespoke; we are still investigating further options for authentication."`
-		Timeout       cli.Duration `help:"Timeout for connections made to the remote server."`
-		Secure        bool         `help:"Whether to use TLS for communication or not."`
-		Gzip          bool         `help:"Whether to use gzip compression for communication."`
-		Zstd          bool         `help:"Whether to use zstd compression for communication."`
-		VerifyOutputs bool         `help:"Whether to verify all outputs are present after a cached remote execution action. Depending on your server implementation, you may require this to ensure files are really present."`
-		HomeDir       string       `help:"The home directory on the build machine."`
-		Platform      []string     `help:"Platform properties to request from remote workers, in the format key=value."`
-		CacheDuration cli.Duration `help:"Length of time before we re-check locally cached build actions. Default is unlimited."`
+		URL                 string       `help:"URL for the remote server."`
+		CASURL              string       `help:"URL for the CAS service, if it is different to the main one."`
+		AssetURL            string       `help:"URL for the remote asset server, if it is different to the main one."`
+		NumExecutors        int          `help:"Maximum number of remote executors to use simultaneously."`
+		Instance            string       `help:"Remote instance name to request; depending on the server this may be required."`
+		Name                string       `help:"A name for this worker instance. This is attached to artifacts uploaded to remote storage." example:"agent-001"`
+		DisplayURL          string       `help:"A URL to browse the remote server with (e.g. using buildbarn-browser). Only used when printing hashes."`
+		TokenFile           string       `help:"A file containing a token that is attached to outgoing RPCs to authenticate them. This is somewhat bespoke; we are still investigating further options for authentication."`
+		Timeout             cli.Duration `help:"Timeout for connections made to the remote server."`
+		Secure              bool         `help:"Whether to use TLS for communication or not."`
+		Gzip                bool         `help:"Whether to use gzip compression for communication."`
+		Zstd                bool         `help:"Whether to use zstd compression for communication."`
+		VerifyOutputs       bool         `help:"Whether to verify all outputs are present after a cached remote execution action. Depending on your server implementation, you may require this to ensure files are really present."`
+		HomeDir             string       `help:"The home directory on the build machine."`
+		Platform            []string     `help:"Platform properties to request from remote workers, in the format key=value."`
+		CacheDuration       cli.Duration `help:"Length of time before we re-check locally cached build actions. Default is unlimited."`
+		LazyDownload        bool         `help:"If set, outputs of remotely built targets are not downloaded after plz build; their digests are recorded in plz-out instead. They are still fetched on demand when needed locally, for example by plz run, plz export outputs or plz query output --materialise."`
+		BlobCacheDuration   cli.Duration `help:"Length of time that we assume blobs we have uploaded to or found in the CAS will remain there. If set, the set of known blobs is persisted between builds so we don't upload them again. Default is zero, i.e. they are not persisted; you should not set it for longer than your server might retain blobs for."`
+		OutputStoreDuration cli.Duration `help:"Length of time that the input and output trees of targets are persisted locally between builds, so they don't need to be recalculated. Stored trees are only reused while their blobs are known to exist remotely, and are removed after being unused for this long. Default is zero, i.e. they are not persisted."`
 	} `help:"Settings related to remote execution & caching using the Google remote execution APIs. This section is still experimental and subject to change."`
+	Auth struct {
+		CertFile     string   `help:"A TLS client certificate to present to the remote execution & asset servers, the HTTP cache, remote_file downloads and subincludes from URLs. Must be set along with KeyFile."`
+		KeyFile      string   `help:"The private key corresponding to CertFile."`
+		CACertFile   string   `help:"A file containing additional CA certificates (in PEM format) to trust when connecting to any of the above. The system roots are still trusted."`
+		TokenCommand string   `help:"A credential helper command that prints a token to stdout. It can print either just the token, or a JSON object like {\"token\": \"abc\", \"expiry\": \"2020-05-01T12:00:00Z\"}, in which case it is invoked again shortly before the token expires.\nThe token is attached to RPCs to the remote execution & asset servers (in preference to remote.tokenfile) and to requests to the HTTP cache."`
+		TokenHosts   []string `help:"Additional hosts that tokens from the credential helper are sent to when downloading remote_file rules or subincludes from URLs. By default they are not sent to any, to avoid leaking them to arbitrary servers."`
+	} `help:"Settings related to authenticating to the remote servers that Please talks to; they apply to remote execution, the HTTP cache, remote_file downloads and subincludes from URLs."`
 	Size  map[string]*Size `help:"Named sizes of targets; these are the definitions of what can be passed to the 'size' argument."`
 	Cover struct {
 		FileExtension    []string `help:"Extensions of files to consider for coverage.\nDefaults to a reasonably obvious set for the builtin rules including .go, .py, .java, etc."`
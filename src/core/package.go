@@ -28,6 +28,17 @@ type Package struct {
 	targets map[string]*BuildTarget
 	// Set of output files from rules.
 	Outputs map[string]*BuildTarget
+	// Calls to glob() made while parsing this package. These are used to check whether the parse cache is still valid.
+	Globs []PackageGlob
+	// Files read by read_file() and friends while parsing this package.
+	// These are used to check whether the parse cache is still valid, and by plz watch.
+	Reads []PackageRead
+	// True if this package can't be stored in the parse cache, because parsing it depends on
+	// something other than its BUILD file and subincludes (or has side effects outside the package).
+	Uncacheable bool
+	// True if this package is only being re-parsed to recover the pre- and post-build functions of
+	// targets that were loaded from the parse cache. Its targets aren't added to the graph.
+	CallbacksOnly bool
 	// Protects access to above
 	mutex sync.RWMutex
 	// Targets whose dependencies got modified during a pre or post-build function.
@@ -38,6 +49,23 @@ type Package struct {
 	buildCallbackMutex sync.Mutex
 }
 
+// A PackageGlob records a single call to glob() made while parsing a package.
+type PackageGlob struct {
+	Root             string
+	Include, Exclude []string
+	Hidden           bool
+	// The files that it matched.
+	Result []string
+}
+
+// A PackageRead records a file that was read while parsing a package.
+type PackageRead struct {
+	// Path to the file, relative to the repo root.
+	Filename string
+	// Hash of the file's contents when it was read.
+	Hash []byte
+}
+
 // NewPackage constructs a new package with the given name.
 func NewPackage(name string) *Package {
 	return &Package{
@@ -116,6 +144,16 @@ func (pkg *Package) HasSubinclude(label BuildLabel) bool {
 	return false
 }
 
+// RegisterRead records that a file was read while parsing this package, guaranteeing uniqueness.
+func (pkg *Package) RegisterRead(read PackageRead) {
+	for _, r := range pkg.Reads {
+		if r.Filename == read.Filename {
+			return
+		}
+	}
+	pkg.Reads = append(pkg.Reads, read)
+}
+
 // SubrepoArchName returns a subrepo name, modified for the architecture of this package if it's not the host.
 func (pkg *Package) SubrepoArchName(subrepo string) string {
 	if subrepo != "" && pkg.Subrepo != nil && pkg.Subrepo.IsCrossCompile && pkg.SubrepoName != subrepo {
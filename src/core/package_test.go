@@ -16,6 +16,17 @@ func TestRegisterSubinclude(t *testing.T) {
 	assert.Equal(t, []BuildLabel{label1, label2}, pkg.Subincludes)
 }
 
+func TestRegisterRead(t *testing.T) {
+	pkg := NewPackage("src/core")
+	pkg.RegisterRead(PackageRead{Filename: "src/core/versions.json", Hash: []byte{1}})
+	pkg.RegisterRead(PackageRead{Filename: "src/core/versions.yaml", Hash: []byte{2}})
+	pkg.RegisterRead(PackageRead{Filename: "src/core/versions.json", Hash: []byte{1}})
+	assert.Equal(t, []PackageRead{
+		{Filename: "src/core/versions.json", Hash: []byte{1}},
+		{Filename: "src/core/versions.yaml", Hash: []byte{2}},
+	}, pkg.Reads)
+}
+
 func TestRegisterOutput(t *testing.T) {
 	target1 := NewBuildTarget(ParseBuildLabel("//src/core:target1", ""))
 	target2 := NewBuildTarget(ParseBuildLabel("//src/core:target2", ""))
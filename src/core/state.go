@@ -96,10 +96,17 @@ type RemoteClient interface {
 	Run(target *BuildTarget) error
 	// Download downloads the outputs for the given target that has already been built remotely.
 	Download(target *BuildTarget) error
+	// Fetch downloads a remote_file target via the remote asset server into its temporary directory.
+	// It returns an error with the gRPC code Unimplemented if there is no server that supports that.
+	Fetch(target *BuildTarget) error
 	// PrintHashes shows the hashes of a target.
 	PrintHashes(target *BuildTarget, isTest bool)
 	// DataRate returns an estimate of the current in/out RPC data rates and totals so far in bytes per second.
 	DataRate() (int, int, int, int)
+	// PrintTimings prints a summary of remote action timings to stderr and writes a detailed report to the given file, if any.
+	PrintTimings(filename string) error
+	// Disconnect is called at the end of the build to persist any state the client wants to keep.
+	Disconnect() error
 }
 
 // A TargetHasher is a thing that knows how to create hashes for targets.
@@ -148,6 +155,8 @@ type BuildState struct {
 	TargetHasher TargetHasher
 	// Arguments to tests.
 	TestArgs []string
+	// Arguments to specific test targets, which take precedence over TestArgs.
+	TargetTestArgs map[BuildLabel][]string
 	// Labels of targets that we will include / exclude
 	Include, Exclude []string
 	// Actual targets to exclude from discovery
@@ -169,6 +178,9 @@ type BuildState struct {
 	NeedBuild bool
 	// True if we're running tests. False if we're only building or parsing.
 	NeedTests bool
+	// True if original targets that no longer exist should be skipped rather than failing the build.
+	// This is used when rerunning previous failures, some of which may since have been removed.
+	SkipMissingTargets bool
 	// True if we will run targets at the end of the build.
 	NeedRun bool
 	// True if we want to calculate target hashes (ie. 'plz hash').
@@ -179,9 +191,16 @@ type BuildState struct {
 	PrepareShell bool
 	// True if we will download outputs during remote execution.
 	DownloadOutputs bool
+	// True if outputs must be present locally even when remote.lazydownload is set; for example
+	// because we're going to run them, or for plz query output --materialise.
+	MaterialiseOutputs bool
 	// True if we only need to parse the initial package (i.e. don't search downwards
 	// through deps) - for example when doing `plz query print`.
 	ParsePackageOnly bool
+	// True if we should collect profiling information about evaluation of BUILD files.
+	ProfileParse bool
+	// Port to serve the Debug Adapter Protocol on for debugging BUILD files, or 0 if not debugging.
+	DebugParsePort int
 	// True if this build is triggered by watching for changes
 	Watch bool
 	// Number of times to run each test target. 1 == once each, plus flakes if necessary.
@@ -454,6 +473,20 @@ func (state *BuildState) AddOriginalTarget(label BuildLabel, addToList bool) {
 	state.AddPendingParse(label, OriginalTarget, false)
 }
 
+// RemoveOriginalTarget removes one of the original targets, for example because it turns out
+// not to exist. It does not affect any parses or builds that have already been queued.
+func (state *BuildState) RemoveOriginalTarget(label BuildLabel) {
+	state.progress.originalTargetMutex.Lock()
+	defer state.progress.originalTargetMutex.Unlock()
+	targets := make([]BuildLabel, 0, len(state.progress.originalTargets))
+	for _, original := range state.progress.originalTargets {
+		if original != label {
+			targets = append(targets, original)
+		}
+	}
+	state.progress.originalTargets = targets
+}
+
 // Hasher returns a PathHasher for the given function (e.g. "SHA1").
 func (state *BuildState) Hasher(name string) *fs.PathHasher {
 	hasher, present := state.hashers[name]
@@ -721,7 +754,11 @@ func (state *BuildState) AddTarget(pkg *Package, target *BuildTarget) {
 // ShouldDownload returns true if the given target should be downloaded during remote execution.
 func (state *BuildState) ShouldDownload(target *BuildTarget) bool {
 	// Need to download the target if it was originally requested (and the user didn't pass --nodownload).
+	// With lazy downloads they're only fetched if they're going to be needed locally.
 	// Also anything needed for subinclude needs to be local.
+	if state.Config.Remote.LazyDownload && !state.MaterialiseOutputs {
+		return target.NeededForSubinclude
+	}
 	return (state.IsOriginalTarget(target) && state.DownloadOutputs && !state.NeedTests) || target.NeededForSubinclude
 }
 
@@ -868,6 +905,24 @@ func (state *BuildState) ForConfig(config ...string) *BuildState {
 	return s
 }
 
+// WithTestArgs returns a copy of this BuildState that passes the given arguments to tests.
+// Unlike ForConfig the copy isn't tracked since it's only used transiently.
+func (state *BuildState) WithTestArgs(args []string) *BuildState {
+	s := &BuildState{}
+	*s = *state
+	s.TestArgs = args
+	s.TargetTestArgs = nil
+	return s
+}
+
+// TestArgsFor returns the arguments to pass to the given test target.
+func (state *BuildState) TestArgsFor(label BuildLabel) []string {
+	if args, present := state.TargetTestArgs[label]; present {
+		return args
+	}
+	return state.TestArgs
+}
+
 // DisableXattrs disables xattr support for this build. This is done for filesystems that
 // don't support it.
 func (state *BuildState) DisableXattrs() {
@@ -123,6 +123,39 @@ func TestComparePendingTasks(t *testing.T) {
 	assertEqualPriority(Stop, Stop)
 }
 
+func TestTestArgsFor(t *testing.T) {
+	state := NewDefaultBuildState()
+	state.TestArgs = []string{"TestA"}
+	state.TargetTestArgs = map[BuildLabel][]string{
+		ParseBuildLabel("//src/core:core_test", ""): {"TestB", "TestC"},
+	}
+	assert.Equal(t, []string{"TestB", "TestC"}, state.TestArgsFor(ParseBuildLabel("//src/core:core_test", "")))
+	assert.Equal(t, []string{"TestA"}, state.TestArgsFor(ParseBuildLabel("//src/parse:parse_test", "")))
+	// Explicitly given arguments replace the per-target ones.
+	s := state.WithTestArgs([]string{"TestD"})
+	assert.Equal(t, []string{"TestD"}, s.TestArgsFor(ParseBuildLabel("//src/core:core_test", "")))
+}
+
+func TestShouldDownloadLazily(t *testing.T) {
+	state := NewDefaultBuildState()
+	state.DownloadOutputs = true
+	addTarget(state, "//src/core:target1")
+	addTarget(state, "//src/core:target2")
+	target1 := state.Graph.TargetOrDie(ParseBuildLabel("//src/core:target1", ""))
+	target2 := state.Graph.TargetOrDie(ParseBuildLabel("//src/core:target2", ""))
+	target2.NeededForSubinclude = true
+	state.AddOriginalTarget(target1.Label, true)
+	assert.True(t, state.ShouldDownload(target1))
+
+	state.Config.Remote.LazyDownload = true
+	assert.False(t, state.ShouldDownload(target1))
+	assert.True(t, state.ShouldDownload(target2), "targets needed for subinclude always need to be local")
+
+	// e.g. plz query output --materialise
+	state.MaterialiseOutputs = true
+	assert.True(t, state.ShouldDownload(target1))
+}
+
 func addTarget(state *BuildState, name string, labels ...string) {
 	target := NewBuildTarget(ParseBuildLabel(name, ""))
 	target.Labels = labels
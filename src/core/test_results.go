@@ -3,6 +3,7 @@ package core
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -86,7 +87,7 @@ func (testSuite *TestSuite) Errors() int {
 
 	for _, result := range testSuite.TestCases {
 		// No success result, not skipped, some errors (don't care about the presence of failures)
-		if result.Success() == nil && result.Skip() == nil && len(result.Errors()) > 0 {
+		if result.Success() == nil && result.Skip() == nil && !result.Quarantined && len(result.Errors()) > 0 {
 			errors++
 		}
 	}
@@ -100,7 +101,7 @@ func (testSuite *TestSuite) Failures() int {
 
 	for _, result := range testSuite.TestCases {
 		// No success result, not skipped, no errors, but some failures.
-		if result.Success() == nil && result.Skip() == nil && len(result.Errors()) == 0 && len(result.Failures()) > 0 {
+		if result.Success() == nil && result.Skip() == nil && !result.Quarantined && len(result.Errors()) == 0 && len(result.Failures()) > 0 {
 			failures++
 		}
 	}
@@ -121,6 +122,19 @@ func (testSuite *TestSuite) Skips() int {
 	return skips
 }
 
+// Quarantined returns the number of TestCases that did not succeed but were quarantined.
+func (testSuite *TestSuite) Quarantined() int {
+	quarantined := 0
+
+	for _, result := range testSuite.TestCases {
+		if result.Quarantined && result.Success() == nil && result.Skip() == nil {
+			quarantined++
+		}
+	}
+
+	return quarantined
+}
+
 // Add puts test cases together if they have the same name and classname, allowing callers to treat
 // multiple test cases as if they were merely multiple executions of the same test.
 func (testSuite *TestSuite) Add(cases ...TestCase) {
@@ -150,6 +164,9 @@ type TestCase struct {
 	ClassName  string          // ClassName of test (optional, for languages that don't have classes)
 	Name       string          // Name of test
 	Executions []TestExecution // The results of executing the test, possibly multiple times
+	// Quarantined is true if this test is in the quarantine file; its failures are reported
+	// but don't cause the target to fail.
+	Quarantined bool
 }
 
 // Success returns either the successful execution of a test case, or nil if it was never successfully executed.
@@ -210,10 +227,10 @@ func (testCase *TestCase) Duration() *time.Duration {
 // TestCases is named so we can add a method to it.
 type TestCases []TestCase
 
-// AllSucceeded checks that every test case either passed or was skipped.
+// AllSucceeded checks that every test case either passed, was skipped or is quarantined.
 func (testCases TestCases) AllSucceeded() bool {
 	for _, testCase := range testCases {
-		if testCase.Success() == nil && testCase.Skip() == nil {
+		if testCase.Success() == nil && testCase.Skip() == nil && !testCase.Quarantined {
 			return false
 		}
 	}
@@ -257,11 +274,29 @@ const (
 
 var lineCoverageOutput = [...]rune{'N', 'X', 'U', 'C'} // Corresponds to ordering of enum.
 
+// A BranchCoverage records whether a single branch was taken.
+type BranchCoverage struct {
+	Line   int // The (1-indexed) line that the branch is on
+	Block  int // Identifies the branch point, since there can be several on one line
+	Branch int // Identifies this branch out of those at that branch point
+	Taken  bool
+}
+
+// A FunctionCoverage records whether a single function was called.
+type FunctionCoverage struct {
+	Name   string
+	Line   int // The (1-indexed) line that the function starts on
+	Called bool
+}
+
 // TestCoverage implements a pretty simple coverage format; we record one int for each line
 // stating what its coverage is.
+// Branch and function coverage are recorded per file as well, although not all formats provide them.
 type TestCoverage struct {
-	Tests map[BuildLabel]map[string][]LineCoverage
-	Files map[string][]LineCoverage
+	Tests     map[BuildLabel]map[string][]LineCoverage
+	Files     map[string][]LineCoverage
+	Branches  map[string][]BranchCoverage
+	Functions map[string][]FunctionCoverage
 }
 
 // Aggregate aggregates results from another coverage object into this one.
@@ -272,6 +307,12 @@ func (coverage *TestCoverage) Aggregate(cov *TestCoverage) {
 	if coverage.Files == nil {
 		coverage.Files = map[string][]LineCoverage{}
 	}
+	if coverage.Branches == nil {
+		coverage.Branches = map[string][]BranchCoverage{}
+	}
+	if coverage.Functions == nil {
+		coverage.Functions = map[string][]FunctionCoverage{}
+	}
 
 	// Assume that tests are independent (will currently always be the case).
 	for label, c := range cov.Tests {
@@ -282,6 +323,12 @@ func (coverage *TestCoverage) Aggregate(cov *TestCoverage) {
 	for filename, c := range cov.Files {
 		coverage.Files[filename] = MergeCoverageLines(coverage.Files[filename], c)
 	}
+	for filename, c := range cov.Branches {
+		coverage.Branches[filename] = MergeBranchCoverage(coverage.Branches[filename], c)
+	}
+	for filename, c := range cov.Functions {
+		coverage.Functions[filename] = MergeFunctionCoverage(coverage.Functions[filename], c)
+	}
 }
 
 // MergeCoverageLines merges two sets of coverage results together, taking
@@ -299,6 +346,63 @@ func MergeCoverageLines(existing, coverage []LineCoverage) []LineCoverage {
 	return ret
 }
 
+// MergeBranchCoverage merges two sets of branch coverage results together; a branch is
+// taken if it was taken in either. The result is sorted by line.
+func MergeBranchCoverage(existing, coverage []BranchCoverage) []BranchCoverage {
+	type key struct{ Line, Block, Branch int }
+	idx := make(map[key]int, len(existing))
+	ret := make([]BranchCoverage, len(existing), len(existing)+len(coverage))
+	copy(ret, existing)
+	for i, b := range ret {
+		idx[key{b.Line, b.Block, b.Branch}] = i
+	}
+	for _, b := range coverage {
+		k := key{b.Line, b.Block, b.Branch}
+		if i, present := idx[k]; present {
+			ret[i].Taken = ret[i].Taken || b.Taken
+		} else {
+			idx[k] = len(ret)
+			ret = append(ret, b)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Line != ret[j].Line {
+			return ret[i].Line < ret[j].Line
+		} else if ret[i].Block != ret[j].Block {
+			return ret[i].Block < ret[j].Block
+		}
+		return ret[i].Branch < ret[j].Branch
+	})
+	return ret
+}
+
+// MergeFunctionCoverage merges two sets of function coverage results together; a function is
+// called if it was called in either. Functions are identified by name and line since some
+// formats give the same name to all anonymous functions. The result is sorted by line.
+func MergeFunctionCoverage(existing, coverage []FunctionCoverage) []FunctionCoverage {
+	type key struct {
+		Name string
+		Line int
+	}
+	idx := make(map[key]int, len(existing))
+	ret := make([]FunctionCoverage, len(existing), len(existing)+len(coverage))
+	copy(ret, existing)
+	for i, f := range ret {
+		idx[key{f.Name, f.Line}] = i
+	}
+	for _, f := range coverage {
+		k := key{f.Name, f.Line}
+		if i, present := idx[k]; present {
+			ret[i].Called = ret[i].Called || f.Called
+		} else {
+			idx[k] = len(ret)
+			ret = append(ret, f)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Line < ret[j].Line })
+	return ret
+}
+
 // OrderedFiles returns an ordered slice of all the files we have coverage information for.
 // Note that files are ordered non-trivially such that each directory remains together.
 func (coverage *TestCoverage) OrderedFiles() []string {
@@ -316,8 +420,10 @@ func (coverage *TestCoverage) OrderedFiles() []string {
 // NewTestCoverage constructs and returns a new TestCoverage instance.
 func NewTestCoverage() *TestCoverage {
 	return &TestCoverage{
-		Tests: map[BuildLabel]map[string][]LineCoverage{},
-		Files: map[string][]LineCoverage{},
+		Tests:     map[BuildLabel]map[string][]LineCoverage{},
+		Files:     map[string][]LineCoverage{},
+		Branches:  map[string][]BranchCoverage{},
+		Functions: map[string][]FunctionCoverage{},
 	}
 }
 
@@ -334,3 +440,19 @@ func TestCoverageString(lines []LineCoverage) string {
 	}
 	return buffer.String()
 }
+
+// ParseTestCoverageString is the inverse of TestCoverageString.
+// Any unknown characters are treated as non-executable lines.
+func ParseTestCoverageString(s string) []LineCoverage {
+	ret := make([]LineCoverage, 0, len(s))
+	for _, r := range s {
+		line := NotExecutable
+		for i, c := range lineCoverageOutput {
+			if c == r {
+				line = LineCoverage(i)
+			}
+		}
+		ret = append(ret, line)
+	}
+	return ret
+}
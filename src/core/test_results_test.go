@@ -57,6 +57,55 @@ func TestMergeCoverageLines8(t *testing.T) {
 	assert.Equal(t, empty, coverage)
 }
 
+func TestMergeBranchCoverage(t *testing.T) {
+	coverage := MergeBranchCoverage([]BranchCoverage{
+		{Line: 3, Branch: 0, Taken: true},
+		{Line: 3, Branch: 1},
+		{Line: 5, Branch: 0},
+	}, []BranchCoverage{
+		{Line: 5, Branch: 0, Taken: true},
+		{Line: 3, Branch: 1},
+		{Line: 4, Block: 1, Branch: 0, Taken: true},
+	})
+	assert.Equal(t, []BranchCoverage{
+		{Line: 3, Branch: 0, Taken: true},
+		{Line: 3, Branch: 1},
+		{Line: 4, Block: 1, Branch: 0, Taken: true},
+		{Line: 5, Branch: 0, Taken: true},
+	}, coverage)
+}
+
+func TestMergeFunctionCoverage(t *testing.T) {
+	coverage := MergeFunctionCoverage([]FunctionCoverage{
+		{Name: "foo", Line: 10},
+		{Name: "(anonymous)", Line: 2, Called: true},
+	}, []FunctionCoverage{
+		{Name: "foo", Line: 10, Called: true},
+		{Name: "(anonymous)", Line: 7},
+	})
+	assert.Equal(t, []FunctionCoverage{
+		{Name: "(anonymous)", Line: 2, Called: true},
+		{Name: "(anonymous)", Line: 7},
+		{Name: "foo", Line: 10, Called: true},
+	}, coverage)
+}
+
+func TestAggregateCoverage(t *testing.T) {
+	coverage := &TestCoverage{}
+	coverage.Aggregate(&TestCoverage{
+		Files:     map[string][]LineCoverage{"a.go": {Covered}},
+		Branches:  map[string][]BranchCoverage{"a.go": {{Line: 1, Branch: 0}, {Line: 1, Branch: 1, Taken: true}}},
+		Functions: map[string][]FunctionCoverage{"a.go": {{Name: "a", Line: 1}}},
+	})
+	coverage.Aggregate(&TestCoverage{
+		Files:     map[string][]LineCoverage{"a.go": {Covered}},
+		Branches:  map[string][]BranchCoverage{"a.go": {{Line: 1, Branch: 0, Taken: true}}},
+		Functions: map[string][]FunctionCoverage{"a.go": {{Name: "a", Line: 1, Called: true}}},
+	})
+	assert.Equal(t, []BranchCoverage{{Line: 1, Branch: 0, Taken: true}, {Line: 1, Branch: 1, Taken: true}}, coverage.Branches["a.go"])
+	assert.Equal(t, []FunctionCoverage{{Name: "a", Line: 1, Called: true}}, coverage.Functions["a.go"])
+}
+
 func TestAdd(t *testing.T) {
 	duration10 := time.Duration(10)
 	duration20 := time.Duration(20)
@@ -0,0 +1,500 @@
+package lint
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/parse/asp"
+)
+
+// labelArgs are the arguments whose values are build labels (or, for some, files).
+// The value is true if every entry must be a label, false if files are permitted too.
+var labelArgs = map[string]bool{
+	"deps":          true,
+	"exported_deps": true,
+	"internal_deps": true,
+	"test_services": true,
+	"visibility":    true,
+	"srcs":          false,
+	"data":          false,
+	"tools":         false,
+	"test_tools":    false,
+}
+
+// A fileLinter holds the state while linting a single file.
+type fileLinter struct {
+	*Linter
+	filename  string
+	isBuild   bool
+	isBuiltin bool
+	issues    []Issue
+	// Functions defined anywhere in this file.
+	functions map[string]*asp.FuncDef
+	// All names bound anywhere in this file (assignments, arguments, loop variables etc).
+	bound map[string]bool
+	// True if the file subincludes or loads anything, in which case we can't know all functions
+	// (and those we do know other than the core builtins might have been redefined).
+	dynamic bool
+	// Records shadowing issues we've already reported, to avoid duplicates.
+	shadowed map[asp.Position]map[string]bool
+}
+
+// addIssue records a new issue.
+func (f *fileLinter) addIssue(pos asp.Position, rule string, severity Severity, msg string, args ...interface{}) {
+	if pos.Line == 0 {
+		pos.Line = 1 // Some errors don't have a position, but it's still useful to attribute them to the file.
+	}
+	f.issues = append(f.issues, Issue{
+		Filename: f.filename,
+		Line:     pos.Line,
+		Column:   pos.Column,
+		Rule:     rule,
+		Severity: severity,
+		Message:  fmt.Sprintf(msg, args...),
+	})
+}
+
+// lint runs all the checks on a file.
+func (f *fileLinter) lint(stmts []*asp.Statement) {
+	f.collectBindings(stmts)
+	if f.isBuild {
+		f.checkUnused(stmts)
+	}
+	f.lintStatements(stmts)
+}
+
+// collectBindings finds all the names that are bound within the given statements.
+// This is deliberately scope-insensitive; the aim is to avoid false positives when
+// deciding whether a function is known or not.
+func (f *fileLinter) collectBindings(stmts []*asp.Statement) {
+	asp.WalkAST(stmts, func(def *asp.FuncDef) bool {
+		f.functions[def.Name] = def
+		f.bindArguments(def.Arguments)
+		return true
+	})
+	asp.WalkAST(stmts, func(stmt *asp.IdentStatement) bool {
+		if stmt.Unpack != nil {
+			f.bound[stmt.Name] = true
+			for _, name := range stmt.Unpack.Names {
+				f.bound[name] = true
+			}
+		} else if stmt.Action != nil && stmt.Action.Assign != nil {
+			f.bound[stmt.Name] = true
+		} else if stmt.Action != nil && stmt.Action.Call != nil && (stmt.Name == "subinclude" || stmt.Name == "load") {
+			f.dynamic = true
+		}
+		return true
+	})
+	asp.WalkAST(stmts, func(stmt *asp.ForStatement) bool {
+		f.bindNames(stmt.Names)
+		return true
+	})
+	asp.WalkAST(stmts, func(comp *asp.Comprehension) bool {
+		f.bindNames(comp.Names)
+		if comp.Second != nil {
+			f.bindNames(comp.Second.Names)
+		}
+		return true
+	})
+	asp.WalkAST(stmts, func(lambda *asp.Lambda) bool {
+		f.bindArguments(lambda.Arguments)
+		return true
+	})
+}
+
+func (f *fileLinter) bindNames(names []string) {
+	for _, name := range names {
+		f.bound[name] = true
+	}
+}
+
+func (f *fileLinter) bindArguments(args []asp.Argument) {
+	for _, arg := range args {
+		f.bound[arg.Name] = true
+	}
+}
+
+// checkUnused checks for variables that are assigned directly in a block but never read anywhere within it.
+func (f *fileLinter) checkUnused(stmts []*asp.Statement) {
+	read := map[string]bool{}
+	asp.WalkAST(stmts, func(expr *asp.IdentExpr) bool {
+		read[expr.Name] = true
+		return true
+	})
+	asp.WalkAST(stmts, func(fs *asp.FString) bool {
+		for _, v := range fs.Vars {
+			read[v.Var] = true
+		}
+		return true
+	})
+	asp.WalkAST(stmts, func(stmt *asp.IdentStatement) bool {
+		if stmt.Index != nil || (stmt.Action != nil && stmt.Action.Assign == nil) {
+			read[stmt.Name] = true
+		}
+		return true
+	})
+	reported := map[string]bool{}
+	var check func(stmts []*asp.Statement)
+	check = func(stmts []*asp.Statement) {
+		for _, stmt := range stmts {
+			if stmt.Ident != nil && stmt.Ident.Action != nil && stmt.Ident.Action.Assign != nil {
+				if name := stmt.Ident.Name; !read[name] && !reported[name] && !strings.HasPrefix(name, "_") {
+					f.addIssue(stmt.Pos, "unused-variable", Warning, "%s is assigned but never used", name)
+					reported[name] = true
+				}
+			} else if stmt.For != nil {
+				check(stmt.For.Statements)
+			} else if stmt.If != nil {
+				check(stmt.If.Statements)
+				for _, elif := range stmt.If.Elif {
+					check(elif.Statements)
+				}
+				check(stmt.If.ElseStatements)
+			}
+		}
+	}
+	check(stmts)
+}
+
+// lintStatements lints a block of statements.
+func (f *fileLinter) lintStatements(stmts []*asp.Statement) {
+	for i, stmt := range stmts {
+		f.lintStatement(stmt)
+		if reason := terminates(stmt); reason != "" && i < len(stmts)-1 {
+			f.addIssue(stmts[i+1].Pos, "unreachable-code", Warning, "Unreachable code after %s", reason)
+			for _, stmt := range stmts[i+1:] {
+				f.lintStatement(stmt)
+			}
+			return
+		}
+	}
+}
+
+// terminates returns a description of the statement if it unconditionally ends execution of the current block.
+func terminates(stmt *asp.Statement) string {
+	if stmt.Return != nil {
+		return "return"
+	} else if stmt.Raise != nil {
+		return "raise"
+	} else if stmt.Continue {
+		return "continue"
+	} else if stmt.Ident != nil && stmt.Ident.Name == "fail" && stmt.Ident.Action != nil && stmt.Ident.Action.Call != nil {
+		return "fail()"
+	}
+	return ""
+}
+
+// lintStatement lints a single statement.
+func (f *fileLinter) lintStatement(stmt *asp.Statement) {
+	if def := stmt.FuncDef; def != nil {
+		f.checkShadowing(stmt.Pos, def.Name)
+		f.lintArguments(stmt.Pos, def.Arguments)
+		f.checkUnused(def.Statements)
+		f.lintStatements(def.Statements)
+	} else if stmt.For != nil {
+		f.checkShadowing(stmt.Pos, stmt.For.Names...)
+		f.lintExpression(&stmt.For.Expr)
+		f.lintStatements(stmt.For.Statements)
+	} else if stmt.If != nil {
+		f.lintExpression(&stmt.If.Condition)
+		f.lintStatements(stmt.If.Statements)
+		for _, elif := range stmt.If.Elif {
+			f.lintExpression(&elif.Condition)
+			f.lintStatements(elif.Statements)
+		}
+		f.lintStatements(stmt.If.ElseStatements)
+	} else if stmt.Return != nil {
+		for _, v := range stmt.Return.Values {
+			f.lintExpression(v)
+		}
+	} else if stmt.Raise != nil {
+		f.lintExpression(stmt.Raise)
+	} else if stmt.Assert != nil {
+		f.lintExpression(stmt.Assert.Expr)
+		f.lintExpression(stmt.Assert.Message)
+	} else if stmt.Literal != nil {
+		f.lintExpression(stmt.Literal)
+	} else if ident := stmt.Ident; ident != nil {
+		if ident.Unpack != nil {
+			f.checkShadowing(stmt.Pos, ident.Name)
+			f.checkShadowing(stmt.Pos, ident.Unpack.Names...)
+			f.lintExpression(ident.Unpack.Expr)
+		} else if ident.Index != nil {
+			f.lintExpression(ident.Index.Expr)
+			f.lintExpression(ident.Index.Assign)
+			f.lintExpression(ident.Index.AugAssign)
+		} else if action := ident.Action; action != nil {
+			if action.Call != nil {
+				f.lintCall(stmt.Pos, ident.Name, action.Call)
+			} else if action.Property != nil {
+				f.lintIdentExpr(action.Property, true)
+			} else if action.Assign != nil {
+				f.checkShadowing(stmt.Pos, ident.Name)
+				f.lintExpression(action.Assign)
+			} else {
+				f.lintExpression(action.AugAssign)
+			}
+		}
+	}
+}
+
+// lintArguments lints the arguments of a function definition or lambda.
+func (f *fileLinter) lintArguments(pos asp.Position, args []asp.Argument) {
+	for _, arg := range args {
+		f.checkShadowing(pos, arg.Name)
+		f.lintExpression(arg.Value)
+	}
+}
+
+// checkShadowing checks whether any of the given names, which are being bound, shadow a builtin.
+func (f *fileLinter) checkShadowing(pos asp.Position, names ...string) {
+	if f.isBuiltin {
+		return // This is where they're defined in the first place.
+	}
+	for _, name := range names {
+		if f.builtins[name] && !f.shadowed[pos][name] {
+			f.addIssue(pos, "shadowed-builtin", Warning, "%s shadows a builtin", name)
+			if f.shadowed[pos] == nil {
+				f.shadowed[pos] = map[string]bool{}
+			}
+			f.shadowed[pos][name] = true
+		}
+	}
+}
+
+// lintExpression lints a single expression, which may be nil.
+func (f *fileLinter) lintExpression(expr *asp.Expression) {
+	if expr == nil {
+		return
+	}
+	if expr.UnaryOp != nil {
+		f.lintValue(expr.Pos, &expr.UnaryOp.Expr)
+	}
+	f.lintValue(expr.Pos, expr.Val)
+	for _, op := range expr.Op {
+		f.lintExpression(op.Expr)
+	}
+	if expr.If != nil {
+		f.lintExpression(expr.If.Condition)
+		f.lintExpression(expr.If.Else)
+	}
+}
+
+// lintValue lints a single value expression, which may be nil.
+func (f *fileLinter) lintValue(pos asp.Position, val *asp.ValueExpression) {
+	if val == nil {
+		return
+	}
+	if val.List != nil {
+		f.lintList(pos, val.List)
+	} else if val.Tuple != nil {
+		f.lintList(pos, val.Tuple)
+	} else if val.Dict != nil {
+		for _, item := range val.Dict.Items {
+			f.lintExpression(&item.Key)
+			f.lintExpression(&item.Value)
+		}
+		f.lintComprehension(pos, val.Dict.Comprehension)
+	} else if val.Lambda != nil {
+		f.lintArguments(pos, val.Lambda.Arguments)
+		f.lintExpression(&val.Lambda.Expr)
+	} else if val.Ident != nil {
+		f.lintIdentExpr(val.Ident, false)
+	}
+	for _, slice := range val.Slices {
+		f.lintExpression(slice.Start)
+		f.lintExpression(slice.End)
+	}
+	if val.Property != nil {
+		f.lintIdentExpr(val.Property, true)
+	}
+	if val.Call != nil {
+		f.lintCallArguments(val.Call)
+	}
+}
+
+func (f *fileLinter) lintList(pos asp.Position, l *asp.List) {
+	for _, v := range l.Values {
+		f.lintExpression(v)
+	}
+	f.lintComprehension(pos, l.Comprehension)
+}
+
+func (f *fileLinter) lintComprehension(pos asp.Position, comp *asp.Comprehension) {
+	if comp == nil {
+		return
+	}
+	f.checkShadowing(pos, comp.Names...)
+	f.lintExpression(comp.Expr)
+	if comp.Second != nil {
+		f.checkShadowing(pos, comp.Second.Names...)
+		f.lintExpression(comp.Second.Expr)
+	}
+	f.lintExpression(comp.If)
+}
+
+// lintIdentExpr lints an identifier expression. If member is true it's a property of some other object
+// (e.g. a method call), in which case we can't check it against any known function.
+func (f *fileLinter) lintIdentExpr(expr *asp.IdentExpr, member bool) {
+	for i, action := range expr.Action {
+		if action.Call != nil {
+			if i == 0 && !member {
+				f.lintCall(expr.Pos, expr.Name, action.Call)
+			} else {
+				f.lintCallArguments(action.Call)
+			}
+		} else if action.Property != nil {
+			f.lintIdentExpr(action.Property, true)
+		}
+	}
+}
+
+// lintCallArguments lints the arguments to a call, without knowing what the function being called is.
+func (f *fileLinter) lintCallArguments(call *asp.Call) {
+	for i, arg := range call.Arguments {
+		f.lintExpression(&call.Arguments[i].Value)
+		if mustBeLabel, present := labelArgs[arg.Name]; present {
+			f.checkLabels(arg.Name, &call.Arguments[i].Value, mustBeLabel)
+		}
+	}
+}
+
+// lintCall lints a call to a named function.
+func (f *fileLinter) lintCall(pos asp.Position, name string, call *asp.Call) {
+	f.lintCallArguments(call)
+	def, present := f.functions[name]
+	if !present {
+		if f.bound[name] {
+			return // Some local variable, we can't tell what it is.
+		} else if def, present = f.Linter.functions[name]; !present {
+			if !f.dynamic && !f.builtins[name] {
+				f.addIssue(pos, "unknown-function", Error, "Unknown function %s", name)
+			}
+			return
+		} else if f.dynamic && !f.builtins[name] {
+			return // Might have been redefined by something we subincluded.
+		}
+	}
+	f.checkArguments(pos, name, def, call)
+}
+
+// checkArguments checks the arguments of a call against the definition of the function being called.
+func (f *fileLinter) checkArguments(pos asp.Position, name string, def *asp.FuncDef, call *asp.Call) {
+	indices := map[string]int{}
+	for i, arg := range def.Arguments {
+		indices[arg.Name] = i
+		for _, alias := range arg.Aliases {
+			indices[alias] = i
+		}
+	}
+	passed := make([]bool, len(def.Arguments))
+	for i, arg := range call.Arguments {
+		idx := i
+		if arg.Name != "" {
+			var present bool
+			if idx, present = indices[arg.Name]; !present {
+				// Builtins implemented natively can take private arguments that aren't in their declarations.
+				if !nativeKwargs[name] && !(f.builtins[name] && strings.HasPrefix(arg.Name, "_")) {
+					f.addIssue(arg.Pos, "unknown-argument", Error, "%s has no argument named %s", name, arg.Name)
+				}
+				continue
+			}
+		} else if nativeVarargs[name] && i > 0 {
+			continue // As in the interpreter, only the first argument to these is matched positionally.
+		} else if i >= len(def.Arguments) {
+			if !nativeVarargs[name] {
+				f.addIssue(arg.Value.Pos, "too-many-arguments", Error, "Too many arguments to %s; it takes at most %d", name, len(def.Arguments))
+			}
+			continue
+		}
+		passed[idx] = true
+		f.checkType(name, &def.Arguments[idx], &call.Arguments[i].Value)
+	}
+	if nativeVarargs[name] {
+		return
+	}
+	for i, arg := range def.Arguments {
+		if !passed[i] && arg.Value == nil {
+			f.addIssue(pos, "missing-argument", Error, "Missing required argument to %s: %s", name, arg.Name)
+		}
+	}
+}
+
+// checkType checks that the type of an argument matches its annotation, if it's a literal whose type we know.
+func (f *fileLinter) checkType(name string, arg *asp.Argument, expr *asp.Expression) {
+	actual := literalType(expr)
+	if len(arg.Type) == 0 || actual == "" {
+		return
+	}
+	for _, t := range arg.Type {
+		if t == actual {
+			return
+		}
+	}
+	// This mirrors the interpreter, which allows these in Bazel compatibility mode.
+	if f.config.Bazel.Compatibility && arg.Type[0] == "bool" && actual == "int" {
+		return
+	}
+	f.addIssue(expr.Pos, "argument-type", Error, "Invalid type for argument %s to %s; expected %s, was %s", arg.Name, name, strings.Join(arg.Type, " or "), actual)
+}
+
+// literalType returns the type of an expression if it's a simple literal, or the empty string if it isn't.
+// None is considered not to have a type since it's always accepted.
+func literalType(expr *asp.Expression) string {
+	val := expr.Val
+	if val == nil || expr.UnaryOp != nil || len(expr.Op) > 0 || expr.If != nil || len(val.Slices) > 0 || val.Property != nil || val.Call != nil {
+		return ""
+	} else if val.String != "" || val.FString != nil {
+		return "str"
+	} else if val.Int != nil {
+		return "int"
+	} else if val.Bool == "True" || val.Bool == "False" {
+		return "bool"
+	} else if val.List != nil || val.Tuple != nil {
+		return "list"
+	} else if val.Dict != nil {
+		return "dict"
+	} else if val.Lambda != nil {
+		return "function"
+	}
+	return ""
+}
+
+// checkLabels checks any string literals in the given argument that should be build labels.
+func (f *fileLinter) checkLabels(name string, expr *asp.Expression, mustBeLabel bool) {
+	if expr.Val == nil || len(expr.Op) > 0 || expr.If != nil {
+		return
+	}
+	if l := expr.Val.List; l != nil && l.Comprehension == nil && len(expr.Val.Slices) == 0 && expr.Val.Property == nil {
+		for _, v := range l.Values {
+			if v.Val != nil && v.Val.String != "" && len(v.Op) == 0 && len(v.Val.Slices) == 0 && v.Val.Property == nil {
+				f.checkLabel(v.Pos, name, strings.Trim(v.Val.String, `"`), mustBeLabel)
+			}
+		}
+	} else if d := expr.Val.Dict; d != nil && d.Comprehension == nil {
+		for _, item := range d.Items {
+			f.checkLabels(name, &item.Value, mustBeLabel)
+		}
+	}
+}
+
+// checkLabel checks a single string that should be a build label.
+func (f *fileLinter) checkLabel(pos asp.Position, name, s string, mustBeLabel bool) {
+	if name == "visibility" && s == "PUBLIC" {
+		return
+	} else if !core.LooksLikeABuildLabel(s) {
+		if mustBeLabel {
+			f.addIssue(pos, "malformed-label", Error, "%s must be build labels, but got %q", name, s)
+		}
+		return
+	} else if !mustBeLabel {
+		s = strings.SplitN(s, "|", 2)[0] // Strip any named output
+	}
+	label, err := core.TryParseBuildLabel(s, "", "")
+	if err != nil {
+		f.addIssue(pos, "malformed-label", Error, "Malformed build label %q in %s", s, name)
+	} else if name != "visibility" && (label.IsAllTargets() || label.IsAllSubpackages()) {
+		f.addIssue(pos, "malformed-label", Error, "%s cannot contain pseudo-labels like %q", name, s)
+	}
+}
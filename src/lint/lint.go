@@ -0,0 +1,252 @@
+// Package lint implements static analysis of BUILD files and build definitions.
+//
+// Unlike the interpreter, which only finds problems in the code paths it happens to execute,
+// this looks over the whole of each file and checks calls against the signatures of the
+// builtin rules (including their type annotations), as well as a few other common mistakes.
+package lint
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/thought-machine/please/rules"
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+	"github.com/thought-machine/please/src/parse/asp"
+)
+
+var log = logging.MustGetLogger("lint")
+
+// A Severity describes how serious an issue is.
+type Severity string
+
+// Error is used for issues that will (or are very likely to) fail at parse time.
+const Error Severity = "error"
+
+// Warning is used for issues that are suspicious but not necessarily incorrect.
+const Warning Severity = "warning"
+
+// Failed returns true if any of the given issues are at least as severe as the given severity.
+func Failed(issues []Issue, severity Severity) bool {
+	for _, issue := range issues {
+		if issue.Severity == Error || issue.Severity == severity {
+			return true
+		}
+	}
+	return false
+}
+
+// An Issue is a single problem found by the linter.
+type Issue struct {
+	Filename string   `json:"file"`
+	Line     int      `json:"line"`
+	Column   int      `json:"column"`
+	Rule     string   `json:"rule"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+// Rules describes each of the rules that the linter checks.
+var Rules = map[string]string{
+	"parse-error":        "File cannot be parsed",
+	"unknown-function":   "Call to a function that is not defined",
+	"unknown-argument":   "Call passes an argument that the function does not accept",
+	"missing-argument":   "Call does not pass a required argument",
+	"too-many-arguments": "Call passes more positional arguments than the function accepts",
+	"argument-type":      "Argument does not match the type annotation of the function",
+	"unused-variable":    "Variable is assigned but never used",
+	"shadowed-builtin":   "Name shadows a builtin function or variable",
+	"unreachable-code":   "Statement can never be executed",
+	"malformed-label":    "String is not a valid build label",
+}
+
+// nativeVarargs are the builtins implemented natively that accept any number of positional arguments.
+var nativeVarargs = map[string]bool{
+	"subinclude": true,
+	"load":       true,
+	"zip":        true,
+	"join_path":  true,
+	"min":        true,
+	"max":        true,
+	"debug":      true,
+	"info":       true,
+	"notice":     true,
+	"warning":    true,
+	"error":      true,
+	"fatal":      true,
+}
+
+// nativeKwargs are the builtins implemented natively that accept arbitrary keyword arguments.
+var nativeKwargs = map[string]bool{
+	"package": true,
+	"struct":  true,
+}
+
+// A Linter checks files against a set of known functions.
+type Linter struct {
+	config *core.Configuration
+	parser *asp.Parser
+	// All the functions that are available to every file.
+	functions map[string]*asp.FuncDef
+	// The names defined in builtins.build_defs; these are the ones we don't want to be shadowed.
+	builtins map[string]bool
+}
+
+// NewLinter creates a new Linter, loading the builtin rules and any configured build definitions.
+func NewLinter(state *core.BuildState) *Linter {
+	l := &Linter{
+		config:    state.Config,
+		parser:    asp.NewParser(state),
+		functions: map[string]*asp.FuncDef{},
+		builtins:  map[string]bool{"True": true, "False": true, "None": true, "CONFIG": true},
+	}
+	dir, _ := rules.AssetDir("")
+	sort.Strings(dir)
+	for _, filename := range dir {
+		if !strings.HasSuffix(filename, ".gob") {
+			if stmts, err := l.parser.ParseData(rules.MustAsset(filename), filename); err != nil {
+				log.Warning("Failed to parse builtin rules %s: %s", filename, err)
+			} else {
+				l.addGlobals(stmts, filename == "builtins.build_defs")
+			}
+		}
+	}
+	// Mirror the interpreter, which replaces filegroup with native code taking the same arguments as build_rule.
+	if buildRule, present := l.functions["build_rule"]; present {
+		l.functions["filegroup"] = buildRule
+	}
+	for _, preload := range state.Config.Parse.PreloadBuildDefs {
+		l.addGlobalsFromFile(preload)
+	}
+	for _, dir := range state.Config.Parse.BuildDefsDir {
+		if files, err := ioutil.ReadDir(dir); err == nil {
+			for _, file := range files {
+				if !file.IsDir() {
+					l.addGlobalsFromFile(path.Join(dir, file.Name()))
+				}
+			}
+		}
+	}
+	return l
+}
+
+// addGlobalsFromFile adds any global functions from the given file.
+func (l *Linter) addGlobalsFromFile(filename string) {
+	if stmts, err := l.parser.ParseFileOnly(filename); err != nil {
+		log.Warning("Failed to parse %s: %s", filename, err)
+	} else {
+		l.addGlobals(stmts, false)
+	}
+}
+
+// addGlobals adds all the top-level functions from a set of statements.
+// Member functions (i.e. those whose first argument is self) are skipped since they can't be called directly.
+func (l *Linter) addGlobals(stmts []*asp.Statement, builtin bool) {
+	for _, stmt := range stmts {
+		if f := stmt.FuncDef; f != nil {
+			if len(f.Arguments) == 0 || f.Arguments[0].Name != "self" {
+				l.functions[f.Name] = f
+				if builtin {
+					l.builtins[f.Name] = true
+				}
+			}
+		} else if builtin && stmt.Ident != nil && stmt.Ident.Action != nil && stmt.Ident.Action.Assign != nil {
+			l.builtins[stmt.Ident.Name] = true
+		}
+	}
+}
+
+// Lint lints the given files. Any directories are searched for BUILD files and build definitions;
+// if none are given then the whole repo is.
+// The returned issues are sorted by file and position.
+func Lint(state *core.BuildState, paths []string) ([]Issue, error) {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	l := NewLinter(state)
+	issues := []Issue{}
+	for _, p := range paths {
+		files, err := l.findFiles(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			i, err := l.LintFile(file)
+			if err != nil {
+				return nil, err
+			}
+			issues = append(issues, i...)
+		}
+	}
+	return issues, nil
+}
+
+// findFiles returns the BUILD files and build definitions under the given path.
+// If it is a file then it is returned regardless of its name.
+func (l *Linter) findFiles(root string) ([]string, error) {
+	files := []string{}
+	err := fs.Walk(root, func(name string, isDir bool) error {
+		basename := path.Base(name)
+		if name == root {
+			if !isDir {
+				files = append(files, name)
+			}
+			return nil
+		} else if isDir {
+			if basename == core.OutDir || strings.HasPrefix(basename, ".") {
+				return filepath.SkipDir // Don't walk output or hidden directories
+			}
+			for _, dir := range l.config.Parse.BlacklistDirs {
+				if dir == basename || strings.HasPrefix(name, dir) {
+					return filepath.SkipDir
+				}
+			}
+		} else if l.config.IsABuildFile(basename) || strings.HasSuffix(basename, ".build_defs") {
+			files = append(files, path.Clean(name))
+		}
+		return nil
+	})
+	return files, err
+}
+
+// LintFile lints a single file. An error is only returned if the file can't be read; if it
+// can't be parsed then that is reported as an issue.
+func (l *Linter) LintFile(filename string) ([]Issue, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return l.LintData(data, filename), nil
+}
+
+// LintData lints the contents of a file.
+func (l *Linter) LintData(data []byte, filename string) []Issue {
+	f := &fileLinter{
+		Linter:    l,
+		filename:  filename,
+		isBuild:   l.config.IsABuildFile(path.Base(filename)),
+		isBuiltin: path.Base(filename) == "builtins.build_defs",
+		functions: map[string]*asp.FuncDef{},
+		bound:     map[string]bool{},
+		shadowed:  map[asp.Position]map[string]bool{},
+	}
+	stmts, err := l.parser.ParseData(data, filename)
+	if err != nil {
+		pos, msg := asp.ErrorPosition(err)
+		f.addIssue(pos, "parse-error", Error, "%s", msg)
+		return f.issues
+	}
+	f.lint(stmts)
+	sort.SliceStable(f.issues, func(i, j int) bool {
+		if f.issues[i].Line != f.issues[j].Line {
+			return f.issues[i].Line < f.issues[j].Line
+		}
+		return f.issues[i].Column < f.issues[j].Column
+	})
+	return f.issues
+}
@@ -0,0 +1,126 @@
+package lint
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/rules"
+	"github.com/thought-machine/please/src/core"
+)
+
+var linter = newLinter()
+
+func newLinter() *Linter {
+	state := core.NewDefaultBuildState()
+	state.Config.Parse.BuildFileName = []string{"BUILD"}
+	return NewLinter(state)
+}
+
+func TestLintGood(t *testing.T) {
+	issues, err := linter.LintFile("src/lint/test_data/good.build_defs")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(issues), "%v", issues)
+}
+
+func TestLintBad(t *testing.T) {
+	data, err := ioutil.ReadFile("src/lint/test_data/bad.build")
+	require.NoError(t, err)
+	issues := linter.LintData(data, "src/lint/test_data/BUILD")
+	type ruleLine struct {
+		Rule string
+		Line int
+	}
+	actual := make([]ruleLine, len(issues))
+	for i, issue := range issues {
+		actual[i] = ruleLine{Rule: issue.Rule, Line: issue.Line}
+	}
+	assert.Equal(t, []ruleLine{
+		{"shadowed-builtin", 1},
+		{"unused-variable", 4},
+		{"unreachable-code", 6},
+		{"unused-variable", 8},
+		{"malformed-label", 12},
+		{"malformed-label", 15},
+		{"malformed-label", 15},
+		{"unknown-argument", 16},
+		{"argument-type", 21},
+		{"missing-argument", 25},
+		{"unknown-function", 27},
+		{"too-many-arguments", 29},
+	}, actual)
+}
+
+func TestLintBuiltinRules(t *testing.T) {
+	dir, err := rules.AssetDir("")
+	require.NoError(t, err)
+	for _, filename := range dir {
+		if strings.HasSuffix(filename, ".build_defs") {
+			for _, issue := range linter.LintData(rules.MustAsset(filename), filename) {
+				assert.NotEqual(t, Error, issue.Severity, "%s", issue)
+			}
+		}
+	}
+}
+
+func TestLintMinMaxVarargs(t *testing.T) {
+	issues := linter.LintData([]byte("x = min(1, 2, 3)\ny = max(x, 4, key=str)\ndebug(y)\n"), "BUILD")
+	assert.Equal(t, 0, len(issues), "%v", issues)
+}
+
+func TestLintParseError(t *testing.T) {
+	issues := linter.LintData([]byte("genrule(\n    name = ,\n)\n"), "BUILD")
+	require.Equal(t, 1, len(issues))
+	assert.Equal(t, "parse-error", issues[0].Rule)
+	assert.Equal(t, 2, issues[0].Line)
+}
+
+func TestLintSubincludeAllowsUnknownFunctions(t *testing.T) {
+	issues := linter.LintData([]byte(`subinclude("//build_defs:foo")
+foo_library(name = "foo")
+go_library(name = "bar", unknown = True)
+`), "BUILD")
+	assert.Equal(t, 0, len(issues), "%v", issues)
+}
+
+func TestFailed(t *testing.T) {
+	warning := Issue{Rule: "unused-variable", Severity: Warning}
+	err := Issue{Rule: "unknown-function", Severity: Error}
+	assert.False(t, Failed(nil, Warning))
+	assert.False(t, Failed([]Issue{warning}, Error))
+	assert.True(t, Failed([]Issue{warning}, Warning))
+	assert.True(t, Failed([]Issue{warning, err}, Error))
+}
+
+func TestPrintIssuesText(t *testing.T) {
+	var buf bytes.Buffer
+	err := PrintIssues(&buf, []Issue{{Filename: "BUILD", Line: 3, Column: 5, Rule: "unknown-function", Severity: Error, Message: "Unknown function foo"}}, "text")
+	assert.NoError(t, err)
+	assert.Equal(t, "BUILD:3:5: error: Unknown function foo [unknown-function]\n", buf.String())
+}
+
+func TestPrintIssuesSARIF(t *testing.T) {
+	var buf bytes.Buffer
+	err := PrintIssues(&buf, []Issue{{Filename: "BUILD", Line: 3, Column: 5, Rule: "unknown-function", Severity: Error, Message: "Unknown function foo"}}, "sarif")
+	require.NoError(t, err)
+	log := &sarifLog{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), log))
+	assert.Equal(t, "2.1.0", log.Version)
+	require.Equal(t, 1, len(log.Runs))
+	assert.Equal(t, len(Rules), len(log.Runs[0].Tool.Driver.Rules))
+	require.Equal(t, 1, len(log.Runs[0].Results))
+	result := log.Runs[0].Results[0]
+	assert.Equal(t, "unknown-function", result.RuleID)
+	assert.Equal(t, Error, result.Level)
+	assert.Equal(t, "BUILD", result.Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	assert.Equal(t, 3, result.Locations[0].PhysicalLocation.Region.StartLine)
+}
+
+func TestPrintIssuesUnknownFormat(t *testing.T) {
+	assert.Error(t, PrintIssues(&bytes.Buffer{}, nil, "xml"))
+}
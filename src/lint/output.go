@@ -0,0 +1,115 @@
+package lint
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// PrintIssues writes the given issues to the writer in the given format, which is one of
+// "text", "json" or "sarif".
+func PrintIssues(w io.Writer, issues []Issue, format string) error {
+	switch format {
+	case "json":
+		return writeJSON(w, issues)
+	case "sarif":
+		return writeJSON(w, toSARIF(issues))
+	case "text", "":
+		for _, issue := range issues {
+			if _, err := fmt.Fprintf(w, "%s:%d:%d: %s: %s [%s]\n", issue.Filename, issue.Line, issue.Column, issue.Severity, issue.Message, issue.Rule); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown output format %s", format)
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// The following types describe the subset of SARIF 2.1.0 that we use.
+// See https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html for the full thing.
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     Severity        `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+		Region struct {
+			StartLine   int `json:"startLine"`
+			StartColumn int `json:"startColumn,omitempty"`
+		} `json:"region"`
+	} `json:"physicalLocation"`
+}
+
+// toSARIF converts a set of issues to a SARIF log.
+func toSARIF(issues []Issue) *sarifLog {
+	driver := sarifDriver{Name: "plz lint", InformationURI: "https://please.build/commands.html#lint"}
+	for id, desc := range Rules {
+		driver.Rules = append(driver.Rules, sarifRule{ID: id, ShortDescription: sarifMessage{Text: desc}})
+	}
+	sort.Slice(driver.Rules, func(i, j int) bool { return driver.Rules[i].ID < driver.Rules[j].ID })
+	results := make([]sarifResult, len(issues))
+	for i, issue := range issues {
+		loc := sarifLocation{}
+		loc.PhysicalLocation.ArtifactLocation.URI = issue.Filename
+		loc.PhysicalLocation.Region.StartLine = issue.Line
+		loc.PhysicalLocation.Region.StartColumn = issue.Column
+		results[i] = sarifResult{
+			RuleID:    issue.Rule,
+			Level:     issue.Severity,
+			Message:   sarifMessage{Text: issue.Message},
+			Locations: []sarifLocation{loc},
+		}
+	}
+	return &sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{{Tool: sarifTool{Driver: driver}, Results: results}},
+	}
+}
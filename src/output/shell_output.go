@@ -266,6 +266,7 @@ func printTestResults(state *core.BuildState, failedTargets []core.BuildLabel, f
 			}
 		}
 	}
+	printQuarantinedResults(state)
 	// Print individual test results
 	targets := 0
 	aggregate := core.TestSuite{}
@@ -317,6 +318,27 @@ func printTestResults(state *core.BuildState, failedTargets []core.BuildLabel, f
 	printf("${BOLD_WHITE}Total time: %s real, %s compute.${RESET}\n", duration, aggregate.Duration.Round(durationGranularity))
 }
 
+// printQuarantinedResults prints the failures of any quarantined tests.
+// These don't fail the build but we still want people to know about them.
+func printQuarantinedResults(state *core.BuildState) {
+	for _, target := range state.Graph.AllTargets() {
+		if !target.IsTest || target.Results.Quarantined() == 0 {
+			continue
+		}
+		printf("${BOLD_YELLOW}Quarantined:${RESET} %s ${BOLD_YELLOW}%s${RESET}\n", target.Label, pluralise(target.Results.Quarantined(), "failure", "failures"))
+		for _, testCase := range target.Results.TestCases {
+			if !testCase.Quarantined || testCase.Success() != nil || testCase.Skip() != nil {
+				continue
+			}
+			if failures := testCase.Failures(); len(failures) > 0 {
+				printf("    ${YELLOW}%s${RESET}: %s\n", testCase.Name, failures[0].Failure.Message)
+			} else if errors := testCase.Errors(); len(errors) > 0 {
+				printf("    ${YELLOW}%s${RESET}: %s\n", testCase.Name, errors[0].Error.Message)
+			}
+		}
+	}
+}
+
 func showExecutionOutput(execution core.TestExecution) {
 	if execution.Stdout != "" && execution.Stderr != "" {
 		printf("StdOut:\n%s\nStdErr:\n%s\n", execution.Stdout, execution.Stderr)
@@ -338,6 +360,8 @@ func formatTestCase(result core.TestCase, name string, detailed bool) string {
 
 	if result.Success() != nil {
 		outcome = *result.Success()
+	} else if result.Quarantined && result.Skip() == nil {
+		return fmt.Sprintf("%s ${BOLD_YELLOW}%s${RESET}", formatTestName(result, name), "QUARANTINED")
 	} else if result.Skip() != nil {
 		outcome = *result.Skip()
 	} else if len(result.Errors()) > 0 {
@@ -428,6 +452,9 @@ func testResultMessage(results core.TestSuite, showDuration bool) string {
 	if results.FlakyPasses() > 0 {
 		msg += fmt.Sprintf(", ${BOLD_MAGENTA}%s${RESET}", pluralise(results.FlakyPasses(), "flake", "flakes"))
 	}
+	if results.Quarantined() > 0 {
+		msg += fmt.Sprintf(", ${BOLD_YELLOW}%d quarantined${RESET}", results.Quarantined())
+	}
 	if results.TimedOut {
 		msg += ", ${RED_ON_WHITE}TIMED OUT${RESET}"
 	}
@@ -616,6 +643,8 @@ func PrintCoverage(state *core.BuildState, includeFiles []string) {
 	printf("${BOLD_WHITE}Coverage results:${RESET}\n")
 	totalCovered := 0
 	totalTotal := 0
+	totalBranchesTaken := 0
+	totalBranches := 0
 	lastDir := "_"
 	for _, file := range state.Coverage.OrderedFiles() {
 		if !shouldInclude(file, includeFiles) {
@@ -631,11 +660,21 @@ func PrintCoverage(state *core.BuildState, includeFiles []string) {
 		}
 		lastDir = dir
 		covered, total := test.CountCoverage(state.Coverage.Files[file])
-		printf("  %s\n", coveragePercentage(covered, total, strings.TrimPrefix(file, dir+"/")))
+		taken, branches := test.CountBranchCoverage(state.Coverage.Branches[file])
+		if branches > 0 {
+			printf("  %s %s\n", coveragePercentage(covered, total, strings.TrimPrefix(file, dir+"/")), branchCoveragePercentage(taken, branches))
+		} else {
+			printf("  %s\n", coveragePercentage(covered, total, strings.TrimPrefix(file, dir+"/")))
+		}
 		totalCovered += covered
 		totalTotal += total
+		totalBranchesTaken += taken
+		totalBranches += branches
 	}
 	printf("${BOLD_WHITE}Total coverage: %s${RESET}\n", coveragePercentage(totalCovered, totalTotal, ""))
+	if totalBranches > 0 {
+		printf("${BOLD_WHITE}Branch coverage: %s${RESET}\n", branchCoveragePercentage(totalBranchesTaken, totalBranches))
+	}
 }
 
 // PrintIncrementalCoverage prints the given incremental coverage statistics.
@@ -715,6 +754,12 @@ func coveragePercentage(covered, total int, label string) string {
 	return fmt.Sprintf("%s%s %d/%s, %2.1f%%${RESET}", coverageColour(percentage), label, covered, pluralise(total, "line", "lines"), percentage)
 }
 
+// branchCoveragePercentage is like coveragePercentage but for branches.
+func branchCoveragePercentage(taken, total int) string {
+	percentage := 100.0 * float32(taken) / float32(total)
+	return fmt.Sprintf("%s(%d/%s, %2.1f%%)${RESET}", coverageColour(percentage), taken, pluralise(total, "branch", "branches"), percentage)
+}
+
 // colouriseError adds a splash of colour to a compiler error message.
 // This is a similar effect to -fcolor-diagnostics in Clang, but we attempt to apply it fairly generically.
 func colouriseError(err error) error {
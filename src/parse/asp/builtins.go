@@ -9,6 +9,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/manifoldco/promptui"
 
@@ -18,7 +19,7 @@ import (
 )
 
 // A few sneaky globals for when we don't have a scope handy
-var stringMethods, dictMethods, configMethods map[string]*pyFunc
+var stringMethods, dictMethods, setMethods, configMethods map[string]*pyFunc
 
 // A nativeFunc is a function that implements a builtin function natively.
 type nativeFunc func(*scope, []pyObject) pyObject
@@ -31,16 +32,27 @@ func registerBuiltins(s *scope) {
 	setNativeCode(s, "subinclude", subinclude).varargs = true
 	setNativeCode(s, "load", bazelLoad).varargs = true
 	setNativeCode(s, "package", pkg).kwargs = true
+	setNativeCode(s, "struct", structType).kwargs = true
 	setNativeCode(s, "sorted", sorted)
+	setNativeCode(s, "reversed", reversed)
+	setNativeCode(s, "min", minFunc).varargs = true
+	setNativeCode(s, "max", maxFunc).varargs = true
+	setNativeCode(s, "sum", sum)
 	setNativeCode(s, "isinstance", isinstance)
 	setNativeCode(s, "range", pyRange)
 	setNativeCode(s, "enumerate", enumerate)
 	setNativeCode(s, "zip", zip).varargs = true
 	setNativeCode(s, "len", lenFunc)
 	setNativeCode(s, "glob", glob)
+	setNativeCode(s, "read_file", readFile)
+	setNativeCode(s, "load_json", loadJSON)
+	setNativeCode(s, "load_yaml", loadYAML)
 	setNativeCode(s, "bool", boolType)
 	setNativeCode(s, "int", intType)
 	setNativeCode(s, "str", strType)
+	setNativeCode(s, "list", listType)
+	setNativeCode(s, "tuple", tupleType)
+	setNativeCode(s, "set", setType)
 	setNativeCode(s, "join_path", joinPath).varargs = true
 	setNativeCode(s, "get_base_path", packageName)
 	setNativeCode(s, "package_name", packageName)
@@ -56,6 +68,7 @@ func registerBuiltins(s *scope) {
 	setNativeCode(s, "json", valueAsJSON)
 	setNativeCode(s, "breakpoint", breakpoint)
 	setNativeCode(s, "get_rule_metadata", getRuleMetadata)
+	setNativeCode(s, "get_provider", getProvider)
 	stringMethods = map[string]*pyFunc{
 		"join":         setNativeCode(s, "join", strJoin),
 		"split":        setNativeCode(s, "split", strSplit),
@@ -85,6 +98,12 @@ func registerBuiltins(s *scope) {
 		"values":     setNativeCode(s, "values", dictValues),
 		"copy":       setNativeCode(s, "copy", dictCopy),
 	}
+	setMethods = map[string]*pyFunc{
+		"add":          setNativeCode(s, "add", setAdd),
+		"union":        setNativeCode(s, "union", setUnion),
+		"intersection": setNativeCode(s, "intersection", setIntersection),
+		"difference":   setNativeCode(s, "difference", setDifference),
+	}
 	configMethods = map[string]*pyFunc{
 		"get":        setNativeCode(s, "config_get", configGet),
 		"setdefault": s.Lookup("setdefault").(*pyFunc),
@@ -161,7 +180,11 @@ func buildRule(s *scope, args []pyObject) pyObject {
 	target := createTarget(s, args)
 	s.Assert(s.pkg.Target(target.Label.Name) == nil, "Duplicate build target in %s: %s", s.pkg.Name, target.Label.Name)
 	populateTarget(s, target, args)
-	s.state.AddTarget(s.pkg, target)
+	if s.pkg.CallbacksOnly {
+		s.pkg.AddTarget(target) // We only want its callbacks, it's already in the graph.
+	} else {
+		s.state.AddTarget(s.pkg, target)
+	}
 	if s.Callback {
 		target.AddedPostBuild = true
 		s.pkg.MarkTargetModified(target)
@@ -183,6 +206,15 @@ func filegroup(s *scope, args []pyObject) pyObject {
 	return buildRule(s, args)
 }
 
+// structType implements the struct() builtin, which creates a new struct from its keyword arguments.
+func structType(s *scope, args []pyObject) pyObject {
+	fields := make(pyDict, len(s.locals))
+	for k, v := range s.locals {
+		fields[k] = v
+	}
+	return newPyStruct(fields)
+}
+
 // pkg implements the package() builtin function.
 func pkg(s *scope, args []pyObject) pyObject {
 	s.Assert(s.pkg.NumTargets() == 0, "package() must be called before any build targets are defined")
@@ -210,6 +242,7 @@ func tagName(name, tag string) string {
 // bazelLoad implements the load() builtin, which is only available for Bazel compatibility.
 func bazelLoad(s *scope, args []pyObject) pyObject {
 	s.Assert(s.state.Config.Bazel.Compatibility, "load() is only available in Bazel compatibility mode. See `plz help bazel` for more information.")
+	s.Uncacheable() // We don't track the files loaded here.
 	// The argument always looks like a build label, but it is not really one (i.e. there is no BUILD file that defines it).
 	// We do not support their legacy syntax here (i.e. "/tools/build_rules/build_test" etc).
 	l := core.ParseBuildLabelContext(string(args[0].(pyString)), s.contextPkg)
@@ -222,7 +255,7 @@ func bazelLoad(s *scope, args []pyObject) pyObject {
 		}
 		filename = subrepo.Dir(filename)
 	}
-	s.SetAll(s.interpreter.Subinclude(filename, l, s.contextPkg), false)
+	s.SetAll(s.interpreter.Subinclude(s, filename, l, s.contextPkg), false)
 	return None
 }
 
@@ -231,23 +264,44 @@ const (
 )
 
 func getRuleMetadata(s *scope, args []pyObject) pyObject {
+	s.Uncacheable() // This depends on the contents of another package.
 	name := args[getConfigRuleConfigNameIndex].(pyString).String()
+	return lookupTarget(s, name, "get_rule_metadata").RuleMetadata.(pyObject)
+}
+
+// getProvider returns a named piece of provider data from a target, or None if it doesn't have it.
+func getProvider(s *scope, args []pyObject) pyObject {
+	s.Uncacheable()
+	t := lookupTarget(s, string(args[0].(pyString)), "get_provider")
+	if data, present := t.ProviderData[string(args[1].(pyString))]; present {
+		return data.(pyObject)
+	}
+	return None
+}
+
+// lookupTarget finds a target for one of the builtins that retrieve information from it,
+// waiting for it to be built if it's in another package.
+func lookupTarget(s *scope, name, function string) *core.BuildTarget {
 	label := core.ParseBuildLabelContext(name, s.pkg)
 
 	t := s.state.Graph.Target(label)
 
 	if t == nil {
 		if label.Subrepo == s.pkg.SubrepoName && label.PackageName == s.pkg.Name {
-			// This is a get_rule_metadata in the same package, check the target exists.
-			log.Fatalf("Target %s is not defined in this package yet; it has to be defined before the get_rule_metadata() call", name)
+			// This is a lookup in the same package, check the target exists.
+			log.Fatalf("Target %s is not defined in this package yet; it has to be defined before the %s() call", name, function)
 		}
 
 		t = s.WaitForBuiltTargetWithoutLimiter(label, core.NewBuildLabel(s.pkg.Name, "all"))
 	}
-	return t.RuleMetadata.(pyObject)
+	return t
 }
 
 func (s *scope) WaitForBuiltTargetWithoutLimiter(l, dependent core.BuildLabel) *core.BuildTarget {
+	if s.interpreter.profiler != nil && !s.Callback {
+		// Don't count the time spent waiting for the build (or to reacquire the limiter) in the profile.
+		defer func(start time.Time) { s.call.Wait(time.Since(start)) }(time.Now())
+	}
 	s.interpreter.limiter.Release()
 	defer s.interpreter.limiter.Acquire()
 
@@ -262,7 +316,23 @@ func builtinFail(s *scope, args []pyObject) pyObject {
 
 func subinclude(s *scope, args []pyObject) pyObject {
 	s.NAssert(s.contextPkg == nil, "Cannot subinclude() from this context")
-	for _, arg := range args {
+	// Any further targets are passed after the hashes and mirrors arguments.
+	targets := append([]pyObject{args[0]}, args[3:]...)
+	var hashes, mirrors []string
+	if args[1] != None {
+		hashes = asStringList(s, args[1], "hashes")
+	}
+	if args[2] != None {
+		mirrors = asStringList(s, args[2], "mirrors")
+	}
+	if isURL(string(args[0].(pyString))) {
+		s.Assert(len(targets) == 1, "Can only pass one URL at a time to subinclude()")
+		s.subincludeURL(string(args[0].(pyString)), hashes, mirrors)
+		return None
+	}
+	s.Assert(len(hashes) == 0 && len(mirrors) == 0, "hashes and mirrors can only be passed to subinclude() with a URL")
+	for _, arg := range targets {
+		s.NAssert(isURL(string(arg.(pyString))), "Can only pass one URL at a time to subinclude()")
 		t := subincludeTarget(s, core.ParseBuildLabelContext(string(arg.(pyString)), s.contextPkg))
 		pkg := s.contextPkg
 		if t.Subrepo != s.contextPkg.Subrepo && t.Subrepo != nil {
@@ -275,7 +345,7 @@ func subinclude(s *scope, args []pyObject) pyObject {
 		l := pkg.Label()
 		s.Assert(l.CanSee(s.state, t), "Target %s isn't visible to be subincluded into %s", t.Label, l)
 		for _, out := range t.Outputs() {
-			s.SetAll(s.interpreter.Subinclude(path.Join(t.OutDir(), out), t.Label, pkg), false)
+			s.SetAll(s.interpreter.Subinclude(s, path.Join(t.OutDir(), out), t.Label, pkg), false)
 		}
 	}
 	return None
@@ -311,6 +381,14 @@ func objLen(obj pyObject) pyInt {
 		return pyInt(len(t))
 	case pyString:
 		return pyInt(len(t))
+	case pyFrozenList:
+		return pyInt(len(t.pyList))
+	case pyFrozenDict:
+		return pyInt(len(t.pyDict))
+	case *pySet:
+		return pyInt(len(t.items))
+	case pyFrozenSet:
+		return pyInt(len(t.items))
 	}
 	panic("object of type " + obj.Type() + " has no len()")
 }
@@ -341,12 +419,16 @@ func isType(obj pyObject, name string) bool {
 		return name == "int"
 	case pyString:
 		return name == "str"
-	case pyList:
-		return name == "list"
-	case pyDict:
+	case pyList, pyFrozenList:
+		return name == "list" || name == "tuple" // Tuples are just lists to us.
+	case pyDict, pyFrozenDict:
 		return name == "dict"
+	case *pySet, pyFrozenSet:
+		return name == "set"
 	case *pyConfig:
 		return name == "config"
+	case *pyStruct:
+		return name == "struct"
 	}
 	return false
 }
@@ -354,6 +436,13 @@ func isType(obj pyObject, name string) bool {
 func strJoin(s *scope, args []pyObject) pyObject {
 	self := string(args[0].(pyString))
 	seq := asStringList(s, args[1], "seq")
+	if len(seq) > 0 {
+		n := len(self) * (len(seq) - 1)
+		for _, x := range seq {
+			n += len(x)
+		}
+		s.checkAllocation("str", n)
+	}
 	return pyString(strings.Join(seq, self))
 }
 
@@ -367,6 +456,9 @@ func strReplace(s *scope, args []pyObject) pyObject {
 	self := args[0].(pyString)
 	old := args[1].(pyString)
 	new := args[2].(pyString)
+	if len(new) > len(old) {
+		s.checkAllocation("str", len(self)+multiply(strings.Count(string(self), string(old)), len(new)-len(old)))
+	}
 	return pyString(strings.Replace(string(self), string(old), string(new), -1))
 }
 
@@ -480,12 +572,34 @@ func strType(s *scope, args []pyObject) pyObject {
 	return pyString(args[0].String())
 }
 
+func listType(s *scope, args []pyObject) pyObject {
+	if args[0] == None {
+		return pyList{}
+	}
+	return append(pyList{}, s.iterable(args[0])...)
+}
+
+func tupleType(s *scope, args []pyObject) pyObject {
+	// Tuples are just immutable lists.
+	return listType(s, args).(pyList).Freeze()
+}
+
+func setType(s *scope, args []pyObject) pyObject {
+	if args[0] == None {
+		return newPySet()
+	}
+	return newPySet(s.iterable(args[0])...)
+}
+
 func glob(s *scope, args []pyObject) pyObject {
 	include := asStringList(s, args[0], "include")
 	exclude := asStringList(s, args[1], "exclude")
 	hidden := args[2].IsTruthy()
 	exclude = append(exclude, s.state.Config.Parse.BuildFileName...)
-	return fromStringList(fs.Glob(s.state.Config.Parse.BuildFileName, s.pkg.SourceRoot(), include, exclude, hidden))
+	root := s.pkg.SourceRoot()
+	result := fs.Glob(s.state.Config.Parse.BuildFileName, root, include, exclude, hidden)
+	s.pkg.Globs = append(s.pkg.Globs, core.PackageGlob{Root: root, Include: include, Exclude: exclude, Hidden: hidden, Result: result})
+	return fromStringList(result)
 }
 
 func asStringList(s *scope, arg pyObject, name string) []string {
@@ -559,14 +673,89 @@ func dictCopy(s *scope, args []pyObject) pyObject {
 	return ret
 }
 
+func setAdd(s *scope, args []pyObject) pyObject {
+	args[0].(*pySet).Add(args[1])
+	return None
+}
+
+func setUnion(s *scope, args []pyObject) pyObject {
+	return args[0].(*pySet).Union(s.set(args[1]))
+}
+
+func setIntersection(s *scope, args []pyObject) pyObject {
+	return args[0].(*pySet).Intersection(s.set(args[1]))
+}
+
+func setDifference(s *scope, args []pyObject) pyObject {
+	return args[0].(*pySet).Difference(s.set(args[1]))
+}
+
+// set returns the given object as a set, or raises an error if it isn't one.
+func (s *scope) set(obj pyObject) *pySet {
+	set, ok := asSet(obj)
+	s.Assert(ok, "Argument must be a set, not %s", obj.Type())
+	return set
+}
+
 func sorted(s *scope, args []pyObject) pyObject {
-	l, ok := args[0].(pyList)
-	s.Assert(ok, "unsortable type %s", args[0].Type())
-	l = l[:]
-	sort.Slice(l, func(i, j int) bool { return l[i].Operator(LessThan, l[j]).IsTruthy() })
+	l := append(pyList{}, s.iterable(args[0])...)
+	sort.SliceStable(l, func(i, j int) bool { return l[i].Operator(LessThan, l[j]).IsTruthy() })
 	return l
 }
 
+func reversed(s *scope, args []pyObject) pyObject {
+	l := s.iterable(args[0])
+	ret := make(pyList, len(l))
+	for i, x := range l {
+		ret[len(l)-i-1] = x
+	}
+	return ret
+}
+
+func minFunc(s *scope, args []pyObject) pyObject {
+	return extreme(s, "min", args, GreaterThan)
+}
+
+func maxFunc(s *scope, args []pyObject) pyObject {
+	return extreme(s, "max", args, LessThan)
+}
+
+// extreme implements min() and max(). They can be called either with a single sequence or with
+// a series of arguments, and take an optional key function to compare items by.
+// The first item is returned if several compare equal, as in Python.
+func extreme(s *scope, name string, args []pyObject, replace Operator) pyObject {
+	items := args[2:]
+	if len(items) > 0 {
+		items = append(pyList{args[0]}, items...)
+	} else {
+		items = s.iterable(args[0])
+	}
+	s.Assert(len(items) > 0, "%s() arg is an empty sequence", name)
+	key := func(obj pyObject) pyObject { return obj }
+	if args[1] != None {
+		key = func(obj pyObject) pyObject {
+			return s.callValues("key", args[1], &Call{Arguments: []CallArgument{{}}}, []pyObject{obj})
+		}
+	}
+	ret := items[0]
+	retKey := key(ret)
+	for _, item := range items[1:] {
+		if k := key(item); s.operate(replace, retKey, k).IsTruthy() {
+			ret = item
+			retKey = k
+		}
+	}
+	return ret
+}
+
+func sum(s *scope, args []pyObject) pyObject {
+	ret := args[1]
+	for _, x := range s.iterable(args[0]) {
+		ret = s.operate(Add, ret, x)
+	}
+	return ret
+}
+
 func joinPath(s *scope, args []pyObject) pyObject {
 	l := make([]string, len(args))
 	for i, arg := range args {
@@ -612,16 +801,23 @@ func pyRange(s *scope, args []pyObject) pyObject {
 		stop = start
 		start = 0
 	}
-	ret := make(pyList, 0, stop-start)
-	for i := start; i < stop; i += step {
-		ret = append(ret, i)
+	s.Assert(step != 0, "range() step must not be zero")
+	n := 0
+	if step > 0 && stop > start {
+		n = int((stop - start + step - 1) / step)
+	} else if step < 0 && start > stop {
+		n = int((start - stop - step - 1) / -step)
+	}
+	s.checkAllocation("list", n)
+	ret := make(pyList, n)
+	for i := range ret {
+		ret[i] = start + pyInt(i)*step
 	}
 	return ret
 }
 
 func enumerate(s *scope, args []pyObject) pyObject {
-	l, ok := args[0].(pyList)
-	s.Assert(ok, "Argument to enumerate must be a list, not %s", args[0].Type())
+	l := s.iterable(args[0])
 	ret := make(pyList, len(l))
 	for i, li := range l {
 		ret[i] = pyList{pyInt(i), li}
@@ -826,6 +1022,7 @@ func selectTarget(s *scope, l core.BuildLabel) *core.BuildTarget {
 // subrepo implements the subrepo() builtin that adds a new repository.
 func subrepo(s *scope, args []pyObject) pyObject {
 	s.NAssert(s.pkg == nil, "Cannot create new subrepos in this context")
+	s.Uncacheable() // Subrepos are registered on the graph, not the package.
 	name := string(args[0].(pyString))
 	dep := string(args[1].(pyString))
 	var target *core.BuildTarget
@@ -874,6 +1071,10 @@ func subrepo(s *scope, args []pyObject) pyObject {
 
 // breakpoint implements an interactive debugger for the breakpoint() builtin
 func breakpoint(s *scope, args []pyObject) pyObject {
+	// If there's a debugger attached, it takes over from here.
+	if d := s.interpreter.debugger; d != nil && s.thread != nil && d.Stop(s.thread, "breakpoint") {
+		return None
+	}
 	// Take this mutex to ensure only one debugger runs at a time
 	s.interpreter.breakpointMutex.Lock()
 	defer s.interpreter.breakpointMutex.Unlock()
@@ -0,0 +1,820 @@
+package asp
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Bytecode is the compiled form of a function body. It is a series of instructions for a simple
+// stack-based VM (see vm.go), along with the tables of things they refer to.
+//
+// It must be public for serialisation (builtin rules are stored in compiled form) but shouldn't
+// be used outside this package.
+type Bytecode struct {
+	Instructions []Instruction
+	Constants    []pyObject
+	// Names of variables, properties & config values that instructions look up by name.
+	Names []string
+	// Call sites. Only the names & positions of their arguments are used; the values are on the stack.
+	Calls []bytecodeCall
+	// f-strings. The variables are on the stack except for config values, which are looked up directly.
+	FStrings []*FString
+	// Nested function definitions and lambdas.
+	Functions []*FuncDef
+	// Names to unpack into, used in error messages.
+	Unpacks [][]string
+	// Source positions for errors. Each refers to its parent (the enclosing statement or expression).
+	Positions []bytecodePosition
+	// The names of each local slot. These are used to look up names in enclosing scopes if a slot
+	// hasn't been assigned yet.
+	Slots []string
+	// True if the function's arguments are stored in its first slots. If not they are set by name in its scope;
+	// this is the case if it defines any nested functions, which need to be able to find its locals.
+	ArgSlots bool
+}
+
+// An Instruction is a single instruction for the VM.
+type Instruction struct {
+	Op  opcode
+	Arg int32
+	// Index into the Positions table, or -1 if there is no position for this instruction.
+	Pos int32
+}
+
+type bytecodeCall struct {
+	Name string
+	Call Call
+}
+
+type bytecodePosition struct {
+	Pos    Position
+	Parent int32
+}
+
+type opcode uint8
+
+const (
+	opConst            opcode = iota // Push Constants[arg]
+	opLoadSlot                       // Push slot arg (or look up its name if it's not set)
+	opStoreSlot                      // Pop into slot arg
+	opLoadName                       // Look up Names[arg] in the scope
+	opStoreName                      // Pop and set Names[arg] in the scope
+	opConfig                         // Push config property Names[arg]
+	opPop                            // Discard the top of the stack
+	opDup2                           // Duplicate the top two items on the stack
+	opOperator                       // Pop two items and apply operator arg to them
+	opNot                            // Logically negate the top of the stack
+	opNegate                         // Arithmetically negate the top of the stack
+	opJump                           // Jump to arg
+	opJumpIfFalse                    // Pop and jump to arg if false
+	opJumpIfTrue                     // Pop and jump to arg if true
+	opJumpIfFalseOrPop               // Jump to arg if the top of the stack is false, otherwise pop it
+	opJumpIfTrueOrPop                // Jump to arg if the top of the stack is true, otherwise pop it
+	opIndex                          // Pop an index and index the top of the stack with it
+	opSlice                          // Slice the top of the stack; arg has sliceStart and/or sliceEnd set if they're on the stack above it
+	opProperty                       // Replace the top of the stack with its property Names[arg]
+	opCall                           // Call the function below the arguments for Calls[arg]
+	opList                           // Pop arg items and push a list of them
+	opDict                           // Pop arg key/value pairs and push a dict of them
+	opListAppend                     // Pop an item and append it to the list arg items further down the stack
+	opDictSet                        // Pop a key & value and set them in the dict arg items further down the stack
+	opFString                        // Pop the variables for FStrings[arg] and push the resulting string
+	opFunction                       // Push a new function for Functions[arg]
+	opIterate                        // Replace the top of the stack with a list to iterate over, and push an index into it
+	opForIter                        // Push the next item from the list being iterated, or pop it and jump to arg if there are none left
+	opUnpack                         // Pop a list and push its items in reverse order to assign to Unpacks[arg]
+	opUnpackAssign                   // As opUnpack, but for an assignment statement of arg items (which has different messages)
+	opIndexAssign                    // Pop a value, index & object and assign the value at that index
+	opReturn                         // Pop and return
+	opRaise                          // Pop and raise an error with it as the message
+)
+
+// Flags for opSlice
+const (
+	sliceStart = 1 << iota
+	sliceEnd
+)
+
+// A compileError is raised when a function can't be compiled.
+type compileError struct {
+	err error
+}
+
+// compile returns the bytecode for this function, compiling it if that hasn't been done already.
+// It returns nil if the function can't be compiled, in which case it should be interpreted directly.
+func (def *FuncDef) compile() *Bytecode {
+	def.compileOnce.Do(func() {
+		if def.Bytecode == nil {
+			code, err := compileFunction(def)
+			if err != nil {
+				log.Debug("Not compiling %s: %s", def.Name, err)
+				return
+			}
+			def.Bytecode = code
+		}
+	})
+	return def.Bytecode
+}
+
+// compileFunction compiles the body of a function to bytecode.
+func compileFunction(def *FuncDef) (code *Bytecode, err error) {
+	c := &compiler{
+		code:      &Bytecode{ArgSlots: canUseSlots(def.Statements)},
+		pos:       -1,
+		constants: map[pyObject]int32{},
+		names:     map[string]int32{},
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(compileError); ok {
+				err = e.err
+				return
+			}
+			panic(r)
+		}
+	}()
+	if c.code.ArgSlots {
+		c.locals = map[string]int32{}
+		for _, arg := range def.Arguments {
+			c.local(arg.Name)
+		}
+		assignedNames(def.Statements, c.local)
+	}
+	c.statements(def.Statements)
+	return c.code, nil
+}
+
+// canUseSlots returns true if we can store a function's local variables in slots.
+// This isn't possible if anything needs to find them in its scope by name.
+func canUseSlots(stmts []*Statement) bool {
+	ok := true
+	WalkAST(stmts, func(def *FuncDef) bool {
+		ok = false
+		return false
+	})
+	WalkAST(stmts, func(lambda *Lambda) bool {
+		ok = false
+		return false
+	})
+	// breakpoint() lets the user inspect the calling scope.
+	WalkAST(stmts, func(ident *IdentStatement) bool {
+		ok = ok && ident.Name != "breakpoint"
+		return true
+	})
+	WalkAST(stmts, func(ident *IdentExpr) bool {
+		ok = ok && ident.Name != "breakpoint"
+		return true
+	})
+	return ok
+}
+
+// assignedNames calls the given function for every name that is assigned in a series of statements.
+func assignedNames(stmts []*Statement, f func(name string) int32) {
+	for _, stmt := range stmts {
+		if stmt.Ident != nil {
+			if stmt.Ident.Unpack != nil {
+				f(stmt.Ident.Name)
+				for _, name := range stmt.Ident.Unpack.Names {
+					f(name)
+				}
+			} else if stmt.Ident.Action != nil && (stmt.Ident.Action.Assign != nil || stmt.Ident.Action.AugAssign != nil) {
+				f(stmt.Ident.Name)
+			}
+		} else if stmt.For != nil {
+			for _, name := range stmt.For.Names {
+				f(name)
+			}
+			assignedNames(stmt.For.Statements, f)
+		} else if stmt.If != nil {
+			assignedNames(stmt.If.Statements, f)
+			for _, elif := range stmt.If.Elif {
+				assignedNames(elif.Statements, f)
+			}
+			assignedNames(stmt.If.ElseStatements, f)
+		}
+	}
+}
+
+// A compiler compiles a single function to bytecode.
+type compiler struct {
+	code *Bytecode
+	// Index of the current position
+	pos int32
+	// Local variables of the function, if they are stored in slots.
+	locals map[string]int32
+	// Variables of any comprehensions we're currently inside, innermost last.
+	scopes []map[string]int32
+	// Start of the for loops we're currently inside, innermost last.
+	loops     []int32
+	constants map[pyObject]int32
+	names     map[string]int32
+}
+
+// fail aborts compilation.
+func (c *compiler) fail(msg string, args ...interface{}) {
+	panic(compileError{err: fmt.Errorf(msg, args...)})
+}
+
+// emit adds a new instruction, returning its index.
+func (c *compiler) emit(op opcode, arg int32) int32 {
+	c.code.Instructions = append(c.code.Instructions, Instruction{Op: op, Arg: arg, Pos: c.pos})
+	return int32(len(c.code.Instructions) - 1)
+}
+
+// patch sets the target of a jump instruction to the next instruction.
+func (c *compiler) patch(idx int32) {
+	c.code.Instructions[idx].Arg = int32(len(c.code.Instructions))
+}
+
+// position sets the position of instructions emitted until the returned function is called.
+func (c *compiler) position(pos Position) func() {
+	parent := c.pos
+	c.code.Positions = append(c.code.Positions, bytecodePosition{Pos: pos, Parent: parent})
+	c.pos = int32(len(c.code.Positions) - 1)
+	return func() { c.pos = parent }
+}
+
+// constant emits an instruction to push a constant.
+func (c *compiler) constant(obj pyObject) {
+	if !isScalar(obj) {
+		// Not comparable, so can't be deduplicated.
+		c.code.Constants = append(c.code.Constants, obj)
+		c.emit(opConst, int32(len(c.code.Constants)-1))
+		return
+	}
+	idx, present := c.constants[obj]
+	if !present {
+		c.code.Constants = append(c.code.Constants, obj)
+		idx = int32(len(c.code.Constants) - 1)
+		c.constants[obj] = idx
+	}
+	c.emit(opConst, idx)
+}
+
+// name returns the index of a name in the names table.
+func (c *compiler) name(name string) int32 {
+	idx, present := c.names[name]
+	if !present {
+		c.code.Names = append(c.code.Names, name)
+		idx = int32(len(c.code.Names) - 1)
+		c.names[name] = idx
+	}
+	return idx
+}
+
+// local returns the slot for a local variable, allocating one if needed.
+func (c *compiler) local(name string) int32 {
+	if idx, present := c.locals[name]; present {
+		return idx
+	}
+	idx := c.slot(name)
+	c.locals[name] = idx
+	return idx
+}
+
+// slot allocates a new slot.
+func (c *compiler) slot(name string) int32 {
+	c.code.Slots = append(c.code.Slots, name)
+	return int32(len(c.code.Slots) - 1)
+}
+
+// resolve returns the slot for a variable, or -1 if it isn't stored in one.
+func (c *compiler) resolve(name string) int32 {
+	for i := len(c.scopes) - 1; i >= 0; i-- {
+		if idx, present := c.scopes[i][name]; present {
+			return idx
+		}
+	}
+	if idx, present := c.locals[name]; present {
+		return idx
+	}
+	return -1
+}
+
+// load emits an instruction to load a variable.
+func (c *compiler) load(name string) {
+	if idx := c.resolve(name); idx != -1 {
+		c.emit(opLoadSlot, idx)
+	} else {
+		c.emit(opLoadName, c.name(name))
+	}
+}
+
+// store emits an instruction to store the top of the stack in a variable.
+func (c *compiler) store(name string) {
+	if idx := c.resolve(name); idx != -1 {
+		c.emit(opStoreSlot, idx)
+	} else {
+		c.emit(opStoreName, c.name(name))
+	}
+}
+
+// function emits an instruction to create a new function.
+func (c *compiler) function(def *FuncDef) {
+	c.code.Functions = append(c.code.Functions, def)
+	c.emit(opFunction, int32(len(c.code.Functions)-1))
+}
+
+// unpack emits instructions to unpack the top of the stack into the given names, as for loops do.
+func (c *compiler) unpack(names []string) {
+	if len(names) > 1 {
+		c.code.Unpacks = append(c.code.Unpacks, names)
+		c.emit(opUnpack, int32(len(c.code.Unpacks)-1))
+	}
+	for _, name := range names {
+		c.store(name)
+	}
+}
+
+func (c *compiler) statements(stmts []*Statement) {
+	for _, stmt := range stmts {
+		c.statement(stmt)
+	}
+}
+
+func (c *compiler) statement(stmt *Statement) {
+	defer c.position(stmt.Pos)()
+	if stmt.FuncDef != nil {
+		c.function(stmt.FuncDef)
+		c.emit(opStoreName, c.name(stmt.FuncDef.Name))
+	} else if stmt.If != nil {
+		c.ifStatement(stmt.If)
+	} else if stmt.For != nil {
+		c.expression(&stmt.For.Expr)
+		c.emit(opIterate, 0)
+		start := c.emit(opForIter, 0)
+		c.unpack(stmt.For.Names)
+		c.loops = append(c.loops, start)
+		c.statements(stmt.For.Statements)
+		c.loops = c.loops[:len(c.loops)-1]
+		c.emit(opJump, start)
+		c.patch(start)
+	} else if stmt.Return != nil {
+		if len(stmt.Return.Values) == 0 {
+			c.constant(None)
+		} else if len(stmt.Return.Values) == 1 {
+			c.expression(stmt.Return.Values[0])
+		} else {
+			c.expressions(stmt.Return.Values)
+			c.emit(opList, int32(len(stmt.Return.Values)))
+		}
+		c.emit(opReturn, 0)
+	} else if stmt.Ident != nil {
+		c.identStatement(stmt.Ident)
+	} else if stmt.Assert != nil {
+		c.expression(stmt.Assert.Expr)
+		j := c.emit(opJumpIfTrue, 0)
+		if stmt.Assert.Message == nil {
+			c.constant(pyString("assertion failed"))
+		} else {
+			c.expression(stmt.Assert.Message)
+		}
+		c.emit(opRaise, 0)
+		c.patch(j)
+	} else if stmt.Raise != nil {
+		c.expression(stmt.Raise)
+		c.emit(opRaise, 0)
+	} else if stmt.Continue {
+		if len(c.loops) == 0 {
+			c.fail("continue outside a loop")
+		}
+		c.emit(opJump, c.loops[len(c.loops)-1])
+	} else if stmt.Literal == nil && !stmt.Pass {
+		c.fail("unknown statement")
+	}
+}
+
+func (c *compiler) ifStatement(stmt *IfStatement) {
+	var ends []int32
+	// branch compiles a single condition & its statements, returning true if no further branches can be reached.
+	branch := func(cond *Expression, stmts []*Statement) bool {
+		if obj := c.fold(cond); obj != nil {
+			if obj.IsTruthy() {
+				c.statements(stmts)
+				return true
+			}
+			return false
+		}
+		c.expression(cond)
+		j := c.emit(opJumpIfFalse, 0)
+		c.statements(stmts)
+		ends = append(ends, c.emit(opJump, 0))
+		c.patch(j)
+		return false
+	}
+	done := branch(&stmt.Condition, stmt.Statements)
+	for i := 0; i < len(stmt.Elif) && !done; i++ {
+		done = branch(&stmt.Elif[i].Condition, stmt.Elif[i].Statements)
+	}
+	if !done {
+		c.statements(stmt.ElseStatements)
+	}
+	for _, j := range ends {
+		c.patch(j)
+	}
+}
+
+func (c *compiler) identStatement(stmt *IdentStatement) {
+	if stmt.Index != nil {
+		c.load(stmt.Name)
+		c.expression(stmt.Index.Expr)
+		if stmt.Index.Assign != nil {
+			c.expression(stmt.Index.Assign)
+		} else {
+			c.emit(opDup2, 0)
+			c.emit(opIndex, 0)
+			c.expression(stmt.Index.AugAssign)
+			c.emit(opOperator, int32(Add))
+		}
+		c.emit(opIndexAssign, 0)
+	} else if stmt.Unpack != nil {
+		c.expression(stmt.Unpack.Expr)
+		c.emit(opUnpackAssign, int32(len(stmt.Unpack.Names)+1))
+		c.store(stmt.Name)
+		for _, name := range stmt.Unpack.Names {
+			c.store(name)
+		}
+	} else if stmt.Action != nil {
+		if stmt.Action.Property != nil {
+			c.load(stmt.Name)
+			c.emit(opProperty, c.name(stmt.Action.Property.Name))
+			c.identActions(stmt.Action.Property)
+			c.emit(opPop, 0)
+		} else if stmt.Action.Call != nil {
+			c.load(stmt.Name)
+			c.call(stmt.Name, stmt.Action.Call)
+			c.emit(opPop, 0)
+		} else if stmt.Action.Assign != nil {
+			c.expression(stmt.Action.Assign)
+			c.store(stmt.Name)
+		} else if stmt.Action.AugAssign != nil {
+			c.load(stmt.Name)
+			c.expression(stmt.Action.AugAssign)
+			c.emit(opOperator, int32(Add))
+			c.store(stmt.Name)
+		}
+	} else {
+		c.load(stmt.Name)
+		c.emit(opPop, 0)
+	}
+}
+
+func (c *compiler) expressions(exprs []*Expression) {
+	for _, expr := range exprs {
+		c.expression(expr)
+	}
+}
+
+func (c *compiler) expression(expr *Expression) {
+	if o := expr.Optimised; o != nil {
+		if o.Constant != nil {
+			c.constant(o.Constant)
+		} else if o.Local != "" {
+			c.load(o.Local)
+		} else {
+			c.emit(opConfig, c.name(o.Config))
+		}
+		return
+	} else if obj := c.fold(expr); obj != nil {
+		c.constant(obj)
+		return
+	}
+	defer c.position(expr.Pos)()
+	if expr.If != nil {
+		c.expression(expr.If.Condition)
+		j := c.emit(opJumpIfFalse, 0)
+		c.operators(expr)
+		end := c.emit(opJump, 0)
+		c.patch(j)
+		c.expression(expr.If.Else)
+		c.patch(end)
+		return
+	}
+	c.operators(expr)
+}
+
+// operators compiles the main part of an expression, i.e. its value & any operators applied to it.
+func (c *compiler) operators(expr *Expression) {
+	if expr.Val != nil {
+		c.valueExpression(expr.Val)
+	} else if expr.UnaryOp != nil {
+		c.valueExpression(&expr.UnaryOp.Expr)
+		if expr.UnaryOp.Op == "not" {
+			c.emit(opNot, 0)
+		} else {
+			c.emit(opNegate, 0)
+		}
+	} else {
+		c.constant(None)
+	}
+	for _, op := range expr.Op {
+		switch op.Op {
+		case And, Or:
+			// Careful here to mimic lazy-evaluation semantics (import for `x = x or []` etc)
+			jumpOp := opJumpIfFalseOrPop
+			if op.Op == Or {
+				jumpOp = opJumpIfTrueOrPop
+			}
+			j := c.emit(jumpOp, 0)
+			c.expression(op.Expr)
+			c.patch(j)
+		default:
+			c.expression(op.Expr)
+			c.emit(opOperator, int32(op.Op))
+		}
+	}
+}
+
+func (c *compiler) valueExpression(expr *ValueExpression) {
+	c.valueExpressionPart(expr)
+	for _, sl := range expr.Slices {
+		if sl.Colon == "" {
+			if sl.End != nil {
+				c.fail("invalid syntax")
+			}
+			c.expression(sl.Start)
+			c.emit(opIndex, 0)
+			continue
+		}
+		var flags int32
+		if sl.Start != nil {
+			c.expression(sl.Start)
+			flags |= sliceStart
+		}
+		if sl.End != nil {
+			c.expression(sl.End)
+			flags |= sliceEnd
+		}
+		c.emit(opSlice, flags)
+	}
+	if expr.Property != nil {
+		c.emit(opProperty, c.name(expr.Property.Name))
+		c.identActions(expr.Property)
+	} else if expr.Call != nil {
+		c.call("", expr.Call)
+	}
+}
+
+func (c *compiler) valueExpressionPart(expr *ValueExpression) {
+	if expr.Ident != nil {
+		c.load(expr.Ident.Name)
+		c.identActions(expr.Ident)
+	} else if expr.String != "" {
+		c.constant(pyString(stringLiteral(expr.String)))
+	} else if expr.FString != nil {
+		for _, v := range expr.FString.Vars {
+			if v.Config == "" {
+				c.load(v.Var)
+			}
+		}
+		c.code.FStrings = append(c.code.FStrings, expr.FString)
+		c.emit(opFString, int32(len(c.code.FStrings)-1))
+	} else if expr.Int != nil {
+		c.constant(pyInt(expr.Int.Int))
+	} else if expr.Bool != "" {
+		if obj, present := singletons[expr.Bool]; present {
+			c.constant(obj)
+		} else {
+			c.load(expr.Bool)
+		}
+	} else if expr.List != nil {
+		c.list(expr.List)
+	} else if expr.Dict != nil {
+		c.dict(expr.Dict)
+	} else if expr.Tuple != nil {
+		// Parentheses can also indicate precedence; a single parenthesised expression does not create a list object.
+		if len(expr.Tuple.Values) == 1 && expr.Tuple.Comprehension == nil {
+			c.expression(expr.Tuple.Values[0])
+		} else {
+			c.list(expr.Tuple)
+		}
+	} else if expr.Lambda != nil {
+		// A lambda is just an inline function definition with a single return statement.
+		c.function(&FuncDef{
+			Name:      "<lambda>",
+			Arguments: expr.Lambda.Arguments,
+			Statements: []*Statement{{
+				Return: &ReturnStatement{Values: []*Expression{&expr.Lambda.Expr}},
+			}},
+		})
+	} else {
+		c.constant(None)
+	}
+}
+
+// identActions compiles the actions (property accesses & calls) on an identifier.
+func (c *compiler) identActions(expr *IdentExpr) {
+	name := expr.Name
+	for _, action := range expr.Action {
+		if action.Property != nil {
+			name = action.Property.Name
+			c.emit(opProperty, c.name(name))
+			c.identActions(action.Property)
+		} else if action.Call != nil {
+			c.call(name, action.Call)
+		}
+	}
+}
+
+// call compiles a function call. The function must already be on the stack.
+func (c *compiler) call(name string, call *Call) {
+	site := bytecodeCall{Name: name, Call: Call{Arguments: make([]CallArgument, len(call.Arguments))}}
+	for i, arg := range call.Arguments {
+		c.expression(&arg.Value)
+		site.Call.Arguments[i] = CallArgument{Pos: arg.Pos, Name: arg.Name, Value: Expression{Pos: arg.Value.Pos}}
+	}
+	c.code.Calls = append(c.code.Calls, site)
+	c.emit(opCall, int32(len(c.code.Calls)-1))
+}
+
+func (c *compiler) list(expr *List) {
+	if expr.Comprehension == nil {
+		c.expressions(expr.Values)
+		c.emit(opList, int32(len(expr.Values)))
+		return
+	}
+	c.checkComprehension(expr)
+	c.emit(opList, 0)
+	c.comprehension(expr.Comprehension, func(depth int32) {
+		if len(expr.Values) == 1 {
+			c.expression(expr.Values[0])
+		} else {
+			c.expressions(expr.Values)
+			c.emit(opList, int32(len(expr.Values)))
+		}
+		c.emit(opListAppend, depth)
+	})
+}
+
+func (c *compiler) dict(expr *Dict) {
+	if expr.Comprehension == nil {
+		for _, item := range expr.Items {
+			c.expression(&item.Key)
+			c.expression(&item.Value)
+		}
+		c.emit(opDict, int32(len(expr.Items)))
+		return
+	}
+	c.checkComprehension(expr)
+	c.emit(opDict, 0)
+	c.comprehension(expr.Comprehension, func(depth int32) {
+		c.expression(&expr.Items[0].Key)
+		c.expression(&expr.Items[0].Value)
+		c.emit(opDictSet, depth)
+	})
+}
+
+// checkComprehension checks that a comprehension can be compiled. Its variables are stored in slots,
+// so it can't contain any lambdas which might need to find them by name.
+func (c *compiler) checkComprehension(node interface{}) {
+	walkAST(reflect.ValueOf(node), reflect.TypeOf(&Lambda{}), reflect.ValueOf(func(*Lambda) bool {
+		c.fail("comprehension contains a lambda")
+		return false
+	}))
+}
+
+// comprehension compiles the loops of a list or dict comprehension, whose result must already be on the stack.
+// The given function is called to compile adding each item to it, with the depth of the result below the items.
+func (c *compiler) comprehension(comp *Comprehension, item func(depth int32)) {
+	// The first expression is evaluated outside the comprehension's scope.
+	c.expression(comp.Expr)
+	scope := map[string]int32{}
+	for _, name := range comp.Names {
+		scope[name] = c.slot(name)
+	}
+	if comp.Second != nil {
+		for _, name := range comp.Second.Names {
+			scope[name] = c.slot(name)
+		}
+	}
+	c.scopes = append(c.scopes, scope)
+	defer func() { c.scopes = c.scopes[:len(c.scopes)-1] }()
+	c.emit(opIterate, 0)
+	outer := c.emit(opForIter, 0)
+	c.unpack(comp.Names)
+	loop := outer
+	var depth int32 = 2
+	if comp.Second != nil {
+		c.expression(comp.Second.Expr)
+		c.emit(opIterate, 0)
+		loop = c.emit(opForIter, 0)
+		c.unpack(comp.Second.Names)
+		depth = 4
+	}
+	j := int32(-1)
+	if comp.If != nil {
+		c.expression(comp.If)
+		j = c.emit(opJumpIfFalse, 0)
+	}
+	item(depth)
+	if j != -1 {
+		c.patch(j)
+	}
+	c.emit(opJump, loop)
+	if loop != outer {
+		c.patch(loop)
+		c.emit(opJump, outer)
+	}
+	c.patch(outer)
+}
+
+// fold returns the value of an expression if it can be determined at compile time, or nil if not.
+// Only immutable values are folded.
+func (c *compiler) fold(expr *Expression) pyObject {
+	if expr == nil {
+		return nil
+	} else if expr.Optimised != nil {
+		if isScalar(expr.Optimised.Constant) {
+			return expr.Optimised.Constant
+		}
+		return nil
+	} else if expr.If != nil {
+		if cond := c.fold(expr.If.Condition); cond == nil {
+			return nil
+		} else if !cond.IsTruthy() {
+			return c.fold(expr.If.Else)
+		}
+	}
+	var obj pyObject
+	if expr.Val != nil {
+		obj = c.foldValue(expr.Val)
+	} else if expr.UnaryOp != nil {
+		if obj = c.foldValue(&expr.UnaryOp.Expr); obj == nil {
+			return nil
+		} else if expr.UnaryOp.Op == "not" {
+			obj = newPyBool(!obj.IsTruthy())
+		} else if i, ok := obj.(pyInt); ok {
+			obj = -i
+		} else {
+			return nil
+		}
+	}
+	for _, op := range expr.Op {
+		if obj == nil {
+			return nil
+		} else if op.Op == And || op.Op == Or {
+			if obj.IsTruthy() == (op.Op == And) {
+				obj = c.fold(op.Expr)
+			}
+		} else if operand := c.fold(op.Expr); operand != nil {
+			obj = foldOperator(op.Op, obj, operand)
+		} else {
+			return nil
+		}
+	}
+	if !isScalar(obj) {
+		return nil
+	}
+	return obj
+}
+
+func (c *compiler) foldValue(expr *ValueExpression) pyObject {
+	if len(expr.Slices) != 0 || expr.Property != nil || expr.Call != nil {
+		return nil
+	} else if expr.String != "" {
+		return pyString(stringLiteral(expr.String))
+	} else if expr.Int != nil {
+		return pyInt(expr.Int.Int)
+	} else if expr.Bool != "" {
+		return singletons[expr.Bool]
+	} else if expr.Tuple != nil && len(expr.Tuple.Values) == 1 && expr.Tuple.Comprehension == nil {
+		return c.fold(expr.Tuple.Values[0])
+	}
+	return nil
+}
+
+// foldOperator applies an operator to two constants. It returns nil if that fails, in which case
+// we leave it until runtime to raise the error.
+func foldOperator(op Operator, a, b pyObject) (ret pyObject) {
+	if allocationSize(op, a, b) > maxFoldSize {
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			ret = nil
+		}
+	}()
+	if str, ok := a.(pyString); ok && op == Modulo {
+		return pyString(interpolate(string(str), b, maxFoldSize))
+	}
+	return operate(op, a, b)
+}
+
+// isScalar returns true if the given object is an immutable scalar value.
+func isScalar(obj pyObject) bool {
+	switch obj.(type) {
+	case pyInt, pyString, pyBool, pyNone:
+		return true
+	}
+	return false
+}
+
+// singletons are the builtin values that are always defined.
+var singletons = map[string]pyObject{
+	"True":  True,
+	"False": False,
+	"None":  None,
+}
+
+// bytecodeType is skipped when walking the AST, since it's derived from it.
+var bytecodeType = reflect.TypeOf(&Bytecode{})
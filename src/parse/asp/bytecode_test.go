@@ -0,0 +1,158 @@
+package asp
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/rules"
+	"github.com/thought-machine/please/src/core"
+)
+
+func newBytecodeParser(bytecode bool) *Parser {
+	parser := NewParser(core.NewDefaultBuildState())
+	parser.interpreter.disableBytecode = !bytecode
+	parser.MustLoadBuiltins("builtins.build_defs", nil, rules.MustAsset("builtins.build_defs.gob"))
+	return parser
+}
+
+// interpretWith interprets the given file either with or without bytecode.
+func interpretWith(filename string, bytecode bool) (*scope, error) {
+	parser := newBytecodeParser(bytecode)
+	statements, err := parser.parse(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parser.interpreter.interpretAll(core.NewPackage("test/package"), statements)
+}
+
+// compileSource compiles the first function defined in the given source.
+func compileSource(t *testing.T, src string) *Bytecode {
+	statements, err := newBytecodeParser(true).ParseData([]byte(src), "test.build")
+	require.NoError(t, err)
+	require.NotNil(t, statements[0].FuncDef)
+	code, err := compileFunction(statements[0].FuncDef)
+	require.NoError(t, err)
+	return code
+}
+
+func TestBytecodeMatchesInterpreter(t *testing.T) {
+	s1, err := interpretWith("src/parse/asp/test_data/interpreter/bytecode.build", true)
+	require.NoError(t, err)
+	s2, err := interpretWith("src/parse/asp/test_data/interpreter/bytecode.build", false)
+	require.NoError(t, err)
+	for _, name := range []string{"r_arithmetic", "r_collections", "r_loops", "r_strings", "r_closures", "r_unpack", "r_config", "r_recurse", "r_nothing"} {
+		assert.Equal(t, s2.Lookup(name).String(), s1.Lookup(name).String(), name)
+	}
+	assert.EqualValues(t, pyInt(120), s1.Lookup("r_recurse"))
+	assert.EqualValues(t, pyList{pyString("//test:test_lib"), pyString("test-2"), pyString("TEST"), pyString("a.go-b.go")}, s1.Lookup("r_strings"))
+
+	// Functions with nested definitions can't resolve their variables to slots.
+	assert.True(t, s1.Lookup("arithmetic").(*pyFunc).def.Bytecode.ArgSlots)
+	assert.False(t, s1.Lookup("closures").(*pyFunc).def.Bytecode.ArgSlots)
+}
+
+func TestBytecodeTestData(t *testing.T) {
+	filenames, err := filepath.Glob("src/parse/asp/test_data/interpreter/*.build")
+	require.NoError(t, err)
+	for _, filename := range filenames {
+		t.Run(filepath.Base(filename), func(t *testing.T) {
+			s1, err1 := interpretWith(filename, true)
+			s2, err2 := interpretWith(filename, false)
+			if err2 != nil {
+				assert.Error(t, err1)
+				return
+			}
+			require.NoError(t, err1)
+			for name, obj := range s2.locals {
+				assert.Equal(t, obj.String(), s1.locals[name].String(), name)
+			}
+		})
+	}
+}
+
+func TestBytecodeConstantFolding(t *testing.T) {
+	code := compileSource(t, "def f():\n    return (2 * 3) + 4 if 5 > 4 else 7\n")
+	require.Equal(t, 1, len(code.Constants))
+	assert.EqualValues(t, pyInt(10), code.Constants[0])
+	assert.Equal(t, []opcode{opConst, opReturn}, opcodes(code))
+}
+
+func TestBytecodeSlots(t *testing.T) {
+	code := compileSource(t, "def f(x, y):\n    z = x + y\n    return z\n")
+	assert.True(t, code.ArgSlots)
+	assert.Equal(t, []string{"x", "y", "z"}, code.Slots)
+	assert.Equal(t, []opcode{opLoadSlot, opLoadSlot, opOperator, opStoreSlot, opLoadSlot, opReturn}, opcodes(code))
+}
+
+func TestBytecodeErrorPosition(t *testing.T) {
+	errorStackWith := func(bytecode bool) []Position {
+		parser := newBytecodeParser(bytecode)
+		statements, err := parser.ParseData([]byte("def f(x):\n    y = x + 1\n    return y[\"z\"]\n\nf(1)\n"), "test.build")
+		require.NoError(t, err)
+		_, err = parser.interpreter.interpretAll(core.NewPackage("test/package"), statements)
+		require.Error(t, err)
+		stack, ok := err.(*errorStack)
+		require.True(t, ok)
+		return stack.Stack
+	}
+	stack := errorStackWith(true)
+	assert.Equal(t, errorStackWith(false), stack)
+	assert.Equal(t, 3, stack[0].Line)
+	assert.Equal(t, 5, stack[len(stack)-1].Line)
+}
+
+func opcodes(code *Bytecode) []opcode {
+	ops := make([]opcode, len(code.Instructions))
+	for i, in := range code.Instructions {
+		ops[i] = in.Op
+	}
+	return ops
+}
+
+// These BUILD files from this repo are used to benchmark the builtin rules.
+var benchmarkFiles = []string{
+	"src/core/BUILD",
+	"src/parse/asp/BUILD",
+	"src/build/BUILD",
+	"tools/please_pex/BUILD",
+}
+
+func BenchmarkBytecode(b *testing.B) {
+	for _, bytecode := range []bool{false, true} {
+		b.Run(fmt.Sprintf("bytecode=%v", bytecode), func(b *testing.B) {
+			parser := NewParser(core.NewDefaultBuildState())
+			parser.interpreter.disableBytecode = !bytecode
+			dir, _ := rules.AssetDir("")
+			sort.Strings(dir) // Loaded in the same order as newAspParser, since later files use earlier ones.
+			for _, filename := range dir {
+				if strings.HasSuffix(filename, ".gob") {
+					parser.MustLoadBuiltins(strings.TrimSuffix(filename, ".gob"), nil, rules.MustAsset(filename))
+				}
+			}
+			statements := make([][]*Statement, len(benchmarkFiles))
+			for i, filename := range benchmarkFiles {
+				stmts, err := parser.parse(filename)
+				require.NoError(b, err)
+				statements[i] = stmts
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				parser.interpreter.scope.state.Graph = core.NewGraph()
+				b.StartTimer()
+				for j, filename := range benchmarkFiles {
+					pkg := core.NewPackage(filepath.Dir(filename))
+					if _, err := parser.interpreter.interpretAll(pkg, statements[j]); err != nil {
+						b.Fatalf("%s", err)
+					}
+				}
+			}
+		})
+	}
+}
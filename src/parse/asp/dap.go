@@ -0,0 +1,328 @@
+package asp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// This file implements the Debug Adapter Protocol on top of the debugger.
+// See https://microsoft.github.io/debug-adapter-protocol/specification for the details of it;
+// we implement only what's needed for breakpoints, stepping and inspecting variables.
+
+// A dapRequest is a request sent to us by the client.
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// A dapResponse is our response to a dapRequest.
+type dapResponse struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Command    string      `json:"command"`
+	Success    bool        `json:"success"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+// A dapEvent is a message we send to the client unprompted.
+type dapEvent struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+// A dapConnection is a connection to a single client.
+type dapConnection struct {
+	conn   io.ReadWriteCloser
+	reader *textproto.Reader
+	mutex  sync.Mutex
+	seq    int
+}
+
+// dapVariable is the representation of a single variable that we send to the client.
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+// Serve accepts connections from clients on the given listener, one at a time.
+func (d *debugger) Serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Error("Failed to accept debugger connection: %s", err)
+			return
+		}
+		d.serveConnection(conn)
+	}
+}
+
+// serveConnection handles requests from a single client until it disconnects.
+func (d *debugger) serveConnection(conn io.ReadWriteCloser) {
+	c := &dapConnection{conn: conn, reader: textproto.NewReader(bufio.NewReader(conn))}
+	d.mutex.Lock()
+	d.client = c
+	d.mutex.Unlock()
+	log.Notice("Debugger attached")
+	defer func() {
+		d.mutex.Lock()
+		d.client = nil
+		d.breakpoints = map[string]map[int]bool{}
+		d.mutex.Unlock()
+		// Nobody is going to tell us to carry on from here, so make sure we don't wait for them.
+		d.Configured()
+		d.ResumeAll()
+		conn.Close()
+		log.Notice("Debugger detached")
+	}()
+	for {
+		req, err := c.Read()
+		if err != nil {
+			if err != io.EOF {
+				log.Error("Failed to read debugger request: %s", err)
+			}
+			return
+		}
+		log.Debug("Received debugger request %s", req.Command)
+		if err := d.handle(c, req); err != nil {
+			c.Respond(req, nil, err)
+		}
+		if req.Command == "disconnect" {
+			return
+		}
+	}
+}
+
+// handle handles a single request. It either sends a response or returns an error.
+func (d *debugger) handle(c *dapConnection, req *dapRequest) error {
+	var args struct {
+		ThreadID           int    `json:"threadId"`
+		FrameID            int    `json:"frameId"`
+		VariablesReference int    `json:"variablesReference"`
+		Expression         string `json:"expression"`
+		Source             struct {
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if len(req.Arguments) != 0 {
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return err
+		}
+	}
+	switch req.Command {
+	case "initialize":
+		c.Respond(req, map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsEvaluateForHovers":        true,
+		}, nil)
+		c.SendEvent("initialized", nil)
+	case "launch", "attach", "setExceptionBreakpoints":
+		// We're already running, and there are no exceptions in the language, so there's nothing to do here.
+		c.Respond(req, nil, nil)
+	case "configurationDone":
+		d.Configured()
+		c.Respond(req, nil, nil)
+	case "disconnect":
+		c.Respond(req, nil, nil)
+	case "setBreakpoints":
+		lines := make([]int, len(args.Breakpoints))
+		breakpoints := make([]map[string]interface{}, len(args.Breakpoints))
+		for i, bp := range args.Breakpoints {
+			lines[i] = bp.Line
+			breakpoints[i] = map[string]interface{}{"verified": true, "line": bp.Line}
+		}
+		d.SetBreakpoints(args.Source.Path, lines)
+		c.Respond(req, map[string]interface{}{"breakpoints": breakpoints}, nil)
+	case "threads":
+		threads := []map[string]interface{}{}
+		for _, t := range d.Threads() {
+			threads = append(threads, map[string]interface{}{"id": t.id, "name": t.name})
+		}
+		c.Respond(req, map[string]interface{}{"threads": threads}, nil)
+	case "stackTrace":
+		frames, err := d.Frames(args.ThreadID)
+		if err != nil {
+			return err
+		}
+		stackFrames := make([]map[string]interface{}, len(frames))
+		for i, f := range frames {
+			filename := canonicalFilename(f.pos.Filename)
+			stackFrames[i] = map[string]interface{}{
+				"id":     frameID(args.ThreadID, i),
+				"name":   f.name,
+				"source": map[string]interface{}{"name": path.Base(filename), "path": filename},
+				"line":   f.pos.Line,
+				"column": f.pos.Column,
+			}
+		}
+		c.Respond(req, map[string]interface{}{"stackFrames": stackFrames, "totalFrames": len(frames)}, nil)
+	case "scopes":
+		f, err := d.Frame(splitFrameID(args.FrameID))
+		if err != nil {
+			return err
+		}
+		locals, globals := f.Scopes()
+		c.Respond(req, map[string]interface{}{"scopes": []map[string]interface{}{
+			{"name": "Locals", "variablesReference": d.VariableReference(locals), "expensive": false},
+			{"name": "Globals", "variablesReference": d.VariableReference(globals), "expensive": false},
+		}}, nil)
+	case "variables":
+		obj, err := d.Variable(args.VariablesReference)
+		if err != nil {
+			return err
+		}
+		names, values := debugChildren(obj)
+		variables := make([]dapVariable, len(names))
+		for i, name := range names {
+			variables[i] = d.variable(name, values[i])
+		}
+		c.Respond(req, map[string]interface{}{"variables": variables}, nil)
+	case "evaluate":
+		f, err := d.Frame(splitFrameID(args.FrameID))
+		if err != nil {
+			return err
+		}
+		obj, err := f.Evaluate(args.Expression)
+		if err != nil {
+			return err
+		}
+		v := d.variable("", obj)
+		c.Respond(req, map[string]interface{}{"result": v.Value, "type": v.Type, "variablesReference": v.VariablesReference}, nil)
+	case "continue":
+		return d.resumeRequest(c, req, args.ThreadID, stepContinue, map[string]interface{}{"allThreadsContinued": false})
+	case "next":
+		return d.resumeRequest(c, req, args.ThreadID, stepOver, nil)
+	case "stepIn":
+		return d.resumeRequest(c, req, args.ThreadID, stepIn, nil)
+	case "stepOut":
+		return d.resumeRequest(c, req, args.ThreadID, stepOut, nil)
+	case "pause":
+		if err := d.Pause(args.ThreadID); err != nil {
+			return err
+		}
+		c.Respond(req, nil, nil)
+	default:
+		return fmt.Errorf("Unsupported request %s", req.Command)
+	}
+	return nil
+}
+
+// resumeRequest handles a request to resume a thread.
+// The response is sent first so the client doesn't see the thread stop again before it.
+func (d *debugger) resumeRequest(c *dapConnection, req *dapRequest, threadID int, step stepMode, body interface{}) error {
+	if _, err := d.stoppedThread(threadID); err != nil {
+		return err
+	}
+	c.Respond(req, body, nil)
+	return d.Resume(threadID, step)
+}
+
+// variable returns the representation of an object to send to the client.
+func (d *debugger) variable(name string, obj pyObject) dapVariable {
+	v := dapVariable{
+		Name:               name,
+		Value:              obj.String(),
+		Type:               obj.Type(),
+		VariablesReference: d.VariableReference(obj),
+	}
+	if s, ok := obj.(pyString); ok {
+		v.Value = strconv.Quote(string(s))
+	}
+	return v
+}
+
+// sendEvent sends an event to the client, if there is one.
+func (d *debugger) sendEvent(event string, body interface{}) {
+	d.mutex.Lock()
+	c := d.client
+	d.mutex.Unlock()
+	if c != nil {
+		c.SendEvent(event, body)
+	}
+}
+
+// frameID returns the identifier we give to the client for a stack frame.
+func frameID(threadID, index int) int {
+	return threadID<<16 | index
+}
+
+// splitFrameID is the inverse of frameID.
+func splitFrameID(id int) (int, int) {
+	return id >> 16, id & 0xffff
+}
+
+// Read reads the next request from the client.
+func (c *dapConnection) Read() (*dapRequest, error) {
+	header, err := c.reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(header.Get("Content-Length")))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Content-Length header: %s", err)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(c.reader.R, b); err != nil {
+		return nil, err
+	}
+	req := &dapRequest{}
+	return req, json.Unmarshal(b, req)
+}
+
+// Respond sends a response to the given request. If err is non-nil it is an error response.
+func (c *dapConnection) Respond(req *dapRequest, body interface{}, err error) {
+	resp := &dapResponse{
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Command:    req.Command,
+		Success:    err == nil,
+		Body:       body,
+	}
+	if err != nil {
+		resp.Message = err.Error()
+	}
+	c.send(func(seq int) interface{} {
+		resp.Seq = seq
+		return resp
+	})
+}
+
+// SendEvent sends an event to the client.
+func (c *dapConnection) SendEvent(event string, body interface{}) {
+	c.send(func(seq int) interface{} {
+		return &dapEvent{Seq: seq, Type: "event", Event: event, Body: body}
+	})
+}
+
+// send sends a single message to the client. The function is given the sequence number to use.
+func (c *dapConnection) send(f func(seq int) interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.seq++
+	b, err := json.Marshal(f(c.seq))
+	if err != nil {
+		log.Error("Failed to encode debugger message: %s", err)
+		return
+	}
+	if _, err := fmt.Fprintf(c.conn, "Content-Length: %d\r\n\r\n%s", len(b), b); err != nil {
+		log.Warning("Failed to send debugger message: %s", err)
+	}
+}
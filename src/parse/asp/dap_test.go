@@ -0,0 +1,181 @@
+package asp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/rules"
+	"github.com/thought-machine/please/src/core"
+)
+
+const debugFilename = "src/parse/asp/test_data/interpreter/debug.build"
+
+// A dapClient is a minimal client for the debugger, for testing.
+type dapClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *textproto.Reader
+	seq    int
+}
+
+type dapMessage struct {
+	Type    string                 `json:"type"`
+	Command string                 `json:"command"`
+	Event   string                 `json:"event"`
+	Success bool                   `json:"success"`
+	Message string                 `json:"message"`
+	Body    map[string]interface{} `json:"body"`
+}
+
+// Request sends a request and returns the body of the response, which must be the next message.
+func (c *dapClient) Request(command string, args interface{}) map[string]interface{} {
+	c.seq++
+	b, err := json.Marshal(map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	require.NoError(c.t, err)
+	_, err = fmt.Fprintf(c.conn, "Content-Length: %d\r\n\r\n%s", len(b), b)
+	require.NoError(c.t, err)
+	msg := c.Read()
+	require.Equal(c.t, "response", msg.Type)
+	require.Equal(c.t, command, msg.Command)
+	require.True(c.t, msg.Success, msg.Message)
+	return msg.Body
+}
+
+// Expect reads the next message, which must be the given event, and returns its body.
+func (c *dapClient) Expect(event string) map[string]interface{} {
+	msg := c.Read()
+	require.Equal(c.t, "event", msg.Type)
+	require.Equal(c.t, event, msg.Event)
+	return msg.Body
+}
+
+func (c *dapClient) Read() *dapMessage {
+	header, err := c.reader.ReadMIMEHeader()
+	require.NoError(c.t, err)
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	require.NoError(c.t, err)
+	b := make([]byte, length)
+	_, err = io.ReadFull(c.reader.R, b)
+	require.NoError(c.t, err)
+	msg := &dapMessage{}
+	require.NoError(c.t, json.Unmarshal(b, msg))
+	return msg
+}
+
+func newDebugParser(t *testing.T) (*Parser, *dapClient) {
+	parser := NewParser(core.NewDefaultBuildState())
+	parser.MustLoadBuiltins("builtins.build_defs", nil, rules.MustAsset("builtins.build_defs.gob"))
+	parser.interpreter.debugger = newDebugger(parser.interpreter)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go parser.interpreter.debugger.Serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	return parser, &dapClient{t: t, conn: conn, reader: textproto.NewReader(bufio.NewReader(conn))}
+}
+
+func TestDebugger(t *testing.T) {
+	parser, c := newDebugParser(t)
+	defer c.conn.Close()
+	body := c.Request("initialize", map[string]interface{}{"adapterID": "plz"})
+	assert.Equal(t, true, body["supportsConfigurationDoneRequest"])
+	c.Expect("initialized")
+	body = c.Request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": debugFilename},
+		"breakpoints": []map[string]interface{}{{"line": 2}},
+	})
+	assert.Equal(t, 1, len(body["breakpoints"].([]interface{})))
+	c.Request("configurationDone", nil)
+
+	statements, err := parser.parse(debugFilename)
+	require.NoError(t, err)
+	done := make(chan *scope)
+	go func() {
+		s, err := parser.interpreter.interpretAll(core.NewPackage("test/package"), statements)
+		assert.NoError(t, err)
+		done <- s
+	}()
+	threadID := c.Expect("thread")["threadId"]
+	body = c.Expect("stopped")
+	assert.Equal(t, "breakpoint", body["reason"])
+	assert.Equal(t, threadID, body["threadId"])
+
+	threads := c.Request("threads", nil)["threads"].([]interface{})
+	require.Equal(t, 1, len(threads))
+	assert.Equal(t, "//test/package:all", threads[0].(map[string]interface{})["name"])
+
+	frames := c.Request("stackTrace", map[string]interface{}{"threadId": threadID})["stackFrames"].([]interface{})
+	require.Equal(t, 2, len(frames))
+	frame := frames[0].(map[string]interface{})
+	assert.Equal(t, "double", frame["name"])
+	assert.EqualValues(t, 2, frame["line"])
+	assert.EqualValues(t, 5, frames[1].(map[string]interface{})["line"])
+
+	scopes := c.Request("scopes", map[string]interface{}{"frameId": frame["id"]})["scopes"].([]interface{})
+	require.Equal(t, 2, len(scopes))
+	locals := scopes[0].(map[string]interface{})
+	assert.Equal(t, "Locals", locals["name"])
+	variables := c.Request("variables", map[string]interface{}{"variablesReference": locals["variablesReference"]})["variables"].([]interface{})
+	require.Equal(t, 1, len(variables))
+	assert.Equal(t, "x", variables[0].(map[string]interface{})["name"])
+	assert.Equal(t, "21", variables[0].(map[string]interface{})["value"])
+
+	body = c.Request("evaluate", map[string]interface{}{"expression": "x + 1", "frameId": frame["id"]})
+	assert.Equal(t, "22", body["result"])
+
+	c.Request("next", map[string]interface{}{"threadId": threadID})
+	assert.Equal(t, "step", c.Expect("stopped")["reason"])
+	frames = c.Request("stackTrace", map[string]interface{}{"threadId": threadID})["stackFrames"].([]interface{})
+	assert.EqualValues(t, 3, frames[0].(map[string]interface{})["line"])
+
+	c.Request("continue", map[string]interface{}{"threadId": threadID})
+	c.Expect("thread")
+	s := <-done
+	assert.EqualValues(t, pyInt(42), s.Lookup("z"))
+}
+
+func TestDebuggerDisconnect(t *testing.T) {
+	parser, c := newDebugParser(t)
+	c.Request("initialize", nil)
+	c.Expect("initialized")
+	c.Request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": debugFilename},
+		"breakpoints": []map[string]interface{}{{"line": 5}},
+	})
+	c.Request("configurationDone", nil)
+	statements, err := parser.parse(debugFilename)
+	require.NoError(t, err)
+	done := make(chan *scope)
+	go func() {
+		s, err := parser.interpreter.interpretAll(core.NewPackage("test/package"), statements)
+		assert.NoError(t, err)
+		done <- s
+	}()
+	c.Expect("thread")
+	c.Expect("stopped")
+	// Disconnecting should let the thread carry on to the end.
+	c.Request("disconnect", nil)
+	s := <-done
+	assert.EqualValues(t, pyInt(42), s.Lookup("z"))
+}
+
+func TestCanonicalFilename(t *testing.T) {
+	assert.Equal(t, "/repo/src/BUILD", canonicalFilenameIn("/repo", "src/BUILD"))
+	assert.Equal(t, "/repo/src/BUILD", canonicalFilenameIn("/repo", "/repo/src/BUILD"))
+	assert.Equal(t, "/repo/build_defs/go.build_defs", canonicalFilenameIn("/repo", "plz-out/gen/build_defs/go.build_defs"))
+}
+
+func canonicalFilenameIn(repoRoot, filename string) string {
+	defer func(old string) { core.RepoRoot = old }(core.RepoRoot)
+	core.RepoRoot = repoRoot
+	return canonicalFilename(filename)
+}
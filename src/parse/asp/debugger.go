@@ -0,0 +1,410 @@
+package asp
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A debugger allows stepping through the interpreter as it evaluates BUILD files.
+// It is driven by a client (typically an editor) over the Debug Adapter Protocol; see dap.go for that side of it.
+//
+// Each package being parsed is presented as a separate thread, which can be stopped independently.
+type debugger struct {
+	interpreter *interpreter
+	mutex       sync.Mutex
+	// Breakpoints, indexed by absolute filename, then by line.
+	breakpoints map[string]map[int]bool
+	threads     map[int]*debugThread
+	lastThread  int
+	// Objects that the client can expand, indexed by their variablesReference.
+	variables map[int]pyObject
+	// Number of threads that are currently stopped; once this returns to zero the variables above are forgotten.
+	stopped int
+	// Closed once the client has finished configuring us (i.e. sent its initial breakpoints).
+	configured     chan struct{}
+	configuredOnce sync.Once
+	// The client that's connected to us, or nil if there isn't one.
+	client *dapConnection
+}
+
+// A debugThread represents the evaluation of one package.
+type debugThread struct {
+	id     int
+	name   string
+	frames []*debugFrame
+	// How we are currently stepping through this thread, and the stack depth we were at when we started.
+	step      stepMode
+	stepDepth int
+	stopped   bool
+	resume    chan stepMode
+}
+
+// A debugFrame is a single frame in the call stack of a thread.
+type debugFrame struct {
+	name  string
+	scope *scope
+	pos   Position
+}
+
+// A stepMode describes how to proceed after being stopped.
+type stepMode int
+
+const (
+	stepContinue stepMode = iota // Run until a breakpoint is hit
+	stepIn                       // Stop at the next statement
+	stepOver                     // Stop at the next statement in this function (or one that called it)
+	stepOut                      // Stop at the next statement in a function that called this one
+	stepPause                    // Stop at the next statement, because the client asked us to
+)
+
+func newDebugger(i *interpreter) *debugger {
+	return &debugger{
+		interpreter: i,
+		breakpoints: map[string]map[int]bool{},
+		threads:     map[int]*debugThread{},
+		variables:   map[int]pyObject{},
+		configured:  make(chan struct{}),
+	}
+}
+
+// Listen starts listening for a client on the given port.
+func (d *debugger) Listen(port int) error {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return err
+	}
+	log.Warning("Waiting for a debugger to attach on port %d before parsing...", port)
+	go d.Serve(l)
+	return nil
+}
+
+// Configured marks that the client has finished its initial configuration.
+// Parsing doesn't start until this has happened.
+func (d *debugger) Configured() {
+	d.configuredOnce.Do(func() { close(d.configured) })
+}
+
+// StartThread registers a new thread for evaluating the given package.
+func (d *debugger) StartThread(pkg *core.Package) *debugThread {
+	<-d.configured
+	d.mutex.Lock()
+	d.lastThread++
+	name := pkg.Label().String()
+	t := &debugThread{
+		id:     d.lastThread,
+		name:   name,
+		frames: []*debugFrame{{name: name}},
+		resume: make(chan stepMode),
+	}
+	d.threads[t.id] = t
+	d.mutex.Unlock()
+	d.sendEvent("thread", map[string]interface{}{"reason": "started", "threadId": t.id})
+	return t
+}
+
+// EndThread marks a thread as finished.
+func (d *debugger) EndThread(t *debugThread) {
+	d.mutex.Lock()
+	delete(d.threads, t.id)
+	d.mutex.Unlock()
+	d.sendEvent("thread", map[string]interface{}{"reason": "exited", "threadId": t.id})
+}
+
+// Push adds a new frame to a thread's call stack, when a function is called.
+func (t *debugThread) Push(name string) {
+	caller := t.frames[len(t.frames)-1]
+	t.frames = append(t.frames, &debugFrame{name: name, scope: caller.scope, pos: caller.pos})
+}
+
+// Pop removes the top frame from a thread's call stack.
+func (t *debugThread) Pop() {
+	t.frames = t.frames[:len(t.frames)-1]
+}
+
+// Statement is called before each statement is interpreted. It blocks if we need to stop here.
+func (d *debugger) Statement(s *scope, stmt *Statement) {
+	t := s.thread
+	if t == nil || s.Callback {
+		return
+	}
+	frame := t.frames[len(t.frames)-1]
+	frame.scope = s
+	frame.pos = stmt.Pos
+	if reason := d.shouldStop(t, stmt.Pos); reason != "" {
+		d.Stop(t, reason)
+	}
+}
+
+// shouldStop returns the reason we should stop at the given position, or the empty string if we shouldn't.
+func (d *debugger) shouldStop(t *debugThread, pos Position) string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.client == nil {
+		return ""
+	}
+	switch depth := len(t.frames); {
+	case t.step == stepPause:
+		return "pause"
+	case t.step == stepIn, t.step == stepOver && depth <= t.stepDepth, t.step == stepOut && depth < t.stepDepth:
+		return "step"
+	}
+	if len(d.breakpoints) != 0 && d.breakpoints[canonicalFilename(pos.Filename)][pos.Line] {
+		return "breakpoint"
+	}
+	return ""
+}
+
+// Stop stops the given thread and blocks until the client tells us to resume.
+// It returns false immediately if there is no client to tell us that.
+func (d *debugger) Stop(t *debugThread, reason string) bool {
+	d.mutex.Lock()
+	if d.client == nil {
+		d.mutex.Unlock()
+		return false
+	}
+	t.stopped = true
+	d.stopped++
+	d.mutex.Unlock()
+	d.sendEvent("stopped", map[string]interface{}{"reason": reason, "threadId": t.id, "allThreadsStopped": false})
+	step := <-t.resume
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	t.step = step
+	t.stepDepth = len(t.frames)
+	if d.stopped--; d.stopped == 0 {
+		d.variables = map[int]pyObject{}
+	}
+	return true
+}
+
+// Resume resumes a stopped thread. It returns an error if the thread isn't stopped.
+func (d *debugger) Resume(id int, step stepMode) error {
+	t, err := d.stoppedThread(id)
+	if err != nil {
+		return err
+	}
+	d.resume(t, step)
+	return nil
+}
+
+// ResumeAll resumes all stopped threads, e.g. when the client disconnects.
+func (d *debugger) ResumeAll() {
+	for _, t := range d.Threads() {
+		d.resume(t, stepContinue)
+	}
+}
+
+// resume resumes a single thread, if it is still stopped.
+func (d *debugger) resume(t *debugThread, step stepMode) {
+	d.mutex.Lock()
+	stopped := t.stopped
+	t.stopped = false
+	d.mutex.Unlock()
+	if stopped {
+		t.resume <- step
+	}
+}
+
+// Pause requests that a running thread stops at its next statement.
+func (d *debugger) Pause(id int) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	t, present := d.threads[id]
+	if !present {
+		return fmt.Errorf("Unknown thread %d", id)
+	}
+	t.step = stepPause
+	return nil
+}
+
+// SetBreakpoints replaces all the breakpoints in the given file.
+func (d *debugger) SetBreakpoints(filename string, lines []int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	filename = canonicalFilename(filename)
+	if len(lines) == 0 {
+		delete(d.breakpoints, filename)
+		return
+	}
+	m := make(map[int]bool, len(lines))
+	for _, line := range lines {
+		m[line] = true
+	}
+	d.breakpoints[filename] = m
+}
+
+// Threads returns the IDs and names of all current threads, sorted by ID.
+func (d *debugger) Threads() []*debugThread {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	threads := make([]*debugThread, 0, len(d.threads))
+	for _, t := range d.threads {
+		threads = append(threads, t)
+	}
+	sort.Slice(threads, func(i, j int) bool { return threads[i].id < threads[j].id })
+	return threads
+}
+
+// Frames returns the call stack of a stopped thread, innermost first.
+func (d *debugger) Frames(id int) ([]*debugFrame, error) {
+	t, err := d.stoppedThread(id)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([]*debugFrame, len(t.frames))
+	for i, f := range t.frames {
+		frames[len(frames)-i-1] = f
+	}
+	return frames, nil
+}
+
+// Frame returns a single frame from a stopped thread, by its index from the innermost frame.
+func (d *debugger) Frame(id, index int) (*debugFrame, error) {
+	frames, err := d.Frames(id)
+	if err != nil {
+		return nil, err
+	} else if index < 0 || index >= len(frames) {
+		return nil, fmt.Errorf("Unknown frame %d", index)
+	}
+	return frames[index], nil
+}
+
+func (d *debugger) stoppedThread(id int) (*debugThread, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if t, present := d.threads[id]; !present {
+		return nil, fmt.Errorf("Unknown thread %d", id)
+	} else if !t.stopped {
+		return nil, fmt.Errorf("Thread %d is not stopped", id)
+	} else {
+		return t, nil
+	}
+}
+
+// Scopes returns the local & global variables visible to a frame.
+func (f *debugFrame) Scopes() (locals, globals pyDict) {
+	locals = pyDict{}
+	globals = pyDict{}
+	// Locals are everything until we get to the scope just inside the root one (which holds the builtins).
+	for s := f.scope; s != nil && s.parent != nil; s = s.parent {
+		if s.parent.parent == nil {
+			globals = s.locals
+			break
+		}
+		for k, v := range s.locals {
+			// CONFIG is copied into every function call; it's more useful to just see it once in the globals.
+			if _, present := locals[k]; !present && k != "CONFIG" {
+				locals[k] = v
+			}
+		}
+	}
+	return locals, globals
+}
+
+// Evaluate evaluates an expression (or any other statement) in the context of a frame.
+func (f *debugFrame) Evaluate(expr string) (ret pyObject, err error) {
+	if f.scope == nil {
+		return nil, fmt.Errorf("Frame has no scope to evaluate in")
+	}
+	// Treat it as an expression to get a value back if we can, but otherwise fall back to statements
+	// so things like assignments work too.
+	stmts, err := f.scope.interpreter.parser.ParseData([]byte("return "+expr), "<evaluate>")
+	if err != nil {
+		if stmts, err = f.scope.interpreter.parser.ParseData([]byte(expr), "<evaluate>"); err != nil {
+			return nil, err
+		}
+	}
+	// Don't let the debugger see these statements, the thread is already stopped.
+	thread := f.scope.thread
+	f.scope.thread = nil
+	defer func() {
+		f.scope.thread = thread
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s", r)
+		}
+	}()
+	if ret = f.scope.interpretStatements(stmts); ret == nil {
+		ret = None
+	}
+	return ret, nil
+}
+
+// VariableReference returns a reference for the client to expand the given object, or 0 if it
+// isn't something that can be expanded.
+func (d *debugger) VariableReference(obj pyObject) int {
+	if names, _ := debugChildren(obj); len(names) == 0 {
+		return 0
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	ref := len(d.variables) + 1
+	d.variables[ref] = obj
+	return ref
+}
+
+// Variable returns the object for a previously returned variable reference.
+func (d *debugger) Variable(ref int) (pyObject, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if obj, present := d.variables[ref]; present {
+		return obj, nil
+	}
+	return nil, fmt.Errorf("Unknown variable reference %d", ref)
+}
+
+// debugChildren returns the children of an object to show in the debugger, sorted by name.
+func debugChildren(obj pyObject) (names []string, values []pyObject) {
+	addDict := func(d pyDict) {
+		for _, k := range d.Keys() {
+			names = append(names, k)
+			values = append(values, d[k])
+		}
+	}
+	switch o := obj.(type) {
+	case pyDict:
+		addDict(o)
+	case pyFrozenDict:
+		addDict(o.pyDict)
+	case *pyStruct:
+		addDict(o.fields)
+	case *pyConfig:
+		merged := pyDict{}
+		for k, v := range o.base {
+			merged[k] = v
+		}
+		for k, v := range o.overlay {
+			merged[k] = v
+		}
+		addDict(merged)
+	case pyList:
+		for i, v := range o {
+			names = append(names, strconv.Itoa(i))
+			values = append(values, v)
+		}
+	case pyFrozenList:
+		return debugChildren(o.pyList)
+	}
+	return names, values
+}
+
+// canonicalFilename returns the absolute path to a file as the client would see it.
+// Subincluded files are evaluated from plz-out, so we map those back to their sources.
+func canonicalFilename(filename string) string {
+	if !filepath.IsAbs(filename) {
+		filename = path.Join(core.RepoRoot, filename)
+	}
+	if rel, err := filepath.Rel(core.RepoRoot, filename); err == nil {
+		if genDir := core.GenDir + "/"; strings.HasPrefix(rel, genDir) {
+			return path.Join(core.RepoRoot, strings.TrimPrefix(rel, genDir))
+		}
+	}
+	return filename
+}
@@ -80,6 +80,15 @@ func (stack *errorStack) ShortError() string {
 	return stack.err.Error()
 }
 
+// ErrorPosition returns the position at which an error from the parser or interpreter occurred,
+// along with its abbreviated message. The position is empty if the error didn't come from asp.
+func ErrorPosition(err error) (Position, string) {
+	if stack, ok := err.(*errorStack); ok && len(stack.Stack) > 0 {
+		return stack.Stack[0], stack.ShortError()
+	}
+	return Position{}, err.Error()
+}
+
 // stackTrace returns the lines of stacktrace from the error.
 func (stack *errorStack) stackTrace() string {
 	ret := make([]string, len(stack.Stack))
@@ -59,6 +59,7 @@ func doExec(s *scope, cmdIn pyObject, wantStdout bool, wantStderr bool, cacheOut
 	if !wantStdout && !wantStderr {
 		return s.Error("exec() must have at least stdout or stderr set to true, both can not be false"), false, nil
 	}
+	s.Uncacheable() // We can't know what the command depends on.
 
 	var argv []string
 	if isType(cmdIn, "str") {
@@ -0,0 +1,119 @@
+package asp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// readFile implements the read_file() builtin, which returns the contents of a file as a string.
+func readFile(s *scope, args []pyObject) pyObject {
+	_, contents := s.readPackageFile(string(args[0].(pyString)))
+	return pyString(contents)
+}
+
+// loadJSON implements the load_json() builtin, which loads a JSON file as a plz value.
+func loadJSON(s *scope, args []pyObject) pyObject {
+	filename, contents := s.readPackageFile(string(args[0].(pyString)))
+	d := json.NewDecoder(bytes.NewReader(contents))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		s.Error("Failed to parse %s as JSON: %s", filename, err)
+	}
+	return s.fromLoadedValue(filename, v)
+}
+
+// loadYAML implements the load_yaml() builtin, which loads a YAML file as a plz value.
+func loadYAML(s *scope, args []pyObject) pyObject {
+	filename, contents := s.readPackageFile(string(args[0].(pyString)))
+	var v interface{}
+	if err := yaml.Unmarshal(contents, &v); err != nil {
+		s.Error("Failed to parse %s as YAML: %s", filename, err)
+	}
+	return s.fromLoadedValue(filename, v)
+}
+
+// readPackageFile reads a file while parsing a package and records it on that package.
+// Relative paths are relative to the package's directory; paths beginning with // are relative to
+// the root of the repo. In either case the file must be in the repo and can't be a generated file.
+// It returns the path to the file (relative to the repo root) and its contents.
+func (s *scope) readPackageFile(filename string) (string, []byte) {
+	s.Assert(filename != "", "Filename to read cannot be empty")
+	p := strings.TrimPrefix(filename, "//")
+	s.NAssert(path.IsAbs(p), "Cannot read absolute path %s; files must be within the repo", filename)
+	if p == filename {
+		s.NAssert(s.pkg == nil, "Cannot read %s relative to a package in this context; use a path beginning with //", filename)
+		p = path.Join(s.pkg.Name, p)
+	} else {
+		p = path.Clean(p)
+	}
+	s.NAssert(p == ".." || strings.HasPrefix(p, "../"), "Cannot read %s; files must be within the repo", filename)
+	s.NAssert(p == core.OutDir || strings.HasPrefix(p, core.OutDir+"/"), "Cannot read %s; generated files can't be read at parse time", filename)
+	if s.pkg != nil && s.pkg.Subrepo != nil {
+		p = s.pkg.Subrepo.Dir(p)
+	}
+	if info, err := os.Stat(p); err == nil {
+		s.checkAllocation("str", int(info.Size()))
+	}
+	contents, err := ioutil.ReadFile(p)
+	if err != nil {
+		s.Error("Failed to read %s: %s", filename, err)
+	}
+	hash := sha1.Sum(contents)
+	s.RegisterRead(core.PackageRead{Filename: p, Hash: hash[:]})
+	return p, contents
+}
+
+// fromLoadedValue converts a value decoded from JSON or YAML into a pyObject.
+func (s *scope) fromLoadedValue(filename string, v interface{}) pyObject {
+	switch v := v.(type) {
+	case nil:
+		return None
+	case bool:
+		return newPyBool(v)
+	case string:
+		return pyString(v)
+	case int:
+		return pyInt(v)
+	case int64:
+		return pyInt(v)
+	case float64:
+		s.Error("Non-integer number %v in %s; only integers are supported", v, filename)
+	case json.Number:
+		i, err := v.Int64()
+		if err != nil {
+			s.Error("Non-integer number %s in %s; only integers are supported", v, filename)
+		}
+		return pyInt(i)
+	case []interface{}:
+		l := make(pyList, len(v))
+		for i, x := range v {
+			l[i] = s.fromLoadedValue(filename, x)
+		}
+		return l
+	case map[string]interface{}:
+		d := make(pyDict, len(v))
+		for k, x := range v {
+			d[k] = s.fromLoadedValue(filename, x)
+		}
+		return d
+	case map[interface{}]interface{}:
+		d := make(pyDict, len(v))
+		for k, x := range v {
+			key, ok := k.(string)
+			s.Assert(ok, "Non-string key %v in %s; dict keys must be strings", k, filename)
+			d[key] = s.fromLoadedValue(filename, x)
+		}
+		return d
+	}
+	return s.Error("Unsupported value %v in %s (is a %T)", v, filename, v)
+}
@@ -1,6 +1,9 @@
 package asp
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+)
 
 // A FileInput is the top-level structure of a BUILD file.
 type FileInput struct {
@@ -64,6 +67,9 @@ type FuncDef struct {
 	IsPrivate bool
 	// True if the function is builtin to Please.
 	IsBuiltin bool
+	// The compiled form of the function; it's compiled when first called if it's not set already.
+	Bytecode    *Bytecode
+	compileOnce sync.Once
 }
 
 // A ForStatement implements the 'for' statement.
@@ -293,7 +299,7 @@ const (
 	And Operator = '&'
 	// Or implements the or operator
 	Or = '∨'
-	// Union implements the | or binary or operator, which is only used for dict unions.
+	// Union implements the | or binary or operator, which is only used for dict and set unions.
 	Union = '∪'
 	// Is implements type identity.
 	Is = '≡'
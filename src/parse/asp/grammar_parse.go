@@ -233,7 +233,7 @@ func (p *parser) parseFuncDef() *FuncDef {
 		p.next('-')
 		p.next('>')
 
-		tok := p.oneofval("bool", "str", "int", "list", "dict", "function", "config")
+		tok := p.oneofval("bool", "str", "int", "list", "dict", "set", "function", "config")
 		fd.Return = tok.Value
 	}
 
@@ -268,7 +268,7 @@ func (p *parser) parseArgument() Argument {
 	if tok.Type == ':' {
 		// Type annotations
 		for {
-			tok = p.oneofval("bool", "str", "int", "list", "dict", "function", "config")
+			tok = p.oneofval("bool", "str", "int", "list", "dict", "set", "function", "config")
 			a.Type = append(a.Type, tok.Value)
 			if !p.optional('|') {
 				break
@@ -533,7 +533,7 @@ func (p *parser) parseIdentStatement() *IdentStatement {
 		p.initField(&i.Unpack)
 		i.Unpack.Names = p.parseIdentList()
 		p.next('=')
-		i.Unpack.Expr = p.parseExpression()
+		i.Unpack.Expr = p.parseAssignedExpression()
 	case '[':
 		p.initField(&i.Index)
 		i.Index.Expr = p.parseExpression()
@@ -552,7 +552,7 @@ func (p *parser) parseIdentStatement() *IdentStatement {
 		i.Action.Call = p.parseCall()
 	case '=':
 		p.initField(&i.Action)
-		i.Action.Assign = p.parseExpression()
+		i.Action.Assign = p.parseAssignedExpression()
 	default:
 		p.assert(tok.Value == "+=", tok, "Unexpected token %s, expected one of , [ . ( = +=", tok)
 		p.initField(&i.Action)
@@ -561,6 +561,26 @@ func (p *parser) parseIdentStatement() *IdentStatement {
 	return i
 }
 
+// parseAssignedExpression parses the right-hand side of an assignment, which can be a tuple
+// without surrounding brackets (e.g. a, b = b, a), optionally with a trailing comma.
+// Tuples are just lists to us, and this is represented as one because a parenthesised
+// expression with a single item isn't a tuple, whereas x = 1, is.
+func (p *parser) parseAssignedExpression() *Expression {
+	e := p.parseExpression()
+	if p.l.Peek().Type != ',' {
+		return e
+	}
+	l := &List{Values: []*Expression{e}}
+	for p.optional(',') && p.l.Peek().Type != EOL {
+		l.Values = append(l.Values, p.parseExpression())
+	}
+	return &Expression{
+		Pos:    e.Pos,
+		EndPos: p.endPos,
+		Val:    &ValueExpression{List: l},
+	}
+}
+
 func (p *parser) parseIdentExpr() *IdentExpr {
 	//var endPos Position
 	identTok := p.next(Ident)
@@ -14,11 +14,16 @@ type interpreter struct {
 	scope           *scope
 	parser          *Parser
 	subincludes     map[string]pyDict
+	subincludeDeps  map[string]subincludeDeps
 	config          map[*core.Configuration]*pyConfig
 	mutex           sync.RWMutex
 	configMutex     sync.RWMutex
 	breakpointMutex sync.Mutex
 	limiter         semaphore
+	profiler        *profiler
+	debugger        *debugger
+	// Set to run functions by interpreting their AST rather than as bytecode.
+	disableBytecode bool
 }
 
 // newInterpreter creates and returns a new interpreter instance.
@@ -29,11 +34,21 @@ func newInterpreter(state *core.BuildState, p *Parser) *interpreter {
 		locals: map[string]pyObject{},
 	}
 	i := &interpreter{
-		scope:       s,
-		parser:      p,
-		subincludes: map[string]pyDict{},
-		config:      map[*core.Configuration]*pyConfig{},
-		limiter:     make(semaphore, state.Config.Parse.NumThreads),
+		scope:          s,
+		parser:         p,
+		subincludes:    map[string]pyDict{},
+		subincludeDeps: map[string]subincludeDeps{},
+		config:         map[*core.Configuration]*pyConfig{},
+		limiter:        make(semaphore, state.Config.Parse.NumThreads),
+	}
+	if state.ProfileParse {
+		i.profiler = newProfiler()
+	}
+	if state.DebugParsePort != 0 {
+		i.debugger = newDebugger(i)
+		if err := i.debugger.Listen(state.DebugParsePort); err != nil {
+			log.Fatalf("Failed to start debugger: %s", err)
+		}
 	}
 	s.interpreter = i
 	s.LoadSingletons(state)
@@ -84,6 +99,15 @@ func (i *interpreter) interpretAll(pkg *core.Package, statements []*Statement) (
 	// mutating operations like .setdefault() otherwise.
 	s.config = i.pkgConfig(pkg).Copy()
 	s.Set("CONFIG", s.config)
+	s.steps = new(int)
+	if i.profiler != nil {
+		s.call = i.profiler.PushPackage(pkg)
+		defer i.profiler.PopPackage(pkg, s.call)
+	}
+	if i.debugger != nil {
+		s.thread = i.debugger.StartThread(pkg)
+		defer i.debugger.EndThread(s.thread)
+	}
 	_, err = i.interpretStatements(s, statements)
 	if err == nil {
 		s.Callback = true // From here on, if anything else uses this scope, it's in a post-build callback.
@@ -106,11 +130,14 @@ func (i *interpreter) interpretStatements(s *scope, statements []*Statement) (re
 }
 
 // Subinclude returns the global values corresponding to subincluding the given file.
-func (i *interpreter) Subinclude(path string, label core.BuildLabel, pkg *core.Package) pyDict {
+// The given scope is the one calling subinclude().
+func (i *interpreter) Subinclude(caller *scope, path string, label core.BuildLabel, pkg *core.Package) pyDict {
 	i.mutex.RLock()
 	globals, present := i.subincludes[path]
+	deps := i.subincludeDeps[path]
 	i.mutex.RUnlock()
 	if present {
+		deps.Apply(caller.contextPkg)
 		return globals
 	}
 	// If we get here, it's not been subincluded already. Parse it now.
@@ -125,6 +152,21 @@ func (i *interpreter) Subinclude(path string, label core.BuildLabel, pkg *core.P
 	s := i.scope.NewScope()
 	s.contextPkg = pkg
 	s.subincludeLabel = &label
+	s.steps = caller.steps
+	s.depth = caller.depth
+	if i.profiler != nil {
+		s.call = i.profiler.PushSubinclude(caller.call, label, path)
+		defer i.profiler.PopSubinclude(label, s.call)
+	}
+	if s.thread = caller.thread; s.thread != nil {
+		s.thread.Push("subinclude " + label.String())
+		defer s.thread.Pop()
+	}
+	// Track what this subinclude depends on, so we can attribute it to any other packages that include it later.
+	numSubincludes := len(pkg.Subincludes)
+	numReads := len(pkg.Reads)
+	uncacheable := pkg.Uncacheable
+	pkg.Uncacheable = false
 	// Scope needs a local version of CONFIG
 	s.config = i.scope.config.Copy()
 	s.Set("CONFIG", s.config)
@@ -134,12 +176,43 @@ func (i *interpreter) Subinclude(path string, label core.BuildLabel, pkg *core.P
 	if s.config.overlay == nil {
 		delete(locals, "CONFIG") // Config doesn't have any local modifications
 	}
+	deps = subincludeDeps{
+		Subincludes: append([]core.BuildLabel{}, pkg.Subincludes[numSubincludes:]...),
+		Reads:       append([]core.PackageRead{}, pkg.Reads[numReads:]...),
+		Uncacheable: pkg.Uncacheable,
+	}
+	pkg.Uncacheable = pkg.Uncacheable || uncacheable
+	deps.Apply(caller.contextPkg)
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
 	i.subincludes[path] = locals
+	i.subincludeDeps[path] = deps
 	return s.locals
 }
 
+// subincludeDeps describes what a subinclude depended on when it was evaluated.
+type subincludeDeps struct {
+	// Any other subincludes that it subincluded in turn.
+	Subincludes []core.BuildLabel
+	// Any files that it read.
+	Reads []core.PackageRead
+	// True if it did anything that means packages including it can't be stored in the parse cache.
+	Uncacheable bool
+}
+
+// Apply registers these dependencies on the given package.
+func (deps subincludeDeps) Apply(pkg *core.Package) {
+	if pkg != nil {
+		for _, l := range deps.Subincludes {
+			pkg.RegisterSubinclude(l)
+		}
+		for _, read := range deps.Reads {
+			pkg.RegisterRead(read)
+		}
+		pkg.Uncacheable = pkg.Uncacheable || deps.Uncacheable
+	}
+}
+
 // getConfig returns a new configuration object for the given configuration object.
 func (i *interpreter) getConfig(state *core.BuildState) *pyConfig {
 	i.configMutex.RLock()
@@ -200,6 +273,14 @@ type scope struct {
 	contextPkg *core.Package
 	// The label that was passed to subinclude(...)
 	subincludeLabel *core.BuildLabel
+	// The call currently being made from this scope; only set when profiling.
+	call *profileCall
+	// The debugger thread that this scope is running in; only set when debugging.
+	thread *debugThread
+	// The number of steps taken so far parsing the current package, which is shared between all its scopes.
+	steps *int
+	// The depth of function calls that this scope is at.
+	depth int
 }
 
 // NewScope creates a new child scope of this one.
@@ -218,6 +299,10 @@ func (s *scope) NewPackagedScope(pkg *core.Package) *scope {
 		locals:      pyDict{},
 		config:      s.config,
 		Callback:    s.Callback,
+		call:        s.call,
+		thread:      s.thread,
+		steps:       s.steps,
+		depth:       s.depth,
 	}
 	if pkg != nil && pkg.Subrepo != nil && pkg.Subrepo.State != nil {
 		s2.state = pkg.Subrepo.State
@@ -225,6 +310,26 @@ func (s *scope) NewPackagedScope(pkg *core.Package) *scope {
 	return s2
 }
 
+// Uncacheable marks the package currently being parsed as one that can't be stored in the parse cache.
+func (s *scope) Uncacheable() {
+	for s2 := s; s2 != nil; s2 = s2.parent {
+		if s2.contextPkg != nil {
+			s2.contextPkg.Uncacheable = true
+			return
+		}
+	}
+}
+
+// RegisterRead records a file that was read while parsing the current package.
+func (s *scope) RegisterRead(read core.PackageRead) {
+	for s2 := s; s2 != nil; s2 = s2.parent {
+		if s2.contextPkg != nil {
+			s2.contextPkg.RegisterRead(read)
+			return
+		}
+	}
+}
+
 // Error emits an error that stops further interpretation.
 // For convenience it is declared to return a pyObject but it never actually returns.
 func (s *scope) Error(msg string, args ...interface{}) pyObject {
@@ -317,6 +422,9 @@ func (s *scope) interpretStatements(statements []*Statement) pyObject {
 		}
 	}()
 	for _, stmt = range statements {
+		if d := s.interpreter.debugger; d != nil {
+			d.Statement(s, stmt)
+		}
 		if stmt.FuncDef != nil {
 			s.Set(stmt.FuncDef.Name, newPyFunc(s, stmt.FuncDef))
 		} else if stmt.If != nil {
@@ -374,6 +482,7 @@ func (s *scope) interpretIf(stmt *IfStatement) pyObject {
 
 func (s *scope) interpretFor(stmt *ForStatement) pyObject {
 	for _, li := range s.iterate(&stmt.Expr) {
+		s.step()
 		s.unpackNames(stmt.Names, li)
 		if ret := s.interpretStatements(stmt.Statements); ret != nil {
 			if s, ok := ret.(pySentinel); ok && s == continueIteration {
@@ -423,33 +532,50 @@ func (s *scope) interpretExpression(expr *Expression) pyObject {
 			if obj.IsTruthy() == (op.Op == And) {
 				obj = s.interpretExpression(op.Expr)
 			}
-		case Equal:
-			obj = newPyBool(reflect.DeepEqual(obj, s.interpretExpression(op.Expr)))
-		case NotEqual:
-			obj = newPyBool(!reflect.DeepEqual(obj, s.interpretExpression(op.Expr)))
-		case Is:
-			obj = s.interpretIs(obj, op)
-		case IsNot:
-			obj = s.negate(s.interpretIs(obj, op))
-		case In, NotIn:
-			// the implementation of in is defined by the right-hand side, not the left.
-			obj = s.interpretExpression(op.Expr).Operator(op.Op, obj)
 		default:
-			obj = obj.Operator(op.Op, s.interpretExpression(op.Expr))
+			obj = s.operate(op.Op, obj, s.interpretExpression(op.Expr))
 		}
 	}
 	return obj
 }
 
-func (s *scope) interpretIs(obj pyObject, op OpExpression) pyObject {
+// operate applies a binary operator (other than the logical ones, which are lazily evaluated) to two objects.
+func operate(op Operator, obj, operand pyObject) pyObject {
+	switch op {
+	case Equal:
+		return newPyBool(equal(obj, operand))
+	case NotEqual:
+		return newPyBool(!equal(obj, operand))
+	case Is:
+		return interpretIs(obj, operand)
+	case IsNot:
+		return newPyBool(!interpretIs(obj, operand).IsTruthy())
+	case In, NotIn:
+		// the implementation of in is defined by the right-hand side, not the left.
+		return operand.Operator(op, obj)
+	default:
+		return obj.Operator(op, operand)
+	}
+}
+
+// equal returns true if two objects are equal.
+// Sets are compared by their items, regardless of order or whether they're frozen.
+func equal(obj, operand pyObject) bool {
+	if s1, ok := asSet(obj); ok {
+		s2, ok := asSet(operand)
+		return ok && s1.Equals(s2)
+	}
+	return reflect.DeepEqual(obj, operand)
+}
+
+func interpretIs(obj, operand pyObject) pyObject {
 	// Is only works None or boolean types.
-	expr := s.interpretExpression(op.Expr)
 	switch tobj := obj.(type) {
 	case pyNone:
-		_, ok := expr.(pyNone)
+		_, ok := operand.(pyNone)
 		return newPyBool(ok)
 	case pyBool:
-		b, ok := expr.(pyBool)
+		b, ok := operand.(pyBool)
 		return newPyBool(ok && b == tobj)
 	default:
 		return newPyBool(false)
@@ -539,26 +665,36 @@ func (s *scope) interpretFString(f *FString) pyObject {
 }
 
 func (s *scope) interpretSlice(obj pyObject, sl *Slice) pyObject {
-	start := s.interpretSliceExpression(obj, sl.Start, 0)
+	return s.slice(obj, s.interpretSliceExpression(sl.Start), s.interpretSliceExpression(sl.End))
+}
+
+// interpretSliceExpression interprets one of the begin or end parts of a slice, which may be nil.
+func (s *scope) interpretSliceExpression(expr *Expression) pyObject {
+	if expr == nil {
+		return nil
+	}
+	return s.interpretExpression(expr)
+}
+
+// slice slices an object. Either of the start or end may be nil, in which case they default to
+// the start or end of the object respectively.
+func (s *scope) slice(obj, start, end pyObject) pyObject {
 	switch t := obj.(type) {
 	case pyList:
-		end := s.interpretSliceExpression(obj, sl.End, pyInt(len(t)))
-		return t[start:end]
+		return t[sliceIndex(obj, start, 0):sliceIndex(obj, end, pyInt(len(t)))]
 	case pyString:
-		end := s.interpretSliceExpression(obj, sl.End, pyInt(len(t)))
-		return t[start:end]
+		return t[sliceIndex(obj, start, 0):sliceIndex(obj, end, pyInt(len(t)))]
 	}
 	s.Error("Unsliceable type %s", obj.Type())
 	return nil
 }
 
-// interpretSliceExpression interprets one of the begin or end parts of a slice.
-// expr may be null, if it is the value of def is used instead.
-func (s *scope) interpretSliceExpression(obj pyObject, expr *Expression, def pyInt) pyInt {
-	if expr == nil {
+// sliceIndex returns the index for one end of a slice, or the given default if it is nil.
+func sliceIndex(obj, idx pyObject, def pyInt) pyInt {
+	if idx == nil {
 		return def
 	}
-	return pyIndex(obj, s.interpretExpression(expr), true)
+	return pyIndex(obj, idx, true)
 }
 
 func (s *scope) interpretIdent(obj pyObject, expr *IdentExpr) pyObject {
@@ -582,12 +718,12 @@ func (s *scope) interpretIdentStatement(stmt *IdentStatement) pyObject {
 		if stmt.Index.Assign != nil {
 			obj.IndexAssign(idx, s.interpretExpression(stmt.Index.Assign))
 		} else {
-			obj.IndexAssign(idx, obj.Operator(Index, idx).Operator(Add, s.interpretExpression(stmt.Index.AugAssign)))
+			obj.IndexAssign(idx, s.operate(Add, obj.Operator(Index, idx), s.interpretExpression(stmt.Index.AugAssign)))
 		}
 	} else if stmt.Unpack != nil {
 		obj := s.interpretExpression(stmt.Unpack.Expr)
-		l, ok := obj.(pyList)
-		s.Assert(ok, "Cannot unpack type %s", l.Type())
+		l, ok := asList(obj)
+		s.Assert(ok, "Cannot unpack type %s", obj.Type())
 		// This is a little awkward because the first item here is the name of the ident node.
 		s.Assert(len(l) == len(stmt.Unpack.Names)+1, "Wrong number of items to unpack; expected %d, got %d", len(stmt.Unpack.Names)+1, len(l))
 		s.Set(stmt.Name, l[0])
@@ -604,7 +740,7 @@ func (s *scope) interpretIdentStatement(stmt *IdentStatement) pyObject {
 		} else if stmt.Action.AugAssign != nil {
 			// The only augmented assignment operation we support is +=, and it's implemented
 			// exactly as x += y -> x = x + y since that matches the semantics of Go types.
-			s.Set(stmt.Name, s.Lookup(stmt.Name).Operator(Add, s.interpretExpression(stmt.Action.AugAssign)))
+			s.Set(stmt.Name, s.operate(Add, s.Lookup(stmt.Name), s.interpretExpression(stmt.Action.AugAssign)))
 		}
 	} else {
 		return s.Lookup(stmt.Name)
@@ -651,8 +787,10 @@ func (s *scope) interpretDict(expr *Dict) pyObject {
 func (s *scope) evaluateComprehension(l pyList, comp *Comprehension, callback func(pyObject)) {
 	if comp.Second != nil {
 		for _, li := range l {
+			s.step()
 			s.unpackNames(comp.Names, li)
 			for _, li := range s.iterate(comp.Second.Expr) {
+				s.step()
 				if s.evaluateComprehensionExpression(comp, comp.Second.Names, li) {
 					callback(li)
 				}
@@ -660,6 +798,7 @@ func (s *scope) evaluateComprehension(l pyList, comp *Comprehension, callback fu
 		}
 	} else {
 		for _, li := range l {
+			s.step()
 			if s.evaluateComprehensionExpression(comp, comp.Names, li) {
 				callback(li)
 			}
@@ -679,7 +818,7 @@ func (s *scope) unpackNames(names []string, obj pyObject) {
 	if len(names) == 1 {
 		s.Set(names[0], obj)
 	} else {
-		l, ok := obj.(pyList)
+		l, ok := asList(obj)
 		s.Assert(ok, "Cannot unpack %s into %s", obj.Type(), names)
 		s.Assert(len(l) == len(names), "Incorrect number of values to unpack; expected %d, got %d", len(names), len(l))
 		for i, name := range names {
@@ -688,16 +827,18 @@ func (s *scope) unpackNames(names []string, obj pyObject) {
 	}
 }
 
-// iterate returns the result of the given expression as a pyList, which is our only iterable type.
+// iterate returns the result of the given expression as a pyList; lists and sets are our only iterable types.
 func (s *scope) iterate(expr *Expression) pyList {
-	o := s.interpretExpression(expr)
-	l, ok := o.(pyList)
-	if !ok {
-		if l, ok := o.(pyFrozenList); ok {
-			return l.pyList
-		}
+	return s.iterable(s.interpretExpression(expr))
+}
+
+// iterable returns the given object as a pyList to iterate over, or raises an error if it isn't a list or set.
+func (s *scope) iterable(o pyObject) pyList {
+	if set, ok := asSet(o); ok {
+		return set.items
 	}
-	s.Assert(ok, "Non-iterable type %s; must be a list", o.Type())
+	l, ok := asList(o)
+	s.Assert(ok, "Non-iterable type %s; must be a list or set", o.Type())
 	return l
 }
 
@@ -717,12 +858,56 @@ func stringLiteral(s string) string {
 
 // callObject attempts to call the given object
 func (s *scope) callObject(name string, obj pyObject, c *Call) pyObject {
+	f := s.callable(name, obj)
+	if done := s.enterCall(f); done != nil {
+		defer done()
+	}
+	return f.Call(s, c)
+}
+
+// callValues attempts to call the given object with a set of already evaluated arguments.
+func (s *scope) callValues(name string, obj pyObject, c *Call, args []pyObject) pyObject {
+	f := s.callable(name, obj)
+	if done := s.enterCall(f); done != nil {
+		defer done()
+	}
+	return f.callValues(s, c, args)
+}
+
+// callable returns the given object as a function, or raises an error if it isn't one.
+func (s *scope) callable(name string, obj pyObject) *pyFunc {
 	// We only allow function objects to be called, so don't bother making it part of the pyObject interface.
 	f, ok := obj.(*pyFunc)
 	if !ok {
 		s.Error("Non-callable object '%s' (is a %s)", name, obj.Type())
 	}
-	return f.Call(s, c)
+	return f
+}
+
+// enterCall records a call to the given function with the profiler and debugger, if they're in use.
+// It returns a function to call once the call is complete, or nil if there's nothing to do.
+func (s *scope) enterCall(f *pyFunc) func() {
+	p := s.interpreter.profiler
+	debug := s.thread != nil && f.nativeCode == nil
+	if s.Callback || (p == nil && !debug) {
+		return nil
+	}
+	caller := s.call
+	if p != nil {
+		s.call = p.Push(caller, functionFor(f))
+	}
+	if debug {
+		s.thread.Push(f.name)
+	}
+	return func() {
+		if debug {
+			s.thread.Pop()
+		}
+		if p != nil {
+			p.Pop(s.call)
+			s.call = caller
+		}
+	}
 }
 
 // Constant returns an object from an expression that describes a constant,
@@ -4,6 +4,8 @@
 package asp
 
 import (
+	"bytes"
+	"encoding/gob"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -147,7 +149,7 @@ func TestInterpreterSorting(t *testing.T) {
 	s, err := parseFile("src/parse/asp/test_data/interpreter/sorted.build")
 	require.NoError(t, err)
 	assert.Equal(t, pyList{pyInt(1), pyInt(2), pyInt(3)}, s.Lookup("y"))
-	// N.B. sorted() sorts in-place, unlike Python's one. We may change that later.
+	assert.Equal(t, pyList{pyInt(3), pyInt(2), pyInt(1)}, s.Lookup("x"))
 }
 
 func TestInterpreterUnpacking(t *testing.T) {
@@ -267,7 +269,7 @@ func TestInterpreterSubincludeConfig(t *testing.T) {
 	s, err := parseFile("src/parse/asp/test_data/interpreter/partition.build")
 	assert.NoError(t, err)
 	pkg := core.NewPackage("test")
-	s.SetAll(s.interpreter.Subinclude("src/parse/asp/test_data/interpreter/subinclude_config.build", pkg.Label(), pkg), false)
+	s.SetAll(s.interpreter.Subinclude(s, "src/parse/asp/test_data/interpreter/subinclude_config.build", pkg.Label(), pkg), false)
 	assert.EqualValues(t, "test test", s.config.Get("test", None))
 }
 
@@ -351,3 +353,164 @@ func TestDivide(t *testing.T) {
 	assert.EqualValues(t, 7, s.Lookup("j"))
 	assert.EqualValues(t, -2, s.Lookup("k"))
 }
+
+func TestStruct(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/struct.build")
+	require.NoError(t, err)
+	assert.EqualValues(t, "foo", s.Lookup("name"))
+	assert.EqualValues(t, pyList{pyString("a.go"), pyString("b.go")}, s.Lookup("srcs").(pyFrozenList).pyList)
+	assert.EqualValues(t, 3, s.Lookup("n"))
+	assert.EqualValues(t, True, s.Lookup("is_struct"))
+	assert.EqualValues(t, False, s.Lookup("is_dict"))
+	assert.EqualValues(t, True, s.Lookup("same"))
+	assert.EqualValues(t, False, s.Lookup("different"))
+	assert.EqualValues(t, "struct(n = 3, name = foo, srcs = [a.go b.go])", s.Lookup("string"))
+	assert.EqualValues(t, `{"n":3,"name":"foo","srcs":["a.go","b.go"]}`, s.Lookup("js"))
+}
+
+func TestStructIsImmutable(t *testing.T) {
+	_, err := parseFile("src/parse/asp/test_data/interpreter/struct_immutable.build")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "struct is immutable")
+}
+
+func TestStructGob(t *testing.T) {
+	var buf bytes.Buffer
+	var in pyObject = newPyStruct(pyDict{"name": pyString("foo"), "srcs": pyList{pyString("a.go")}})
+	require.NoError(t, gob.NewEncoder(&buf).Encode(&in))
+	var out pyObject
+	require.NoError(t, gob.NewDecoder(&buf).Decode(&out))
+	assert.Equal(t, "struct", out.Type())
+	assert.EqualValues(t, "foo", out.Property("name"))
+}
+
+func TestProviderData(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/provider_data.build")
+	require.NoError(t, err)
+	assert.EqualValues(t, "github.com/example/lib", s.Lookup("import_path"))
+	assert.Equal(t, None, s.Lookup("cc"))
+	target := s.pkg.Target("lib")
+	require.NotNil(t, target)
+	assert.Equal(t, s.Lookup("go"), target.ProviderData["go"])
+}
+
+func TestProviderDataMustBeStructs(t *testing.T) {
+	_, err := parseFile("src/parse/asp/test_data/interpreter/provider_data_not_struct.build")
+	assert.Error(t, err)
+}
+
+func TestReadFile(t *testing.T) {
+	pkg := core.NewPackage("src/parse/asp/test_data/interpreter")
+	s, _, err := parseFileToStatementsInPkg("src/parse/asp/test_data/interpreter/read_file.build", pkg)
+	require.NoError(t, err)
+	expected := pyDict{
+		"go":         pyString("1.15"),
+		"protoc":     pyDict{"version": pyString("3.12.4"), "patch": pyInt(2)},
+		"platforms":  pyList{pyString("linux_amd64"), pyString("darwin_amd64")},
+		"stable":     True,
+		"deprecated": None,
+	}
+	assert.EqualValues(t, expected, s.Lookup("json_versions"))
+	assert.EqualValues(t, expected, s.Lookup("yaml_versions"))
+	assert.Contains(t, string(s.Lookup("contents").(pyString)), `"protoc": {"version": "3.12.4", "patch": 2}`)
+	// versions.json is read twice but only recorded once.
+	require.Equal(t, 2, len(pkg.Reads))
+	assert.Equal(t, "src/parse/asp/test_data/interpreter/versions.json", pkg.Reads[0].Filename)
+	assert.Equal(t, "src/parse/asp/test_data/interpreter/versions.yaml", pkg.Reads[1].Filename)
+	assert.NotEmpty(t, pkg.Reads[0].Hash)
+}
+
+func TestReadFileOutsideRepo(t *testing.T) {
+	_, err := parseFile("src/parse/asp/test_data/interpreter/read_file_outside_repo.build")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "files must be within the repo")
+}
+
+func TestInterpreterSets(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/sets.build")
+	require.NoError(t, err)
+	assert.Equal(t, "{b, a, c}", s.Lookup("s").String())
+	assert.EqualValues(t, 3, s.Lookup("n"))
+	assert.EqualValues(t, True, s.Lookup("has_a"))
+	assert.EqualValues(t, True, s.Lookup("no_d"))
+	assert.Equal(t, "{b, a, c, d}", s.Lookup("union").String())
+	assert.Equal(t, "{b, c}", s.Lookup("difference").String())
+	assert.Equal(t, "{a}", s.Lookup("intersection").String())
+	assert.EqualValues(t, True, s.Lookup("equal"))
+	assert.EqualValues(t, pyList{pyString("z"), pyString("y")}, s.Lookup("items"))
+	assert.Equal(t, "set()", s.Lookup("empty").String())
+	assert.EqualValues(t, True, s.Lookup("is_set"))
+	assert.EqualValues(t, True, s.Lookup("list_is_tuple"))
+	assert.EqualValues(t, True, s.Lookup("tuple_is_tuple"))
+	assert.EqualValues(t, False, s.Lookup("set_is_tuple"))
+}
+
+func TestInterpreterSetErrors(t *testing.T) {
+	_, err := parseFile("src/parse/asp/test_data/interpreter/set_unhashable.build")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unhashable type: list")
+}
+
+func TestInterpreterSequenceBuiltins(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/sequences.build")
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, s.Lookup("min_list"))
+	assert.EqualValues(t, 3, s.Lookup("max_args"))
+	assert.EqualValues(t, "d", s.Lookup("min_key"))
+	assert.EqualValues(t, "abc", s.Lookup("max_key"))
+	assert.EqualValues(t, pyList{pyInt(3), pyInt(2), pyInt(1)}, s.Lookup("rev"))
+	assert.EqualValues(t, 6, s.Lookup("total"))
+	assert.EqualValues(t, pyList{pyString("a"), pyString("b")}, s.Lookup("concat"))
+	assert.EqualValues(t, pyList{pyString("a"), pyString("b")}.Freeze(), s.Lookup("tup"))
+	assert.EqualValues(t, pyList{pyInt(1), pyInt(2)}, s.Lookup("copied"))
+}
+
+func TestInterpreterTupleAssignment(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/tuple_assignment.build")
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, s.Lookup("a"))
+	assert.EqualValues(t, 1, s.Lookup("b"))
+	assert.EqualValues(t, pyList{pyString("x"), pyString("y")}, s.Lookup("c"))
+	assert.EqualValues(t, "p", s.Lookup("d"))
+	assert.EqualValues(t, "q", s.Lookup("e"))
+	assert.EqualValues(t, "f", s.Lookup("f"))
+	assert.EqualValues(t, "g", s.Lookup("g"))
+	assert.EqualValues(t, pyList{pyString("hi")}, s.Lookup("h"))
+	assert.EqualValues(t, pyList{pyString("s")}, s.Lookup("single"))
+	assert.EqualValues(t, True, s.Lookup("literal_is_tuple"))
+	assert.EqualValues(t, True, s.Lookup("bare_is_tuple"))
+}
+
+func TestInterpreterFormatting(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/formatting.build")
+	require.NoError(t, err)
+	assert.EqualValues(t, "x-3", s.Lookup("a"))
+	assert.EqualValues(t, "   ab|cd   |", s.Lookup("b"))
+	assert.EqualValues(t, "00042 ff FF 10 0o10 0xff", s.Lookup("c"))
+	assert.EqualValues(t, "x is 3", s.Lookup("d"))
+	assert.EqualValues(t, `"it's" ['a', 1]`, s.Lookup("e"))
+	assert.EqualValues(t, "50%", s.Lookup("f"))
+	assert.EqualValues(t, "None True 1", s.Lookup("g"))
+	assert.EqualValues(t, "ab", s.Lookup("h"))
+	assert.EqualValues(t, "Ab", s.Lookup("i"))
+	assert.EqualValues(t, `{"a": 1}`, s.Lookup("j"))
+	assert.EqualValues(t, "[a b]", s.Lookup("k"))
+}
+
+func TestInterpolateErrors(t *testing.T) {
+	assert.PanicsWithValue(t, "not enough arguments for format string", func() {
+		interpolate("%s %s", pyString("a"), 0)
+	})
+	assert.PanicsWithValue(t, "not all arguments converted during string formatting", func() {
+		interpolate("%s", pyList{pyString("a"), pyString("b")}, 0)
+	})
+	assert.PanicsWithValue(t, "%d format: a number is required, not str", func() {
+		interpolate("%d", pyString("a"), 0)
+	})
+	assert.PanicsWithValue(t, "unsupported format character 'z'", func() {
+		interpolate("%z", pyInt(1), 0)
+	})
+	assert.PanicsWithValue(t, "format requires a mapping", func() {
+		interpolate("%(a)s", pyString("a"), 0)
+	})
+}
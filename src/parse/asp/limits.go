@@ -0,0 +1,92 @@
+package asp
+
+// maxFoldSize is the largest string that we'll create while constant folding.
+// Anything bigger is left until runtime, where it's subject to the allocation limit.
+const maxFoldSize = 1024
+
+// maxInt is the largest value of an int.
+const maxInt = int(^uint(0) >> 1)
+
+// step records a step (a function call or loop iteration) against the package being parsed,
+// and raises an error if it's exceeded the configured limit.
+func (s *scope) step() {
+	if s.steps != nil {
+		*s.steps++
+		if max := s.state.Config.Parse.MaxSteps; max > 0 && *s.steps > max {
+			s.Error("Exceeded the maximum of %d steps while parsing this package (see parse.maxsteps in the config)", max)
+		}
+	}
+}
+
+// enterFunction returns the call depth for a function called from this scope, raising an error
+// if it's deeper than the configured limit.
+func (s *scope) enterFunction(name string) int {
+	if max := s.state.Config.Parse.MaxCallDepth; max > 0 && s.depth >= max {
+		s.Error("Exceeded the maximum call depth of %d calling %s (see parse.maxcalldepth in the config)", max, name)
+	}
+	return s.depth + 1
+}
+
+// checkAllocation raises an error if a list or string of the given length exceeds the configured limit.
+func (s *scope) checkAllocation(typ string, n int) {
+	if max := s.state.Config.Parse.MaxAllocation; max > 0 && n > max {
+		s.Error("Cannot create a %s of length %d; the maximum is %d (see parse.maxallocation in the config)", typ, n, max)
+	}
+}
+
+// operate applies a binary operator, checking the size of any list or string it would create first.
+func (s *scope) operate(op Operator, obj, operand pyObject) pyObject {
+	if str, ok := obj.(pyString); ok && op == Modulo {
+		return pyString(interpolate(string(str), operand, s.state.Config.Parse.MaxAllocation))
+	}
+	if n := allocationSize(op, obj, operand); n > 0 {
+		if _, ok := obj.(pyInt); ok {
+			s.checkAllocation(operand.Type(), n)
+		} else {
+			s.checkAllocation(obj.Type(), n)
+		}
+	}
+	return operate(op, obj, operand)
+}
+
+// allocationSize returns the length of the list or string that applying the given operator would create,
+// or 0 if it doesn't create one (or would fail anyway).
+func allocationSize(op Operator, obj, operand pyObject) int {
+	a, aok := length(obj)
+	switch op {
+	case Add:
+		if b, bok := length(operand); aok && bok {
+			return a + b
+		}
+	case Multiply:
+		if i, ok := operand.(pyInt); ok && aok {
+			return multiply(a, int(i))
+		} else if i, ok := obj.(pyInt); ok {
+			if b, bok := length(operand); bok {
+				return multiply(b, int(i))
+			}
+		}
+	}
+	return 0
+}
+
+// multiply multiplies two non-negative lengths, saturating instead of overflowing.
+func multiply(a, b int) int {
+	if a > 0 && b > maxInt/a {
+		return maxInt
+	}
+	return a * b
+}
+
+// length returns the length of a list or string, and false if the object is neither.
+func length(obj pyObject) (int, bool) {
+	switch o := obj.(type) {
+	case pyString:
+		return len(o), true
+	case pyList:
+		return len(o), true
+	case pyFrozenList:
+		return len(o.pyList), true
+	}
+	return 0, false
+}
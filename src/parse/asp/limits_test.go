@@ -0,0 +1,88 @@
+package asp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/rules"
+	"github.com/thought-machine/please/src/core"
+)
+
+// interpretWithLimits interprets the given file with the given configuration, either with or without bytecode.
+func interpretWithLimits(filename string, config *core.Configuration, bytecode bool) (*scope, error) {
+	parser := NewParser(core.NewBuildState(config))
+	parser.interpreter.disableBytecode = !bytecode
+	parser.MustLoadBuiltins("builtins.build_defs", nil, rules.MustAsset("builtins.build_defs.gob"))
+	statements, err := parser.parse(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parser.interpreter.interpretAll(core.NewPackage("test/package"), statements)
+}
+
+// assertLimitExceeded asserts that interpreting the given file fails with an error containing the given message,
+// and that the error carries the call stack.
+func assertLimitExceeded(t *testing.T, filename string, config *core.Configuration, message string, depth int) {
+	for _, bytecode := range []bool{true, false} {
+		_, err := interpretWithLimits(filename, config, bytecode)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), message)
+		stack, ok := err.(*errorStack)
+		require.True(t, ok, "Error should be an *errorStack, was %T", err)
+		assert.True(t, len(stack.Stack) >= depth, "Error should have at least %d stack frames, had %d", depth, len(stack.Stack))
+	}
+}
+
+func TestLimitsCallDepth(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Parse.MaxCallDepth = 50
+	assertLimitExceeded(t, "src/parse/asp/test_data/limits/recursion.build", config, "Exceeded the maximum call depth of 50 calling countdown", 2)
+}
+
+func TestLimitsAllocation(t *testing.T) {
+	config := core.DefaultConfiguration()
+	assertLimitExceeded(t, "src/parse/asp/test_data/limits/range.build", config, "Cannot create a list of length 100000000", 2)
+	assertLimitExceeded(t, "src/parse/asp/test_data/limits/string.build", config, "Cannot create a str of length 300000000", 2)
+	assertLimitExceeded(t, "src/parse/asp/test_data/limits/format.build", config, "Cannot create a str longer than 10000000 characters", 2)
+}
+
+func TestLimitsSteps(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Parse.MaxSteps = 100
+	assertLimitExceeded(t, "src/parse/asp/test_data/limits/steps.build", config, "Exceeded the maximum of 100 steps", 1)
+	// Steps are counted per package, so a new parse starts again from zero.
+	config.Parse.MaxSteps = 10000
+	s, err := interpretWithLimits("src/parse/asp/test_data/limits/steps.build", config, true)
+	require.NoError(t, err)
+	assert.EqualValues(t, pyInt(499500), s.Lookup("total"))
+}
+
+func TestLimitsDisabled(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Parse.MaxCallDepth = 0
+	config.Parse.MaxSteps = 0
+	config.Parse.MaxAllocation = 0
+	for _, bytecode := range []bool{true, false} {
+		s, err := interpretWithLimits("src/parse/asp/test_data/limits/within_limits.build", config, bytecode)
+		require.NoError(t, err)
+		assert.EqualValues(t, pyInt(55), s.Lookup("result"))
+		assert.Equal(t, 1099, len(s.Lookup("names").(pyString)))
+	}
+}
+
+func TestLimitsWithinDefaults(t *testing.T) {
+	for _, bytecode := range []bool{true, false} {
+		s, err := interpretWithLimits("src/parse/asp/test_data/limits/within_limits.build", core.DefaultConfiguration(), bytecode)
+		require.NoError(t, err)
+		assert.EqualValues(t, pyInt(55), s.Lookup("result"))
+	}
+}
+
+func TestRangeNegativeStep(t *testing.T) {
+	s := &scope{state: core.NewDefaultBuildState()}
+	assert.EqualValues(t, pyList{pyInt(5), pyInt(3), pyInt(1)}, pyRange(s, []pyObject{pyInt(5), pyInt(0), pyInt(-2)}))
+	assert.EqualValues(t, pyList{pyInt(0), pyInt(3), pyInt(6)}, pyRange(s, []pyObject{pyInt(0), pyInt(7), pyInt(3)}))
+	assert.EqualValues(t, pyList{}, pyRange(s, []pyObject{pyInt(5), pyInt(0), pyInt(1)}))
+}
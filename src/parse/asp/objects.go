@@ -1,6 +1,9 @@
 package asp
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"sort"
@@ -268,23 +271,7 @@ func (s pyString) Operator(operator Operator, operand pyObject) pyObject {
 	case GreaterThanOrEqual:
 		return newPyBool(s >= s2)
 	case Modulo:
-		if ok {
-			// Special case: "%s" % "x"
-			return pyString(fmt.Sprintf(string(s), s2))
-		} else if i, ok := operand.(pyInt); ok {
-			// Another one: "%d" % 4
-			return pyString(fmt.Sprintf(string(s), i))
-		}
-		l, ok := operand.(pyList)
-		if !ok {
-			panic("Argument to string interpolation must be a string or list; was " + operand.Type())
-		}
-		// Classic issue: can't use a []pyObject as a []interface{} :(
-		l2 := make([]interface{}, len(l))
-		for i, v := range l {
-			l2[i] = v
-		}
-		return pyString(fmt.Sprintf(string(s), l2...))
+		return pyString(interpolate(string(s), operand, 0))
 	case In:
 		return newPyBool(strings.Contains(string(s), string(s2)))
 	case NotIn:
@@ -303,6 +290,186 @@ func (s pyString) String() string {
 	return string(s)
 }
 
+// maxFormatWidth is the largest width or precision we allow in a format specifier.
+// It matches the limit in Go's fmt package.
+const maxFormatWidth = 1000000
+
+// interpolate implements Python's printf-style string formatting (i.e. "%s-%d" % ("a", 1)).
+// The operand is either a list of values to format, a dict if the format uses mapping keys
+// (e.g. "%(name)s"), or a single value. Since tuples are just lists, any list is taken as the
+// values to format rather than as a single value itself.
+// If limit is positive, it panics rather than create a string longer than it; the length can't be
+// known in advance since it depends on the widths in the format and the formatted values.
+func interpolate(format string, operand pyObject, limit int) string {
+	var args pyList
+	var mapping pyDict
+	if l, ok := asList(operand); ok {
+		args = l
+	} else if d, ok := asDict(operand); ok && strings.Contains(format, "%(") {
+		mapping = d
+	} else {
+		args = pyList{operand}
+	}
+	var b strings.Builder
+	used := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i >= len(format) {
+			panic("incomplete format")
+		} else if format[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		var arg pyObject
+		if format[i] == '(' {
+			end := strings.IndexByte(format[i:], ')')
+			if mapping == nil {
+				panic("format requires a mapping")
+			} else if end == -1 {
+				panic("incomplete format key")
+			}
+			key := format[i+1 : i+end]
+			v, present := mapping[key]
+			if !present {
+				panic("unknown dict key: " + key)
+			}
+			arg = v
+			i += end + 1
+		}
+		// Flags, then width and precision, then the conversion character.
+		start := i
+		for i < len(format) && strings.IndexByte("-+ 0#", format[i]) != -1 {
+			i++
+		}
+		flags := format[start:i]
+		var width, precision string
+		width, i = formatNumber(format, i)
+		if i < len(format) && format[i] == '.' {
+			precision, i = formatNumber(format, i+1)
+			precision = "." + precision
+		}
+		if i >= len(format) {
+			panic("incomplete format")
+		}
+		if arg == nil {
+			if used >= len(args) {
+				panic("not enough arguments for format string")
+			}
+			arg = args[used]
+			used++
+		}
+		value := formatValue(format[i], flags, width, precision, arg)
+		if limit > 0 && b.Len()+len(value) > limit {
+			panic(fmt.Sprintf("Cannot create a str longer than %d characters (see parse.maxallocation in the config)", limit))
+		}
+		b.WriteString(value)
+	}
+	if mapping == nil && used < len(args) {
+		panic("not all arguments converted during string formatting")
+	}
+	return b.String()
+}
+
+// formatNumber returns the width or precision of a format specifier starting at the given index,
+// and the index following it.
+func formatNumber(format string, i int) (string, int) {
+	start := i
+	for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+		i++
+	}
+	if i < len(format) && format[i] == '*' {
+		panic("* is not supported in format specifiers")
+	} else if n, _ := strconv.Atoi(format[start:i]); n > maxFormatWidth {
+		panic("width or precision in format specifier is too large")
+	}
+	return format[start:i], i
+}
+
+// formatValue formats a single value for interpolate.
+func formatValue(conversion byte, flags, width, precision string, arg pyObject) string {
+	switch conversion {
+	case 's', 'r', 'c':
+		// The numeric flags don't mean anything for strings; notably Go would pad with zeroes.
+		spec := "%" + strings.Trim(flags, "+ 0#") + width + precision + "s"
+		if conversion == 's' {
+			return fmt.Sprintf(spec, arg.String())
+		} else if conversion == 'r' {
+			return fmt.Sprintf(spec, repr(arg))
+		} else if i, ok := arg.(pyInt); ok {
+			return fmt.Sprintf(spec, string(rune(i)))
+		} else if s, ok := arg.(pyString); ok && len([]rune(string(s))) == 1 {
+			return fmt.Sprintf(spec, string(s))
+		}
+		panic("%c requires an int or a single character, not " + arg.Type())
+	case 'd', 'i', 'u', 'o', 'x', 'X':
+		var i pyInt
+		switch a := arg.(type) {
+		case pyInt:
+			i = a
+		case pyBool:
+			if a {
+				i = 1
+			}
+		default:
+			panic(fmt.Sprintf("%%%c format: a number is required, not %s", conversion, arg.Type()))
+		}
+		verb := string(conversion)
+		if conversion == 'i' || conversion == 'u' {
+			verb = "d"
+		} else if conversion == 'o' && strings.Contains(flags, "#") {
+			// Python's alternate form for octal is 0o, which Go spells %O.
+			verb = "O"
+			flags = strings.Replace(flags, "#", "", -1)
+		}
+		return fmt.Sprintf("%"+flags+width+precision+verb, int(i))
+	}
+	panic(fmt.Sprintf("unsupported format character '%c'", conversion))
+}
+
+// repr returns a representation of an object, as in Python's repr().
+// It differs from the object's String() in that strings are quoted, including when they're inside collections.
+func repr(obj pyObject) string {
+	switch o := obj.(type) {
+	case pyString:
+		quote := "'"
+		if strings.ContainsRune(string(o), '\'') && !strings.ContainsRune(string(o), '"') {
+			quote = `"`
+		}
+		r := strings.NewReplacer(`\`, `\\`, quote, `\`+quote, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+		return quote + r.Replace(string(o)) + quote
+	case pyList, pyFrozenList:
+		l, _ := asList(o)
+		return "[" + strings.Join(reprs(l), ", ") + "]"
+	case pyDict, pyFrozenDict:
+		d, _ := asDict(o)
+		items := make([]string, 0, len(d))
+		for _, k := range d.Keys() {
+			items = append(items, repr(pyString(k))+": "+repr(d[k]))
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	case *pySet, pyFrozenSet:
+		s, _ := asSet(o)
+		if len(s.items) == 0 {
+			return "set()"
+		}
+		return "{" + strings.Join(reprs(s.items), ", ") + "}"
+	}
+	return obj.String()
+}
+
+// reprs returns the repr of each of a series of objects.
+func reprs(l []pyObject) []string {
+	ret := make([]string, len(l))
+	for i, x := range l {
+		ret[i] = repr(x)
+	}
+	return ret
+}
+
 type pyList []pyObject
 
 func (l pyList) Type() string {
@@ -517,6 +684,290 @@ func (d pyFrozenDict) IndexAssign(index, value pyObject) {
 	panic("dict is immutable")
 }
 
+// A pySet is a set of hashable objects (i.e. strings, ints, bools and None).
+// Unlike in Python, sets iterate in the order items were first added to them, which keeps the
+// results of BUILD files deterministic.
+type pySet struct {
+	items []pyObject
+	index map[pyObject]struct{}
+}
+
+// newPySet creates a new set containing the given items.
+func newPySet(items ...pyObject) *pySet {
+	s := &pySet{index: make(map[pyObject]struct{}, len(items))}
+	for _, item := range items {
+		s.Add(item)
+	}
+	return s
+}
+
+// asSet returns the given object as a set, and false if it isn't one.
+func asSet(obj pyObject) (*pySet, bool) {
+	switch s := obj.(type) {
+	case *pySet:
+		return s, true
+	case pyFrozenSet:
+		return s.pySet, true
+	}
+	return nil, false
+}
+
+// checkHashable panics if the given object can't be added to a set.
+func checkHashable(obj pyObject) {
+	switch obj.(type) {
+	case pyString, pyInt, pyBool, pyNone:
+	default:
+		panic("unhashable type: " + obj.Type())
+	}
+}
+
+func (s *pySet) Type() string {
+	return "set"
+}
+
+func (s *pySet) IsTruthy() bool {
+	return len(s.items) > 0
+}
+
+func (s *pySet) Property(name string) pyObject {
+	if prop, present := setMethods[name]; present {
+		return prop.Member(s)
+	}
+	panic("set object has no property " + name)
+}
+
+func (s *pySet) Operator(operator Operator, operand pyObject) pyObject {
+	switch operator {
+	case In, NotIn:
+		checkHashable(operand)
+		return newPyBool(s.Contains(operand) == (operator == In))
+	case Union, Subtract:
+		s2, ok := asSet(operand)
+		if !ok {
+			panic(fmt.Sprintf("Operand to %s must be another set, not %s", operator, operand.Type()))
+		} else if operator == Union {
+			return s.Union(s2)
+		}
+		return s.Difference(s2)
+	}
+	panic("Unsupported operator on set: " + operator.String())
+}
+
+func (s *pySet) IndexAssign(index, value pyObject) {
+	panic("set type is not indexable")
+}
+
+func (s *pySet) String() string {
+	if len(s.items) == 0 {
+		return "set()"
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, item := range s.items {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(item.String())
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Add adds an item to this set, if it isn't already present.
+func (s *pySet) Add(item pyObject) {
+	checkHashable(item)
+	if _, present := s.index[item]; !present {
+		s.index[item] = struct{}{}
+		s.items = append(s.items, item)
+	}
+}
+
+// Contains returns true if the given item is in this set.
+func (s *pySet) Contains(item pyObject) bool {
+	_, present := s.index[item]
+	return present
+}
+
+// Equals returns true if this set contains the same items as another, regardless of their order.
+func (s *pySet) Equals(other *pySet) bool {
+	if len(s.items) != len(other.items) {
+		return false
+	}
+	for _, item := range s.items {
+		if !other.Contains(item) {
+			return false
+		}
+	}
+	return true
+}
+
+// Union returns a new set containing the items of both this set and another.
+func (s *pySet) Union(other *pySet) *pySet {
+	ret := newPySet(s.items...)
+	for _, item := range other.items {
+		ret.Add(item)
+	}
+	return ret
+}
+
+// Intersection returns a new set containing the items of this set that are also in another.
+func (s *pySet) Intersection(other *pySet) *pySet {
+	ret := newPySet()
+	for _, item := range s.items {
+		if other.Contains(item) {
+			ret.Add(item)
+		}
+	}
+	return ret
+}
+
+// Difference returns a new set containing the items of this set that aren't in another.
+func (s *pySet) Difference(other *pySet) *pySet {
+	ret := newPySet()
+	for _, item := range s.items {
+		if !other.Contains(item) {
+			ret.Add(item)
+		}
+	}
+	return ret
+}
+
+// Freeze freezes this set for further updates.
+// As for lists, this is a "soft" freeze; callers holding the original unfrozen
+// reference can still modify it.
+func (s *pySet) Freeze() pyObject {
+	return pyFrozenSet{pySet: s}
+}
+
+func (s *pySet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.items)
+}
+
+// GobEncode implements the gob.GobEncoder interface.
+func (s *pySet) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(pyList(s.items))
+	return buf.Bytes(), err
+}
+
+// GobDecode implements the gob.GobDecoder interface.
+func (s *pySet) GobDecode(b []byte) error {
+	var items pyList
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&items); err != nil {
+		return err
+	}
+	*s = *newPySet(items...)
+	return nil
+}
+
+// A pyFrozenSet implements an immutable set.
+type pyFrozenSet struct{ *pySet }
+
+func (s pyFrozenSet) Property(name string) pyObject {
+	if name == "add" {
+		panic("set is immutable")
+	}
+	return s.pySet.Property(name)
+}
+
+// Freeze returns this set, which is already frozen.
+func (s pyFrozenSet) Freeze() pyObject {
+	return s
+}
+
+// A pyStruct is an immutable record type, as created by the struct() builtin.
+// Its fields are accessed as properties (e.g. s.name) and can't be changed after creation.
+type pyStruct struct {
+	fields pyDict
+}
+
+// newPyStruct creates a new struct from the given fields, freezing any of them that can be.
+func newPyStruct(fields pyDict) *pyStruct {
+	for k, v := range fields {
+		if f, ok := v.(freezable); ok {
+			fields[k] = f.Freeze()
+		}
+	}
+	return &pyStruct{fields: fields}
+}
+
+func (s *pyStruct) Type() string {
+	return "struct"
+}
+
+func (s *pyStruct) IsTruthy() bool {
+	return true
+}
+
+func (s *pyStruct) Property(name string) pyObject {
+	if obj, present := s.fields[name]; present {
+		return obj
+	}
+	panic("struct has no field " + name)
+}
+
+func (s *pyStruct) Operator(operator Operator, operand pyObject) pyObject {
+	panic(fmt.Sprintf("operator %s not implemented on type struct", operator))
+}
+
+func (s *pyStruct) IndexAssign(index, value pyObject) {
+	panic("struct is immutable")
+}
+
+func (s *pyStruct) String() string {
+	var b strings.Builder
+	b.WriteString("struct(")
+	for i, k := range s.fields.Keys() {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(k)
+		b.WriteString(" = ")
+		b.WriteString(s.fields[k].String())
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+func (s *pyStruct) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.thaw())
+}
+
+// GobEncode implements the gob.GobEncoder interface.
+func (s *pyStruct) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(s.thaw())
+	return buf.Bytes(), err
+}
+
+// GobDecode implements the gob.GobDecoder interface.
+func (s *pyStruct) GobDecode(b []byte) error {
+	fields := pyDict{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&fields); err != nil {
+		return err
+	}
+	*s = *newPyStruct(fields)
+	return nil
+}
+
+// thaw returns a copy of this struct's fields with any frozen values unwrapped.
+// This is needed to serialise them since the frozen types don't have any exported fields.
+func (s *pyStruct) thaw() pyDict {
+	fields := make(pyDict, len(s.fields))
+	for k, v := range s.fields {
+		if l, ok := v.(pyFrozenList); ok {
+			fields[k] = l.pyList
+		} else if d, ok := v.(pyFrozenDict); ok {
+			fields[k] = d.pyDict
+		} else if set, ok := v.(pyFrozenSet); ok {
+			fields[k] = set.pySet
+		} else {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
 type pyFunc struct {
 	name       string
 	docstring  string
@@ -541,6 +992,8 @@ type pyFunc struct {
 	kwargsonly bool
 	// return type of the function
 	returnType string
+	// The definition of the function, if it's not native.
+	def *FuncDef
 }
 
 func newPyFunc(parentScope *scope, def *FuncDef) pyObject {
@@ -554,6 +1007,7 @@ func newPyFunc(parentScope *scope, def *FuncDef) pyObject {
 		code:       def.Statements,
 		kwargsonly: def.KeywordsOnly,
 		returnType: def.Return,
+		def:        def,
 	}
 	if def.Docstring != "" {
 		f.docstring = stringLiteral(def.Docstring)
@@ -605,45 +1059,60 @@ func (f *pyFunc) String() string {
 }
 
 func (f *pyFunc) Call(s *scope, c *Call) pyObject {
+	args := make([]pyObject, len(c.Arguments))
+	for i, a := range c.Arguments {
+		args[i] = s.interpretExpression(&a.Value)
+	}
+	return f.callValues(s, c, args)
+}
+
+// callValues calls this function with a set of already evaluated arguments, which correspond
+// to the arguments of the given call.
+func (f *pyFunc) callValues(s *scope, c *Call, values []pyObject) pyObject {
+	s.step()
 	if f.nativeCode != nil {
 		if f.kwargs {
-			return f.callNative(s.NewScope(), c)
+			return f.callNative(s.NewScope(), c, values)
 		}
-		return f.callNative(s, c)
+		return f.callNative(s, c, values)
 	}
 	s2 := f.scope.NewPackagedScope(s.pkg)
 	s2.config = s.config
 	s2.Set("CONFIG", s.config) // This needs to be copied across too :(
 	s2.Callback = s.Callback
+	s2.call = s.call
+	s2.thread = s.thread
+	s2.steps = s.steps
+	s2.depth = s.enterFunction(f.name)
+	args := make([]pyObject, len(f.args))
 	// Handle implicit 'self' parameter for bound functions.
-	args := c.Arguments
+	offset := 0
 	if f.self != nil {
-		args = append([]CallArgument{{
-			Value: Expression{Optimised: &OptimisedExpression{Constant: f.self}},
-		}}, args...)
+		args[0] = f.validateType(s, 0, f.self, Position{})
+		offset = 1
 	}
-	for i, a := range args {
+	for i, a := range c.Arguments {
 		if a.Name != "" { // Named argument
-			name := a.Name
-			idx, present := f.argIndices[name]
-			s.Assert(present || f.kwargs, "Unknown argument to %s: %s", f.name, name)
+			idx, present := f.argIndices[a.Name]
+			s.Assert(present || f.kwargs, "Unknown argument to %s: %s", f.name, a.Name)
 			if present {
-				name = f.args[idx]
+				args[idx] = f.validateType(s, idx, values[i], a.Value.Pos)
+			} else {
+				s2.Set(a.Name, values[i])
 			}
-			s2.Set(name, f.validateType(s, idx, &a.Value))
 		} else {
-			s.NAssert(i >= len(f.args), "Too many arguments to %s", f.name)
+			s.NAssert(i+offset >= len(f.args), "Too many arguments to %s", f.name)
 			s.NAssert(f.kwargsonly, "Function %s can only be called with keyword arguments", f.name)
-			s2.Set(f.args[i], f.validateType(s, i, &a.Value))
+			args[i+offset] = f.validateType(s, i+offset, values[i], a.Value.Pos)
 		}
 	}
 	// Now make sure any arguments with defaults are set, and check any others have been passed.
 	for i, a := range f.args {
-		if s2.LocalLookup(a) == nil {
-			s2.Set(a, f.defaultArg(s, i, a))
+		if args[i] == nil {
+			args[i] = f.defaultArg(s, i, a)
 		}
 	}
-	ret := s2.interpretStatements(f.code)
+	ret := f.run(s2, args)
 	if ret == nil {
 		return None // Implicit 'return None' in any function that didn't do that itself.
 	}
@@ -654,10 +1123,40 @@ func (f *pyFunc) Call(s *scope, c *Call) pyObject {
 	return ret
 }
 
+// run runs the body of this function in the given scope, with the given arguments.
+// It uses the function's bytecode if it's available, otherwise it interprets its statements.
+func (f *pyFunc) run(s *scope, args []pyObject) pyObject {
+	code := f.compiled(s)
+	if code == nil {
+		for i, arg := range args {
+			s.Set(f.args[i], arg)
+		}
+		return s.interpretStatements(f.code)
+	}
+	slots := make([]pyObject, len(code.Slots))
+	if code.ArgSlots {
+		copy(slots, args)
+	} else {
+		for i, arg := range args {
+			s.Set(f.args[i], arg)
+		}
+	}
+	return s.runBytecode(code, slots)
+}
+
+// compiled returns the bytecode for this function, or nil if it should be interpreted instead.
+// Functions are always interpreted while the debugger is in use so it can step through them.
+func (f *pyFunc) compiled(s *scope) *Bytecode {
+	if f.def == nil || s.interpreter.debugger != nil || s.interpreter.disableBytecode {
+		return nil
+	}
+	return f.def.compile()
+}
+
 // callNative implements the "calling convention" for functions implemented with native code.
 // For performance reasons these are done differently - rather then receiving a pointer to a scope
 // they receive their arguments as a slice, in which unpassed arguments are nil.
-func (f *pyFunc) callNative(s *scope, c *Call) pyObject {
+func (f *pyFunc) callNative(s *scope, c *Call, values []pyObject) pyObject {
 	args := make([]pyObject, len(f.args))
 	offset := 0
 	if f.self != nil {
@@ -667,18 +1166,20 @@ func (f *pyFunc) callNative(s *scope, c *Call) pyObject {
 	for i, a := range c.Arguments {
 		if a.Name != "" { // Named argument
 			if idx, present := f.argIndices[a.Name]; present {
-				args[idx] = f.validateType(s, idx, &a.Value)
+				args[idx] = f.validateType(s, idx, values[i], a.Value.Pos)
 			} else if f.kwargs {
-				s.Set(a.Name, s.interpretExpression(&a.Value))
+				s.Set(a.Name, values[i])
 			} else {
 				s.Error("Unknown argument to %s: %s", f.name, a.Name)
 			}
-		} else if i >= len(args) {
+		} else if i >= len(args) || (f.varargs && i > 0) {
+			// Varargs functions only take their first argument positionally; any others are passed
+			// after all the declared arguments, which can then only be given as keywords.
 			s.Assert(f.varargs, "Too many arguments to %s", f.name)
-			args = append(args, s.interpretExpression(&a.Value))
+			args = append(args, values[i])
 		} else {
 			s.NAssert(f.kwargsonly, "Function %s can only be called with keyword arguments", f.name)
-			args[i+offset] = f.validateType(s, i+offset, &a.Value)
+			args[i+offset] = f.validateType(s, i+offset, values[i], a.Value.Pos)
 		}
 	}
 
@@ -715,12 +1216,12 @@ func (f *pyFunc) Member(obj pyObject) pyObject {
 		varargs:    f.varargs,
 		kwargs:     f.kwargs,
 		self:       obj,
+		def:        f.def,
 	}
 }
 
 // validateType validates that this argument matches the given type
-func (f *pyFunc) validateType(s *scope, i int, expr *Expression) pyObject {
-	val := s.interpretExpression(expr)
+func (f *pyFunc) validateType(s *scope, i int, val pyObject, pos Position) pyObject {
 	if f.types[i] == nil {
 		return val
 	} else if val == None {
@@ -740,7 +1241,7 @@ func (f *pyFunc) validateType(s *scope, i int, expr *Expression) pyObject {
 		return val
 	}
 	defer func() {
-		panic(AddStackFrame(expr.Pos, recover()))
+		panic(AddStackFrame(pos, recover()))
 	}()
 	return s.Error("Invalid type for argument %s to %s; expected %s, was %s", f.args[i], f.name, strings.Join(f.types[i], " or "), actual)
 }
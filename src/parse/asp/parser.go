@@ -5,7 +5,9 @@ package asp
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"encoding/gob"
+	"fmt"
 	"io"
 	"os"
 	"strings"
@@ -25,6 +27,8 @@ func init() {
 	gob.Register(pyString(""))
 	gob.Register(pyList{})
 	gob.Register(pyDict{})
+	gob.Register(&pyStruct{})
+	gob.Register(&pySet{})
 }
 
 // A semaphore implements the standard synchronisation mechanism based on a buffered channel.
@@ -58,6 +62,31 @@ func newParser() *Parser {
 	}
 }
 
+// WriteProfile writes a pprof-compatible profile of BUILD file evaluation to the given writer,
+// followed by a summary of the n slowest packages and subincludes to the second one.
+// It returns an error if profiling wasn't enabled (via the ProfileParse field on the BuildState).
+func (p *Parser) WriteProfile(w, summary io.Writer, n int) error {
+	if p.interpreter.profiler == nil {
+		return fmt.Errorf("Parse profiling is not enabled")
+	}
+	p.interpreter.profiler.WriteSummary(summary, n)
+	return p.interpreter.profiler.WriteProfile(w)
+}
+
+// ConfigHash returns a hash of the configuration that is visible (as CONFIG) to the given package.
+func (p *Parser) ConfigHash(pkg *core.Package) []byte {
+	c := p.interpreter.pkgConfig(pkg)
+	keys := c.base.Keys()
+	h := sha1.New()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(c.base[k].String()))
+		h.Write([]byte{0})
+	}
+	return h.Sum(nil)
+}
+
 // LoadBuiltins instructs the parser to load rules from this file as built-ins.
 // Optionally the file contents can be supplied directly.
 // Also optionally a previously parsed form (acquired from ParseToFile) can be supplied.
@@ -137,6 +166,11 @@ func (p *Parser) ParseToFile(input, output string) error {
 			stmt.FuncDef.IsBuiltin = true
 		}
 	}
+	// Compile all the functions up front so they're stored ready to run.
+	WalkAST(stmts, func(def *FuncDef) bool {
+		def.compile()
+		return true
+	})
 	f, err := os.Create(output)
 	if err != nil {
 		return err
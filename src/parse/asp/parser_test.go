@@ -413,6 +413,20 @@ func TestDestructuringAssignment(t *testing.T) {
 	assert.Equal(t, 19, statements[0].EndPos.Column)
 }
 
+func TestTupleAssignment(t *testing.T) {
+	statements, err := newParser().parse("src/parse/asp/test_data/tuple_assign.build")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(statements))
+	assert.NotNil(t, statements[0].Ident.Unpack)
+	tuple := statements[0].Ident.Unpack.Expr.Val.List
+	assert.NotNil(t, tuple)
+	assert.Equal(t, 2, len(tuple.Values))
+	assert.Equal(t, "y", tuple.Values[0].Val.Ident.Name)
+	assert.Equal(t, "x", tuple.Values[1].Val.Ident.Name)
+	assert.Equal(t, 1, statements[0].EndPos.Line)
+	assert.Equal(t, 12, statements[0].EndPos.Column)
+}
+
 func TestMultipleActions(t *testing.T) {
 	statements, err := newParser().parse("src/parse/asp/test_data/multiple_action.build")
 	assert.NoError(t, err)
@@ -0,0 +1,296 @@
+package asp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A profiler collects timings and call counts while BUILD files are being evaluated.
+// Times are wall-clock but exclude any time spent waiting for targets to build (e.g. for subinclude()).
+type profiler struct {
+	mutex       sync.Mutex
+	root        profileNode
+	packages    map[string]time.Duration
+	subincludes map[string]time.Duration
+	start       time.Time
+}
+
+// A profileFunction identifies a single function (or package / subinclude) in the profile.
+type profileFunction struct {
+	Name     string
+	Filename string
+	Line     int
+}
+
+// A profileNode is a node in the call tree; it holds the aggregated totals for a single call stack.
+type profileNode struct {
+	function profileFunction
+	parent   *profileNode
+	children map[profileFunction]*profileNode
+	calls    int64
+	time     time.Duration // Self time, i.e. excluding any functions called from this one.
+}
+
+// A profileCall represents a single invocation of a function that is currently being profiled.
+// It is only ever accessed from the goroutine making the call.
+type profileCall struct {
+	node     *profileNode
+	parent   *profileCall
+	start    time.Time
+	children time.Duration // Time spent in functions called from this one.
+	waited   time.Duration // Time spent waiting for things outside the interpreter.
+}
+
+func newProfiler() *profiler {
+	return &profiler{
+		packages:    map[string]time.Duration{},
+		subincludes: map[string]time.Duration{},
+		start:       time.Now(),
+	}
+}
+
+// Push records the start of a call to the given function.
+func (p *profiler) Push(parent *profileCall, f profileFunction) *profileCall {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	parentNode := &p.root
+	if parent != nil {
+		parentNode = parent.node
+	}
+	node, present := parentNode.children[f]
+	if !present {
+		node = &profileNode{function: f, parent: parentNode}
+		if parentNode.children == nil {
+			parentNode.children = map[profileFunction]*profileNode{}
+		}
+		parentNode.children[f] = node
+	}
+	return &profileCall{node: node, parent: parent, start: time.Now()}
+}
+
+// Pop records the end of a call. It returns the total time spent in the call.
+func (p *profiler) Pop(call *profileCall) time.Duration {
+	total := time.Since(call.start) - call.waited
+	if call.parent != nil {
+		call.parent.children += total
+		call.parent.waited += call.waited
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	call.node.calls++
+	call.node.time += total - call.children
+	return total
+}
+
+// Wait records time that the given call spent waiting, which is excluded from its timings.
+func (call *profileCall) Wait(d time.Duration) {
+	if call != nil {
+		call.waited += d
+	}
+}
+
+// PushPackage records the start of evaluation of a BUILD file.
+func (p *profiler) PushPackage(pkg *core.Package) *profileCall {
+	return p.Push(nil, profileFunction{Name: profileName(pkg), Filename: pkg.Filename})
+}
+
+// PopPackage records the end of evaluation of a BUILD file.
+func (p *profiler) PopPackage(pkg *core.Package, call *profileCall) {
+	d := p.Pop(call)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.packages[profileName(pkg)] += d
+}
+
+// profileName returns the name we use for a package in the profile, e.g. //src/core.
+func profileName(pkg *core.Package) string {
+	return strings.TrimSuffix(pkg.Label().String(), ":all")
+}
+
+// PushSubinclude records the start of evaluation of a subinclude.
+func (p *profiler) PushSubinclude(parent *profileCall, label core.BuildLabel, filename string) *profileCall {
+	return p.Push(parent, profileFunction{Name: "subinclude " + label.String(), Filename: filename})
+}
+
+// PopSubinclude records the end of evaluation of a subinclude.
+func (p *profiler) PopSubinclude(label core.BuildLabel, call *profileCall) {
+	d := p.Pop(call)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.subincludes[label.String()] += d
+}
+
+// functionFor returns the profile function describing a pyFunc.
+func functionFor(f *pyFunc) profileFunction {
+	if len(f.code) == 0 {
+		return profileFunction{Name: f.name} // Native code, we don't know where it comes from.
+	}
+	pos := f.code[0].Pos
+	return profileFunction{Name: f.name, Filename: pos.Filename, Line: pos.Line}
+}
+
+// WriteSummary writes a human-readable summary of the n slowest packages and subincludes.
+func (p *profiler) WriteSummary(w io.Writer, n int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	writeSlowest(w, "packages", p.packages, n)
+	writeSlowest(w, "subincludes", p.subincludes, n)
+}
+
+func writeSlowest(w io.Writer, title string, times map[string]time.Duration, n int) {
+	names := make([]string, 0, len(times))
+	for name := range times {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if times[names[i]] != times[names[j]] {
+			return times[names[i]] > times[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > n {
+		names = names[:n]
+	}
+	fmt.Fprintf(w, "Slowest %s:\n", title)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %10s  %s\n", times[name].Round(time.Microsecond), name)
+	}
+}
+
+// WriteProfile writes the collected profile to the given writer in pprof's format
+// (a gzipped protobuf, see https://github.com/google/pprof/blob/master/proto/profile.proto).
+// Each function becomes a pprof function & location, and each distinct call stack a sample
+// with two values; the number of calls and the time spent in it.
+func (p *profiler) WriteProfile(w io.Writer) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	e := profileEncoder{strings: map[string]int64{"": 0}, stringTable: []string{""}, functions: map[profileFunction]uint64{}}
+	var prof bytes.Buffer
+	for _, vt := range [][2]string{{"calls", "count"}, {"time", "nanoseconds"}} {
+		var b bytes.Buffer
+		e.writeInt(&b, 1, e.str(vt[0]))
+		e.writeInt(&b, 2, e.str(vt[1]))
+		e.writeBytes(&prof, 1, b.Bytes()) // sample_type
+	}
+	e.writeSamples(&prof, &p.root)
+	// Now the locations and functions that the samples referred to.
+	functions := make([]profileFunction, len(e.functions))
+	for f, id := range e.functions {
+		functions[id-1] = f
+	}
+	for i, f := range functions {
+		id := int64(i + 1)
+		var line, loc bytes.Buffer
+		e.writeInt(&line, 1, id)
+		e.writeInt(&line, 2, int64(f.Line))
+		e.writeInt(&loc, 1, id)
+		e.writeBytes(&loc, 4, line.Bytes())
+		e.writeBytes(&prof, 4, loc.Bytes()) // location
+		var fn bytes.Buffer
+		e.writeInt(&fn, 1, id)
+		e.writeInt(&fn, 2, e.str(f.Name))
+		e.writeInt(&fn, 3, e.str(f.Name))
+		e.writeInt(&fn, 4, e.str(f.Filename))
+		e.writeInt(&fn, 5, int64(f.Line))
+		e.writeBytes(&prof, 5, fn.Bytes()) // function
+	}
+	defaultSampleType := e.str("time")
+	for _, s := range e.stringTable {
+		e.writeBytes(&prof, 6, []byte(s)) // string_table
+	}
+	e.writeInt(&prof, 9, p.start.UnixNano())          // time_nanos
+	e.writeInt(&prof, 10, int64(time.Since(p.start))) // duration_nanos
+	e.writeInt(&prof, 14, defaultSampleType)          // default_sample_type
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(prof.Bytes()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// A profileEncoder implements the small subset of protobuf encoding that we need to write pprof profiles.
+type profileEncoder struct {
+	strings     map[string]int64
+	stringTable []string
+	functions   map[profileFunction]uint64
+}
+
+// str returns the index of the given string in the string table, adding it if needed.
+func (e *profileEncoder) str(s string) int64 {
+	if idx, present := e.strings[s]; present {
+		return idx
+	}
+	idx := int64(len(e.stringTable))
+	e.strings[s] = idx
+	e.stringTable = append(e.stringTable, s)
+	return idx
+}
+
+// function returns the id of the given function, assigning one if needed.
+func (e *profileEncoder) function(f profileFunction) uint64 {
+	if id, present := e.functions[f]; present {
+		return id
+	}
+	id := uint64(len(e.functions) + 1)
+	e.functions[f] = id
+	return id
+}
+
+// writeSamples writes a sample for each node in the call tree below the given one.
+func (e *profileEncoder) writeSamples(w *bytes.Buffer, node *profileNode) {
+	children := make([]*profileNode, 0, len(node.children))
+	for _, child := range node.children {
+		children = append(children, child)
+	}
+	// Sort them so the output is deterministic.
+	sort.Slice(children, func(i, j int) bool {
+		a, b := children[i].function, children[j].function
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		} else if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Line < b.Line
+	})
+	for _, child := range children {
+		var locations, values, sample bytes.Buffer
+		for n := child; n.parent != nil; n = n.parent {
+			writeVarint(&locations, e.function(n.function)) // Leaf first, as pprof expects.
+		}
+		writeVarint(&values, uint64(child.calls))
+		writeVarint(&values, uint64(child.time))
+		e.writeBytes(&sample, 1, locations.Bytes())
+		e.writeBytes(&sample, 2, values.Bytes())
+		e.writeBytes(w, 2, sample.Bytes())
+		e.writeSamples(w, child)
+	}
+}
+
+// writeInt writes a varint field. Zero values are omitted, as protobuf would.
+func (e *profileEncoder) writeInt(w *bytes.Buffer, field int, value int64) {
+	if value != 0 {
+		writeVarint(w, uint64(field)<<3)
+		writeVarint(w, uint64(value))
+	}
+}
+
+// writeBytes writes a length-delimited field.
+func (e *profileEncoder) writeBytes(w *bytes.Buffer, field int, value []byte) {
+	writeVarint(w, uint64(field)<<3|2)
+	writeVarint(w, uint64(len(value)))
+	w.Write(value)
+}
+
+func writeVarint(w *bytes.Buffer, value uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], value)])
+}
@@ -0,0 +1,91 @@
+package asp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/rules"
+	"github.com/thought-machine/please/src/core"
+)
+
+func profileFile(t *testing.T, filename string) *Parser {
+	state := core.NewDefaultBuildState()
+	state.ProfileParse = true
+	parser := NewParser(state)
+	parser.MustLoadBuiltins("builtins.build_defs", nil, rules.MustAsset("builtins.build_defs.gob"))
+	statements, err := parser.parse(filename)
+	require.NoError(t, err)
+	_, err = parser.interpreter.interpretAll(core.NewPackage("test/package"), statements)
+	require.NoError(t, err)
+	return parser
+}
+
+func TestProfileCallTree(t *testing.T) {
+	p := profileFile(t, "src/parse/asp/test_data/interpreter/profile.build").interpreter.profiler
+	require.Equal(t, 1, len(p.root.children))
+	pkg := p.root.children[profileFunction{Name: "//test/package"}]
+	require.NotNil(t, pkg)
+	assert.EqualValues(t, 1, pkg.calls)
+	outer := pkg.children[profileFunction{Name: "outer", Filename: "src/parse/asp/test_data/interpreter/profile.build", Line: 5}]
+	require.NotNil(t, outer)
+	assert.EqualValues(t, 1, outer.calls)
+	inner := outer.children[profileFunction{Name: "inner", Filename: "src/parse/asp/test_data/interpreter/profile.build", Line: 2}]
+	require.NotNil(t, inner)
+	assert.EqualValues(t, 5, inner.calls)
+	assert.NotNil(t, outer.children[profileFunction{Name: "range"}])
+	assert.Contains(t, p.packages, "//test/package")
+}
+
+func TestProfileNotEnabled(t *testing.T) {
+	parser := NewParser(core.NewDefaultBuildState())
+	assert.Nil(t, parser.interpreter.profiler)
+	assert.Error(t, parser.WriteProfile(&bytes.Buffer{}, &bytes.Buffer{}, 10))
+}
+
+func TestWriteProfile(t *testing.T) {
+	parser := profileFile(t, "src/parse/asp/test_data/interpreter/profile.build")
+	var buf, summary bytes.Buffer
+	require.NoError(t, parser.WriteProfile(&buf, &summary, 10))
+	assert.Contains(t, summary.String(), "Slowest packages:\n")
+	assert.Contains(t, summary.String(), "//test/package\n")
+	assert.Contains(t, summary.String(), "Slowest subincludes:\n")
+
+	r, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	// Decode just enough of the protobuf to check the top-level fields.
+	fields := map[uint64]int{}
+	strings := []string{}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		require.True(t, n > 0)
+		b = b[n:]
+		field, wireType := tag>>3, tag&7
+		fields[field]++
+		value, n := binary.Uvarint(b)
+		require.True(t, n > 0)
+		b = b[n:]
+		if wireType == 2 {
+			if field == 6 {
+				strings = append(strings, string(b[:value]))
+			}
+			b = b[value:]
+		}
+	}
+	assert.Equal(t, 2, fields[1])   // sample_type
+	assert.Equal(t, 4, fields[2])   // sample: package, outer, inner and range
+	assert.Equal(t, 4, fields[4])   // location
+	assert.Equal(t, 4, fields[5])   // function
+	assert.Equal(t, 1, fields[14])  // default_sample_type
+	assert.Equal(t, "", strings[0]) // string_table must start with the empty string
+	assert.Contains(t, strings, "outer")
+	assert.Contains(t, strings, "inner")
+	assert.Contains(t, strings, "nanoseconds")
+}
@@ -0,0 +1,197 @@
+package asp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thought-machine/please/src/auth"
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// httpClient is the shared http client that we use for downloading subincludes.
+var httpClient http.Client
+var httpClientOnce sync.Once
+var httpClientErr error // Set if we fail to set up the client (e.g. invalid credentials)
+
+// isURL returns true if the given argument to subinclude() is a URL rather than a build label.
+func isURL(target string) bool {
+	return strings.HasPrefix(target, "https://") || strings.HasPrefix(target, "http://")
+}
+
+// subincludeURL implements subinclude() for a URL.
+// The file is stored in the subinclude dir under its hash, so it's only downloaded once
+// (and can be shared between repos); after that it's verified and interpreted like any other subinclude.
+func (s *scope) subincludeURL(url string, hashes, mirrors []string) {
+	s.Assert(len(hashes) > 0, "Must pass hashes to subinclude() a URL")
+	hs := make([]urlHash, len(hashes))
+	for i, h := range hashes {
+		uh, err := parseURLHash(h)
+		s.Assert(err == nil, "Invalid hash for %s: %s", url, err)
+		hs[i] = uh
+	}
+	filename, err := s.fetchURL(url, hs, mirrors)
+	if err != nil {
+		s.Error("Failed to subinclude %s: %s", url, err)
+	}
+	// There isn't really a label for this, but it's useful for the profiler & debugger to have something.
+	label := core.BuildLabel{PackageName: "", Name: path.Base(url)}
+	s.SetAll(s.interpreter.Subinclude(s, filename, label, s.contextPkg), false)
+}
+
+// fetchURL returns the path to a file in the subinclude dir matching one of the given hashes,
+// downloading it from the URL (or any of the mirrors) if needed.
+func (s *scope) fetchURL(url string, hashes []urlHash, mirrors []string) (string, error) {
+	dir := subincludeDir(s.state.Config)
+	for _, h := range hashes {
+		filename := path.Join(dir, h.Hex)
+		if contents, err := ioutil.ReadFile(filename); err == nil {
+			if h.Matches(contents) {
+				return filename, nil
+			}
+			log.Warning("Contents of %s don't match its hash, will download it again", filename)
+		}
+	}
+	if s.state.Config.Parse.Offline {
+		return "", fmt.Errorf("it isn't in %s and parse.offline is set", dir)
+	}
+	if s.interpreter.profiler != nil && !s.Callback {
+		// Don't count the time spent downloading in the profile.
+		defer func(start time.Time) { s.call.Wait(time.Since(start)) }(time.Now())
+	}
+	// Release the parallelism limiter while we download, as for waiting on subinclude targets.
+	s.interpreter.limiter.Release()
+	defer s.interpreter.limiter.Acquire()
+	errs := []string{}
+	for _, u := range append([]string{url}, mirrors...) {
+		contents, err := download(s.state, u)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		for _, h := range hashes {
+			if h.Matches(contents) {
+				filename := path.Join(dir, h.Hex)
+				return filename, fs.WriteFile(bytes.NewReader(contents), filename, 0644)
+			}
+		}
+		errs = append(errs, fmt.Sprintf("Bad hash for %s: was %s but expected one of [%s]", u, hashes[0].Of(contents), strings.Join(urlHashStrings(hashes), ", ")))
+	}
+	return "", fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// subincludeDir returns the directory to store files subincluded from URLs in.
+// If none is configured (e.g. because we couldn't find the user's cache dir), they go in plz-out.
+func subincludeDir(config *core.Configuration) string {
+	if config.Parse.SubincludeDir == "" {
+		return path.Join(core.OutDir, "subincludes")
+	}
+	return fs.ExpandHomePath(config.Parse.SubincludeDir)
+}
+
+// download downloads a single URL and returns its contents.
+func download(state *core.BuildState, url string) ([]byte, error) {
+	httpClientOnce.Do(func() {
+		var transport *http.Transport
+		if state.Config.Build.HTTPProxy != "" {
+			transport = &http.Transport{
+				Proxy: http.ProxyURL(state.Config.Build.HTTPProxy.AsURL()),
+			}
+		}
+		creds, err := auth.FromConfig(state.Config)
+		if err != nil {
+			httpClientErr = err
+			return
+		}
+		httpClient.Transport = creds.Transport(transport)
+		httpClient.Timeout = time.Duration(state.Config.Build.Timeout)
+	})
+	if httpClientErr != nil {
+		return nil, httpClientErr
+	}
+	log.Notice("Downloading subinclude %s", url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("please.build/%s", core.PleaseVersion))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("Error retrieving %s: %s", url, resp.Status)
+	}
+	max := state.Config.Parse.MaxAllocation
+	if max <= 0 {
+		return ioutil.ReadAll(resp.Body)
+	} else if resp.ContentLength > int64(max) {
+		return nil, fmt.Errorf("%s is too large (%d bytes)", url, resp.ContentLength)
+	}
+	// The server doesn't have to tell us the length (or tell the truth about it), so check as we read too.
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(max)+1))
+	if err != nil {
+		return nil, err
+	} else if len(b) > max {
+		return nil, fmt.Errorf("%s is too large (more than %d bytes)", url, max)
+	}
+	return b, nil
+}
+
+// A urlHash is one of the hashes passed to subinclude() for a URL.
+type urlHash struct {
+	Hex string
+	New func() hash.Hash
+}
+
+// parseURLHash parses a hash passed to subinclude().
+// As for remote_file, they can have an optional prefix before a colon which is ignored; the algorithm
+// (SHA-1 or SHA-256) is determined by their length.
+func parseURLHash(h string) (urlHash, error) {
+	if index := strings.LastIndexByte(h, ':'); index != -1 {
+		h = strings.TrimSpace(h[index+1:])
+	}
+	h = strings.ToLower(h)
+	if _, err := hex.DecodeString(h); err != nil {
+		return urlHash{}, fmt.Errorf("%s is not a hex-encoded hash", h)
+	}
+	switch len(h) {
+	case 2 * sha1.Size:
+		return urlHash{Hex: h, New: sha1.New}, nil
+	case 2 * sha256.Size:
+		return urlHash{Hex: h, New: sha256.New}, nil
+	}
+	return urlHash{}, fmt.Errorf("%s is not a SHA-1 or SHA-256 hash", h)
+}
+
+// Of returns the hex-encoded hash of the given contents, using this hash's algorithm.
+func (h urlHash) Of(contents []byte) string {
+	hasher := h.New()
+	hasher.Write(contents)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// Matches returns true if the given contents match this hash.
+func (h urlHash) Matches(contents []byte) bool {
+	return h.Of(contents) == h.Hex
+}
+
+func urlHashStrings(hashes []urlHash) []string {
+	ret := make([]string, len(hashes))
+	for i, h := range hashes {
+		ret[i] = h.Hex
+	}
+	return ret
+}
@@ -0,0 +1,173 @@
+package asp
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/rules"
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+const remoteDefs = `
+def remote_rule(name):
+    return "remote_" + name
+`
+
+var remoteDefsSHA256 = sha256.Sum256([]byte(remoteDefs))
+var remoteDefsSHA1 = sha1.Sum([]byte(remoteDefs))
+
+// newRemoteServer returns a server that serves the remote defs at /defs.build_defs, counting requests to it.
+func newRemoteServer(requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if r.URL.Path != "/defs.build_defs" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(remoteDefs))
+	}))
+}
+
+// interpretRemote interprets the given source, using the given dir to store subincludes.
+func interpretRemote(t *testing.T, src, dir string, offline bool) (*scope, error) {
+	state := core.NewDefaultBuildState()
+	state.Config.Parse.SubincludeDir = dir
+	state.Config.Parse.Offline = offline
+	parser := NewParser(state)
+	parser.MustLoadBuiltins("builtins.build_defs", nil, rules.MustAsset("builtins.build_defs.gob"))
+	statements, err := parser.ParseData([]byte(src), "BUILD")
+	require.NoError(t, err)
+	parser.limiter.Acquire()
+	defer parser.limiter.Release()
+	return parser.interpreter.interpretAll(core.NewPackage("test/package"), statements)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "subincludes")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestSubincludeURL(t *testing.T) {
+	var requests int32
+	srv := newRemoteServer(&requests)
+	defer srv.Close()
+	dir := tempDir(t)
+	src := fmt.Sprintf("subinclude(%q, hashes=[\"sha256: %x\"])\nx = remote_rule('test')\n", srv.URL+"/defs.build_defs", remoteDefsSHA256)
+	s, err := interpretRemote(t, src, dir, false)
+	require.NoError(t, err)
+	assert.EqualValues(t, pyString("remote_test"), s.Lookup("x"))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&requests))
+	assert.True(t, fs.FileExists(path.Join(dir, hex.EncodeToString(remoteDefsSHA256[:]))))
+
+	// The second time round it should come from the subinclude dir.
+	s, err = interpretRemote(t, src, dir, false)
+	require.NoError(t, err)
+	assert.EqualValues(t, pyString("remote_test"), s.Lookup("x"))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&requests))
+}
+
+func TestSubincludeURLSHA1(t *testing.T) {
+	var requests int32
+	srv := newRemoteServer(&requests)
+	defer srv.Close()
+	src := fmt.Sprintf("subinclude(%q, hashes=[%q])\nx = remote_rule('test')\n", srv.URL+"/defs.build_defs", hex.EncodeToString(remoteDefsSHA1[:]))
+	s, err := interpretRemote(t, src, tempDir(t), false)
+	require.NoError(t, err)
+	assert.EqualValues(t, pyString("remote_test"), s.Lookup("x"))
+}
+
+func TestSubincludeURLBadHash(t *testing.T) {
+	var requests int32
+	srv := newRemoteServer(&requests)
+	defer srv.Close()
+	dir := tempDir(t)
+	src := fmt.Sprintf("subinclude(%q, hashes=[%q])\n", srv.URL+"/defs.build_defs", hex.EncodeToString(make([]byte, sha256.Size)))
+	_, err := interpretRemote(t, src, dir, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Bad hash")
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 0, len(files), "Nothing should be stored if the hash doesn't match")
+}
+
+func TestSubincludeURLNoHashes(t *testing.T) {
+	_, err := interpretRemote(t, "subinclude('https://example.com/defs.build_defs')\n", tempDir(t), false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Must pass hashes")
+}
+
+func TestSubincludeURLMirrors(t *testing.T) {
+	var requests int32
+	srv := newRemoteServer(&requests)
+	defer srv.Close()
+	src := fmt.Sprintf("subinclude(%q, hashes=[\"%x\"], mirrors=[%q])\nx = remote_rule('test')\n", srv.URL+"/missing.build_defs", remoteDefsSHA256, srv.URL+"/defs.build_defs")
+	s, err := interpretRemote(t, src, tempDir(t), false)
+	require.NoError(t, err)
+	assert.EqualValues(t, pyString("remote_test"), s.Lookup("x"))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&requests))
+}
+
+func TestSubincludeURLOffline(t *testing.T) {
+	var requests int32
+	srv := newRemoteServer(&requests)
+	defer srv.Close()
+	dir := tempDir(t)
+	src := fmt.Sprintf("subinclude(%q, hashes=[\"%x\"])\nx = remote_rule('test')\n", srv.URL+"/defs.build_defs", remoteDefsSHA256)
+	_, err := interpretRemote(t, src, dir, true)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "parse.offline is set")
+	assert.EqualValues(t, 0, atomic.LoadInt32(&requests))
+
+	// Once it's in the subinclude dir it can be used offline.
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, hex.EncodeToString(remoteDefsSHA256[:])), []byte(remoteDefs), 0644))
+	s, err := interpretRemote(t, src, dir, true)
+	require.NoError(t, err)
+	assert.EqualValues(t, pyString("remote_test"), s.Lookup("x"))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&requests))
+}
+
+func TestSubincludeURLWithLabels(t *testing.T) {
+	_, err := interpretRemote(t, "subinclude('//build_defs:go', hashes=['abc'])\n", tempDir(t), false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can only be passed to subinclude() with a URL")
+}
+
+func TestDownloadTooLarge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Flushing first means it's sent chunked, so the client doesn't know the length up front.
+		w.(http.Flusher).Flush()
+		w.Write(make([]byte, 200))
+	}))
+	defer srv.Close()
+	state := core.NewDefaultBuildState()
+	state.Config.Parse.MaxAllocation = 100
+	_, err := download(state, srv.URL)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "too large")
+	state.Config.Parse.MaxAllocation = 200
+	b, err := download(state, srv.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, len(b))
+}
+
+func TestSubincludeDirDefault(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Parse.SubincludeDir = ""
+	assert.Equal(t, "plz-out/subincludes", subincludeDir(config))
+	config.Parse.SubincludeDir = "/tmp/subincludes"
+	assert.Equal(t, "/tmp/subincludes", subincludeDir(config))
+}
@@ -62,6 +62,8 @@ const (
 	configBuildRuleArgIdx
 	exitOnErrorArgIdx
 	entryPointsArgIdx
+	testServicesArgIdx
+	providerDataArgIdx
 )
 
 // createTarget creates a new build target as part of build_rule().
@@ -100,6 +102,14 @@ func createTarget(s *scope, args []pyObject) *core.BuildTarget {
 	target.Local = isTruthy(localBuildRuleArgIdx)
 	target.ExitOnError = isTruthy(exitOnErrorArgIdx)
 	target.RuleMetadata = args[configBuildRuleArgIdx]
+	if providerData, ok := asDict(args[providerDataArgIdx]); ok {
+		target.ProviderData = make(map[string]interface{}, len(providerData))
+		for k, v := range providerData {
+			_, ok := v.(*pyStruct)
+			s.Assert(ok, "Values of provider_data must be structs, not %s", v.Type())
+			target.ProviderData[k] = v
+		}
+	}
 	for _, o := range asStringList(s, args[outDirsBuildRuleArgIdx], "output_dirs") {
 		target.AddOutputDirectory(o)
 	}
@@ -224,6 +234,7 @@ func populateTarget(s *scope, t *core.BuildTarget, args []pyObject) {
 		t.Visibility = append(t.Visibility, parseVisibility(s, str))
 	})
 	addEntryPoints(s, args[entryPointsArgIdx], t)
+	addTestServices(s, args[testServicesArgIdx], t)
 	addMaybeNamedSecret(s, "secrets", args[secretsBuildRuleArgIdx], t.AddSecret, t.AddNamedSecret, t, true)
 	addProvides(s, "provides", args[providesBuildRuleArgIdx], t)
 	if f := callbackFunction(s, "pre_build", args[preBuildBuildRuleArgIdx], 1, "argument"); f != nil {
@@ -367,6 +378,14 @@ func addDependencies(s *scope, name string, obj pyObject, target *core.BuildTarg
 	})
 }
 
+// addTestServices adds the services that a test needs running while it runs.
+func addTestServices(s *scope, obj pyObject, target *core.BuildTarget) {
+	addStrings(s, "test_services", obj, func(str string) {
+		s.Assert(target.IsTest, "test_services can only be given for tests")
+		target.AddTestService(checkLabel(s, core.ParseBuildLabelContext(str, s.pkg)))
+	})
+}
+
 // addStrings adds an arbitrary set of strings to the target (e.g. labels etc).
 func addStrings(s *scope, name string, obj pyObject, f func(string)) {
 	if obj != nil && obj != None {
@@ -79,7 +79,9 @@ func walkAST(v reflect.Value, nodeType reflect.Type, callback reflect.Value) {
 		return true
 	}
 
-	if v.Kind() == reflect.Ptr && !v.IsNil() {
+	if v.Type() == bytecodeType {
+		return // Compiled from the AST, so there's nothing more to find in here.
+	} else if v.Kind() == reflect.Ptr && !v.IsNil() {
 		walkAST(v.Elem(), nodeType, callback)
 	} else if v.Kind() == reflect.Slice {
 		for i := 0; i < v.Len(); i++ {
@@ -88,7 +90,9 @@ func walkAST(v reflect.Value, nodeType reflect.Type, callback reflect.Value) {
 	} else if v.Kind() == reflect.Struct {
 		if call(v.Addr()) {
 			for i := 0; i < v.NumField(); i++ {
-				walkAST(v.Field(i), nodeType, callback)
+				if v.Type().Field(i).PkgPath == "" { // Skip unexported fields
+					walkAST(v.Field(i), nodeType, callback)
+				}
 			}
 		}
 	}
@@ -0,0 +1,196 @@
+package asp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// runBytecode runs a compiled function body in this scope, with the given slots for its local variables.
+// Like interpretStatements, it returns nil if the function finishes without an explicit return.
+func (s *scope) runBytecode(code *Bytecode, slots []pyObject) pyObject {
+	stack := make([]pyObject, 0, 16)
+	pc := 0
+	defer func() {
+		if r := recover(); r != nil {
+			panic(code.addStackFrames(pc, r))
+		}
+	}()
+	for ; pc < len(code.Instructions); pc++ {
+		in := &code.Instructions[pc]
+		top := len(stack) - 1
+		switch in.Op {
+		case opConst:
+			stack = append(stack, code.Constants[in.Arg])
+		case opLoadSlot:
+			obj := slots[in.Arg]
+			if obj == nil {
+				// Not assigned yet, so it may be defined in an enclosing scope.
+				obj = s.Lookup(code.Slots[in.Arg])
+			}
+			stack = append(stack, obj)
+		case opStoreSlot:
+			slots[in.Arg] = stack[top]
+			stack = stack[:top]
+		case opLoadName:
+			stack = append(stack, s.Lookup(code.Names[in.Arg]))
+		case opStoreName:
+			s.Set(code.Names[in.Arg], stack[top])
+			stack = stack[:top]
+		case opConfig:
+			stack = append(stack, s.config.Property(code.Names[in.Arg]))
+		case opPop:
+			stack = stack[:top]
+		case opDup2:
+			stack = append(stack, stack[top-1], stack[top])
+		case opOperator:
+			stack[top-1] = s.operate(Operator(in.Arg), stack[top-1], stack[top])
+			stack = stack[:top]
+		case opNot:
+			stack[top] = s.negate(stack[top])
+		case opNegate:
+			i, ok := stack[top].(pyInt)
+			s.Assert(ok, "Unary - can only be applied to an integer")
+			stack[top] = -i
+		case opJump:
+			pc = int(in.Arg) - 1
+		case opJumpIfFalse:
+			if !stack[top].IsTruthy() {
+				pc = int(in.Arg) - 1
+			}
+			stack = stack[:top]
+		case opJumpIfTrue:
+			if stack[top].IsTruthy() {
+				pc = int(in.Arg) - 1
+			}
+			stack = stack[:top]
+		case opJumpIfFalseOrPop:
+			if !stack[top].IsTruthy() {
+				pc = int(in.Arg) - 1
+			} else {
+				stack = stack[:top]
+			}
+		case opJumpIfTrueOrPop:
+			if stack[top].IsTruthy() {
+				pc = int(in.Arg) - 1
+			} else {
+				stack = stack[:top]
+			}
+		case opIndex:
+			stack[top-1] = stack[top-1].Operator(Index, stack[top])
+			stack = stack[:top]
+		case opSlice:
+			var start, end pyObject
+			if in.Arg&sliceEnd != 0 {
+				end = stack[top]
+				stack = stack[:top]
+				top--
+			}
+			if in.Arg&sliceStart != 0 {
+				start = stack[top]
+				stack = stack[:top]
+				top--
+			}
+			stack[top] = s.slice(stack[top], start, end)
+		case opProperty:
+			stack[top] = stack[top].Property(code.Names[in.Arg])
+		case opCall:
+			call := &code.Calls[in.Arg]
+			n := len(call.Call.Arguments)
+			f := top - n
+			stack[f] = s.callValues(call.Name, stack[f], &call.Call, stack[f+1:])
+			stack = stack[:f+1]
+		case opList:
+			n := int(in.Arg)
+			l := make(pyList, n)
+			copy(l, stack[len(stack)-n:])
+			stack = append(stack[:len(stack)-n], l)
+		case opDict:
+			n := 2 * int(in.Arg)
+			d := make(pyDict, in.Arg)
+			for i := len(stack) - n; i < len(stack); i += 2 {
+				d.IndexAssign(stack[i], stack[i+1])
+			}
+			stack = append(stack[:len(stack)-n], d)
+		case opListAppend:
+			idx := top - 1 - int(in.Arg)
+			stack[idx] = append(stack[idx].(pyList), stack[top])
+			stack = stack[:top]
+		case opDictSet:
+			stack[top-2-int(in.Arg)].IndexAssign(stack[top-1], stack[top])
+			stack = stack[:top-1]
+		case opFString:
+			f := code.FStrings[in.Arg]
+			n := 0
+			for _, v := range f.Vars {
+				if v.Config == "" {
+					n++
+				}
+			}
+			vars := stack[len(stack)-n:]
+			var b strings.Builder
+			for _, v := range f.Vars {
+				b.WriteString(v.Prefix)
+				if v.Config != "" {
+					b.WriteString(s.config.MustGet(v.Config).String())
+				} else {
+					b.WriteString(vars[0].String())
+					vars = vars[1:]
+				}
+			}
+			b.WriteString(f.Suffix)
+			stack = append(stack[:len(stack)-n], pyString(b.String()))
+		case opFunction:
+			stack = append(stack, newPyFunc(s, code.Functions[in.Arg]))
+		case opIterate:
+			stack[top] = s.iterable(stack[top])
+			stack = append(stack, pyInt(0))
+		case opForIter:
+			l := stack[top-1].(pyList)
+			i := stack[top].(pyInt)
+			if int(i) >= len(l) {
+				stack = stack[:top-1]
+				pc = int(in.Arg) - 1
+			} else {
+				s.step()
+				stack[top] = i + 1
+				stack = append(stack, l[i])
+			}
+		case opUnpack:
+			names := code.Unpacks[in.Arg]
+			l, ok := asList(stack[top])
+			s.Assert(ok, "Cannot unpack %s into %s", stack[top].Type(), names)
+			s.Assert(len(l) == len(names), "Incorrect number of values to unpack; expected %d, got %d", len(names), len(l))
+			stack = stack[:top]
+			for i := len(l) - 1; i >= 0; i-- {
+				stack = append(stack, l[i])
+			}
+		case opUnpackAssign:
+			l, ok := asList(stack[top])
+			s.Assert(ok, "Cannot unpack type %s", stack[top].Type())
+			s.Assert(len(l) == int(in.Arg), "Wrong number of items to unpack; expected %d, got %d", in.Arg, len(l))
+			stack = stack[:top]
+			for i := len(l) - 1; i >= 0; i-- {
+				stack = append(stack, l[i])
+			}
+		case opIndexAssign:
+			stack[top-2].IndexAssign(stack[top-1], stack[top])
+			stack = stack[:top-2]
+		case opReturn:
+			return stack[top]
+		case opRaise:
+			s.Error(stack[top].String())
+		}
+	}
+	return nil
+}
+
+// addStackFrames adds the positions of the given instruction to an error.
+func (code *Bytecode) addStackFrames(pc int, err interface{}) error {
+	for i := code.Instructions[pc].Pos; i >= 0; i = code.Positions[i].Parent {
+		err = AddStackFrame(code.Positions[i].Pos, err)
+	}
+	if e, ok := err.(error); ok {
+		return e
+	}
+	return fmt.Errorf("%s", err)
+}
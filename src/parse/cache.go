@@ -0,0 +1,375 @@
+package parse
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/thought-machine/please/rules"
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// parseCacheDir is the directory that the parse cache is stored in.
+var parseCacheDir = path.Join(core.OutDir, "parse_cache")
+
+// parseCacheMaxAge is how long an entry in the parse cache can go unused before it's removed.
+const parseCacheMaxAge = 7 * 24 * time.Hour
+
+var pruneParseCacheOnce sync.Once
+
+// A cacheEntry is what we store in the parse cache for each package.
+type cacheEntry struct {
+	// Hash of the BUILD file, the config it sees and the builtin rules.
+	Key []byte
+	// The package's (transitive) subincludes, and a hash of each of their outputs.
+	Subincludes      []core.BuildLabel
+	SubincludeHashes [][]byte
+	// The globs that were evaluated while parsing it.
+	Globs []core.PackageGlob
+	// The files that were read while parsing it.
+	Reads   []core.PackageRead
+	Targets []*core.BuildTarget
+	// Descriptions of the pre- and post-build functions of any targets that have them, keyed by target name.
+	// The functions themselves can't be stored so are recovered by re-interpreting the BUILD file if needed.
+	PreBuildFunctions, PostBuildFunctions map[string]string
+}
+
+// parseFile parses the BUILD file for a package, loading it from the parse cache if it's
+// enabled and the cached version is still valid.
+func parseFile(state *core.BuildState, pkg *core.Package) error {
+	if !state.Config.Parse.Cache || state.ProfileParse || state.DebugParsePort != 0 {
+		// The profiler and debugger need to see every package actually being interpreted.
+		return state.Parser.ParseFile(state, pkg, pkg.Filename)
+	}
+	p, ok := state.Parser.(*aspParser)
+	if !ok {
+		return state.Parser.ParseFile(state, pkg, pkg.Filename)
+	}
+	key, err := cacheKey(state, p, pkg)
+	if err != nil {
+		return err
+	}
+	pruneParseCacheOnce.Do(func() {
+		go pruneParseCache(parseCacheDir, parseCacheMaxAge)
+	})
+	if loadCachedPackage(state, pkg, key) {
+		log.Debug("Loaded %s from parse cache", pkg.Label())
+		return nil
+	}
+	if err := state.Parser.ParseFile(state, pkg, pkg.Filename); err != nil {
+		return err
+	}
+	if err := storeCachedPackage(state, pkg, key); err != nil {
+		log.Debug("Not storing %s in parse cache: %s", pkg.Label(), err)
+	}
+	return nil
+}
+
+// cacheFilename returns the file that we store the cache entry for a package in.
+func cacheFilename(pkg *core.Package) string {
+	h := sha1.Sum([]byte(pkg.Label().String()))
+	return path.Join(parseCacheDir, hex.EncodeToString(h[:]))
+}
+
+// pruneParseCache removes any entries in the parse cache that haven't been used for the given time.
+// Entries are rewritten or touched whenever they're used, so this catches packages that no longer exist.
+func pruneParseCache(dir string, maxAge time.Duration) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return // Most likely it doesn't exist yet.
+	}
+	for _, entry := range entries {
+		if time.Since(entry.ModTime()) > maxAge {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				log.Warning("Failed to remove old parse cache entry: %s", err)
+			}
+		}
+	}
+}
+
+// cacheKey returns the key for a package in the parse cache; this covers everything except the
+// subincludes & globs, which we only know about after it's been parsed.
+func cacheKey(state *core.BuildState, p *aspParser, pkg *core.Package) ([]byte, error) {
+	contents, err := ioutil.ReadFile(pkg.Filename)
+	if err != nil {
+		return nil, err
+	}
+	builtins, err := builtinsHash(state)
+	if err != nil {
+		return nil, err
+	}
+	h := sha1.New()
+	h.Write(builtins)
+	h.Write(p.asp.ConfigHash(pkg))
+	h.Write([]byte(packageConfig(state, pkg).Build.Arch.String()))
+	h.Write([]byte(pkg.Filename))
+	h.Write(contents)
+	return h.Sum(nil), nil
+}
+
+var builtinsHashOnce sync.Once
+var builtinsHashValue []byte
+var builtinsHashErr error
+
+// builtinsHash returns a hash of everything that is loaded before any BUILD file is, i.e. the
+// builtin rules and any preloaded build defs. It's only calculated once.
+func builtinsHash(state *core.BuildState) ([]byte, error) {
+	builtinsHashOnce.Do(func() {
+		h := sha1.New()
+		h.Write([]byte(core.PleaseVersion.String()))
+		dir, _ := rules.AssetDir("")
+		sort.Strings(dir)
+		for _, filename := range dir {
+			h.Write([]byte(filename))
+			h.Write(rules.MustAsset(filename))
+		}
+		for _, preload := range state.Config.Parse.PreloadBuildDefs {
+			contents, err := ioutil.ReadFile(preload)
+			if err != nil {
+				builtinsHashErr = err
+				return
+			}
+			h.Write([]byte(preload))
+			h.Write(contents)
+		}
+		builtinsHashValue = h.Sum(nil)
+	})
+	return builtinsHashValue, builtinsHashErr
+}
+
+// packageConfig returns the config that applies to the given package.
+func packageConfig(state *core.BuildState, pkg *core.Package) *core.Configuration {
+	if pkg.Subrepo != nil && pkg.Subrepo.State != nil {
+		return pkg.Subrepo.State.Config
+	}
+	return state.Config
+}
+
+// subincludeHash returns a hash of the outputs of a subincluded target, which must have been built.
+func subincludeHash(state *core.BuildState, target *core.BuildTarget) ([]byte, error) {
+	h := sha1.New()
+	for _, out := range target.FullOutputs() {
+		hash, err := state.PathHasher.Hash(out, false, true)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(hash)
+	}
+	return h.Sum(nil), nil
+}
+
+// readHash returns a hash of the contents of a file that was read while parsing a package.
+func readHash(filename string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum(contents)
+	return hash[:], nil
+}
+
+// isSamePackage returns true if the given label is in the given package.
+func isSamePackage(pkg *core.Package, label core.BuildLabel) bool {
+	return label.PackageName == pkg.Name && label.Subrepo == pkg.SubrepoName
+}
+
+// loadCachedPackage attempts to load a package from the parse cache.
+// It returns true if it was successfully loaded.
+func loadCachedPackage(state *core.BuildState, pkg *core.Package, key []byte) bool {
+	b, err := ioutil.ReadFile(cacheFilename(pkg))
+	if err != nil {
+		return false // Most likely it's just not been cached yet.
+	}
+	entry := &cacheEntry{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(entry); err != nil {
+		log.Warning("Failed to decode parse cache entry for %s: %s", pkg.Label(), err)
+		return false
+	} else if !bytes.Equal(entry.Key, key) || len(entry.Subincludes) != len(entry.SubincludeHashes) {
+		return false
+	}
+	config := packageConfig(state, pkg)
+	for _, g := range entry.Globs {
+		if !stringSlicesEqual(g.Result, fs.Glob(config.Parse.BuildFileName, g.Root, g.Include, g.Exclude, g.Hidden)) {
+			log.Debug("Glob results for %s have changed, not using parse cache", pkg.Label())
+			return false
+		}
+	}
+	for _, read := range entry.Reads {
+		if hash, err := readHash(read.Filename); err != nil || !bytes.Equal(hash, read.Hash) {
+			log.Debug("%s has changed, not using parse cache for %s", read.Filename, pkg.Label())
+			return false
+		}
+	}
+	for i, l := range entry.Subincludes {
+		if isSamePackage(pkg, l) {
+			return false // We'd deadlock waiting for this; shouldn't be in the cache anyway.
+		}
+		hash, err := subincludeHash(state, state.WaitForBuiltTarget(l, pkg.Label()))
+		if err != nil || !bytes.Equal(hash, entry.SubincludeHashes[i]) {
+			log.Debug("Subinclude %s of %s has changed, not using parse cache", l, pkg.Label())
+			return false
+		}
+	}
+	pkg.Subincludes = entry.Subincludes
+	pkg.Globs = entry.Globs
+	pkg.Reads = entry.Reads
+	callbacks := &packageCallbacks{state: state, pkg: pkg}
+	for _, target := range entry.Targets {
+		target.Subrepo = pkg.Subrepo
+		if description, present := entry.PreBuildFunctions[target.Label.Name]; present {
+			target.PreBuildFunction = &cachedPreBuildFunction{callbacks: callbacks, description: description}
+		}
+		if description, present := entry.PostBuildFunctions[target.Label.Name]; present {
+			target.PostBuildFunction = &cachedPostBuildFunction{callbacks: callbacks, description: description}
+		}
+		state.AddTarget(pkg, target)
+	}
+	// Mark it as recently used so it isn't pruned.
+	now := time.Now()
+	_ = os.Chtimes(cacheFilename(pkg), now, now)
+	return true
+}
+
+// storeCachedPackage stores a newly parsed package in the parse cache.
+func storeCachedPackage(state *core.BuildState, pkg *core.Package, key []byte) error {
+	if pkg.Uncacheable {
+		return fmt.Errorf("its BUILD file depends on things that can't be tracked")
+	}
+	entry := &cacheEntry{
+		Key:              key,
+		Subincludes:      pkg.Subincludes,
+		SubincludeHashes: make([][]byte, len(pkg.Subincludes)),
+		Globs:            pkg.Globs,
+		Reads:            pkg.Reads,
+		Targets:          pkg.AllTargets(),
+	}
+	for _, target := range entry.Targets {
+		if target.PreBuildFunction != nil {
+			if entry.PreBuildFunctions == nil {
+				entry.PreBuildFunctions = map[string]string{}
+			}
+			entry.PreBuildFunctions[target.Label.Name] = target.PreBuildFunction.String()
+		}
+		if target.PostBuildFunction != nil {
+			if entry.PostBuildFunctions == nil {
+				entry.PostBuildFunctions = map[string]string{}
+			}
+			entry.PostBuildFunctions[target.Label.Name] = target.PostBuildFunction.String()
+		}
+	}
+	for i, l := range pkg.Subincludes {
+		if isSamePackage(pkg, l) {
+			return fmt.Errorf("it subincludes %s from the same package", l)
+		}
+		target := state.Graph.Target(l)
+		if target == nil {
+			return fmt.Errorf("subinclude %s isn't in the graph", l)
+		}
+		hash, err := subincludeHash(state, target)
+		if err != nil {
+			return err
+		}
+		entry.SubincludeHashes[i] = hash
+	}
+	sort.Slice(entry.Targets, func(i, j int) bool { return entry.Targets[i].Label.Name < entry.Targets[j].Label.Name })
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return err
+	}
+	return fs.WriteFile(&buf, cacheFilename(pkg), 0644)
+}
+
+// packageCallbacks recovers the pre- and post-build functions of targets in a package that was
+// loaded from the parse cache. They're code in the interpreter so can't be stored; instead, the
+// first time one is needed we re-interpret the package's BUILD file (without adding the targets
+// it defines to the graph) and take them from the targets it creates. The cache key guarantees
+// that it defines the same targets as when it was stored.
+type packageCallbacks struct {
+	state    *core.BuildState
+	pkg      *core.Package
+	once     sync.Once
+	reparsed *core.Package
+	err      error
+}
+
+// target returns the re-interpreted version of the given target.
+func (c *packageCallbacks) target(label core.BuildLabel) (*core.BuildTarget, error) {
+	c.once.Do(func() {
+		log.Debug("Re-interpreting %s to recover build callbacks", c.pkg.Filename)
+		pkg := core.NewPackage(c.pkg.Name)
+		pkg.Subrepo = c.pkg.Subrepo
+		pkg.SubrepoName = c.pkg.SubrepoName
+		pkg.Filename = c.pkg.Filename
+		pkg.CallbacksOnly = true
+		c.err = c.state.Parser.ParseFile(c.state, pkg, pkg.Filename)
+		c.reparsed = pkg
+	})
+	if c.err != nil {
+		return nil, c.err
+	} else if target := c.reparsed.Target(label.Name); target != nil {
+		return target, nil
+	}
+	return nil, fmt.Errorf("%s is no longer defined by %s", label, c.pkg.Filename)
+}
+
+// A cachedPreBuildFunction is the pre-build function of a target loaded from the parse cache.
+type cachedPreBuildFunction struct {
+	callbacks   *packageCallbacks
+	description string
+}
+
+func (f *cachedPreBuildFunction) Call(target *core.BuildTarget) error {
+	t, err := f.callbacks.target(target.Label)
+	if err != nil {
+		return err
+	} else if t.PreBuildFunction == nil {
+		return fmt.Errorf("%s no longer has a pre-build function", target)
+	}
+	return t.PreBuildFunction.Call(target)
+}
+
+func (f *cachedPreBuildFunction) String() string {
+	return f.description
+}
+
+// A cachedPostBuildFunction is the post-build function of a target loaded from the parse cache.
+type cachedPostBuildFunction struct {
+	callbacks   *packageCallbacks
+	description string
+}
+
+func (f *cachedPostBuildFunction) Call(target *core.BuildTarget, output string) error {
+	t, err := f.callbacks.target(target.Label)
+	if err != nil {
+		return err
+	} else if t.PostBuildFunction == nil {
+		return fmt.Errorf("%s no longer has a post-build function", target)
+	}
+	return t.PostBuildFunction.Call(target, output)
+}
+
+func (f *cachedPostBuildFunction) String() string {
+	return f.description
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, x := range a {
+		if b[i] != x {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,210 @@
+package parse
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+const cacheTestBuildFile = `
+filegroup(
+    name = "files",
+    srcs = glob(["*.txt"]),
+)
+
+genrule(
+    name = "gen",
+    outs = ["gen.txt"],
+    cmd = "echo hello > $OUT",
+    labels = ["test"],
+)
+`
+
+// setupCacheTest creates a package directory & BUILD file, and points the parse cache at a temporary location.
+func setupCacheTest(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir(".", "parse_cache_test")
+	require.NoError(t, err)
+	cacheDir, err := ioutil.TempDir("", "parse_cache")
+	require.NoError(t, err)
+	oldCacheDir := parseCacheDir
+	parseCacheDir = cacheDir
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "BUILD"), []byte(contents), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "a.txt"), nil, 0644))
+	return path.Clean(dir), func() {
+		parseCacheDir = oldCacheDir
+		os.RemoveAll(dir)
+		os.RemoveAll(cacheDir)
+	}
+}
+
+func newCacheTestState() *core.BuildState {
+	state := core.NewDefaultBuildState()
+	state.Config.Parse.BuildFileName = []string{"BUILD"}
+	state.Config.Parse.Cache = true
+	InitParser(state)
+	return state
+}
+
+func newCacheTestPackage(dir string) *core.Package {
+	pkg := core.NewPackage(dir)
+	pkg.Filename = path.Join(dir, "BUILD")
+	return pkg
+}
+
+// loadFromCache attempts to load the given package from the cache with a new state.
+func loadFromCache(t *testing.T, dir string) (*core.Package, bool) {
+	state := newCacheTestState()
+	pkg := newCacheTestPackage(dir)
+	key, err := cacheKey(state, state.Parser.(*aspParser), pkg)
+	require.NoError(t, err)
+	return pkg, loadCachedPackage(state, pkg, key)
+}
+
+func TestParseCache(t *testing.T) {
+	dir, cleanup := setupCacheTest(t, cacheTestBuildFile)
+	defer cleanup()
+	state := newCacheTestState()
+	pkg := newCacheTestPackage(dir)
+	require.NoError(t, parseFile(state, pkg))
+	assert.Equal(t, 2, pkg.NumTargets())
+	assert.FileExists(t, cacheFilename(pkg))
+
+	cached, loaded := loadFromCache(t, dir)
+	require.True(t, loaded)
+	require.Equal(t, 2, cached.NumTargets())
+	files := cached.Target("files")
+	require.NotNil(t, files)
+	assert.True(t, files.IsFilegroup)
+	assert.Equal(t, pkg.Target("files").Sources, files.Sources)
+	gen := cached.Target("gen")
+	require.NotNil(t, gen)
+	assert.Equal(t, pkg.Target("gen").Command, gen.Command)
+	assert.Equal(t, []string{"test"}, gen.Labels)
+	assert.Equal(t, []string{"gen.txt"}, gen.DeclaredOutputs())
+	assert.Equal(t, gen, cached.Outputs["gen.txt"])
+}
+
+func TestParseCacheInvalidatedByGlob(t *testing.T) {
+	dir, cleanup := setupCacheTest(t, cacheTestBuildFile)
+	defer cleanup()
+	require.NoError(t, parseFile(newCacheTestState(), newCacheTestPackage(dir)))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "b.txt"), nil, 0644))
+	_, loaded := loadFromCache(t, dir)
+	assert.False(t, loaded)
+}
+
+func TestParseCacheInvalidatedByBuildFile(t *testing.T) {
+	dir, cleanup := setupCacheTest(t, cacheTestBuildFile)
+	defer cleanup()
+	require.NoError(t, parseFile(newCacheTestState(), newCacheTestPackage(dir)))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "BUILD"), []byte(cacheTestBuildFile+"\n# changed\n"), 0644))
+	_, loaded := loadFromCache(t, dir)
+	assert.False(t, loaded)
+}
+
+func TestParseCacheInvalidatedByRead(t *testing.T) {
+	dir, cleanup := setupCacheTest(t, cacheTestBuildFile+`
+versions = load_json("versions.json")
+`)
+	defer cleanup()
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "versions.json"), []byte(`{"go": 1}`), 0644))
+	pkg := newCacheTestPackage(dir)
+	require.NoError(t, parseFile(newCacheTestState(), pkg))
+	require.Equal(t, 1, len(pkg.Reads))
+	assert.Equal(t, path.Join(dir, "versions.json"), pkg.Reads[0].Filename)
+
+	cached, loaded := loadFromCache(t, dir)
+	assert.True(t, loaded)
+	assert.Equal(t, pkg.Reads, cached.Reads)
+
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "versions.json"), []byte(`{"go": 2}`), 0644))
+	_, loaded = loadFromCache(t, dir)
+	assert.False(t, loaded)
+}
+
+func TestParseCacheUncacheable(t *testing.T) {
+	dir, cleanup := setupCacheTest(t, cacheTestBuildFile+`
+subrepo(
+    name = "test_subrepo",
+    path = "test_subrepo",
+)
+`)
+	defer cleanup()
+	pkg := newCacheTestPackage(dir)
+	require.NoError(t, parseFile(newCacheTestState(), pkg))
+	assert.True(t, pkg.Uncacheable)
+	_, err := os.Stat(cacheFilename(pkg))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestParseCacheWithCallbacks(t *testing.T) {
+	dir, cleanup := setupCacheTest(t, `
+def make_rule(name, licence):
+    def _post_build(rule_name, output):
+        add_licence(rule_name, licence)
+    return genrule(
+        name = name,
+        outs = [name + ".txt"],
+        cmd = "echo hello > $OUT",
+        post_build = _post_build,
+    )
+
+make_rule("callback", "captured")
+`)
+	defer cleanup()
+	pkg := newCacheTestPackage(dir)
+	require.NoError(t, parseFile(newCacheTestState(), pkg))
+	assert.FileExists(t, cacheFilename(pkg))
+
+	state := newCacheTestState()
+	cached := newCacheTestPackage(dir)
+	key, err := cacheKey(state, state.Parser.(*aspParser), cached)
+	require.NoError(t, err)
+	require.True(t, loadCachedPackage(state, cached, key))
+	state.Graph.AddPackage(cached)
+	target := cached.Target("callback")
+	require.NotNil(t, target)
+	require.NotNil(t, target.PostBuildFunction)
+	assert.Equal(t, pkg.Target("callback").PostBuildFunction.String(), target.PostBuildFunction.String())
+	// Calling it should re-interpret the BUILD file to find the real function, including the
+	// values it closes over, and apply it to the target in the graph.
+	require.NoError(t, target.PostBuildFunction.Call(target, "hello"))
+	assert.Equal(t, []string{"captured"}, target.Licences)
+	assert.Equal(t, 1, len(state.Graph.AllTargets()))
+	assert.Equal(t, target, state.Graph.TargetOrDie(target.Label))
+}
+
+func TestParseCacheDisabledWhenProfiling(t *testing.T) {
+	dir, cleanup := setupCacheTest(t, cacheTestBuildFile)
+	defer cleanup()
+	state := core.NewDefaultBuildState()
+	state.Config.Parse.BuildFileName = []string{"BUILD"}
+	state.Config.Parse.Cache = true
+	state.ProfileParse = true
+	InitParser(state)
+	pkg := newCacheTestPackage(dir)
+	require.NoError(t, parseFile(state, pkg))
+	_, err := os.Stat(cacheFilename(pkg))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPruneParseCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parse_cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "new"), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "old"), nil, 0644))
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(path.Join(dir, "old"), old, old))
+	pruneParseCache(dir, time.Hour)
+	assert.FileExists(t, path.Join(dir, "new"))
+	_, err = os.Stat(path.Join(dir, "old"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -116,3 +116,19 @@ func createBazelSubrepo(state *core.BuildState) {
 		}
 	}
 }
+
+// WriteProfile writes a profile of BUILD file evaluation to the given file, and a summary of
+// the slowest packages and subincludes to the given writer.
+// The state must have had ProfileParse set before the parser was initialised.
+func WriteProfile(state *core.BuildState, filename string, summary io.Writer) error {
+	p, ok := state.Parser.(*aspParser)
+	if !ok {
+		return fmt.Errorf("Parser was not initialised")
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.asp.WriteProfile(f, summary, 10)
+}
@@ -57,6 +57,13 @@ func parse(tid int, state *core.BuildState, label, dependent core.BuildLabel, fo
 	if label.Subrepo != "" && label.PackageName == "" && label.Name == "" {
 		return nil
 	}
+	if skipMissingTarget(state, label, dependent) {
+		if filename, _ := buildFileName(state, label.PackageName, subrepo); filename == "" {
+			log.Warning("Skipping %s; its package no longer exists", label)
+			state.RemoveOriginalTarget(label)
+			return nil
+		}
+	}
 	if state.Config.FeatureFlags.RemovePleasings {
 		pkg, err = parsePackage(state, label, dependent, subrepo)
 	} else {
@@ -131,6 +138,10 @@ func activateTarget(tid int, state *core.BuildState, pkg *core.Package, label, d
 			// to load(). It suits us to treat that as though it is one, but we now have to
 			// implicitly make it available.
 			exportFile(state, pkg, label)
+		} else if skipMissingTarget(state, label, dependent) {
+			log.Warning("Skipping %s; it no longer exists", label)
+			state.RemoveOriginalTarget(label)
+			return nil
 		} else {
 			msg := fmt.Sprintf("Parsed build file %s but it doesn't contain target %s", pkg.Filename, label.Name)
 			if dependent != core.OriginalTarget {
@@ -168,6 +179,11 @@ func activateTarget(tid int, state *core.BuildState, pkg *core.Package, label, d
 	return nil
 }
 
+// skipMissingTarget returns true if the given target should be skipped if it doesn't exist.
+func skipMissingTarget(state *core.BuildState, label, dependent core.BuildLabel) bool {
+	return state.SkipMissingTargets && dependent == core.OriginalTarget && !label.IsAllTargets()
+}
+
 // parsePackage performs the initial parse of a package.
 func parsePackage(state *core.BuildState, label, dependent core.BuildLabel, subrepo *core.Subrepo) (*core.Package, error) {
 	packageName := label.PackageName
@@ -190,7 +206,7 @@ func parsePackage(state *core.BuildState, label, dependent core.BuildLabel, subr
 		return nil, fmt.Errorf("Can't build %s; the directory %s doesn't exist", label, dir)
 	}
 	pkg.Filename = filename
-	if err := state.Parser.ParseFile(state, pkg, pkg.Filename); err != nil {
+	if err := parseFile(state, pkg); err != nil {
 		return nil, err
 	}
 
@@ -229,7 +245,7 @@ func parsePackageWithPleasings(state *core.BuildState, label, dependent core.Bui
 		}
 	} else {
 		pkg.Filename = filename
-		if err := state.Parser.ParseFile(state, pkg, pkg.Filename); err != nil {
+		if err := parseFile(state, pkg); err != nil {
 			return nil, err
 		}
 	}
@@ -109,6 +109,24 @@ func TestAddParseDepDeferred(t *testing.T) {
 	assert.Equal(t, 2, state.NumActive())
 }
 
+func TestActivateMissingTarget(t *testing.T) {
+	state := makeState(true, false)
+	pkg := state.Graph.Package("package1", "")
+	label := buildLabel("//package1:target9")
+	state.AddOriginalTarget(label, true)
+	err := activateTarget(tid, state, pkg, label, core.OriginalTarget, false)
+	assert.Error(t, err)
+	assert.Equal(t, core.BuildLabels{label}, state.ExpandOriginalLabels())
+
+	state.SkipMissingTargets = true
+	err = activateTarget(tid, state, pkg, label, core.OriginalTarget, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(state.ExpandOriginalLabels()))
+	// Dependencies are still required to exist.
+	err = activateTarget(tid, state, pkg, label, buildLabel("//package1:target1"), false)
+	assert.Error(t, err)
+}
+
 func makeTarget(label string, deps ...string) *core.BuildTarget {
 	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
 	for _, dep := range deps {
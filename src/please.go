@@ -27,7 +27,9 @@ import (
 	"github.com/thought-machine/please/src/gc"
 	"github.com/thought-machine/please/src/hashes"
 	"github.com/thought-machine/please/src/help"
+	"github.com/thought-machine/please/src/lint"
 	"github.com/thought-machine/please/src/output"
+	"github.com/thought-machine/please/src/parse"
 	"github.com/thought-machine/please/src/plz"
 	"github.com/thought-machine/please/src/plzinit"
 	"github.com/thought-machine/please/src/query"
@@ -45,6 +47,9 @@ var log = logging.MustGetLogger("plz")
 
 var config *core.Configuration
 
+// failedTestArgs are the test cases to rerun for each target when running with --failed.
+var failedTestArgs map[core.BuildLabel][]string
+
 var opts struct {
 	Usage      string `usage:"Please is a high-performance multi-language build system.\n\nIt uses BUILD files to describe what to build and how to build it.\nSee https://please.build for more information about how it works and what Please can do for you."`
 	BuildFlags struct {
@@ -69,6 +74,7 @@ var opts struct {
 		Colour            bool          `long:"colour" description:"Forces coloured output from logging & other shell output."`
 		NoColour          bool          `long:"nocolour" description:"Forces colourless output from logging & other shell output."`
 		TraceFile         cli.Filepath  `long:"trace_file" description:"File to write Chrome tracing output into"`
+		RemoteTimingsFile cli.Filepath  `long:"remote_timings_file" description:"File to write a JSON report of remote execution timings into. A summary is also printed to stderr at the end of builds that ran remote actions."`
 		ShowAllOutput     bool          `long:"show_all_output" description:"Show all output live from all commands. Implies --plain_output."`
 		CompletionScript  bool          `long:"completion_script" description:"Prints the bash / zsh completion script to stdout"`
 	} `group:"Options controlling output & logging"`
@@ -90,6 +96,8 @@ var opts struct {
 	Profile          string `long:"profile_file" hidden:"true" description:"Write profiling output to this file"`
 	MemProfile       string `long:"mem_profile_file" hidden:"true" description:"Write a memory profile to this file"`
 	ProfilePort      int    `long:"profile_port" hidden:"true" description:"Serve profiling info on this port."`
+	ParseProfile     string `long:"parse_profile" description:"Write a pprof profile of BUILD file evaluation to this file"`
+	DebugParsePort   int    `long:"debug_parse_port" description:"Serve the Debug Adapter Protocol on this port and wait for a debugger to attach before parsing"`
 	ParsePackageOnly bool   `description:"Parses a single package only. All that's necessary for some commands." no-flag:"true"`
 	Complete         string `long:"complete" hidden:"true" env:"PLZ_COMPLETE" description:"Provide completion options for this build target."`
 
@@ -125,6 +133,9 @@ var opts struct {
 		Detailed        bool         `long:"detailed" description:"Prints more detailed output after tests."`
 		Shell           bool         `long:"shell" description:"Opens a shell in the test directory with the appropriate environment variables."`
 		StreamResults   bool         `long:"stream_results" description:"Prints test results on stdout as they are run."`
+		ReportFlakes    cli.Filepath `long:"report_flakes" description:"File to write test cases that only passed on retry to, in the same format as the quarantine file."`
+		Affected        string       `long:"affected" optional:"true" optional-value:"origin/master" description:"Runs only the tests affected by changes since the given revision (default origin/master)."`
+		CoveringChanges bool         `long:"covering_changes" description:"Runs only the tests that cover lines changed since origin/master, based on the coverage recorded by previous runs of plz cover."`
 		// Slightly awkward since we can specify a single test with arguments or multiple test targets.
 		Args struct {
 			Target core.BuildLabel `positional-arg-name:"target" description:"Target to test"`
@@ -146,6 +157,8 @@ var opts struct {
 		SurefireDir         cli.Filepath  `long:"surefire_dir" default:"plz-out/surefire-reports" description:"Directory to copy XML test results to."`
 		CoverageResultsFile cli.Filepath  `long:"coverage_results_file" default:"plz-out/log/coverage.json" description:"File to write combined coverage results to."`
 		CoverageXMLReport   cli.Filepath  `long:"coverage_xml_report" default:"plz-out/log/coverage.xml" description:"XML File to write combined coverage results to."`
+		CoverageLCOVReport  cli.Filepath  `long:"coverage_lcov_report" description:"File to write combined coverage results to as an LCOV tracefile."`
+		HTMLReport          cli.Filepath  `long:"html_report" description:"Directory to write a browsable HTML coverage report to."`
 		Incremental         bool          `short:"i" long:"incremental" description:"Calculates summary statistics for incremental coverage, i.e. stats for just the lines currently modified."`
 		ShowOutput          bool          `short:"s" long:"show_output" description:"Always show output of tests, even on success."`
 		Debug               bool          `short:"d" long:"debug" description:"Allows starting an interactive debugger on test failure. Does not work with all test types (currently only python/pytest, C and C++). Implies -c dbg unless otherwise set."`
@@ -153,6 +166,8 @@ var opts struct {
 		Detailed            bool          `long:"detailed" description:"Prints more detailed output after tests."`
 		Shell               bool          `long:"shell" description:"Opens a shell in the test directory with the appropriate environment variables."`
 		StreamResults       bool          `long:"stream_results" description:"Prints test results on stdout as they are run."`
+		ReportFlakes        cli.Filepath  `long:"report_flakes" description:"File to write test cases that only passed on retry to, in the same format as the quarantine file."`
+		Affected            string        `long:"affected" optional:"true" optional-value:"origin/master" description:"Runs only the tests affected by changes since the given revision (default origin/master)."`
 		Args                struct {
 			Target core.BuildLabel `positional-arg-name:"target" description:"Target to test" group:"one test"`
 			Args   []string        `positional-arg-name:"arguments" description:"Arguments or test selectors" group:"one test"`
@@ -263,6 +278,14 @@ var opts struct {
 		} `positional-args:"true"`
 	} `command:"format" alias:"fmt" description:"Autoformats BUILD files"`
 
+	Lint struct {
+		Format string `long:"format" short:"f" choice:"text" choice:"json" choice:"sarif" default:"text" description:"Format to print issues in"`
+		FailOn string `long:"fail_on" choice:"error" choice:"warning" default:"error" description:"Least severe level of issue that causes plz to exit unsuccessfully"`
+		Args   struct {
+			Files cli.Filepaths `positional-arg-name:"files" description:"BUILD files, build definitions or directories to lint"`
+		} `positional-args:"true"`
+	} `command:"lint" description:"Statically analyses BUILD files and build definitions"`
+
 	Help struct {
 		Args struct {
 			Topic help.Topic `positional-arg-name:"topic" description:"Topic to display help on"`
@@ -323,7 +346,8 @@ var opts struct {
 			} `positional-args:"true" required:"true"`
 		} `command:"input" alias:"inputs" description:"Prints all transitive inputs of a target."`
 		Output struct {
-			Args struct {
+			Materialise bool `long:"materialise" description:"Builds the targets and ensures their outputs are present locally, downloading them if they were built remotely."`
+			Args        struct {
 				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to display outputs for" required:"true"`
 			} `positional-args:"true" required:"true"`
 		} `command:"output" alias:"outputs" description:"Prints all outputs of a target."`
@@ -364,6 +388,16 @@ var opts struct {
 				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to filter"`
 			} `positional-args:"true"`
 		} `command:"filter" description:"Filter the given set of targets according to some rules"`
+		TestHistory struct {
+			Args struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Test targets to show history for"`
+			} `positional-args:"true"`
+		} `command:"test_history" description:"Shows the recorded history of test runs, including flakiness & durations."`
+		CoveringTests struct {
+			Args struct {
+				Files []string `positional-arg-name:"files" required:"true" description:"Files to find covering tests for, optionally as file:line"`
+			} `positional-args:"true"`
+		} `command:"covering_tests" description:"Shows which tests cover a file or line, based on previous runs of plz cover."`
 	} `command:"query" description:"Queries information about the build graph"`
 }
 
@@ -389,8 +423,14 @@ var buildFunctions = map[string]func() int{
 		return toExitCode(success, state)
 	},
 	"test": func() int {
-		targets := testTargets(opts.Test.Args.Target, opts.Test.Args.Args, opts.Test.Failed, opts.Test.TestResultsFile)
-		success, state := doTest(targets, opts.Test.SurefireDir, opts.Test.TestResultsFile)
+		targets := testTargets(opts.Test.Args.Target, opts.Test.Args.Args, opts.Test.Failed, opts.Test.TestResultsFile, opts.Test.Affected)
+		if opts.Test.CoveringChanges {
+			targets = coveringChangedTests(targets)
+		}
+		if len(targets) == 0 && (opts.Test.Affected != "" || opts.Test.CoveringChanges) {
+			return 0
+		}
+		success, state := doTest(targets, opts.Test.SurefireDir, opts.Test.TestResultsFile, opts.Test.ReportFlakes)
 		return toExitCode(success, state)
 	},
 	"cover": func() int {
@@ -400,22 +440,33 @@ var buildFunctions = map[string]func() int{
 		} else {
 			opts.BuildFlags.Config = "cover"
 		}
-		targets := testTargets(opts.Cover.Args.Target, opts.Cover.Args.Args, opts.Cover.Failed, opts.Cover.TestResultsFile)
+		targets := testTargets(opts.Cover.Args.Target, opts.Cover.Args.Args, opts.Cover.Failed, opts.Cover.TestResultsFile, opts.Cover.Affected)
+		if len(targets) == 0 && opts.Cover.Affected != "" {
+			return 0
+		}
 		os.RemoveAll(string(opts.Cover.CoverageResultsFile))
-		success, state := doTest(targets, opts.Cover.SurefireDir, opts.Cover.TestResultsFile)
+		success, state := doTest(targets, opts.Cover.SurefireDir, opts.Cover.TestResultsFile, opts.Cover.ReportFlakes)
 		test.AddOriginalTargetsToCoverage(state, opts.Cover.IncludeAllFiles)
 		test.RemoveFilesFromCoverage(state.Coverage, state.Config.Cover.ExcludeExtension)
 
 		var stats *test.IncrementalStats
+		var lines map[string][]int
 		if opts.Cover.Incremental {
-			lines, err := scm.NewFallback(core.RepoRoot).ChangedLines()
-			if err != nil {
+			var err error
+			if lines, err = scm.NewFallback(core.RepoRoot).ChangedLines(); err != nil {
 				log.Fatalf("Failed to determine changes: %s", err)
 			}
 			stats = test.CalculateIncrementalStats(state, lines)
 		}
 		test.WriteCoverageToFileOrDie(state.Coverage, string(opts.Cover.CoverageResultsFile), stats)
+		test.UpdateCoverageMapOrDie(state.Graph, state.Coverage)
 		test.WriteXMLCoverageToFileOrDie(targets, state.Coverage, string(opts.Cover.CoverageXMLReport))
+		if opts.Cover.CoverageLCOVReport != "" {
+			test.WriteLCOVCoverageToFileOrDie(state.Coverage, string(opts.Cover.CoverageLCOVReport))
+		}
+		if opts.Cover.HTMLReport != "" {
+			test.WriteHTMLCoverageReportOrDie(state.Coverage, string(opts.Cover.HTMLReport), lines, stats)
+		}
 
 		if opts.Cover.LineCoverageReport {
 			output.PrintLineCoverageReport(state, opts.Cover.IncludeFile.AsStrings())
@@ -508,6 +559,17 @@ var buildFunctions = map[string]func() int{
 		}
 		return 0
 	},
+	"lint": func() int {
+		issues, err := lint.Lint(core.NewBuildState(config), opts.Lint.Args.Files.AsStrings())
+		if err != nil {
+			log.Fatalf("Failed to lint files: %s", err)
+		} else if err := lint.PrintIssues(os.Stdout, issues, opts.Lint.Format); err != nil {
+			log.Fatalf("Failed to print lint results: %s", err)
+		} else if lint.Failed(issues, lint.Severity(opts.Lint.FailOn)) {
+			return 1
+		}
+		return 0
+	},
 	"init": func() int {
 		plzinit.InitConfig(string(opts.Init.Dir), opts.Init.BazelCompatibility, opts.Init.NoPrompt)
 
@@ -594,6 +656,13 @@ var buildFunctions = map[string]func() int{
 		})
 	},
 	"output": func() int {
+		if opts.Query.Output.Materialise {
+			success, state := runBuild(opts.Query.Output.Args.Targets, true, false, false)
+			if success {
+				query.TargetOutputs(state.Graph, state.ExpandOriginalLabels())
+			}
+			return toExitCode(success, state)
+		}
 		return runQuery(true, opts.Query.Output.Args.Targets, func(state *core.BuildState) {
 			query.TargetOutputs(state.Graph, state.ExpandOriginalLabels())
 		})
@@ -663,20 +732,7 @@ var buildFunctions = map[string]func() int{
 		} else if opts.Query.Changes.Inexact {
 			return runInexact(scm.ChangedFiles(opts.Query.Changes.Since, true, ""))
 		}
-		original := scm.CurrentRevIdentifier()
-		files := scm.ChangedFiles(opts.Query.Changes.Since, true, "")
-		if err := scm.Checkout(opts.Query.Changes.Since); err != nil {
-			log.Fatalf("%s", err)
-		}
-		readConfig(false)
-		_, before := runBuild(core.WholeGraph, false, false, false)
-		// N.B. Ignore failure here; if we can't parse the graph before then it will suffice to
-		//      assume that anything we don't know about has changed.
-		if err := scm.Checkout(original); err != nil {
-			log.Fatalf("%s", err)
-		}
-		readConfig(false)
-		success, after := runBuild(core.WholeGraph, false, false, false)
+		before, after, files, success := parseGraphsSince(scm, opts.Query.Changes.Since)
 		if !success {
 			return 1
 		}
@@ -702,6 +758,20 @@ var buildFunctions = map[string]func() int{
 			query.Filter(state, state.ExpandOriginalLabels(), opts.Query.Filter.Hidden)
 		})
 	},
+	"test_history": func() int {
+		if len(opts.Query.TestHistory.Args.Targets) == 0 {
+			// No need to parse anything, we can show everything we have.
+			query.TestHistory(nil)
+			return 0
+		}
+		return runQuery(false, opts.Query.TestHistory.Args.Targets, func(state *core.BuildState) {
+			query.TestHistory(state.ExpandOriginalLabels())
+		})
+	},
+	"covering_tests": func() int {
+		query.CoveringTests(opts.Query.CoveringTests.Args.Files)
+		return 0
+	},
 	"pleasings": func() int {
 		if err := plzinit.InitPleasings(opts.Init.Pleasings.Location, opts.Init.Pleasings.PrintOnly, opts.Init.Pleasings.Revision); err != nil {
 			log.Fatalf("failed to write pleasings subrepo file: %v", err)
@@ -737,13 +807,100 @@ func runQuery(needFullParse bool, labels []core.BuildLabel, onSuccess func(state
 	return 1
 }
 
-func doTest(targets []core.BuildLabel, surefireDir cli.Filepath, resultsFile cli.Filepath) (bool, *core.BuildState) {
+// parseGraphsSince parses the whole build graph at the given revision and then again at the
+// current one, so they can be compared. It also returns the files that have changed between them.
+func parseGraphsSince(scm scm.SCM, since string) (before, after *core.BuildState, files []string, success bool) {
+	original := scm.CurrentRevIdentifier()
+	files = scm.ChangedFiles(since, true, "")
+	if err := scm.Checkout(since); err != nil {
+		log.Fatalf("%s", err)
+	}
+	readConfig(false)
+	_, before = runBuild(core.WholeGraph, false, false, false)
+	// N.B. Ignore failure here; if we can't parse the graph before then it will suffice to
+	//      assume that anything we don't know about has changed.
+	if err := scm.Checkout(original); err != nil {
+		log.Fatalf("%s", err)
+	}
+	readConfig(false)
+	success, after = runBuild(core.WholeGraph, false, false, false)
+	return before, after, files, success
+}
+
+// affectedTests returns the test targets affected by changes since the given revision, logging
+// why each one was selected. If any targets are given, only tests within them are returned.
+func affectedTests(since string, targets []core.BuildLabel) []core.BuildLabel {
+	before, after, files, success := parseGraphsSince(scm.MustNew(core.RepoRoot), since)
+	if !success {
+		log.Fatalf("Failed to parse the build graph to determine affected tests")
+	}
+	labels := []core.BuildLabel{}
+	for _, affected := range query.AffectedTests(before, after, files) {
+		if len(targets) > 0 && !labelsInclude(targets, affected.Label) {
+			continue
+		} else if affected.Cause == affected.Label {
+			log.Notice("Testing %s: it has changed since %s", affected.Label, since)
+		} else {
+			log.Notice("Testing %s: it depends on %s, which has changed since %s", affected.Label, affected.Cause, since)
+		}
+		labels = append(labels, affected.Label)
+	}
+	if len(labels) == 0 {
+		log.Notice("No tests are affected by changes since %s", since)
+	}
+	return labels
+}
+
+// labelsInclude returns true if any of the given labels include the given one.
+// coveringChangedTests returns the tests that cover lines changed since origin/master, based on
+// the coverage recorded by previous runs of plz cover. Only tests within the given targets are returned.
+func coveringChangedTests(targets []core.BuildLabel) []core.BuildLabel {
+	lines, err := scm.NewFallback(core.RepoRoot).ChangedLines()
+	if err != nil {
+		log.Fatalf("Failed to determine changes: %s", err)
+	}
+	m, err := test.LoadCoverageMap(test.CoverageMapFile)
+	if err != nil {
+		log.Fatalf("Failed to load coverage map: %s", err)
+	} else if len(m) == 0 {
+		log.Fatalf("No coverage has been recorded yet; run plz cover first")
+	}
+	tests, unknown := m.CoveringLines(lines)
+	for _, file := range unknown {
+		log.Notice("No tests are known to cover %s, so changes to it can't be used to select tests", file)
+	}
+	labels := []core.BuildLabel{}
+	for _, label := range tests {
+		if labelsInclude(targets, label) {
+			log.Notice("Testing %s: it covers lines changed since origin/master", label)
+			labels = append(labels, label)
+		}
+	}
+	if len(labels) == 0 {
+		log.Notice("No tests cover lines changed since origin/master")
+	}
+	return labels
+}
+
+func labelsInclude(labels []core.BuildLabel, label core.BuildLabel) bool {
+	for _, l := range labels {
+		if l.Includes(label) {
+			return true
+		}
+	}
+	return false
+}
+
+func doTest(targets []core.BuildLabel, surefireDir cli.Filepath, resultsFile cli.Filepath, flakesFile cli.Filepath) (bool, *core.BuildState) {
 	os.RemoveAll(string(surefireDir))
 	os.RemoveAll(string(resultsFile))
 	os.MkdirAll(string(surefireDir), core.DirPermissions)
 	success, state := runBuild(targets, true, true, false)
 	test.CopySurefireXMLFilesToDir(state, string(surefireDir))
 	test.WriteResultsToFileOrDie(state.Graph, string(resultsFile))
+	if flakesFile != "" {
+		test.WriteFlakyTestsOrDie(state.Graph, string(flakesFile))
+	}
 	return success, state
 }
 
@@ -782,6 +939,8 @@ func Please(targets []core.BuildLabel, config *core.Configuration, shouldBuild,
 	state.NumTestRuns = utils.Max(opts.Test.NumRuns, opts.Cover.NumRuns)       // Only one of these can be passed
 	state.TestSequentially = opts.Test.Sequentially || opts.Cover.Sequentially // Similarly here.
 	state.TestArgs = append(opts.Test.Args.Args, opts.Cover.Args.Args...)      // And here
+	state.TargetTestArgs = failedTestArgs
+	state.SkipMissingTargets = opts.Test.Failed || opts.Cover.Failed
 	state.NeedCoverage = opts.Cover.active
 	state.NeedBuild = shouldBuild
 	state.NeedTests = shouldTest
@@ -797,7 +956,10 @@ func Please(targets []core.BuildLabel, config *core.Configuration, shouldBuild,
 	state.DebugTests = debugTests
 	state.ShowAllOutput = opts.OutputFlags.ShowAllOutput
 	state.ParsePackageOnly = opts.ParsePackageOnly
+	state.ProfileParse = opts.ParseProfile != ""
+	state.DebugParsePort = opts.DebugParsePort
 	state.DownloadOutputs = (!opts.Build.NoDownload && !opts.Run.Remote && len(targets) > 0 && (!targets[0].IsAllSubpackages() || len(opts.BuildFlags.Include) > 0)) || opts.Build.Download
+	state.MaterialiseOutputs = state.NeedRun || len(opts.Export.Outputs.Args.Targets) > 0 || opts.Query.Output.Materialise || opts.Build.Download
 	state.SetIncludeAndExclude(opts.BuildFlags.Include, opts.BuildFlags.Exclude)
 	if opts.BuildFlags.Arch.OS != "" {
 		state.OriginalArch = opts.BuildFlags.Arch
@@ -808,6 +970,11 @@ func Please(targets []core.BuildLabel, config *core.Configuration, shouldBuild,
 	}
 
 	runPlease(state, targets)
+	if opts.ParseProfile != "" {
+		if err := parse.WriteProfile(state, opts.ParseProfile, os.Stderr); err != nil {
+			log.Error("Failed to write parse profile: %s", err)
+		}
+	}
 	return state.Successful(), state
 }
 
@@ -838,17 +1005,31 @@ func runPlease(state *core.BuildState, targets []core.BuildLabel) {
 	plz.Run(targets, opts.BuildFlags.PreTargets, state, config, opts.BuildFlags.Arch)
 	cancel()
 	wg.Wait()
+	if state.RemoteClient != nil {
+		if err := state.RemoteClient.PrintTimings(string(opts.OutputFlags.RemoteTimingsFile)); err != nil {
+			log.Error("Failed to write remote timings: %s", err)
+		}
+	}
 }
 
 // testTargets handles test targets which can be given in two formats; a list of targets or a single
 // target with a list of trailing arguments.
 // Alternatively they can be completely omitted in which case we test everything under the working dir.
 // One can also pass a 'failed' flag which runs the failed tests from last time.
-func testTargets(target core.BuildLabel, args []string, failed bool, resultsFile cli.Filepath) []core.BuildLabel {
-	if failed {
+func testTargets(target core.BuildLabel, args []string, failed bool, resultsFile cli.Filepath, affected string) []core.BuildLabel {
+	if affected != "" {
+		var targets []core.BuildLabel
+		if target.Name != "" {
+			targets = append(core.ParseBuildLabels(args), target)
+		}
+		opts.Test.Args.Args = nil
+		opts.Cover.Args.Args = nil
+		return affectedTests(affected, targets)
+	} else if failed {
 		targets, args := test.LoadPreviousFailures(string(resultsFile))
-		// Have to reset these - it doesn't matter which gets which.
-		opts.Test.Args.Args = args
+		// Each target is given only its own failed test cases.
+		failedTestArgs = args
+		opts.Test.Args.Args = nil
 		opts.Cover.Args.Args = nil
 		return targets
 	} else if target.Name == "" {
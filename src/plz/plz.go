@@ -61,6 +61,9 @@ func Run(targets, preTargets []core.BuildLabel, state *core.BuildState, config *
 	if state.RemoteClient != nil {
 		_, _, in, out := state.RemoteClient.DataRate()
 		log.Info("Total remote RPC data in: %d out: %d", in, out)
+		if err := state.RemoteClient.Disconnect(); err != nil {
+			log.Warning("%s", err)
+		}
 	}
 	state.CloseResults()
 }
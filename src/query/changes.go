@@ -124,3 +124,51 @@ func addRevdeps(state *core.BuildState, done, changed map[*core.BuildTarget]stru
 		}
 	}
 }
+
+// An AffectedTest is a test target that is affected by a set of changes.
+type AffectedTest struct {
+	Label core.BuildLabel
+	// Cause is the changed target that this test depends on. It's the same as Label if the
+	// test itself changed.
+	Cause core.BuildLabel
+}
+
+// AffectedTests returns all the test targets that are transitively affected by the differences
+// between two build graphs, and the given set of changed files, along with the reason for each one.
+// before can be nil in which case only the changed files are considered.
+func AffectedTests(before, after *core.BuildState, files []string) []AffectedTest {
+	changed := map[*core.BuildTarget]struct{}{}
+	if before != nil {
+		changed = diffGraphs(before, after)
+	}
+	// N.B. We don't pass includeDirect etc here since we need to do the walk ourselves to track causes.
+	changedTargets(after, files, changed, false, false)
+	queue := make([]*core.BuildTarget, 0, len(changed))
+	for target := range changed {
+		queue = append(queue, target)
+	}
+	// Sort so we get consistent causes when a test depends on several changed targets.
+	sort.Slice(queue, func(i, j int) bool { return queue[i].Label.Less(queue[j].Label) })
+	causes := make(map[*core.BuildTarget]core.BuildLabel, len(queue))
+	for _, target := range queue {
+		causes[target] = target.Label
+	}
+	for len(queue) > 0 {
+		target := queue[0]
+		queue = queue[1:]
+		for _, revdep := range after.Graph.ReverseDependencies(target) {
+			if _, present := causes[revdep]; !present {
+				causes[revdep] = causes[target]
+				queue = append(queue, revdep)
+			}
+		}
+	}
+	tests := []AffectedTest{}
+	for target, cause := range causes {
+		if target.IsTest && after.ShouldInclude(target) {
+			tests = append(tests, AffectedTest{Label: target.Label, Cause: cause})
+		}
+	}
+	sort.Slice(tests, func(i, j int) bool { return tests[i].Label.Less(tests[j].Label) })
+	return tests
+}
@@ -72,6 +72,41 @@ func TestChangesIncludesDataDirs(t *testing.T) {
 	assert.EqualValues(t, []core.BuildLabel{t3.Label}, Changes(s, []string{"src/query/test_data/some_dir/test_file1.txt"}, false, false))
 }
 
+func TestAffectedTests(t *testing.T) {
+	s1 := core.NewDefaultBuildState()
+	s2 := core.NewDefaultBuildState()
+	t1 := addTarget(s1, "//src/core:core", nil, "src/core/core.go")
+	t2 := addTarget(s1, "//src/query:changes", t1, "src/query/changes.go")
+	addTarget(s1, "//src/query:changes_test", t2, "src/query/changes_test.go").IsTest = true
+	addTarget(s1, "//src/core:core_test", t1, "src/core/core_test.go").IsTest = true
+	t1 = addTarget(s2, "//src/core:core", nil, "src/core/core_changed.go")
+	t2 = addTarget(s2, "//src/query:changes", t1, "src/query/changes.go")
+	t3 := addTarget(s2, "//src/query:changes_test", t2, "src/query/changes_test.go")
+	t3.IsTest = true
+	t4 := addTarget(s2, "//src/core:core_test", t1, "src/core/core_test.go")
+	t4.IsTest = true
+	assert.Equal(t, []AffectedTest{
+		{Label: t4.Label, Cause: t1.Label},
+		{Label: t3.Label, Cause: t1.Label},
+	}, AffectedTests(s1, s2, nil))
+}
+
+func TestAffectedTestsFiles(t *testing.T) {
+	s := core.NewDefaultBuildState()
+	t1 := addTarget(s, "//src/core:core", nil, "src/core/core.go")
+	t2 := addTarget(s, "//src/query:changes", t1, "src/query/changes.go")
+	t3 := addTarget(s, "//src/query:changes_test", t2, "src/query/changes_test.go")
+	t3.IsTest = true
+	t4 := addTarget(s, "//src/core:core_test", t1, "src/core/core_test.go")
+	t4.IsTest = true
+	assert.Equal(t, []AffectedTest{
+		{Label: t3.Label, Cause: t2.Label},
+	}, AffectedTests(nil, s, []string{"src/query/changes.go"}))
+	assert.Equal(t, []AffectedTest{
+		{Label: t3.Label, Cause: t3.Label},
+	}, AffectedTests(nil, s, []string{"src/query/changes_test.go"}))
+}
+
 func addTarget(state *core.BuildState, label string, dep *core.BuildTarget, sources ...string) *core.BuildTarget {
 	t := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
 	for _, src := range sources {
@@ -0,0 +1,38 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/thought-machine/please/src/test"
+)
+
+// CoveringTests prints the tests that cover each of the given files, which can optionally
+// be suffixed with a line number (e.g. src/core/utils.go:47).
+// This is based on the coverage recorded by previous runs of plz cover.
+func CoveringTests(files []string) {
+	m, err := test.LoadCoverageMap(test.CoverageMapFile)
+	if err != nil {
+		log.Fatalf("Failed to load coverage map: %s", err)
+	} else if len(m) == 0 {
+		log.Warning("No coverage has been recorded yet; run plz cover first")
+		return
+	}
+	for _, f := range files {
+		file, line := splitFileLine(f)
+		for _, label := range m.CoveringTests(file, line) {
+			fmt.Printf("%s\n", label)
+		}
+	}
+}
+
+// splitFileLine splits a file:line specifier into its two parts. The line is zero if not given.
+func splitFileLine(s string) (string, int) {
+	if idx := strings.LastIndexByte(s, ':'); idx != -1 {
+		if line, err := strconv.Atoi(s[idx+1:]); err == nil {
+			return s[:idx], line
+		}
+	}
+	return s, 0
+}
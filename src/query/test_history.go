@@ -0,0 +1,44 @@
+package query
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/test"
+)
+
+// TestHistory prints a summary of the recorded history of the given test targets.
+func TestHistory(labels []core.BuildLabel) {
+	histories, err := test.LoadHistory(test.HistoryFile, labels)
+	if err != nil {
+		log.Fatalf("Failed to load test history: %s", err)
+	} else if len(histories) == 0 {
+		log.Warning("No test history found for these targets")
+		return
+	}
+	printTestHistory(os.Stdout, histories)
+}
+
+func printTestHistory(w io.Writer, histories []*test.TestCaseHistory) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	var last core.BuildLabel
+	for _, h := range histories {
+		if h.Label != last {
+			fmt.Fprintf(tw, "%s\n", h.Label)
+			last = h.Label
+		}
+		name := h.Name
+		if h.ClassName != "" {
+			name = h.ClassName + "." + name
+		}
+		outcome, streak := h.Streak()
+		fmt.Fprintf(tw, "    %s\t%d runs\t%s streak %d\t%.1f%% flaky\tp50 %s\tp95 %s\n",
+			name, len(h.Entries), outcome, streak, 100.0*h.FlakeRate(),
+			h.Percentile(50).Round(time.Millisecond), h.Percentile(95).Round(time.Millisecond))
+	}
+}
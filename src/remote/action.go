@@ -1,6 +1,7 @@
 package remote
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
 	"fmt"
@@ -16,6 +17,7 @@ import (
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/filemetadata"
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/tree"
 	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 
 	"github.com/thought-machine/please/src/core"
@@ -146,8 +148,8 @@ func (c *Client) buildTestCommand(target *core.BuildTarget) (*pb.Command, error)
 	}
 	const commandPrefix = "export TMP_DIR=\"`pwd`\" TEST_DIR=\"`pwd`\" && "
 	cmd, err := core.ReplaceTestSequences(c.state, target, target.GetTestCommand(c.state))
-	if len(c.state.TestArgs) != 0 {
-		cmd += " " + strings.Join(c.state.TestArgs, " ")
+	if args := c.state.TestArgsFor(target.Label); len(args) != 0 {
+		cmd += " " + strings.Join(args, " ")
 	}
 	return &pb.Command{
 		Platform: &pb.Platform{
@@ -180,33 +182,113 @@ func (c *Client) buildRunCommand(target *core.BuildTarget) (*pb.Command, error)
 }
 
 // uploadInputs finds and uploads a set of inputs from a target.
+// The input tree is memoised between builds; if none of the inputs have changed and we know that
+// everything we uploaded for it last time still exists remotely, we don't rebuild or check it again.
 func (c *Client) uploadInputs(ch chan<- *chunker.Chunker, target *core.BuildTarget, isTest bool) (*pb.Directory, error) {
 	if target.IsRemoteFile {
 		return &pb.Directory{}, nil
+	} else if c.outputStore == nil {
+		b, err := c.uploadInputDir(ch, target, isTest)
+		if err != nil {
+			return nil, err
+		}
+		return b.Root(ch), nil
+	}
+	key, err := c.inputStoreKey(target, isTest)
+	if err != nil {
+		return nil, err
 	}
-	b, err := c.uploadInputDir(ch, target, isTest)
+	if outs := c.retrieveStoredOutputs(target, key); outs != nil && outs.Directory != nil && c.blobsExist(outs.Blobs) {
+		root := &pb.Directory{}
+		if err := proto.Unmarshal(outs.Directory, root); err == nil {
+			log.Debug("Inputs of %s are unchanged since last build", target)
+			return root, nil
+		}
+	}
+	// Record everything we send so we know what has to exist remotely for us to reuse this later.
+	// We do this even if we aren't uploading anything now since we might reuse it for an upload.
+	var blobs []string
+	recorder := make(chan *chunker.Chunker, 10)
+	done := make(chan struct{})
+	go func() {
+		for chomk := range recorder {
+			blobs = append(blobs, chomk.Digest().Hash)
+			if ch != nil {
+				ch <- chomk
+			}
+		}
+		close(done)
+	}()
+	root, err := func() (*pb.Directory, error) {
+		defer close(recorder)
+		b, err := c.uploadInputDir(recorder, target, isTest)
+		if err != nil {
+			return nil, err
+		}
+		return b.Root(recorder), nil
+	}()
+	<-done
 	if err != nil {
 		return nil, err
 	}
-	return b.Root(ch), nil
+	c.storeOutputs(target, key, &storedOutputs{Directory: mustMarshal(root), Blobs: blobs})
+	return root, nil
+}
+
+// inputStoreKey returns the key we use to store the input tree of a target in the output store.
+// It is derived from the output trees of its dependencies and the hashes of its other inputs,
+// which we generally already know, so is much cheaper to find than the tree itself.
+func (c *Client) inputStoreKey(target *core.BuildTarget, isTest bool) (string, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%v %v\n", isTest, target.IsFilegroup)
+	for input := range c.iterInputs(target, isTest, target.IsFilegroup) {
+		if l := input.Label(); l != nil {
+			o, err := c.inputTargetOutputs(*l)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&buf, "%s %s\n", l, c.digestMessage(o).Hash)
+			continue
+		} else if _, ok := input.(core.SystemPathLabel); ok {
+			continue
+		}
+		fullPaths := input.FullPaths(c.state.Graph)
+		for i, out := range input.Paths(c.state.Graph) {
+			h, err := c.state.PathHasher.Hash(fullPaths[i], false, true)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&buf, "%s %x\n", out, h)
+		}
+	}
+	if !isTest && target.Stamp {
+		buf.Write(core.StampFile(target))
+	}
+	return c.outputStoreKey(target, "input", hex.EncodeToString(c.sum(buf.Bytes()))), nil
+}
+
+// inputTargetOutputs returns the output tree of a target that is an input to another one.
+// If it was built locally its outputs are uploaded first.
+func (c *Client) inputTargetOutputs(label core.BuildLabel) (*pb.Directory, error) {
+	if o := c.targetOutputs(label); o != nil {
+		return o, nil
+	} else if dep := c.state.Graph.TargetOrDie(label); !dep.Local {
+		// Classic "we shouldn't get here" stuff
+		return nil, fmt.Errorf("Outputs not known for %s (should be built by now)", label)
+	} else if err := c.uploadLocalTarget(dep); err != nil {
+		// We have built this locally, need to upload its outputs
+		return nil, err
+	}
+	return c.targetOutputs(label), nil
 }
 
 func (c *Client) uploadInputDir(ch chan<- *chunker.Chunker, target *core.BuildTarget, isTest bool) (*dirBuilder, error) {
 	b := newDirBuilder(c)
 	for input := range c.iterInputs(target, isTest, target.IsFilegroup) {
 		if l := input.Label(); l != nil {
-			o := c.targetOutputs(*l)
-			if o == nil {
-				if dep := c.state.Graph.TargetOrDie(*l); dep.Local {
-					// We have built this locally, need to upload its outputs
-					if err := c.uploadLocalTarget(dep); err != nil {
-						return nil, err
-					}
-					o = c.targetOutputs(*l)
-				} else {
-					// Classic "we shouldn't get here" stuff
-					return nil, fmt.Errorf("Outputs not known for %s (should be built by now)", *l)
-				}
+			o, err := c.inputTargetOutputs(*l)
+			if err != nil {
+				return nil, err
 			}
 			pkgName := l.PackageName
 			if target.IsFilegroup {
@@ -457,28 +539,50 @@ func (c *Client) verifyActionResult(target *core.BuildTarget, command *pb.Comman
 			digests = append(digests, output.Digest)
 		}
 	}
+	// Always ask the server about these; blobs we think exist may have been evicted since.
 	if missing, err := c.client.MissingBlobs(context.Background(), digests); err != nil {
 		return fmt.Errorf("Failed to verify action result outputs: %s", err)
 	} else if len(missing) != 0 {
 		return fmt.Errorf("Action result missing %d blobs", len(missing))
 	}
+	c.markBlobsExist(digests)
 	log.Debug("Verified action result for %s in %s", target, time.Since(start))
 	return nil
 }
 
 // uploadLocalTarget uploads the outputs of a target that was built locally.
+// If the target's outputs haven't changed since we last uploaded them, and we know they still
+// exist remotely, we can skip rehashing & uploading them again.
 func (c *Client) uploadLocalTarget(target *core.BuildTarget) error {
+	var key string
+	if c.state.TargetHasher != nil {
+		if hash, err := c.state.TargetHasher.OutputHash(target); err == nil {
+			key = c.outputStoreKey(target, "local", hex.EncodeToString(hash))
+			if outs := c.retrieveStoredOutputs(target, key); outs != nil && outs.ActionResult != nil && c.blobsExist(outs.Blobs) {
+				ar := &pb.ActionResult{}
+				if err := proto.Unmarshal(outs.ActionResult, ar); err == nil {
+					log.Debug("Outputs of %s are unchanged since last upload", target)
+					return c.setOutputs(target, ar)
+				}
+			}
+		}
+	}
 	m, ar, err := tree.ComputeOutputsToUpload(target.OutDir(), target.Outputs(), int(c.client.ChunkMaxSize), filemetadata.NewNoopCache())
 	if err != nil {
 		return err
 	}
 	chomks := make([]*chunker.Chunker, 0, len(m))
-	for _, c := range m {
+	blobs := make([]string, 0, len(m))
+	for dg, c := range m {
 		chomks = append(chomks, c)
+		blobs = append(blobs, dg.Hash)
 	}
 	if err := c.uploadIfMissing(context.Background(), chomks...); err != nil {
 		return err
 	}
+	if key != "" {
+		c.storeOutputs(target, key, &storedOutputs{ActionResult: mustMarshal(ar), Blobs: blobs})
+	}
 	return c.setOutputs(target, ar)
 }
 
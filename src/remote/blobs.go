@@ -1,12 +1,23 @@
 package remote
 
 import (
+	"bytes"
 	"context"
+	"encoding/gob"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/chunker"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
 	"golang.org/x/sync/errgroup"
+
+	"github.com/thought-machine/please/src/fs"
 )
 
+const knownBlobsDirectoryName = "known-blobs"
+
 // uploadBlobs uploads a series of blobs to the remote.
 // It handles all the logic around the various upload methods etc.
 // The given function is a callback that receives a channel to send these blobs on; it
@@ -33,10 +44,11 @@ func (c *Client) uploadIfMissing(ctx context.Context, chomks ...*chunker.Chunker
 	} else if _, err := c.client.UploadIfMissing(ctx, filtered...); err != nil {
 		return err
 	}
+	now := time.Now()
 	c.existingBlobMutex.Lock()
 	defer c.existingBlobMutex.Unlock()
 	for _, chunker := range filtered {
-		c.existingBlobs[chunker.Digest().Hash] = struct{}{}
+		c.existingBlobs[chunker.Digest().Hash] = now
 	}
 	return nil
 }
@@ -52,3 +64,93 @@ func (c *Client) filterChunks(chomks []*chunker.Chunker) []*chunker.Chunker {
 	}
 	return ret
 }
+
+// blobsExist returns true if all the given blob hashes are known to exist remotely.
+func (c *Client) blobsExist(hashes []string) bool {
+	c.existingBlobMutex.Lock()
+	defer c.existingBlobMutex.Unlock()
+	for _, hash := range hashes {
+		if _, present := c.existingBlobs[hash]; !present {
+			return false
+		}
+	}
+	return true
+}
+
+// markBlobsExist records that the given digests are known to exist remotely.
+func (c *Client) markBlobsExist(digests []digest.Digest) {
+	now := time.Now()
+	c.existingBlobMutex.Lock()
+	defer c.existingBlobMutex.Unlock()
+	for _, dg := range digests {
+		c.existingBlobs[dg.Hash] = now
+	}
+}
+
+// knownBlobsFile returns the file that we persist the set of known blobs to between builds.
+// It is specific to the remote server & instance since they will not share a CAS.
+func (c *Client) knownBlobsFile() string {
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		log.Warning("Failed to find user cache dir for known blobs: %s", err)
+		return ""
+	}
+	key := c.sum([]byte(c.state.Config.Remote.URL + "\x00" + c.state.Config.Remote.CASURL + "\x00" + c.instance))
+	return filepath.Join(userCacheDir, pleaseCacheDirName, knownBlobsDirectoryName, hex.EncodeToString(key))
+}
+
+// loadKnownBlobs loads the set of blobs that a previous build found to exist remotely.
+// Any older than the configured duration are discarded since the server may have evicted them.
+func (c *Client) loadKnownBlobs() {
+	duration := time.Duration(c.state.Config.Remote.BlobCacheDuration)
+	if duration == 0 {
+		return
+	}
+	filename := c.knownBlobsFile()
+	if filename == "" {
+		return
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warning("Failed to load known remote blobs: %s", err)
+		}
+		return
+	}
+	defer f.Close()
+	blobs := map[string]time.Time{}
+	if err := gob.NewDecoder(f).Decode(&blobs); err != nil {
+		log.Warning("Failed to decode known remote blobs: %s", err)
+		return
+	}
+	c.existingBlobMutex.Lock()
+	defer c.existingBlobMutex.Unlock()
+	for hash, t := range blobs {
+		if time.Since(t) < duration {
+			c.existingBlobs[hash] = t
+		}
+	}
+	log.Debug("Loaded %d known remote blobs", len(c.existingBlobs))
+}
+
+// saveKnownBlobs persists the set of blobs known to exist remotely for the next build.
+func (c *Client) saveKnownBlobs() error {
+	if c.state.Config.Remote.BlobCacheDuration == 0 {
+		return nil
+	}
+	filename := c.knownBlobsFile()
+	if filename == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), fs.DirPermissions); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	c.existingBlobMutex.Lock()
+	err := gob.NewEncoder(&buf).Encode(c.existingBlobs)
+	c.existingBlobMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return fs.WriteFile(&buf, filename, 0644)
+}
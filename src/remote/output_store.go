@@ -0,0 +1,116 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/thought-machine/please/src/fs"
+)
+
+const outputStoreDirectoryName = "output-tree-store"
+
+// An outputStore persists the output and input trees of targets between builds, keyed by their hashes.
+// This lets us skip re-reading Tree protos for targets built remotely, re-hashing and re-uploading
+// the outputs of targets built locally, and rebuilding the input trees of actions, when they have
+// not changed.
+type outputStore interface {
+	storeOutputs(key string, outs *storedOutputs) error
+	retrieveOutputs(key string) (*storedOutputs, error)
+}
+
+// storedOutputs is the persisted form of a target's outputs.
+type storedOutputs struct {
+	// Directory is the serialised Directory proto as constructed by setOutputs, or the input root for an action.
+	Directory []byte
+	// Outputs are any outputs that were discovered on the target from its output directories.
+	Outputs []string
+	// ActionResult is the serialised ActionResult for a target that was built locally and uploaded.
+	ActionResult []byte
+	// Blobs are the hashes of all the blobs that were uploaded for a locally built target or an action's inputs.
+	Blobs []string
+}
+
+type directoryOutputStore struct {
+	directory     string
+	cacheDuration time.Duration
+}
+
+// newDirOutputStore returns a new output store with the given cache duration, or nil if it is zero.
+// Entries that haven't been used for longer than that are removed.
+func newDirOutputStore(cacheDuration time.Duration) outputStore {
+	if cacheDuration == 0 {
+		return nil
+	}
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		log.Fatalf("failed to find user cache dir for output store: %v", err)
+	}
+	dir := filepath.Join(userCacheDir, pleaseCacheDirName, outputStoreDirectoryName)
+	if err := os.MkdirAll(dir, fs.DirPermissions); err != nil {
+		log.Fatalf("failed to create output store directory: %v", err)
+	}
+	store := &directoryOutputStore{
+		directory:     dir,
+		cacheDuration: cacheDuration,
+	}
+	go store.clean()
+	return store
+}
+
+// clean deletes any stored outputs that haven't been used within the cache duration.
+func (d *directoryOutputStore) clean() {
+	_ = fs.Walk(d.directory, func(name string, isDir bool) error {
+		if isDir {
+			return nil
+		}
+		if info, err := os.Stat(name); err == nil && d.hasExpired(info) {
+			_ = os.Remove(name)
+		}
+		return nil
+	})
+}
+
+func (d *directoryOutputStore) hasExpired(info os.FileInfo) bool {
+	return time.Since(info.ModTime()) > d.cacheDuration
+}
+
+func (d *directoryOutputStore) storeOutputs(key string, outs *storedOutputs) error {
+	dir := filepath.Join(d.directory, key[:2])
+	if err := os.MkdirAll(dir, fs.DirPermissions); err != nil {
+		return fmt.Errorf("failed to create output store directory: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(outs); err != nil {
+		return fmt.Errorf("failed to encode stored outputs: %w", err)
+	}
+	return fs.WriteFile(&buf, filepath.Join(dir, key), 0644)
+}
+
+func (d *directoryOutputStore) retrieveOutputs(key string) (*storedOutputs, error) {
+	filename := filepath.Join(d.directory, key[:2], key)
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return nil, err
+	} else if d.hasExpired(info) {
+		return nil, nil
+	}
+	outs := &storedOutputs{}
+	if err := gob.NewDecoder(f).Decode(outs); err != nil {
+		return nil, err
+	}
+	// Mark it as recently used so it isn't cleaned.
+	now := time.Now()
+	_ = os.Chtimes(filename, now, now)
+	return outs, nil
+}
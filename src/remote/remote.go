@@ -4,6 +4,7 @@
 package remote
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
 	"fmt"
@@ -17,6 +18,7 @@ import (
 
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/chunker"
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/filemetadata"
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/retry"
 	fpb "github.com/bazelbuild/remote-apis/build/bazel/remote/asset/v1"
@@ -85,14 +87,20 @@ type Client struct {
 	byteRateIn, byteRateOut, totalBytesIn, totalBytesOut int
 	stats                                                *statsHandler
 
+	// Timings of remotely executed actions, for reporting at the end of the build
+	timings timingAggregator
+
 	// Used to store and retrieve action results to reduce RPC calls when re-building targets
 	mdStore buildMetadataStore
 
+	// Used to store and retrieve the output trees of targets between builds
+	outputStore outputStore
+
 	// Passed to various SDK functions.
 	fileMetadataCache filemetadata.Cache
 
-	// existingBlobs is used to track the set of existing blobs remotely.
-	existingBlobs     map[string]struct{}
+	// existingBlobs is used to track the set of existing blobs remotely, and when we last knew them to exist.
+	existingBlobs     map[string]time.Time
 	existingBlobMutex sync.Mutex
 }
 
@@ -128,10 +136,12 @@ func New(state *core.BuildState) *Client {
 		instance:          state.Config.Remote.Instance,
 		outputs:           map[core.BuildLabel]*pb.Directory{},
 		mdStore:           newDirMDStore(time.Duration(state.Config.Remote.CacheDuration)),
-		existingBlobs:     map[string]struct{}{},
+		outputStore:       newDirOutputStore(time.Duration(state.Config.Remote.OutputStoreDuration)),
+		existingBlobs:     map[string]time.Time{},
 		fileMetadataCache: filemetadata.NewNoopCache(),
 	}
 	c.stats = newStatsHandler(c)
+	c.loadKnownBlobs()
 	go c.CheckInitialised() // Kick off init now, but we don't have to wait for it.
 	return c
 }
@@ -166,10 +176,22 @@ func (c *Client) initExec() error {
 	if err != nil {
 		return err
 	}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return err
+	}
+	noSecurity := !c.state.Config.Remote.Secure
+	if tlsConfig != nil && c.state.Config.Remote.Secure {
+		// The SDK always applies its own default TLS credentials after any we give it, so to
+		// present a client certificate or trust a custom CA we do the TLS handshake ourselves
+		// when dialling and tell it not to bother.
+		dialOpts = append(dialOpts, grpc.WithContextDialer(tlsDialer(tlsConfig)))
+		noSecurity = true
+	}
 	client, err := client.NewClient(context.Background(), c.instance, client.DialParams{
 		Service:            c.state.Config.Remote.URL,
 		CASService:         c.state.Config.Remote.CASURL,
-		NoSecurity:         !c.state.Config.Remote.Secure,
+		NoSecurity:         noSecurity,
 		TransportCredsOnly: c.state.Config.Remote.Secure,
 		DialOpts:           dialOpts,
 	}, client.UseBatchOps(true), client.RetryTransient(), client.RPCTimeout(c.state.Config.Remote.Timeout))
@@ -237,7 +259,13 @@ func (c *Client) initFetch() error {
 	if err != nil {
 		return err
 	}
-	if c.state.Config.Remote.Secure {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return err
+	}
+	if c.state.Config.Remote.Secure && tlsConfig != nil {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else if c.state.Config.Remote.Secure {
 		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, "")))
 	} else {
 		dialOpts = append(dialOpts, grpc.WithInsecure())
@@ -307,10 +335,33 @@ func (c *Client) Build(tid int, target *core.BuildTarget) (*core.BuildMetadata,
 		if err := c.downloadData(target); err != nil {
 			return metadata, err
 		}
+	} else if c.state.Config.Remote.LazyDownload {
+		if err := c.recordRemoteOutputs(target, ar); err != nil {
+			log.Warning("Failed to record remote outputs for %s: %s", target, err)
+		}
 	}
 	return metadata, nil
 }
 
+// recordRemoteOutputs writes a record of the outputs of a target that we have not downloaded into plz-out,
+// so that the user can see what they are (and a later build can fetch them on demand).
+func (c *Client) recordRemoteOutputs(target *core.BuildTarget, ar *pb.ActionResult) error {
+	var buf bytes.Buffer
+	for _, f := range ar.OutputFiles {
+		fmt.Fprintf(&buf, "%s %s/%d\n", f.Path, f.Digest.Hash, f.Digest.SizeBytes)
+	}
+	for _, d := range ar.OutputDirectories {
+		fmt.Fprintf(&buf, "%s/ %s/%d\n", d.Path, d.TreeDigest.Hash, d.TreeDigest.SizeBytes)
+	}
+	for _, s := range append(ar.OutputFileSymlinks, ar.OutputDirectorySymlinks...) {
+		fmt.Fprintf(&buf, "%s -> %s\n", s.Path, s.Target)
+	}
+	if err := os.MkdirAll(target.OutDir(), core.DirPermissions); err != nil {
+		return err
+	}
+	return fs.WriteFile(&buf, target.RemoteOutputsFile(), 0644)
+}
+
 // downloadData downloads all the runtime data for a target, recursively.
 func (c *Client) downloadData(target *core.BuildTarget) error {
 	var g errgroup.Group
@@ -413,6 +464,10 @@ func (c *Client) reallyDownload(target *core.BuildTarget, digest *pb.Digest, ar
 		return c.wrapActionErr(err, digest)
 	}
 	c.recordAttrs(target, digest)
+	// The outputs are materialised now so any record of them being remote is no longer relevant.
+	if err := os.RemoveAll(target.RemoteOutputsFile()); err != nil {
+		log.Warning("Failed to remove remote outputs record for %s: %s", target, err)
+	}
 	log.Debug("Downloaded outputs for %s", target)
 	return nil
 }
@@ -549,6 +604,7 @@ func (c *Client) maybeRetrieveResults(tid int, target *core.BuildTarget, command
 	if !c.state.ShouldRebuild(target) && !(c.state.NeedTests && isTest && c.state.ForceRerun) {
 		c.state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Checking remote...")
 		if metadata, ar := c.retrieveResults(target, command, digest, needStdout, isTest); metadata != nil {
+			c.timings.RecordCacheHit()
 			return metadata, ar
 		}
 	}
@@ -660,6 +716,7 @@ func (c *Client) reallyExecute(tid int, target *core.BuildTarget, command *pb.Co
 		failed := respErr != nil || response.Result.ExitCode != 0
 		metadata, err := c.buildMetadata(response.Result, needStdout || failed, failed)
 		logResponseTimings(target, response.Result)
+		c.timings.Record(target, response.Result, response.CachedResult)
 		// The original error is higher priority than us trying to retrieve the
 		// output of the thing that failed.
 		if respErr != nil {
@@ -751,31 +808,66 @@ func (c *Client) PrintHashes(target *core.BuildTarget, isTest bool) {
 	}
 }
 
+// Disconnect is called at the end of the build to persist any state that later builds can use.
+func (c *Client) Disconnect() error {
+	if err := c.saveKnownBlobs(); err != nil {
+		return fmt.Errorf("Failed to save known remote blobs: %s", err)
+	}
+	return nil
+}
+
+// PrintTimings prints a summary of the timings of remotely executed actions during this build to stderr,
+// and writes a more detailed report to the given file if it's not empty.
+// Nothing is printed if no remote actions were needed (for example, for most queries) and no file was requested.
+func (c *Client) PrintTimings(filename string) error {
+	in, out := c.stats.Totals()
+	report := c.timings.Report(out, in)
+	if filename == "" {
+		if report.Actions > 0 {
+			report.Print(os.Stderr)
+		}
+		return nil
+	}
+	report.Print(os.Stderr)
+	return report.Write(filename)
+}
+
 // DataRate returns an estimate of the current in/out RPC data rates in bytes per second.
 func (c *Client) DataRate() (int, int, int, int) {
 	return c.byteRateIn, c.byteRateOut, c.totalBytesIn, c.totalBytesOut
 }
 
+// Fetch downloads a remote_file target using the remote asset API into its temporary directory.
+// This is used when it is being built locally, so we still go via the asset server instead of
+// needing to reach the internet ourselves.
+// If the server doesn't implement the asset API, or we don't have one to talk to at all,
+// the error returned has the code Unimplemented.
+func (c *Client) Fetch(target *core.BuildTarget) error {
+	if err := c.CheckInitialised(); err != nil {
+		return err
+	} else if c.fetchClient == nil {
+		return status.Errorf(codes.Unimplemented, "No remote asset server available to fetch %s", target)
+	}
+	dg, err := c.fetchBlob(target)
+	if status.Code(err) == codes.Unimplemented {
+		return err // Returned as-is so the caller can identify it.
+	} else if err != nil {
+		return fmt.Errorf("Failed to download file: %s", err)
+	}
+	filename := path.Join(target.TmpDir(), target.Outputs()[0])
+	if _, err := c.client.ReadBlobToFile(context.Background(), digest.NewFromProtoUnvalidated(dg), filename); err != nil {
+		return fmt.Errorf("Failed to download %s: %s", target, err)
+	}
+	if b, err := hex.DecodeString(dg.Hash); err == nil {
+		c.state.PathHasher.SetHash(filename, b)
+	}
+	return nil
+}
+
 // fetchRemoteFile sends a request to fetch a file using the remote asset API.
 func (c *Client) fetchRemoteFile(tid int, target *core.BuildTarget, actionDigest *pb.Digest) (*core.BuildMetadata, *pb.ActionResult, error) {
 	c.state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Downloading...")
-	urls := target.AllURLs(c.state.Config)
-	req := &fpb.FetchBlobRequest{
-		InstanceName: c.instance,
-		Timeout:      ptypes.DurationProto(target.BuildTimeout),
-		Uris:         urls,
-	}
-	if !c.state.NeedHashesOnly || !c.state.IsOriginalTargetOrParent(target) {
-		if sri := subresourceIntegrity(target); sri != "" {
-			req.Qualifiers = []*fpb.Qualifier{{
-				Name:  "checksum.sri",
-				Value: sri,
-			}}
-		}
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), target.BuildTimeout)
-	defer cancel()
-	resp, err := c.fetchClient.FetchBlob(ctx, req)
+	dg, err := c.fetchBlob(target)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Failed to download file: %s", err)
 	}
@@ -785,7 +877,7 @@ func (c *Client) fetchRemoteFile(tid int, target *core.BuildTarget, actionDigest
 	ar := &pb.ActionResult{
 		OutputFiles: []*pb.OutputFile{{
 			Path:         outs[0],
-			Digest:       resp.BlobDigest,
+			Digest:       dg,
 			IsExecutable: target.IsBinary,
 		}},
 	}
@@ -799,6 +891,32 @@ func (c *Client) fetchRemoteFile(tid int, target *core.BuildTarget, actionDigest
 	return &core.BuildMetadata{}, ar, nil
 }
 
+// fetchBlob requests the asset server to fetch the file for a remote_file target into the CAS.
+// The request is keyed by its URLs and the target's declared hashes (if there are any).
+func (c *Client) fetchBlob(target *core.BuildTarget) (*pb.Digest, error) {
+	urls := target.AllURLs(c.state.Config)
+	req := &fpb.FetchBlobRequest{
+		InstanceName: c.instance,
+		Timeout:      ptypes.DurationProto(target.BuildTimeout),
+		Uris:         urls,
+	}
+	if !c.state.NeedHashesOnly || !c.state.IsOriginalTargetOrParent(target) {
+		if sri := subresourceIntegrity(target); sri != "" {
+			req.Qualifiers = []*fpb.Qualifier{{
+				Name:  "checksum.sri",
+				Value: sri,
+			}}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), target.BuildTimeout)
+	defer cancel()
+	resp, err := c.fetchClient.FetchBlob(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.BlobDigest, nil
+}
+
 // buildFilegroup "builds" a single filegroup target.
 func (c *Client) buildFilegroup(target *core.BuildTarget, command *pb.Command, actionDigest *pb.Digest) (*core.BuildMetadata, *pb.ActionResult, error) {
 	b, err := c.uploadInputDir(nil, target, false) // We don't need to actually upload the inputs here, that is already done.
@@ -1,6 +1,8 @@
 package remote
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
@@ -9,13 +11,18 @@ import (
 	"testing"
 	"time"
 
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/chunker"
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
 	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/thought-machine/please/src/fs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
+	"github.com/thought-machine/please/src/cli"
 	"github.com/thought-machine/please/src/core"
 )
 
@@ -97,6 +104,37 @@ func TestExecuteFetch(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestFetch(t *testing.T) {
+	defer server.Reset()
+	server.blobs["edeaaff3f1774ad2888673770c6d64097e391bc362d7d6fb34982ddf0efd18cb"] = []byte("abc")
+	c := newClient()
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "remote2"})
+	target.IsRemoteFile = true
+	target.AddSource(core.URLLabel("https://get.please.build/linux_amd64/14.2.0/please_14.2.0.tar.gz"))
+	target.AddOutput("please_14.2.0.tar.gz")
+	target.Hashes = []string{"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"}
+	target.BuildTimeout = time.Minute
+	require.NoError(t, os.MkdirAll(target.TmpDir(), os.ModeDir|0755))
+	defer os.RemoveAll(target.TmpDir())
+	err := c.Fetch(target)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile(path.Join(target.TmpDir(), "please_14.2.0.tar.gz"))
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", string(b))
+}
+
+func TestFetchWithoutAssetServer(t *testing.T) {
+	c := newClient()
+	require.NoError(t, c.CheckInitialised())
+	c.fetchClient = nil
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "remote3"})
+	target.IsRemoteFile = true
+	target.AddSource(core.URLLabel("https://get.please.build/linux_amd64/14.2.0/please_14.2.0.tar.gz"))
+	target.AddOutput("please_14.2.0.tar.gz")
+	err := c.Fetch(target)
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
 func TestExecuteTest(t *testing.T) {
 	c := newClientInstance("test")
 	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target3"})
@@ -272,6 +310,52 @@ func TestOutDirsSetOutsOnTarget(t *testing.T) {
 	}
 }
 
+func TestLazyDownload(t *testing.T) {
+	c := newClientInstance("mock")
+	c.state.Config.Remote.LazyDownload = true
+	defer server.Reset()
+
+	out := []byte("this is the content of out")
+	outDigest := digest.NewFromBlob(out)
+	server.blobs[outDigest.Hash] = out
+	server.mockActionResult = &pb.ActionResult{
+		OutputFiles: []*pb.OutputFile{{Path: "out.txt", Digest: outDigest.ToProto()}},
+		ExecutionMetadata: &pb.ExecutedActionMetadata{
+			Worker:                      "kev",
+			QueuedTimestamp:             ptypes.TimestampNow(),
+			ExecutionStartTimestamp:     ptypes.TimestampNow(),
+			ExecutionCompletedTimestamp: ptypes.TimestampNow(),
+		},
+	}
+
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "lazy_target"})
+	target.AddOutput("out.txt")
+	target.Command = "echo 'this is the content of out' > $OUT"
+	c.state.Graph.AddTarget(target)
+	c.state.AddOriginalTarget(target.Label, true)
+	c.state.DownloadOutputs = true
+	require.False(t, c.state.ShouldDownload(target))
+	defer os.RemoveAll(target.OutDir())
+
+	_, err := c.Build(0, target)
+	require.NoError(t, err)
+	// The output isn't downloaded, but its digest is recorded.
+	assert.False(t, fs.FileExists(filepath.Join(target.OutDir(), "out.txt")))
+	record, err := ioutil.ReadFile(target.RemoteOutputsFile())
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("out.txt %s/%d\n", outDigest.Hash, outDigest.Size), string(record))
+
+	// When it's needed it gets fetched on demand, at which point the record goes away.
+	// A real server would have cached the result of executing the action; our fake one doesn't.
+	server.actionResults[c.unstampedBuildActionDigests.Get(target.Label).Hash] = server.mockActionResult
+	require.NoError(t, c.Download(target))
+	b, err := ioutil.ReadFile(filepath.Join(target.OutDir(), "out.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, out, b)
+	_, err = os.Stat(target.RemoteOutputsFile())
+	assert.True(t, os.IsNotExist(err))
+}
+
 func TestDirectoryMetadataStore(t *testing.T) {
 	cacheDuration := time.Hour
 	now := time.Now().UTC()
@@ -320,3 +404,186 @@ func (c *Client) Store(target *core.BuildTarget) error {
 	}
 	return c.uploadLocalTarget(target)
 }
+
+func TestDirectoryOutputStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output_store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store := directoryOutputStore{directory: dir, cacheDuration: time.Hour}
+
+	outs, err := store.retrieveOutputs("missing")
+	require.NoError(t, err)
+	assert.Nil(t, outs)
+
+	stored := &storedOutputs{
+		Directory: mustMarshal(&pb.Directory{
+			Files: []*pb.FileNode{{Name: "out.txt"}},
+		}),
+		Outputs: []string{"out.txt"},
+		Blobs:   []string{"1234"},
+	}
+	require.NoError(t, store.storeOutputs("present", stored))
+	filename := filepath.Join(dir, "pr", "present")
+	assert.FileExists(t, filename)
+
+	outs, err = store.retrieveOutputs("present")
+	require.NoError(t, err)
+	assert.Equal(t, stored, outs)
+
+	// Once it's been unused for long enough it should be ignored, and then cleaned up.
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(filename, old, old))
+	outs, err = store.retrieveOutputs("present")
+	require.NoError(t, err)
+	assert.Nil(t, outs)
+	store.clean()
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestOutputStoreDisabledByDefault(t *testing.T) {
+	c := newClient()
+	assert.Nil(t, c.outputStore)
+}
+
+func TestInputTreeMemoised(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output_store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := newClient()
+	require.NoError(t, c.CheckInitialised())
+	c.outputStore = &directoryOutputStore{directory: dir, cacheDuration: time.Hour}
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "memoised"})
+	target.AddSource(core.FileLabel{File: "src1.txt", Package: "package"})
+
+	// The first time round everything should be sent for upload.
+	root, blobs := uploadInputsForTest(t, c, target)
+	assert.NotEqual(t, 0, len(blobs))
+	// We don't know those exist remotely yet, so they should be sent again.
+	root2, blobs2 := uploadInputsForTest(t, c, target)
+	assert.Equal(t, root, root2)
+	assert.Equal(t, blobs, blobs2)
+	// Once they're known to exist, the stored tree should be reused and nothing sent.
+	c.markBlobsExist(blobs)
+	root3, blobs3 := uploadInputsForTest(t, c, target)
+	assert.Equal(t, c.digestMessage(root), c.digestMessage(root3))
+	assert.Equal(t, 0, len(blobs3))
+	// If the inputs change, the stored tree must not be used.
+	target.AddSource(core.FileLabel{File: "src2.txt", Package: "package"})
+	_, blobs4 := uploadInputsForTest(t, c, target)
+	assert.NotEqual(t, 0, len(blobs4))
+}
+
+// uploadInputsForTest calls uploadInputs for a target and returns the input root and all the digests sent for upload.
+func uploadInputsForTest(t *testing.T, c *Client, target *core.BuildTarget) (*pb.Directory, []digest.Digest) {
+	ch := make(chan *chunker.Chunker, 100)
+	root, err := c.uploadInputs(ch, target, false)
+	require.NoError(t, err)
+	close(ch)
+	var digests []digest.Digest
+	for chomk := range ch {
+		digests = append(digests, chomk.Digest())
+	}
+	return root, digests
+}
+
+func TestVerifyActionResultIgnoresKnownBlobs(t *testing.T) {
+	defer server.Reset()
+	c := newClient()
+	require.NoError(t, c.CheckInitialised())
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "evicted"})
+	command := &pb.Command{OutputFiles: []string{"out.txt"}}
+	content := []byte("this blob has been evicted")
+	dg := digest.NewFromBlob(content)
+	ar := &pb.ActionResult{
+		OutputFiles: []*pb.OutputFile{{Path: "out.txt", Digest: dg.ToProto()}},
+	}
+	// We think this exists, but the server has since lost it, so the result isn't usable.
+	c.markBlobsExist([]digest.Digest{dg})
+	assert.Error(t, c.verifyActionResult(target, command, nil, ar, true, false))
+	server.blobs[dg.Hash] = content
+	assert.NoError(t, c.verifyActionResult(target, command, nil, ar, true, false))
+}
+
+func TestKnownBlobsPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known_blobs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", dir)
+
+	c := newClient()
+	c.state.Config.Remote.BlobCacheDuration = cli.Duration(time.Hour)
+	c.existingBlobs = map[string]time.Time{
+		"fresh": time.Now(),
+		"stale": time.Now().Add(-2 * time.Hour),
+	}
+	require.NoError(t, c.Disconnect())
+
+	c2 := newClient()
+	c2.state.Config.Remote.BlobCacheDuration = cli.Duration(time.Hour)
+	c2.loadKnownBlobs()
+	assert.True(t, c2.blobsExist([]string{"fresh"}))
+	assert.False(t, c2.blobsExist([]string{"stale"}))
+
+	// A different instance doesn't share the same CAS, so shouldn't know about any of them.
+	c3 := newClientInstance("wobble")
+	c3.state.Config.Remote.BlobCacheDuration = cli.Duration(time.Hour)
+	c3.loadKnownBlobs()
+	assert.False(t, c3.blobsExist([]string{"fresh"}))
+}
+
+func TestTimingReport(t *testing.T) {
+	ts := func(secs int64) *timestamp.Timestamp { return &timestamp.Timestamp{Seconds: secs} }
+	a := timingAggregator{}
+	a.Record(core.NewBuildTarget(core.ParseBuildLabel("//package:fast", "")), &pb.ActionResult{
+		ExecutionMetadata: &pb.ExecutedActionMetadata{
+			Worker:                       "kev",
+			QueuedTimestamp:              ts(0),
+			WorkerStartTimestamp:         ts(1),
+			InputFetchStartTimestamp:     ts(1),
+			InputFetchCompletedTimestamp: ts(2),
+			ExecutionStartTimestamp:      ts(2),
+			ExecutionCompletedTimestamp:  ts(4),
+		},
+	}, false)
+	a.Record(core.NewBuildTarget(core.ParseBuildLabel("//package:slow", "")), &pb.ActionResult{
+		ExecutionMetadata: &pb.ExecutedActionMetadata{
+			Worker:                      "kev",
+			ExecutionStartTimestamp:     ts(0),
+			ExecutionCompletedTimestamp: ts(10),
+		},
+	}, false)
+	a.Record(core.NewBuildTarget(core.ParseBuildLabel("//package:partial", "")), &pb.ActionResult{
+		ExecutionMetadata: &pb.ExecutedActionMetadata{
+			Worker:                      "bob",
+			QueuedTimestamp:             ts(1000000000),
+			ExecutionStartTimestamp:     ts(1000000000),
+			ExecutionCompletedTimestamp: ts(1000000003),
+			OutputUploadStartTimestamp:  ts(1000000003),
+		},
+	}, false)
+	a.Record(core.NewBuildTarget(core.ParseBuildLabel("//package:cached", "")), &pb.ActionResult{}, true)
+	a.RecordCacheHit()
+
+	report := a.Report(100, 200)
+	assert.Equal(t, 5, report.Actions)
+	assert.Equal(t, 2, report.CacheHits)
+	assert.Equal(t, 0.4, report.CacheHitRatio)
+	assert.Equal(t, 100, report.BytesUploaded)
+	assert.Equal(t, 200, report.BytesDownloaded)
+	assert.Equal(t, &workerReport{Actions: 2, Queued: 1, InputFetch: 1, Execution: 12}, report.Workers["kev"])
+	// Phases where the server didn't send both timestamps are counted as zero.
+	assert.Equal(t, &workerReport{Actions: 1, Execution: 3}, report.Workers["bob"])
+	require.Equal(t, 3, len(report.Slowest))
+	assert.Equal(t, "//package:slow", report.Slowest[0].Label)
+	assert.Equal(t, "//package:fast", report.Slowest[1].Label)
+	assert.Equal(t, 4.0, report.Slowest[1].Total)
+	assert.Equal(t, "//package:partial", report.Slowest[2].Label)
+	assert.Equal(t, 3.0, report.Slowest[2].Total)
+
+	var buf bytes.Buffer
+	report.Print(&buf)
+	assert.True(t, strings.HasPrefix(buf.String(), "Remote execution: 5 actions, 2 cache hits (40.0%)"))
+	assert.Contains(t, buf.String(), "//package:slow")
+}
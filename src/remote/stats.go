@@ -62,6 +62,15 @@ func (h *statsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) con
 func (h *statsHandler) HandleConn(ctx context.Context, s stats.ConnStats) {
 }
 
+// Totals returns the total number of bytes received and sent so far.
+func (h *statsHandler) Totals() (int, int) {
+	h.inmtx.Lock()
+	defer h.inmtx.Unlock()
+	h.outmtx.Lock()
+	defer h.outmtx.Unlock()
+	return h.totalIn, h.totalOut
+}
+
 // update runs continually, updating the aggregated stats on the Client instance.
 func (h *statsHandler) update() {
 	for range time.NewTicker(updateFrequency).C {
@@ -0,0 +1,201 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/dustin/go-humanize"
+	"github.com/golang/protobuf/ptypes/timestamp"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// numSlowestActions is the number of slowest actions we report on.
+const numSlowestActions = 10
+
+// An actionTiming records how long the various stages of a single remote action took.
+type actionTiming struct {
+	Label        string
+	Worker       string
+	Queued       time.Duration
+	InputFetch   time.Duration
+	Execution    time.Duration
+	OutputUpload time.Duration
+}
+
+// Total returns the total time the action took from being queued to finishing uploading its outputs.
+func (t *actionTiming) Total() time.Duration {
+	return t.Queued + t.InputFetch + t.Execution + t.OutputUpload
+}
+
+// A timingAggregator collects the timings of all remote actions during a build.
+type timingAggregator struct {
+	actions   []*actionTiming
+	cacheHits int
+	mutex     sync.Mutex
+}
+
+// Record records the execution metadata of a single action that was executed remotely.
+// cached is true if the server returned a cached result instead of executing it.
+func (a *timingAggregator) Record(target *core.BuildTarget, ar *pb.ActionResult, cached bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if cached {
+		a.cacheHits++
+		return
+	} else if ar == nil || ar.ExecutionMetadata == nil {
+		return
+	}
+	md := ar.ExecutionMetadata
+	a.actions = append(a.actions, &actionTiming{
+		Label:        target.Label.String(),
+		Worker:       md.Worker,
+		Queued:       duration(md.QueuedTimestamp, md.WorkerStartTimestamp),
+		InputFetch:   duration(md.InputFetchStartTimestamp, md.InputFetchCompletedTimestamp),
+		Execution:    duration(md.ExecutionStartTimestamp, md.ExecutionCompletedTimestamp),
+		OutputUpload: duration(md.OutputUploadStartTimestamp, md.OutputUploadCompletedTimestamp),
+	})
+}
+
+// duration returns the time between two timestamps, or zero if the server didn't send both of them.
+func duration(start, end *timestamp.Timestamp) time.Duration {
+	if start == nil || end == nil {
+		return 0
+	}
+	return toTime(end).Sub(toTime(start))
+}
+
+// RecordCacheHit records that an action was found in the action cache without needing to execute it.
+func (a *timingAggregator) RecordCacheHit() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.cacheHits++
+}
+
+// A timingReport is the serialisable form of the aggregated timings.
+type timingReport struct {
+	Actions         int                      `json:"actions"`
+	CacheHits       int                      `json:"cache_hits"`
+	CacheHitRatio   float64                  `json:"cache_hit_ratio"`
+	BytesUploaded   int                      `json:"bytes_uploaded"`
+	BytesDownloaded int                      `json:"bytes_downloaded"`
+	Workers         map[string]*workerReport `json:"workers"`
+	Slowest         []*actionReport          `json:"slowest"`
+	All             []*actionReport          `json:"all"`
+}
+
+// A workerReport is the total time spent in each stage on a single worker.
+type workerReport struct {
+	Actions      int     `json:"actions"`
+	Queued       float64 `json:"queued_secs"`
+	InputFetch   float64 `json:"input_fetch_secs"`
+	Execution    float64 `json:"execution_secs"`
+	OutputUpload float64 `json:"output_upload_secs"`
+}
+
+// An actionReport is the serialisable form of a single actionTiming.
+type actionReport struct {
+	Label        string  `json:"label"`
+	Worker       string  `json:"worker"`
+	Total        float64 `json:"total_secs"`
+	Queued       float64 `json:"queued_secs"`
+	InputFetch   float64 `json:"input_fetch_secs"`
+	Execution    float64 `json:"execution_secs"`
+	OutputUpload float64 `json:"output_upload_secs"`
+}
+
+// Report aggregates the recorded timings into a report.
+func (a *timingAggregator) Report(bytesUploaded, bytesDownloaded int) *timingReport {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	report := &timingReport{
+		Actions:         len(a.actions) + a.cacheHits,
+		CacheHits:       a.cacheHits,
+		BytesUploaded:   bytesUploaded,
+		BytesDownloaded: bytesDownloaded,
+		Workers:         map[string]*workerReport{},
+		All:             make([]*actionReport, len(a.actions)),
+	}
+	if report.Actions > 0 {
+		report.CacheHitRatio = float64(a.cacheHits) / float64(report.Actions)
+	}
+	for i, action := range a.actions {
+		w, present := report.Workers[action.Worker]
+		if !present {
+			w = &workerReport{}
+			report.Workers[action.Worker] = w
+		}
+		w.Actions++
+		w.Queued += action.Queued.Seconds()
+		w.InputFetch += action.InputFetch.Seconds()
+		w.Execution += action.Execution.Seconds()
+		w.OutputUpload += action.OutputUpload.Seconds()
+		report.All[i] = &actionReport{
+			Label:        action.Label,
+			Worker:       action.Worker,
+			Total:        action.Total().Seconds(),
+			Queued:       action.Queued.Seconds(),
+			InputFetch:   action.InputFetch.Seconds(),
+			Execution:    action.Execution.Seconds(),
+			OutputUpload: action.OutputUpload.Seconds(),
+		}
+	}
+	slowest := make([]*actionReport, len(report.All))
+	copy(slowest, report.All)
+	sort.SliceStable(slowest, func(i, j int) bool { return slowest[i].Total > slowest[j].Total })
+	if len(slowest) > numSlowestActions {
+		slowest = slowest[:numSlowestActions]
+	}
+	report.Slowest = slowest
+	return report
+}
+
+// Print prints a human-readable summary of this report to the given writer.
+func (r *timingReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "Remote execution: %d actions, %d cache hits (%.1f%%), %s uploaded, %s downloaded\n",
+		r.Actions, r.CacheHits, 100.0*r.CacheHitRatio, humanize.Bytes(uint64(r.BytesUploaded)), humanize.Bytes(uint64(r.BytesDownloaded)))
+	if len(r.Workers) == 0 {
+		return
+	}
+	workers := make([]string, 0, len(r.Workers))
+	for worker := range r.Workers {
+		workers = append(workers, worker)
+	}
+	sort.Strings(workers)
+	fmt.Fprintf(w, "  %-30s %8s %10s %10s %10s %10s\n", "Worker", "Actions", "Queued", "Fetch", "Execute", "Upload")
+	for _, worker := range workers {
+		wr := r.Workers[worker]
+		fmt.Fprintf(w, "  %-30s %8d %10s %10s %10s %10s\n", worker, wr.Actions, secs(wr.Queued), secs(wr.InputFetch), secs(wr.Execution), secs(wr.OutputUpload))
+	}
+	fmt.Fprintf(w, "Slowest actions:\n")
+	for _, action := range r.Slowest {
+		fmt.Fprintf(w, "  %s: %s (queued %s, fetch %s, execute %s, upload %s)\n", action.Label, secs(action.Total),
+			secs(action.Queued), secs(action.InputFetch), secs(action.Execution), secs(action.OutputUpload))
+	}
+}
+
+// Write writes this report to the given file as JSON.
+func (r *timingReport) Write(filename string) error {
+	if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fs.WriteFile(bytes.NewReader(b), filename, 0644)
+}
+
+// secs formats a number of seconds as a duration.
+func secs(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(time.Millisecond).String()
+}
@@ -5,11 +5,13 @@ import (
 	"context"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	treesdk "github.com/bazelbuild/remote-apis-sdks/go/pkg/tree"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
 	"sort"
@@ -30,6 +32,7 @@ import (
 	"google.golang.org/grpc/encoding/gzip"
 	"google.golang.org/grpc/status"
 
+	"github.com/thought-machine/please/src/auth"
 	"github.com/thought-machine/please/src/core"
 	"github.com/thought-machine/please/src/fs"
 )
@@ -54,6 +57,39 @@ func (c *Client) targetOutputs(label core.BuildLabel) *pb.Directory {
 
 // setOutputs sets the outputs for a previously executed target.
 func (c *Client) setOutputs(target *core.BuildTarget, ar *pb.ActionResult) error {
+	// N.B. We don't use outputHash here since that would include the execution metadata.
+	key := c.outputStoreKey(target, "remote", c.digestMessage(&pb.ActionResult{
+		OutputFiles:             ar.OutputFiles,
+		OutputDirectories:       ar.OutputDirectories,
+		OutputFileSymlinks:      ar.OutputFileSymlinks,
+		OutputDirectorySymlinks: ar.OutputDirectorySymlinks,
+	}).Hash)
+	if outs := c.retrieveStoredOutputs(target, key); outs != nil && outs.Directory != nil {
+		o := &pb.Directory{}
+		if err := proto.Unmarshal(outs.Directory, o); err == nil {
+			for _, out := range outs.Outputs {
+				target.AddOutput(out)
+			}
+			c.outputMutex.Lock()
+			defer c.outputMutex.Unlock()
+			c.outputs[target.Label] = o
+			return nil
+		}
+	}
+	o, added, err := c.outputDirectory(target, ar)
+	if err != nil {
+		return err
+	}
+	c.storeOutputs(target, key, &storedOutputs{Directory: mustMarshal(o), Outputs: added})
+	c.outputMutex.Lock()
+	defer c.outputMutex.Unlock()
+	c.outputs[target.Label] = o
+	return nil
+}
+
+// outputDirectory constructs the Directory proto describing the outputs of an ActionResult.
+// It also returns any outputs that were added to the target from its output directories.
+func (c *Client) outputDirectory(target *core.BuildTarget, ar *pb.ActionResult) (*pb.Directory, []string, error) {
 	o := &pb.Directory{
 		Files:       make([]*pb.FileNode, len(ar.OutputFiles)),
 		Directories: make([]*pb.DirectoryNode, 0, len(ar.OutputDirectories)),
@@ -71,19 +107,26 @@ func (c *Client) setOutputs(target *core.BuildTarget, ar *pb.ActionResult) error
 			IsExecutable: f.IsExecutable,
 		}
 	}
+	var added []string
 	for _, d := range ar.OutputDirectories {
 		tree := &pb.Tree{}
 		if err := c.client.ReadProto(context.Background(), digest.NewFromProtoUnvalidated(d.TreeDigest), tree); err != nil {
-			return wrap(err, "Downloading tree digest for %s [%s]", d.Path, d.TreeDigest.Hash)
+			return nil, nil, wrap(err, "Downloading tree digest for %s [%s]", d.Path, d.TreeDigest.Hash)
 		}
 
 		if outDir := maybeGetOutDir(d.Path, target.OutputDirectories); outDir != "" {
 			files, dirs, err := getOutputsForOutDir(target, outDir, tree)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
 			o.Directories = append(o.Directories, dirs...)
 			o.Files = append(o.Files, files...)
+			for _, f := range files {
+				added = append(added, f.Name)
+			}
+			for _, d := range dirs {
+				added = append(added, d.Name)
+			}
 		} else {
 			o.Directories = append(o.Directories, &pb.DirectoryNode{
 				Name:   d.Path,
@@ -97,10 +140,36 @@ func (c *Client) setOutputs(target *core.BuildTarget, ar *pb.ActionResult) error
 			Target: s.Target,
 		}
 	}
-	c.outputMutex.Lock()
-	defer c.outputMutex.Unlock()
-	c.outputs[target.Label] = o
-	return nil
+	return o, added, nil
+}
+
+// outputStoreKey returns the key we use to store the outputs of a target in the output store.
+// It incorporates the target's label since the Directory protos contain paths that are specific to it.
+func (c *Client) outputStoreKey(target *core.BuildTarget, kind, outputHash string) string {
+	return hex.EncodeToString(c.sum([]byte(kind + "\x00" + target.Label.String() + "\x00" + outputHash)))
+}
+
+// retrieveStoredOutputs retrieves a previously stored set of outputs for a target, or nil if there aren't any.
+func (c *Client) retrieveStoredOutputs(target *core.BuildTarget, key string) *storedOutputs {
+	if c.outputStore == nil {
+		return nil
+	}
+	outs, err := c.outputStore.retrieveOutputs(key)
+	if err != nil {
+		log.Warning("Failed to retrieve stored outputs for %s: %s", target, err)
+		return nil
+	}
+	return outs
+}
+
+// storeOutputs stores a set of outputs for a target, if the output store is enabled.
+func (c *Client) storeOutputs(target *core.BuildTarget, key string, outs *storedOutputs) {
+	if c.outputStore == nil {
+		return
+	}
+	if err := c.outputStore.storeOutputs(key, outs); err != nil {
+		log.Warning("Failed to store outputs for %s: %s", target, err)
+	}
 }
 
 func getOutputsForOutDir(target *core.BuildTarget, outDir core.OutputDirectory, tree *pb.Tree) ([]*pb.FileNode, []*pb.DirectoryNode, error) {
@@ -534,7 +603,12 @@ func (c *Client) dialOpts() ([]grpc.DialOption, error) {
 		grpc.WithStatsHandler(c.stats),
 		grpc.WithDefaultCallOptions(callOpts...),
 	}
-	if c.state.Config.Remote.TokenFile == "" {
+	creds, err := auth.FromConfig(c.state.Config)
+	if err != nil {
+		return opts, err
+	} else if creds.HasToken() {
+		return append(opts, grpc.WithPerRPCCredentials(tokenSourceCredentials{creds: creds})), nil
+	} else if c.state.Config.Remote.TokenFile == "" {
 		return opts, nil
 	}
 	token, err := ioutil.ReadFile(c.state.Config.Remote.TokenFile)
@@ -544,6 +618,45 @@ func (c *Client) dialOpts() ([]grpc.DialOption, error) {
 	return append(opts, grpc.WithPerRPCCredentials(preSharedToken(string(token)))), nil
 }
 
+// tlsConfig returns the custom TLS config to connect to the remote servers with, or nil if
+// there isn't one (in which case the default settings should be used).
+func (c *Client) tlsConfig() (*tls.Config, error) {
+	creds, err := auth.FromConfig(c.state.Config)
+	if err != nil {
+		return nil, err
+	}
+	return creds.TLSConfig(), nil
+}
+
+// tlsDialer returns a dialer for gRPC that establishes TLS connections using the given config.
+func tlsDialer(config *tls.Config) func(context.Context, string) (net.Conn, error) {
+	config.NextProtos = []string{"h2"} // gRPC requires HTTP/2
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		config := config.Clone()
+		if config.ServerName == "" {
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				config.ServerName = host
+			} else {
+				config.ServerName = addr
+			}
+		}
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		if deadline, present := ctx.Deadline(); present {
+			tlsConn.SetDeadline(deadline)
+			defer tlsConn.SetDeadline(time.Time{})
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
 // outputHash returns an output hash for a target. If it has a single output it's the hash
 // of that output, otherwise it's the hash of the whole thing.
 // The special-casing is important to make remote_file hash properly (also so you can
@@ -571,3 +684,20 @@ func (cred tokenCredProvider) GetRequestMetadata(ctx context.Context, uri ...str
 func (cred tokenCredProvider) RequireTransportSecurity() bool {
 	return false // Allow these to be provided over an insecure channel; this facilitates e.g. service meshes like Istio.
 }
+
+// tokenSourceCredentials is a gRPC credential provider that gets tokens from a credential helper.
+type tokenSourceCredentials struct {
+	creds *auth.Credentials
+}
+
+func (cred tokenSourceCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, err := cred.creds.Token()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+func (cred tokenSourceCredentials) RequireTransportSecurity() bool {
+	return false // As above.
+}
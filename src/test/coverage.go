@@ -37,6 +37,8 @@ func parseTestCoverage(target *core.BuildTarget, data []byte, run int) (*core.Te
 		return coverage, parseGcovCoverageResults(target, coverage, data)
 	} else if looksLikeIstanbulCoverageResults(data) {
 		return coverage, parseIstanbulCoverageResults(target, coverage, data, run)
+	} else if looksLikeLCOVCoverageResults(data) {
+		return coverage, parseLCOVCoverageResults(target, coverage, data, run)
 	} else {
 		return coverage, parseXMLCoverageResults(target, coverage, data)
 	}
@@ -48,7 +50,12 @@ func parseTestCoverage(target *core.BuildTarget, data []byte, run int) (*core.Te
 // tests, so it's important that we identify anything with zero coverage here.
 func AddOriginalTargetsToCoverage(state *core.BuildState, includeAllFiles bool) {
 	recordedCoverage := state.Coverage
-	state.Coverage = core.TestCoverage{Tests: recordedCoverage.Tests, Files: map[string][]core.LineCoverage{}}
+	state.Coverage = core.TestCoverage{
+		Tests:     recordedCoverage.Tests,
+		Files:     map[string][]core.LineCoverage{},
+		Branches:  map[string][]core.BranchCoverage{},
+		Functions: map[string][]core.FunctionCoverage{},
+	}
 	mergeCoverage(state, recordedCoverage, collectCoverageFiles(state, includeAllFiles))
 }
 
@@ -101,6 +108,16 @@ func mergeCoverage(state *core.BuildState, recordedCoverage core.TestCoverage, c
 			doneFiles[file] = true
 		}
 	}
+	for file, branches := range recordedCoverage.Branches {
+		if coverageFiles[file] {
+			state.Coverage.Branches[file] = branches
+		}
+	}
+	for file, functions := range recordedCoverage.Functions {
+		if coverageFiles[file] {
+			state.Coverage.Functions[file] = functions
+		}
+	}
 	// For any files left over now, enter them in as 100% uncovered.
 	// This is pessimistic but there's not much we can do at this point.
 	for file, include := range coverageFiles {
@@ -151,6 +168,28 @@ func WriteXMLCoverageToFileOrDie(sources []core.BuildLabel, coverage core.TestCo
 	}
 }
 
+// CountBranchCoverage counts the number of branches taken and the total number of branches in a single file.
+func CountBranchCoverage(branches []core.BranchCoverage) (int, int) {
+	taken := 0
+	for _, branch := range branches {
+		if branch.Taken {
+			taken++
+		}
+	}
+	return taken, len(branches)
+}
+
+// CountFunctionCoverage counts the number of functions called and the total number of functions in a single file.
+func CountFunctionCoverage(functions []core.FunctionCoverage) (int, int) {
+	called := 0
+	for _, function := range functions {
+		if function.Called {
+			called++
+		}
+	}
+	return called, len(functions)
+}
+
 // CountCoverage counts the number of lines covered and the total number coverable in a single file.
 func CountCoverage(lines []core.LineCoverage) (int, int) {
 	covered := 0
@@ -255,6 +294,25 @@ func RemoveFilesFromCoverage(coverage core.TestCoverage, extensions []string) {
 		removeFilesFromCoverage(files, extensions)
 	}
 	removeFilesFromCoverage(coverage.Files, extensions)
+	for filename := range coverage.Branches {
+		if hasAnySuffix(filename, extensions) {
+			delete(coverage.Branches, filename)
+		}
+	}
+	for filename := range coverage.Functions {
+		if hasAnySuffix(filename, extensions) {
+			delete(coverage.Functions, filename)
+		}
+	}
+}
+
+func hasAnySuffix(filename string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(filename, suffix) {
+			return true
+		}
+	}
+	return false
 }
 
 func removeFilesFromCoverage(files map[string][]core.LineCoverage, extensions []string) {
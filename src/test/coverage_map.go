@@ -0,0 +1,166 @@
+// Persistent record of which tests cover which files.
+//
+// plz cover merges coverage from all the tests it runs into one result, but we also keep
+// each test's individual coverage here so we can later answer which tests cover a given line.
+// Each run of plz cover updates the entries for the tests it ran and leaves the others alone,
+// apart from removing any for tests that no longer exist.
+
+package test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// CoverageMapFile is the file that we record per-test coverage in.
+var CoverageMapFile = path.Join(core.OutDir, "log/coverage_map.json")
+
+// A CoverageMap maps test targets to the coverage of each file they cover.
+type CoverageMap map[core.BuildLabel]map[string][]core.LineCoverage
+
+// UpdateCoverageMapOrDie updates the coverage map with the coverage of each test in the given results. Dies on failure.
+func UpdateCoverageMapOrDie(graph *core.BuildGraph, coverage core.TestCoverage) {
+	if err := updateCoverageMap(CoverageMapFile, graph, coverage); err != nil {
+		log.Fatalf("Failed to update coverage map: %s", err)
+	}
+}
+
+func updateCoverageMap(filename string, graph *core.BuildGraph, coverage core.TestCoverage) error {
+	m, err := LoadCoverageMap(filename)
+	if err != nil {
+		log.Warning("Discarding existing coverage map: %s", err)
+		m = CoverageMap{}
+	}
+	m.prune(graph)
+	for label, files := range coverage.Tests {
+		m[label] = files
+	}
+	out := make(map[string]map[string]string, len(m))
+	for label, files := range m {
+		out[label.String()] = make(map[string]string, len(files))
+		for file, lines := range files {
+			out[label.String()][file] = core.TestCoverageString(lines)
+		}
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0644)
+}
+
+// LoadCoverageMap loads the coverage map from the given file.
+// It's not an error if the file doesn't exist, the map will just be empty.
+func LoadCoverageMap(filename string) (CoverageMap, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return CoverageMap{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	in := map[string]map[string]string{}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return nil, err
+	}
+	m := make(CoverageMap, len(in))
+	for label, files := range in {
+		l, err := core.TryParseBuildLabel(label, "", "")
+		if err != nil {
+			return nil, err
+		}
+		m[l] = make(map[string][]core.LineCoverage, len(files))
+		for file, lines := range files {
+			m[l][file] = core.ParseTestCoverageString(lines)
+		}
+	}
+	return m, nil
+}
+
+// prune removes any tests that no longer exist. We only know that for packages that have been
+// parsed in this build, or that have been removed entirely.
+func (m CoverageMap) prune(graph *core.BuildGraph) {
+	for label := range m {
+		if pkg := graph.PackageByLabel(label); pkg != nil {
+			if pkg.Target(label.Name) == nil {
+				log.Debug("Removing coverage for %s, it no longer exists", label)
+				delete(m, label)
+			}
+		} else if label.Subrepo == "" && !core.PathExists(label.PackageDir()) {
+			log.Debug("Removing coverage for %s, its package no longer exists", label)
+			delete(m, label)
+		}
+	}
+}
+
+// CoveringLines returns the tests that cover any of the given lines, which are a map of
+// filename -> line numbers as returned by scm.ChangedLines, sorted by label.
+// It also returns any of the files that no test is known to cover at all; we can't tell
+// which tests might be affected by changes to those.
+func (m CoverageMap) CoveringLines(lines map[string][]int) ([]core.BuildLabel, []string) {
+	tests := []core.BuildLabel{}
+	unknown := []string{}
+	for file, fileLines := range lines {
+		known := false
+		for label, files := range m {
+			if coversLine(files[file], 0) {
+				known = true
+				for _, line := range fileLines {
+					if coversLine(files[file], line) {
+						tests = append(tests, label)
+						break
+					}
+				}
+			}
+		}
+		if !known {
+			unknown = append(unknown, file)
+		}
+	}
+	sort.Slice(tests, func(i, j int) bool { return tests[i].Less(tests[j]) })
+	sort.Strings(unknown)
+	return dedupeLabels(tests), unknown
+}
+
+// dedupeLabels removes any duplicates from the given sorted slice of labels.
+func dedupeLabels(labels []core.BuildLabel) []core.BuildLabel {
+	ret := labels[:0]
+	for i, label := range labels {
+		if i == 0 || label != labels[i-1] {
+			ret = append(ret, label)
+		}
+	}
+	return ret
+}
+
+// CoveringTests returns the tests that cover the given file, sorted by label.
+// If line is nonzero then only tests that cover that (1-indexed) line are returned.
+func (m CoverageMap) CoveringTests(file string, line int) []core.BuildLabel {
+	ret := []core.BuildLabel{}
+	for label, files := range m {
+		if coversLine(files[file], line) {
+			ret = append(ret, label)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Less(ret[j]) })
+	return ret
+}
+
+// coversLine returns true if the given coverage covers the given line, or any line if it's zero.
+func coversLine(lines []core.LineCoverage, line int) bool {
+	if line > 0 {
+		return line <= len(lines) && lines[line-1] == core.Covered
+	}
+	for _, l := range lines {
+		if l == core.Covered {
+			return true
+		}
+	}
+	return false
+}
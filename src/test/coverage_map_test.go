@@ -0,0 +1,113 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestCoverageMapRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coverage_map_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "log", "coverage_map.json")
+
+	coreTest := core.ParseBuildLabel("//src/core:core_test", "")
+	testTest := core.ParseBuildLabel("//src/test:coverage_test", "")
+	require.NoError(t, updateCoverageMap(filename, core.NewGraph(), core.TestCoverage{
+		Tests: map[core.BuildLabel]map[string][]core.LineCoverage{
+			coreTest: {
+				"src/core/utils.go": {core.NotExecutable, core.Covered, core.Uncovered},
+			},
+			testTest: {
+				"src/core/utils.go":    {core.NotExecutable, core.Uncovered, core.Covered},
+				"src/test/coverage.go": {core.Covered},
+			},
+		},
+	}))
+	// A later run only updates the tests that it ran.
+	require.NoError(t, updateCoverageMap(filename, core.NewGraph(), core.TestCoverage{
+		Tests: map[core.BuildLabel]map[string][]core.LineCoverage{
+			testTest: {
+				"src/core/utils.go": {core.NotExecutable, core.Uncovered, core.Uncovered, core.Covered},
+			},
+		},
+	}))
+
+	m, err := LoadCoverageMap(filename)
+	require.NoError(t, err)
+	assert.Equal(t, CoverageMap{
+		coreTest: {
+			"src/core/utils.go": {core.NotExecutable, core.Covered, core.Uncovered},
+		},
+		testTest: {
+			"src/core/utils.go": {core.NotExecutable, core.Uncovered, core.Uncovered, core.Covered},
+		},
+	}, m)
+
+	assert.Equal(t, []core.BuildLabel{coreTest, testTest}, m.CoveringTests("src/core/utils.go", 0))
+	assert.Equal(t, []core.BuildLabel{coreTest}, m.CoveringTests("src/core/utils.go", 2))
+	assert.Equal(t, []core.BuildLabel{}, m.CoveringTests("src/core/utils.go", 3))
+	assert.Equal(t, []core.BuildLabel{testTest}, m.CoveringTests("src/core/utils.go", 4))
+	assert.Equal(t, []core.BuildLabel{}, m.CoveringTests("src/core/utils.go", 5))
+	assert.Equal(t, []core.BuildLabel{}, m.CoveringTests("src/test/coverage.go", 0))
+}
+
+func TestLoadMissingCoverageMap(t *testing.T) {
+	m, err := LoadCoverageMap("/this/file/does/not/exist")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(m))
+}
+
+func TestCoverageMapCoveringLines(t *testing.T) {
+	coreTest := core.ParseBuildLabel("//src/core:core_test", "")
+	testTest := core.ParseBuildLabel("//src/test:coverage_test", "")
+	m := CoverageMap{
+		coreTest: {
+			"src/core/utils.go": {core.NotExecutable, core.Covered, core.Uncovered},
+		},
+		testTest: {
+			"src/core/utils.go":    {core.NotExecutable, core.Uncovered, core.Covered},
+			"src/test/coverage.go": {core.Covered},
+		},
+	}
+	tests, unknown := m.CoveringLines(map[string][]int{
+		"src/core/utils.go":    {2, 3},
+		"src/test/coverage.go": {1},
+		"src/core/BUILD":       {5},
+	})
+	assert.Equal(t, []core.BuildLabel{coreTest, testTest}, tests)
+	assert.Equal(t, []string{"src/core/BUILD"}, unknown)
+	// Changing a line that nothing covers selects nothing, but the file is still known.
+	tests, unknown = m.CoveringLines(map[string][]int{"src/core/utils.go": {1}})
+	assert.Equal(t, []core.BuildLabel{}, tests)
+	assert.Equal(t, []string{}, unknown)
+}
+
+func TestCoverageMapPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coverage_map_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	require.NoError(t, os.Chdir(dir))
+	require.NoError(t, os.MkdirAll("src/core", core.DirPermissions))
+
+	graph := core.NewGraph()
+	pkg := core.NewPackage("src/test")
+	pkg.AddTarget(core.NewBuildTarget(core.ParseBuildLabel("//src/test:coverage_test", "")))
+	graph.AddPackage(pkg)
+	existing := core.ParseBuildLabel("//src/test:coverage_test", "")
+	removed := core.ParseBuildLabel("//src/test:removed_test", "")
+	unparsed := core.ParseBuildLabel("//src/core:core_test", "")
+	deleted := core.ParseBuildLabel("//src/no_longer_exists:some_test", "")
+	m := CoverageMap{existing: nil, removed: nil, unparsed: nil, deleted: nil}
+	m.prune(graph)
+	assert.Equal(t, CoverageMap{existing: nil, unparsed: nil}, m)
+}
@@ -1,6 +1,10 @@
 package test
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/peterebden/tools/cover"
@@ -19,6 +23,8 @@ const (
 	gcovCoverageFile      = "src/test/test_data/gcov_coverage.gcov"
 	istanbulCoverageFile  = "src/test/test_data/istanbul_coverage.json"
 	istanbulCoverageFile2 = "src/test/test_data/istanbul_coverage_2.json"
+	lcovCoverageFile      = "src/test/test_data/lcov_coverage.info"
+	gcovBranchesFile      = "src/test/test_data/gcov_branches.gcov"
 )
 
 // Test that tests aren't required to produce coverage, ie. it's not an error if the file doesn't exist.
@@ -183,6 +189,23 @@ func TestGcovParsing(t *testing.T) {
 	assertLine(t, lines, 18, core.Covered)
 }
 
+func TestGcovBranchParsing(t *testing.T) {
+	target := &core.BuildTarget{Label: core.BuildLabel{PackageName: "test", Name: "gcov_test"}}
+	coverage, err := parseTestCoverageFile(target, gcovBranchesFile, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "NCCCNCNUUN", core.TestCoverageString(coverage.Files["test/cc_rules/branches.cc"]))
+	assert.Equal(t, []core.BranchCoverage{
+		{Line: 3, Branch: 0, Taken: true},
+		{Line: 3, Branch: 1, Taken: true},
+		{Line: 9, Branch: 0},
+		{Line: 9, Branch: 1},
+	}, coverage.Branches["test/cc_rules/branches.cc"])
+	assert.Equal(t, []core.FunctionCoverage{
+		{Name: "_Z3fooi", Line: 2, Called: true},
+		{Name: "_Z3barv", Line: 8},
+	}, coverage.Functions["test/cc_rules/branches.cc"])
+}
+
 func TestIstanbulCoverage(t *testing.T) {
 	target := &core.BuildTarget{Label: core.BuildLabel{PackageName: "common/js/components/ActionButton", Name: "test"}}
 	coverage, err := parseTestCoverageFile(target, istanbulCoverageFile, 1)
@@ -199,6 +222,20 @@ func TestIstanbulCoverage(t *testing.T) {
 	assertLine(t, lines, 22, core.NotExecutable)
 	assertLine(t, lines, 23, core.Uncovered)
 	assertLine(t, lines, 24, core.NotExecutable)
+	// The switch statement has three cases, none of which were hit.
+	assert.Equal(t, []core.BranchCoverage{
+		{Line: 58, Branch: 0},
+		{Line: 58, Branch: 1},
+		{Line: 58, Branch: 2},
+	}, coverage.Branches["common/js/components/LoadingSpinner/LoadingSpinner.js"])
+	assert.Equal(t, 4, len(coverage.Functions["common/js/components/LoadingSpinner/LoadingSpinner.js"]))
+	assert.Equal(t, core.FunctionCoverage{Name: "(anonymous_0)", Line: 22}, coverage.Functions["common/js/components/LoadingSpinner/LoadingSpinner.js"][0])
+	taken, total := CountBranchCoverage(coverage.Branches["common/js/components/ActionButton/ActionButton.js"])
+	assert.Equal(t, 9, taken)
+	assert.Equal(t, 11, total)
+	called, total := CountFunctionCoverage(coverage.Functions["common/js/components/ActionButton/ActionButton.js"])
+	assert.Equal(t, 4, called)
+	assert.Equal(t, 4, total)
 }
 
 func TestIstanbulCoverage2(t *testing.T) {
@@ -219,6 +256,83 @@ func TestIstanbulCoverage2(t *testing.T) {
 	assertLine(t, lines, 23, core.Covered)
 }
 
+func TestLCOVCoverage(t *testing.T) {
+	target := &core.BuildTarget{Label: core.BuildLabel{PackageName: "src/core", Name: "core_test"}}
+	coverage, err := parseTestCoverageFile(target, lcovCoverageFile, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(coverage.Files))
+	assert.Contains(t, coverage.Tests, target.Label)
+	// The two records for this file are merged together.
+	assert.Equal(t, "NNCCNCCNU", core.TestCoverageString(coverage.Files["src/core/file_label.go"]))
+	assert.Equal(t, "UC", core.TestCoverageString(coverage.Files["src/core/utils.rs"]))
+}
+
+func TestLCOVRoundTrip(t *testing.T) {
+	coverage := core.TestCoverage{
+		Files: map[string][]core.LineCoverage{
+			"src/test/coverage.go": {core.NotExecutable, core.Uncovered, core.Covered, core.Unreachable},
+			"src/core/utils.go":    {core.Covered},
+		},
+		Branches: map[string][]core.BranchCoverage{
+			"src/test/coverage.go": {{Line: 3, Branch: 0, Taken: true}, {Line: 3, Branch: 1}},
+		},
+		Functions: map[string][]core.FunctionCoverage{
+			"src/test/coverage.go": {{Name: "countLines", Line: 2, Called: true}},
+		},
+	}
+	var buf bytes.Buffer
+	writeLCOVCoverage(&buf, coverage)
+	assert.Equal(t, "TN:\nSF:src/core/utils.go\nDA:1,1\nLF:1\nLH:1\nend_of_record\n"+
+		"TN:\nSF:src/test/coverage.go\nFN:2,countLines\nFNDA:1,countLines\nFNF:1\nFNH:1\n"+
+		"BRDA:3,0,0,1\nBRDA:3,0,1,0\nBRF:2\nBRH:1\n"+
+		"DA:2,0\nDA:3,1\nDA:4,0\nLF:3\nLH:1\nend_of_record\n", buf.String())
+
+	parsed, err := parseTestCoverage(target, buf.Bytes(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "NUCU", core.TestCoverageString(parsed.Files["src/test/coverage.go"]))
+	assert.Equal(t, "C", core.TestCoverageString(parsed.Files["src/core/utils.go"]))
+	assert.Equal(t, coverage.Branches, parsed.Branches)
+	assert.Equal(t, coverage.Functions, parsed.Functions)
+}
+
+const xmlBranchCoverage = `<?xml version="1.0" ?>
+<coverage branch-rate="0.5" line-rate="1" version="5.0">
+	<packages>
+		<package name="src">
+			<classes>
+				<class filename="src/branches.py" name="branches.py">
+					<methods>
+						<method name="f">
+							<lines>
+								<line hits="1" number="2"/>
+								<line hits="1" number="3"/>
+							</lines>
+						</method>
+					</methods>
+					<lines>
+						<line hits="1" number="2"/>
+						<line branch="true" condition-coverage="50% (1/2)" hits="1" number="3"/>
+					</lines>
+				</class>
+			</classes>
+		</package>
+	</packages>
+</coverage>
+`
+
+func TestXMLBranchCoverage(t *testing.T) {
+	coverage, err := parseTestCoverage(target, []byte(xmlBranchCoverage), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []core.BranchCoverage{{Line: 3, Branch: 0, Taken: true}, {Line: 3, Branch: 1}}, coverage.Branches["src/branches.py"])
+	assert.Equal(t, []core.FunctionCoverage{{Name: "f", Line: 2, Called: true}}, coverage.Functions["src/branches.py"])
+
+	report := string(coverageResultToXML(nil, *coverage))
+	assert.Contains(t, report, `branch-rate="0.5"`)
+	assert.Contains(t, report, `branches-covered="1" branches-valid="2"`)
+	assert.Contains(t, report, `branch="true" condition-coverage="50% (1/2)"`)
+	assert.Contains(t, report, `<method name="f"`)
+}
+
 func TestIncrementalStats(t *testing.T) {
 	state := core.NewDefaultBuildState()
 	state.Config.Cover.FileExtension = []string{".go"}
@@ -265,3 +379,70 @@ func TestGetDirectoryCoverage(t *testing.T) {
 	}
 	assert.Equal(t, expectedDirCoverage, dirCoverage)
 }
+
+func TestHTMLCoverageReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "html_coverage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cov := core.TestCoverage{
+		Files: map[string][]core.LineCoverage{
+			// This isn't really a source file but it's one we know will be present.
+			lcovCoverageFile: {core.NotExecutable, core.Covered, core.Uncovered, core.Covered},
+		},
+	}
+	changes := map[string][]int{lcovCoverageFile: {3}}
+	err = writeHTMLCoverageReport(cov, dir, changes, nil)
+	assert.NoError(t, err)
+
+	index, err := ioutil.ReadFile(path.Join(dir, "index.html"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(index), `<a href="files/src/test/test_data/lcov_coverage.info.html">lcov_coverage.info</a> *`)
+	assert.Contains(t, string(index), "66.7%")
+
+	page, err := ioutil.ReadFile(path.Join(dir, "files", lcovCoverageFile+".html"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(page), `<a href="../../../../index.html">`)
+	assert.Contains(t, string(page), `<tr class="C"><td class="lineno" id="L2">2</td><td>SF:src/core/file_label.go</td></tr>`)
+	assert.Contains(t, string(page), `<tr class="U changed"><td class="lineno" id="L3">3</td>`)
+	assert.Contains(t, string(page), `<tr class="N"><td class="lineno" id="L5">5</td>`)
+}
+
+func TestHTMLCoverageReportKeepsOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "html_coverage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cov := core.TestCoverage{
+		Files: map[string][]core.LineCoverage{
+			lcovCoverageFile: {core.NotExecutable, core.Covered, core.Uncovered, core.Covered},
+		},
+	}
+	err = writeHTMLCoverageReport(cov, dir, nil, nil)
+	assert.NoError(t, err)
+	unrelated := path.Join(dir, "files", "unrelated.txt")
+	err = ioutil.WriteFile(unrelated, []byte("don't delete me"), 0644)
+	assert.NoError(t, err)
+
+	// Writing a new report removes the files from the old one, but nothing else.
+	err = writeHTMLCoverageReport(core.TestCoverage{Files: map[string][]core.LineCoverage{}}, dir, nil, nil)
+	assert.NoError(t, err)
+	assert.FileExists(t, unrelated)
+	assert.FileExists(t, path.Join(dir, "index.html"))
+	_, err = os.Stat(path.Join(dir, "files", lcovCoverageFile+".html"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(dir, "files", "src"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestHTMLCoverageReportRefusesNonEmptyDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "html_coverage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	unrelated := path.Join(dir, "BUILD")
+	err = ioutil.WriteFile(unrelated, []byte("don't delete me"), 0644)
+	assert.NoError(t, err)
+	err = writeHTMLCoverageReport(core.TestCoverage{Files: map[string][]core.LineCoverage{}}, dir, nil, nil)
+	assert.Error(t, err)
+	assert.FileExists(t, unrelated)
+	_, err = os.Stat(path.Join(dir, "index.html"))
+	assert.True(t, os.IsNotExist(err))
+}
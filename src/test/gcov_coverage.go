@@ -24,7 +24,32 @@ func parseGcovCoverageResults(target *core.BuildTarget, coverage *core.TestCover
 		return fmt.Errorf("Empty coverage file")
 	}
 	currentFilename := ""
+	lastLine := 0
+	var functions []core.FunctionCoverage // Functions whose first line we haven't seen yet
 	for lineno, line := range lines {
+		if bytes.HasPrefix(line, []byte("function ")) {
+			// e.g. function _Z3fooi called 2 returned 100% blocks executed 100%
+			if fields := strings.Fields(string(line)); len(fields) >= 4 && fields[2] == "called" {
+				functions = append(functions, core.FunctionCoverage{Name: fields[1], Called: fields[3] != "0"})
+			}
+			continue
+		} else if bytes.HasPrefix(line, []byte("branch ")) {
+			// e.g. branch  0 taken 1 (fallthrough), or branch  1 never executed
+			fields := strings.Fields(string(line))
+			if len(fields) < 3 || lastLine == 0 {
+				continue
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return fmt.Errorf("Bad branch on line %d: %s", lineno, string(line))
+			}
+			coverage.Branches[currentFilename] = append(coverage.Branches[currentFilename], core.BranchCoverage{
+				Line:   lastLine,
+				Branch: n,
+				Taken:  fields[2] == "taken" && len(fields) > 3 && strings.TrimRight(fields[3], "%") != "0",
+			})
+			continue
+		}
 		fields := bytes.Split(line, []byte{':'})
 		if len(fields) < 3 {
 			continue
@@ -34,6 +59,7 @@ func parseGcovCoverageResults(target *core.BuildTarget, coverage *core.TestCover
 				return fmt.Errorf("Bad source on line %d: %s", lineno, string(line))
 			}
 			currentFilename = string(fields[3])
+			lastLine = 0
 			continue
 		}
 		covLine, err := strconv.Atoi(strings.TrimSpace(string(fields[1])))
@@ -41,8 +67,15 @@ func parseGcovCoverageResults(target *core.BuildTarget, coverage *core.TestCover
 			return fmt.Errorf("Bad line number on line %d: %s", lineno, string(line))
 		} else if covLine > 0 {
 			coverage.Files[currentFilename] = append(coverage.Files[currentFilename], translateGcovCount(bytes.TrimSpace(fields[0])))
+			lastLine = covLine
+			for _, f := range functions {
+				f.Line = covLine
+				coverage.Functions[currentFilename] = append(coverage.Functions[currentFilename], f)
+			}
+			functions = nil
 		}
 	}
+	coverage.Tests[target.Label] = coverage.Files
 	return nil
 }
 
@@ -0,0 +1,320 @@
+// Local history of test results.
+//
+// Each time a test runs we append the outcome of each of its test cases to a JSON-lines file
+// under plz-out, which lets us report on things like flakiness and duration over time.
+// It's deliberately simple; it's only ever appended to (or deleted by plz clean), although once it
+// gets too large the oldest entries are discarded.
+
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// HistoryFile is the file that we record test history in.
+var HistoryFile = path.Join(core.OutDir, "log/test_history.jsonl")
+
+// Outcomes of an individual test case as recorded in the history.
+const (
+	OutcomePass  = "pass"
+	OutcomeFlaky = "flaky" // Passed, but only after being retried
+	OutcomeFail  = "fail"
+	OutcomeError = "error"
+	OutcomeSkip  = "skip"
+)
+
+// A HistoryEntry is a single record of one test case running.
+type HistoryEntry struct {
+	Label     core.BuildLabel `json:"label"`
+	ClassName string          `json:"class,omitempty"`
+	Name      string          `json:"name"`
+	Outcome   string          `json:"outcome"`
+	Duration  time.Duration   `json:"duration,omitempty"`
+	Hash      string          `json:"hash,omitempty"` // The runtime hash of the test target
+	Time      time.Time       `json:"time"`
+}
+
+// maxHistorySize is the size in bytes beyond which we discard the oldest entries from the history file.
+// It's trimmed to half this size so we don't have to rewrite it on every run once it gets there.
+var maxHistorySize int64 = 10 * 1024 * 1024
+
+// historyMutex guards writes to the history file from concurrently running tests.
+var historyMutex sync.Mutex
+
+// recordHistory appends the results of one run of a test target to the history file.
+func recordHistory(label core.BuildLabel, results *core.TestSuite, hash []byte) {
+	if err := appendHistory(HistoryFile, historyEntries(label, results, hash, time.Now())); err != nil {
+		log.Warning("Failed to record test history: %s", err)
+	}
+}
+
+// historyEntries converts a set of test results to history entries.
+func historyEntries(label core.BuildLabel, results *core.TestSuite, hash []byte, now time.Time) []HistoryEntry {
+	entries := make([]HistoryEntry, 0, len(results.TestCases))
+	for _, testCase := range results.TestCases {
+		entry := HistoryEntry{
+			Label:     label,
+			ClassName: testCase.ClassName,
+			Name:      testCase.Name,
+			Hash:      hex.EncodeToString(hash),
+			Time:      now,
+		}
+		if success := testCase.Success(); success != nil {
+			entry.Outcome = OutcomePass
+			if len(testCase.Executions) > 1 {
+				entry.Outcome = OutcomeFlaky
+			}
+		} else if testCase.Skip() != nil {
+			entry.Outcome = OutcomeSkip
+		} else if len(testCase.Errors()) > 0 {
+			entry.Outcome = OutcomeError
+		} else {
+			entry.Outcome = OutcomeFail
+		}
+		if d := testCase.Duration(); d != nil {
+			entry.Duration = *d
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// appendHistory appends some entries to the given history file.
+func appendHistory(filename string, entries []HistoryEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	// Marshal everything up front so it can be written in a single call; that way concurrent
+	// writers (including other plz processes) don't interleave their lines.
+	var b []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		b = append(append(b, line...), '\n')
+	}
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	if info, err := f.Stat(); err != nil {
+		return err
+	} else if info.Size() > maxHistorySize {
+		return trimHistory(filename, maxHistorySize/2)
+	}
+	return nil
+}
+
+// trimHistory discards the oldest entries from the given history file so it's no larger than the given size.
+// The file is replaced atomically; we might lose entries appended by another process in the meantime, but
+// since it's only a record of what's happened it's not worth locking it against that.
+func trimHistory(filename string, size int64) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	} else if int64(len(b)) <= size {
+		return nil
+	}
+	b = b[int64(len(b))-size:]
+	// Don't keep a partial line at the start.
+	if idx := bytes.IndexByte(b, '\n'); idx != -1 {
+		b = b[idx+1:]
+	} else {
+		b = nil
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// A TestCaseHistory is the history of a single test case, in chronological order.
+type TestCaseHistory struct {
+	Label     core.BuildLabel
+	ClassName string
+	Name      string
+	Entries   []HistoryEntry
+}
+
+// LoadHistory loads the test history for the given targets from the given file.
+// If no targets are given then it loads the history for all of them.
+// The results are sorted by target and then by test case name.
+func LoadHistory(filename string, labels []core.BuildLabel) ([]*TestCaseHistory, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	include := make(map[core.BuildLabel]bool, len(labels))
+	for _, label := range labels {
+		include[label] = true
+	}
+	type key struct {
+		Label           core.BuildLabel
+		ClassName, Name string
+	}
+	histories := map[key]*TestCaseHistory{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		entry := HistoryEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Most likely a partially written line from an interrupted process; not fatal.
+			log.Debug("Ignoring invalid test history entry: %s", err)
+			continue
+		} else if len(include) > 0 && !include[entry.Label] {
+			continue
+		}
+		k := key{Label: entry.Label, ClassName: entry.ClassName, Name: entry.Name}
+		if h, present := histories[k]; present {
+			h.Entries = append(h.Entries, entry)
+		} else {
+			histories[k] = &TestCaseHistory{Label: entry.Label, ClassName: entry.ClassName, Name: entry.Name, Entries: []HistoryEntry{entry}}
+		}
+	}
+	ret := make([]*TestCaseHistory, 0, len(histories))
+	for _, h := range histories {
+		sort.SliceStable(h.Entries, func(i, j int) bool { return h.Entries[i].Time.Before(h.Entries[j].Time) })
+		ret = append(ret, h)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Label != ret[j].Label {
+			return ret[i].Label.Less(ret[j].Label)
+		} else if ret[i].ClassName != ret[j].ClassName {
+			return ret[i].ClassName < ret[j].ClassName
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, scanner.Err()
+}
+
+// Last returns the most recent entry for this test case.
+func (h *TestCaseHistory) Last() HistoryEntry {
+	return h.Entries[len(h.Entries)-1]
+}
+
+// Failed returns true if the most recent run of this test case failed.
+func (h *TestCaseHistory) Failed() bool {
+	outcome := h.Last().Outcome
+	return outcome == OutcomeFail || outcome == OutcomeError
+}
+
+// Streak returns the outcome of the most recent run and how many consecutive runs up to
+// and including it had the same outcome (treating flaky passes as passes).
+func (h *TestCaseHistory) Streak() (string, int) {
+	outcome := normaliseOutcome(h.Last().Outcome)
+	n := 0
+	for i := len(h.Entries) - 1; i >= 0 && normaliseOutcome(h.Entries[i].Outcome) == outcome; i-- {
+		n++
+	}
+	return outcome, n
+}
+
+func normaliseOutcome(outcome string) string {
+	if outcome == OutcomeFlaky {
+		return OutcomePass
+	} else if outcome == OutcomeError {
+		return OutcomeFail
+	}
+	return outcome
+}
+
+// FlakeRate returns the proportion of runs of this test case that were flaky.
+// A run counts as flaky if it only passed on retry, or if it failed when another run with the
+// same runtime hash passed (i.e. nothing changed, but the outcome did).
+func (h *TestCaseHistory) FlakeRate() float64 {
+	passedHashes := map[string]bool{}
+	for _, entry := range h.Entries {
+		if entry.Hash != "" && (entry.Outcome == OutcomePass || entry.Outcome == OutcomeFlaky) {
+			passedHashes[entry.Hash] = true
+		}
+	}
+	runs := 0
+	flakes := 0
+	for _, entry := range h.Entries {
+		if entry.Outcome == OutcomeSkip {
+			continue
+		}
+		runs++
+		if entry.Outcome == OutcomeFlaky || (entry.Outcome != OutcomePass && passedHashes[entry.Hash]) {
+			flakes++
+		}
+	}
+	if runs == 0 {
+		return 0.0
+	}
+	return float64(flakes) / float64(runs)
+}
+
+// Percentile returns the given percentile (between 0 and 100) of the durations of the runs of
+// this test case that passed. It returns zero if it has never passed.
+func (h *TestCaseHistory) Percentile(p int) time.Duration {
+	durations := []time.Duration{}
+	for _, entry := range h.Entries {
+		if entry.Outcome == OutcomePass || entry.Outcome == OutcomeFlaky {
+			durations = append(durations, entry.Duration)
+		}
+	}
+	if len(durations) == 0 {
+		return 0
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	// Nearest-rank method.
+	idx := (p*len(durations)+99)/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return durations[idx]
+}
+
+// loadHistoricalFailures returns any targets that failed the most recent time they ran, along
+// with the test cases of each that failed. Test cases that didn't run at all that time are
+// ignored since they've presumably been removed or renamed.
+func loadHistoricalFailures(filename string) ([]core.BuildLabel, map[core.BuildLabel][]string) {
+	histories, err := LoadHistory(filename, nil)
+	if err != nil {
+		log.Warning("Failed to load test history: %s", err)
+		return nil, nil
+	}
+	lastRun := map[core.BuildLabel]time.Time{}
+	for _, h := range histories {
+		if t := h.Last().Time; t.After(lastRun[h.Label]) {
+			lastRun[h.Label] = t
+		}
+	}
+	labels := []core.BuildLabel{}
+	args := map[core.BuildLabel][]string{}
+	for _, h := range histories {
+		if h.Failed() && h.Last().Time.Equal(lastRun[h.Label]) {
+			if len(labels) == 0 || labels[len(labels)-1] != h.Label {
+				labels = append(labels, h.Label)
+			}
+			args[h.Label] = append(args[h.Label], h.Name)
+		}
+	}
+	return labels, args
+}
@@ -0,0 +1,157 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+var historyLabel = core.ParseBuildLabel("//src/test:history_test", "")
+
+func TestHistoryEntries(t *testing.T) {
+	d := 2 * time.Second
+	results := &core.TestSuite{
+		TestCases: []core.TestCase{
+			{Name: "TestPass", Executions: []core.TestExecution{{Duration: &d}}},
+			{Name: "TestFlaky", Executions: []core.TestExecution{{Failure: &core.TestResultFailure{}}, {Duration: &d}}},
+			{Name: "TestFail", Executions: []core.TestExecution{{Failure: &core.TestResultFailure{Message: "it broke"}}}},
+			{Name: "TestError", Executions: []core.TestExecution{{Error: &core.TestResultFailure{}}}},
+			{Name: "TestSkip", Executions: []core.TestExecution{{Skip: &core.TestResultSkip{}}}},
+		},
+	}
+	now := time.Now()
+	entries := historyEntries(historyLabel, results, []byte{0x12, 0x34}, now)
+	require.Equal(t, 5, len(entries))
+	assert.Equal(t, HistoryEntry{
+		Label:    historyLabel,
+		Name:     "TestPass",
+		Outcome:  OutcomePass,
+		Duration: d,
+		Hash:     "1234",
+		Time:     now,
+	}, entries[0])
+	assert.Equal(t, OutcomeFlaky, entries[1].Outcome)
+	assert.Equal(t, OutcomeFail, entries[2].Outcome)
+	assert.Equal(t, OutcomeError, entries[3].Outcome)
+	assert.Equal(t, OutcomeSkip, entries[4].Outcome)
+}
+
+func TestHistoryRoundTrip(t *testing.T) {
+	filename := tempHistoryFile(t)
+	defer os.RemoveAll(filepath.Dir(filename))
+	other := core.ParseBuildLabel("//src/test:other_test", "")
+	start := time.Date(2020, time.May, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, appendHistory(filename, []HistoryEntry{
+		historyEntry(historyLabel, "TestA", OutcomePass, "abc", start),
+		historyEntry(historyLabel, "TestB", OutcomeFail, "abc", start),
+		historyEntry(other, "TestC", OutcomePass, "def", start),
+	}))
+	require.NoError(t, appendHistory(filename, []HistoryEntry{
+		historyEntry(historyLabel, "TestA", OutcomePass, "abc", start.Add(time.Hour)),
+		historyEntry(historyLabel, "TestB", OutcomePass, "abc", start.Add(time.Hour)),
+	}))
+
+	histories, err := LoadHistory(filename, []core.BuildLabel{historyLabel})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(histories))
+	assert.Equal(t, "TestA", histories[0].Name)
+	assert.Equal(t, 2, len(histories[0].Entries))
+	assert.Equal(t, "TestB", histories[1].Name)
+	assert.Equal(t, OutcomePass, histories[1].Last().Outcome)
+
+	histories, err = LoadHistory(filename, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(histories))
+}
+
+func TestLoadMissingHistory(t *testing.T) {
+	histories, err := LoadHistory("/this/file/does/not/exist", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(histories))
+}
+
+func TestHistoryStatistics(t *testing.T) {
+	start := time.Date(2020, time.May, 1, 12, 0, 0, 0, time.UTC)
+	h := &TestCaseHistory{Label: historyLabel, Name: "TestA"}
+	outcomes := []string{OutcomeFail, OutcomePass, OutcomeFail, OutcomeFlaky, OutcomePass, OutcomePass}
+	hashes := []string{"a", "a", "b", "c", "c", "d"}
+	for i, outcome := range outcomes {
+		entry := historyEntry(historyLabel, "TestA", outcome, hashes[i], start.Add(time.Duration(i)*time.Hour))
+		entry.Duration = time.Duration(i+1) * time.Second
+		h.Entries = append(h.Entries, entry)
+	}
+	outcome, streak := h.Streak()
+	assert.Equal(t, OutcomePass, outcome)
+	assert.Equal(t, 3, streak)
+	assert.False(t, h.Failed())
+	// The first failure has the same hash as a later pass, and one run was a flaky pass.
+	// The second failure's hash never passed so it's considered a real failure.
+	assert.InDelta(t, 2.0/6.0, h.FlakeRate(), 0.0001)
+	// Passing durations are 2, 4, 5 & 6 seconds.
+	assert.Equal(t, 4*time.Second, h.Percentile(50))
+	assert.Equal(t, 6*time.Second, h.Percentile(95))
+}
+
+func TestLoadHistoricalFailures(t *testing.T) {
+	filename := tempHistoryFile(t)
+	defer os.RemoveAll(filepath.Dir(filename))
+	other := core.ParseBuildLabel("//src/test:other_test", "")
+	start := time.Date(2020, time.May, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, appendHistory(filename, []HistoryEntry{
+		historyEntry(historyLabel, "TestRemoved", OutcomeFail, "abc", start),
+		historyEntry(historyLabel, "TestFixed", OutcomeFail, "abc", start),
+		historyEntry(other, "TestC", OutcomeError, "def", start),
+	}))
+	require.NoError(t, appendHistory(filename, []HistoryEntry{
+		historyEntry(historyLabel, "TestFixed", OutcomePass, "abd", start.Add(time.Hour)),
+		historyEntry(historyLabel, "TestBroken", OutcomeFail, "abd", start.Add(time.Hour)),
+	}))
+	labels, args := loadHistoricalFailures(filename)
+	assert.Equal(t, []core.BuildLabel{historyLabel, other}, labels)
+	assert.Equal(t, map[core.BuildLabel][]string{
+		historyLabel: {"TestBroken"},
+		other:        {"TestC"},
+	}, args)
+}
+
+func TestHistoryTrimmed(t *testing.T) {
+	filename := tempHistoryFile(t)
+	defer os.RemoveAll(filepath.Dir(filename))
+	defer func(size int64) { maxHistorySize = size }(maxHistorySize)
+	maxHistorySize = 1000
+	start := time.Date(2020, time.May, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, appendHistory(filename, []HistoryEntry{
+			historyEntry(historyLabel, "TestA", OutcomePass, "abc", start.Add(time.Duration(i)*time.Hour)),
+		}))
+		info, err := os.Stat(filename)
+		require.NoError(t, err)
+		assert.True(t, info.Size() <= maxHistorySize)
+	}
+	histories, err := LoadHistory(filename, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(histories))
+	h := histories[0]
+	// The oldest entries have been discarded but the most recent is still there.
+	assert.True(t, len(h.Entries) < 20)
+	assert.Equal(t, start.Add(19*time.Hour), h.Last().Time)
+	// Every remaining line should be a whole entry.
+	assert.Equal(t, len(h.Entries), countLines(filename))
+}
+
+func historyEntry(label core.BuildLabel, name, outcome, hash string, t time.Time) HistoryEntry {
+	return HistoryEntry{Label: label, Name: name, Outcome: outcome, Hash: hash, Time: t}
+}
+
+func tempHistoryFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "history_test")
+	require.NoError(t, err)
+	return filepath.Join(dir, "log", "test_history.jsonl")
+}
@@ -0,0 +1,258 @@
+// Code for writing coverage results as a static HTML site.
+
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+const htmlCoverageStyle = `
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 2px 12px; text-align: left; }
+td.pct { text-align: right; }
+tr.dir td { font-weight: bold; padding-top: 8px; }
+.low { color: #c00; }
+.medium { color: #c60; }
+.high { color: #080; }
+table.source td { font-family: monospace; white-space: pre; padding: 0 8px; }
+table.source td.lineno { color: #999; text-align: right; user-select: none; }
+tr.C { background: #dfd; }
+tr.U { background: #fdd; }
+tr.X { background: #ffc; }
+tr.changed td.lineno { background: #99f; color: #000; }
+`
+
+var htmlCoverageIndexTemplate = template.Must(template.New("index").Funcs(htmlCoverageFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Coverage report</title>
+<style>{{ .Style }}</style>
+</head>
+<body>
+<h1>Coverage report</h1>
+<p>Total coverage: <span class="{{ grade .Total }}">{{ pct .Total }}</span></p>
+{{ if .Incremental }}<p>Incremental coverage: <span class="{{ grade .Incremental.Percentage }}">{{ pct .Incremental.Percentage }}</span> ({{ .Incremental.CoveredLines }} of {{ .Incremental.ModifiedLines }} modified lines in {{ .Incremental.ModifiedFiles }} files)</p>{{ end }}
+<table>
+<tr><th>File</th><th>Coverage</th><th>Lines</th></tr>
+{{ range .Dirs }}<tr class="dir"><td>{{ .Name }}/</td><td class="pct {{ grade .Percentage }}">{{ pct .Percentage }}</td><td></td></tr>
+{{ range .Files }}<tr><td>&nbsp;&nbsp;<a href="{{ .Link }}">{{ .Base }}</a>{{ if .Changed }} *{{ end }}</td><td class="pct {{ grade .Percentage }}">{{ pct .Percentage }}</td><td class="pct">{{ .Covered }} / {{ .Total }}</td></tr>
+{{ end }}{{ end }}</table>
+</body>
+</html>
+`))
+
+var htmlCoverageFileTemplate = template.Must(template.New("file").Funcs(htmlCoverageFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{ .Name }}</title>
+<style>{{ .Style }}</style>
+</head>
+<body>
+<p><a href="{{ .Index }}">Index</a></p>
+<h1>{{ .Name }}</h1>
+<p>Coverage: <span class="{{ grade .Percentage }}">{{ pct .Percentage }}</span> ({{ .Covered }} of {{ .Total }} lines)</p>
+{{ if .Error }}<p class="low">Can't read source: {{ .Error }}</p>{{ end }}
+<table class="source">
+{{ range .Lines }}<tr class="{{ .Class }}{{ if .Changed }} changed{{ end }}"><td class="lineno" id="L{{ .Number }}">{{ .Number }}</td><td>{{ .Text }}</td></tr>
+{{ end }}</table>
+</body>
+</html>
+`))
+
+var htmlCoverageFuncs = template.FuncMap{
+	"pct": func(p float32) string { return fmt.Sprintf("%.1f%%", p) },
+	"grade": func(p float32) string {
+		if p < 60.0 {
+			return "low"
+		} else if p < 80.0 {
+			return "medium"
+		}
+		return "high"
+	},
+}
+
+type htmlCoverageIndex struct {
+	Style       template.CSS
+	Total       float32
+	Incremental *IncrementalStats
+	Dirs        []*htmlCoverageDir
+}
+
+type htmlCoverageDir struct {
+	Name       string
+	Percentage float32
+	Files      []*htmlCoverageFile
+}
+
+type htmlCoverageFile struct {
+	Style          template.CSS
+	Name, Base     string
+	Link, Index    string
+	Percentage     float32
+	Covered, Total int
+	Changed        bool
+	Error          string
+	Lines          []htmlCoverageLine
+}
+
+type htmlCoverageLine struct {
+	Number  int
+	Text    string
+	Class   string
+	Changed bool
+}
+
+// htmlCoverageMarker is a file we write into the report directory listing the files in the report,
+// so we know which ones we can remove when writing a new report there.
+const htmlCoverageMarker = ".plz_coverage_report"
+
+// WriteHTMLCoverageReportOrDie writes the collected coverage data to the given directory as a set of
+// HTML pages. If changedLines is given then those lines are highlighted. Dies on failure.
+func WriteHTMLCoverageReportOrDie(coverage core.TestCoverage, dir string, changedLines map[string][]int, incrementalStats *IncrementalStats) {
+	if err := writeHTMLCoverageReport(coverage, dir, changedLines, incrementalStats); err != nil {
+		log.Fatalf("Failed to write HTML coverage report to %s: %s", dir, err)
+	}
+}
+
+func writeHTMLCoverageReport(coverage core.TestCoverage, dir string, changedLines map[string][]int, incrementalStats *IncrementalStats) error {
+	if err := cleanHTMLCoverageReport(dir); err != nil {
+		return err
+	}
+	written := []string{}
+	stats := getStats(coverage)
+	dirCoverage := getDirectoryCoverage(coverage)
+	index := &htmlCoverageIndex{
+		Style:       template.CSS(htmlCoverageStyle),
+		Total:       stats.TotalCoverage,
+		Incremental: incrementalStats,
+	}
+	dirs := map[string]*htmlCoverageDir{}
+	for _, file := range coverage.OrderedFiles() {
+		lines, present := coverage.Files[file]
+		if !present {
+			continue
+		}
+		covered, total := CountCoverage(lines)
+		f := &htmlCoverageFile{
+			Style:      template.CSS(htmlCoverageStyle),
+			Name:       file,
+			Base:       path.Base(file),
+			Link:       path.Join("files", file+".html"),
+			Index:      strings.Repeat("../", strings.Count(file, "/")+1) + "index.html",
+			Percentage: stats.CoverageByFile[file],
+			Covered:    covered,
+			Total:      total,
+			Changed:    len(changedLines[file]) > 0,
+		}
+		if err := f.readLines(lines, changedLines[file]); err != nil {
+			f.Error = err.Error()
+		}
+		if err := writeHTMLTemplate(htmlCoverageFileTemplate, path.Join(dir, f.Link), f); err != nil {
+			return err
+		}
+		written = append(written, f.Link)
+		f.Lines = nil // Don't need to keep these around any longer.
+		dirname := path.Dir(file)
+		d, present := dirs[dirname]
+		if !present {
+			d = &htmlCoverageDir{Name: dirname, Percentage: dirCoverage[dirname]}
+			dirs[dirname] = d
+			index.Dirs = append(index.Dirs, d)
+		}
+		d.Files = append(d.Files, f)
+	}
+	sort.SliceStable(index.Dirs, func(i, j int) bool { return index.Dirs[i].Name < index.Dirs[j].Name })
+	if err := writeHTMLTemplate(htmlCoverageIndexTemplate, path.Join(dir, "index.html"), index); err != nil {
+		return err
+	}
+	written = append(written, "index.html")
+	return ioutil.WriteFile(path.Join(dir, htmlCoverageMarker), []byte(strings.Join(written, "\n")+"\n"), 0644)
+}
+
+// cleanHTMLCoverageReport removes the files written by a previous report in the given directory.
+// It won't touch anything else, and refuses to use a directory that already has other things in it
+// and no previous report, since that's likely to be a mistake (e.g. --html_report=.)
+func cleanHTMLCoverageReport(dir string) error {
+	contents, err := ioutil.ReadFile(path.Join(dir, htmlCoverageMarker))
+	if os.IsNotExist(err) {
+		if entries, err := ioutil.ReadDir(dir); err == nil && len(entries) > 0 {
+			return fmt.Errorf("%s already exists and doesn't contain a previous coverage report; refusing to write into it", dir)
+		} else if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, file := range strings.Split(string(contents), "\n") {
+		// Don't trust the marker to only name files within the report directory.
+		if file = path.Clean(file); file == "." || path.IsAbs(file) || strings.HasPrefix(file, "../") {
+			continue
+		}
+		if err := os.Remove(path.Join(dir, file)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// Tidy up any directories that are now empty; os.Remove fails harmlessly on any that aren't.
+		for d := path.Dir(file); d != "."; d = path.Dir(d) {
+			os.Remove(path.Join(dir, d))
+		}
+	}
+	return nil
+}
+
+// readLines reads the source of this file and annotates each line with its coverage.
+func (f *htmlCoverageFile) readLines(coverage []core.LineCoverage, changed []int) error {
+	changedLines := make(map[int]bool, len(changed))
+	for _, line := range changed {
+		changedLines[line] = true
+	}
+	file, err := os.Open(f.Name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for i := 0; scanner.Scan(); i++ {
+		cov := core.NotExecutable // Lines beyond the end of the coverage data are assumed not executable
+		if i < len(coverage) {
+			cov = coverage[i]
+		}
+		f.Lines = append(f.Lines, htmlCoverageLine{
+			Number:  i + 1,
+			Text:    scanner.Text(),
+			Class:   core.TestCoverageString([]core.LineCoverage{cov}),
+			Changed: changedLines[i+1],
+		})
+	}
+	return scanner.Err()
+}
+
+// writeHTMLTemplate executes a template into the given file.
+func writeHTMLTemplate(tmpl *template.Template, filename string, data interface{}) error {
+	if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+		return err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if err := tmpl.Execute(w, data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -6,6 +6,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/thought-machine/please/src/core"
@@ -23,7 +25,14 @@ func parseIstanbulCoverageResults(target *core.BuildTarget, coverage *core.TestC
 		return err
 	}
 	for filename, file := range files {
-		coverage.Files[sanitiseFileName(target, filename, run)] = file.toLineCoverage()
+		filename = sanitiseFileName(target, filename, run)
+		coverage.Files[filename] = file.toLineCoverage()
+		if branches := file.toBranchCoverage(); len(branches) > 0 {
+			coverage.Branches[filename] = branches
+		}
+		if functions := file.toFunctionCoverage(); len(functions) > 0 {
+			coverage.Functions[filename] = functions
+		}
 	}
 	coverage.Tests[target.Label] = coverage.Files
 	return nil
@@ -34,6 +43,27 @@ type istanbulFile struct {
 	StatementMap map[string]istanbulLocation `json:"statementMap"`
 	// Statements identifies the covered statements.
 	Statements map[string]int `json:"s"`
+	// FunctionMap identifies each function.
+	FunctionMap map[string]istanbulFunction `json:"fnMap"`
+	// Functions identifies the called functions.
+	Functions map[string]int `json:"f"`
+	// BranchMap identifies each branch point.
+	BranchMap map[string]istanbulBranch `json:"branchMap"`
+	// Branches identifies how many times each branch from each branch point was taken.
+	Branches map[string][]int `json:"b"`
+}
+
+// An istanbulFunction defines a single function in the instrumented source code.
+type istanbulFunction struct {
+	Name string           `json:"name"`
+	Decl istanbulLocation `json:"decl"`
+	Line int              `json:"line"` // Only present in older versions of the format
+}
+
+// An istanbulBranch defines a single branch point in the instrumented source code.
+type istanbulBranch struct {
+	Loc  istanbulLocation `json:"loc"`
+	Line int              `json:"line"` // Only present in older versions of the format
 }
 
 // An istanbulLocation defines a start/end location in the instrumented source code.
@@ -66,6 +96,46 @@ func (file *istanbulFile) toLineCoverage() []core.LineCoverage {
 	return ret
 }
 
+// toBranchCoverage converts the branches in this object to our internal format.
+func (file *istanbulFile) toBranchCoverage() []core.BranchCoverage {
+	ret := []core.BranchCoverage{}
+	for id, counts := range file.Branches {
+		block, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+		b := file.BranchMap[id]
+		line := b.Loc.Start.Line
+		if line == 0 {
+			line = b.Line
+		}
+		for i, count := range counts {
+			ret = append(ret, core.BranchCoverage{Line: line, Block: block, Branch: i, Taken: count > 0})
+		}
+	}
+	return core.MergeBranchCoverage(nil, ret) // Sorts them
+}
+
+// toFunctionCoverage converts the functions in this object to our internal format.
+func (file *istanbulFile) toFunctionCoverage() []core.FunctionCoverage {
+	ret := []core.FunctionCoverage{}
+	for id, count := range file.Functions {
+		f := file.FunctionMap[id]
+		line := f.Decl.Start.Line
+		if line == 0 {
+			line = f.Line
+		}
+		ret = append(ret, core.FunctionCoverage{Name: f.Name, Line: line, Called: count > 0})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Line != ret[j].Line {
+			return ret[i].Line < ret[j].Line
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
 // maxLineNumber returns the highest line number present in this file.
 func (file *istanbulFile) maxLineNumber() int {
 	max := 0
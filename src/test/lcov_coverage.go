@@ -0,0 +1,176 @@
+// Code for parsing and writing LCOV tracefiles.
+//
+// The format is described in the geninfo(1) man page; we only care about the per-line (DA),
+// per-branch (BRDA) and per-function (FN & FNDA) records, everything else is ignored when parsing.
+
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// looksLikeLCOVCoverageResults returns true if the given data appears to be an LCOV tracefile.
+func looksLikeLCOVCoverageResults(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return bytes.HasPrefix(data, []byte("TN:")) || bytes.HasPrefix(data, []byte("SF:"))
+}
+
+func parseLCOVCoverageResults(target *core.BuildTarget, coverage *core.TestCoverage, data []byte, run int) error {
+	filename := ""
+	var lines []core.LineCoverage
+	var branches []core.BranchCoverage
+	var functions []core.FunctionCoverage
+	for i, line := range bytes.Split(data, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if bytes.HasPrefix(line, []byte("SF:")) {
+			filename = strings.TrimPrefix(sanitiseFileName(target, string(line[3:]), run), core.RepoRoot+"/")
+			lines = nil
+			branches = nil
+			functions = nil
+		} else if bytes.HasPrefix(line, []byte("BRDA:")) {
+			// BRDA:<line>,<block>,<branch>,<taken>, where taken is - if the line was never executed.
+			fields := strings.Split(string(line[5:]), ",")
+			if len(fields) != 4 {
+				return fmt.Errorf("Bad branch record on line %d: %s", i+1, line)
+			}
+			b := core.BranchCoverage{Taken: fields[3] != "-" && fields[3] != "0"}
+			var err1, err2, err3 error
+			b.Line, err1 = strconv.Atoi(fields[0])
+			b.Block, err2 = strconv.Atoi(fields[1])
+			b.Branch, err3 = strconv.Atoi(fields[2])
+			if err1 != nil || err2 != nil || err3 != nil {
+				return fmt.Errorf("Bad branch record on line %d: %s", i+1, line)
+			}
+			branches = append(branches, b)
+		} else if bytes.HasPrefix(line, []byte("FN:")) {
+			// FN:<line>,<name>
+			fields := strings.SplitN(string(line[3:]), ",", 2)
+			lineno, err := strconv.Atoi(fields[0])
+			if err != nil || len(fields) != 2 {
+				return fmt.Errorf("Bad function record on line %d: %s", i+1, line)
+			}
+			functions = append(functions, core.FunctionCoverage{Name: fields[1], Line: lineno})
+		} else if bytes.HasPrefix(line, []byte("FNDA:")) {
+			// FNDA:<count>,<name>
+			fields := strings.SplitN(string(line[5:]), ",", 2)
+			if len(fields) != 2 {
+				return fmt.Errorf("Bad function record on line %d: %s", i+1, line)
+			}
+			for j, f := range functions {
+				if f.Name == fields[1] {
+					functions[j].Called = fields[0] != "0"
+				}
+			}
+		} else if bytes.HasPrefix(line, []byte("DA:")) {
+			if filename == "" {
+				return fmt.Errorf("Line record outside a file record on line %d: %s", i+1, line)
+			}
+			fields := strings.Split(string(line[3:]), ",")
+			if len(fields) < 2 {
+				return fmt.Errorf("Bad line record on line %d: %s", i+1, line)
+			}
+			lineno, err := strconv.Atoi(fields[0])
+			if err != nil || lineno < 1 {
+				return fmt.Errorf("Bad line number on line %d: %s", i+1, line)
+			}
+			// Some tools (e.g. grcov) can emit negative counts on overflow; treat anything nonzero as covered.
+			count, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("Bad execution count on line %d: %s", i+1, line)
+			}
+			for len(lines) < lineno {
+				lines = append(lines, core.NotExecutable)
+			}
+			if count != 0 {
+				lines[lineno-1] = core.Covered
+			} else if lines[lineno-1] != core.Covered {
+				lines[lineno-1] = core.Uncovered
+			}
+		} else if bytes.Equal(line, []byte("end_of_record")) {
+			if filename != "" {
+				// The same file can appear in several records (e.g. once per test name), so merge them.
+				coverage.Files[filename] = core.MergeCoverageLines(coverage.Files[filename], lines)
+				if len(branches) > 0 {
+					coverage.Branches[filename] = core.MergeBranchCoverage(coverage.Branches[filename], branches)
+				}
+				if len(functions) > 0 {
+					coverage.Functions[filename] = core.MergeFunctionCoverage(coverage.Functions[filename], functions)
+				}
+			}
+			filename = ""
+			lines = nil
+			branches = nil
+			functions = nil
+		}
+	}
+	coverage.Tests[target.Label] = coverage.Files
+	return nil
+}
+
+// WriteLCOVCoverageToFileOrDie writes the collected coverage data to a file as an LCOV tracefile. Dies on failure.
+func WriteLCOVCoverageToFileOrDie(coverage core.TestCoverage, filename string) {
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Fatalf("Failed to write coverage results to %s: %s", filename, err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	writeLCOVCoverage(w, coverage)
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Failed to write coverage results to %s: %s", filename, err)
+	}
+}
+
+func writeLCOVCoverage(w io.Writer, coverage core.TestCoverage) {
+	files := make([]string, 0, len(coverage.Files))
+	for file := range coverage.Files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		fmt.Fprintf(w, "TN:\nSF:%s\n", file)
+		if functions := coverage.Functions[file]; len(functions) > 0 {
+			for _, f := range functions {
+				fmt.Fprintf(w, "FN:%d,%s\n", f.Line, f.Name)
+			}
+			for _, f := range functions {
+				if f.Called {
+					fmt.Fprintf(w, "FNDA:1,%s\n", f.Name)
+				} else {
+					fmt.Fprintf(w, "FNDA:0,%s\n", f.Name)
+				}
+			}
+			called, total := CountFunctionCoverage(functions)
+			fmt.Fprintf(w, "FNF:%d\nFNH:%d\n", total, called)
+		}
+		if branches := coverage.Branches[file]; len(branches) > 0 {
+			for _, b := range branches {
+				if b.Taken {
+					fmt.Fprintf(w, "BRDA:%d,%d,%d,1\n", b.Line, b.Block, b.Branch)
+				} else {
+					fmt.Fprintf(w, "BRDA:%d,%d,%d,0\n", b.Line, b.Block, b.Branch)
+				}
+			}
+			taken, total := CountBranchCoverage(branches)
+			fmt.Fprintf(w, "BRF:%d\nBRH:%d\n", total, taken)
+		}
+		for i, line := range coverage.Files[file] {
+			if line == core.Covered {
+				fmt.Fprintf(w, "DA:%d,1\n", i+1)
+			} else if line != core.NotExecutable {
+				fmt.Fprintf(w, "DA:%d,0\n", i+1)
+			}
+		}
+		covered, total := CountCoverage(coverage.Files[file])
+		fmt.Fprintf(w, "LF:%d\nLH:%d\nend_of_record\n", total, covered)
+	}
+}
@@ -0,0 +1,148 @@
+// Support for quarantining flaky tests.
+//
+// Tests listed in the quarantine file still run, but if they fail it doesn't fail the build;
+// the failures are reported separately so people can keep track of them.
+
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A quarantine is the set of tests listed in the quarantine file.
+type quarantine struct {
+	targets map[core.BuildLabel]bool            // Targets that are quarantined in their entirety
+	cases   map[core.BuildLabel]map[string]bool // Individual test cases that are quarantined
+}
+
+// loadedQuarantine is the quarantine loaded from the configured file.
+var loadedQuarantine struct {
+	q    *quarantine
+	once sync.Once
+}
+
+// getQuarantine returns the quarantine for the given config, loading it if needed.
+// It returns nil if there isn't one configured.
+func getQuarantine(config *core.Configuration) *quarantine {
+	loadedQuarantine.once.Do(func() {
+		if config.Test.QuarantineFile == "" {
+			return
+		}
+		f, err := os.Open(config.Test.QuarantineFile)
+		if err != nil {
+			log.Warning("Failed to read quarantine file: %s", err)
+			return
+		}
+		defer f.Close()
+		q, err := parseQuarantine(f)
+		if err != nil {
+			log.Warning("Failed to parse quarantine file %s: %s", config.Test.QuarantineFile, err)
+			return
+		}
+		loadedQuarantine.q = q
+	})
+	return loadedQuarantine.q
+}
+
+// parseQuarantine parses the contents of a quarantine file.
+func parseQuarantine(r io.Reader) (*quarantine, error) {
+	q := &quarantine{
+		targets: map[core.BuildLabel]bool{},
+		cases:   map[core.BuildLabel]map[string]bool{},
+	}
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		target, testCase := line, ""
+		if idx := strings.IndexAny(line, " \t"); idx != -1 {
+			target, testCase = line[:idx], strings.TrimSpace(line[idx+1:])
+		}
+		label, err := core.TryParseBuildLabel(target, "", "")
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		if testCase == "" {
+			q.targets[label] = true
+		} else if cases, present := q.cases[label]; present {
+			cases[testCase] = true
+		} else {
+			q.cases[label] = map[string]bool{testCase: true}
+		}
+	}
+	return q, scanner.Err()
+}
+
+// Apply marks any failing test cases of the given target as quarantined if they're listed.
+func (q *quarantine) Apply(target *core.BuildTarget) {
+	target.UpdateTestResults(func(results *core.TestSuite) {
+		q.apply(target.Label, results)
+	})
+}
+
+// apply marks any failing test cases in the given results as quarantined if they're listed.
+func (q *quarantine) apply(label core.BuildLabel, results *core.TestSuite) {
+	cases := q.cases[label]
+	if !q.targets[label] && cases == nil {
+		return
+	}
+	for i, testCase := range results.TestCases {
+		if testCase.Success() != nil || testCase.Skip() != nil {
+			continue
+		} else if q.targets[label] || cases[testCase.Name] || (testCase.ClassName != "" && cases[testCase.ClassName+"."+testCase.Name]) {
+			results.TestCases[i].Quarantined = true
+		}
+	}
+}
+
+// WriteFlakyTestsOrDie writes all the test cases that only passed on retry to the given file,
+// in the same format as the quarantine file.
+func WriteFlakyTestsOrDie(graph *core.BuildGraph, filename string) {
+	if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+		log.Fatalf("Failed to create directory for flaky test report: %s", err)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Fatalf("Failed to write flaky test report: %s", err)
+	}
+	defer f.Close()
+	if err := writeFlakyTests(f, graph.AllTargets()); err != nil {
+		log.Fatalf("Failed to write flaky test report: %s", err)
+	}
+}
+
+func writeFlakyTests(w io.Writer, targets []*core.BuildTarget) error {
+	for _, target := range targets {
+		if !target.IsTest {
+			continue
+		}
+		names := []string{}
+		for _, testCase := range target.Results.TestCases {
+			if testCase.Success() != nil && len(testCase.Executions) > 1 {
+				if testCase.ClassName != "" {
+					names = append(names, testCase.ClassName+"."+testCase.Name)
+				} else {
+					names = append(names, testCase.Name)
+				}
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if _, err := fmt.Fprintf(w, "%s %s\n", target.Label, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
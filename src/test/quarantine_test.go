@@ -0,0 +1,101 @@
+package test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+const testQuarantine = `
+# Flaky tests
+//src/core:core_test
+//src/test:results_test TestFlaky
+//src/test:results_test   TestAlsoFlaky
+//src/test:results_test ResultsTest.testWithClass
+`
+
+func TestParseQuarantine(t *testing.T) {
+	q, err := parseQuarantine(strings.NewReader(testQuarantine))
+	require.NoError(t, err)
+	assert.Equal(t, map[core.BuildLabel]bool{
+		core.ParseBuildLabel("//src/core:core_test", ""): true,
+	}, q.targets)
+	assert.Equal(t, map[core.BuildLabel]map[string]bool{
+		core.ParseBuildLabel("//src/test:results_test", ""): {
+			"TestFlaky":                 true,
+			"TestAlsoFlaky":             true,
+			"ResultsTest.testWithClass": true,
+		},
+	}, q.cases)
+}
+
+// quarantineFailure is a failed execution of a test case.
+var quarantineFailure = core.TestExecution{Failure: &core.TestResultFailure{Message: "it broke"}}
+
+func TestParseQuarantineInvalid(t *testing.T) {
+	_, err := parseQuarantine(strings.NewReader("//src/core:core_test\nnot a label\n"))
+	assert.Error(t, err)
+}
+
+func TestApplyQuarantine(t *testing.T) {
+	q, err := parseQuarantine(strings.NewReader(testQuarantine))
+	require.NoError(t, err)
+	results := core.TestSuite{
+		TestCases: []core.TestCase{
+			{Name: "TestFlaky", Executions: []core.TestExecution{quarantineFailure}},
+			{Name: "TestBroken", Executions: []core.TestExecution{quarantineFailure}},
+			{ClassName: "ResultsTest", Name: "testWithClass", Executions: []core.TestExecution{quarantineFailure}},
+			{Name: "TestAlsoFlaky", Executions: []core.TestExecution{{}}},
+		},
+	}
+	q.apply(core.ParseBuildLabel("//src/test:results_test", ""), &results)
+	assert.True(t, results.TestCases[0].Quarantined)
+	assert.False(t, results.TestCases[1].Quarantined)
+	assert.True(t, results.TestCases[2].Quarantined)
+	assert.False(t, results.TestCases[3].Quarantined) // It passed so there's nothing to quarantine
+	assert.Equal(t, 1, results.Failures())
+	assert.Equal(t, 2, results.Quarantined())
+	assert.False(t, results.TestCases.AllSucceeded())
+
+	results.TestCases = results.TestCases[2:]
+	assert.Equal(t, 0, results.Failures())
+	assert.True(t, results.TestCases.AllSucceeded())
+}
+
+func TestApplyQuarantineWholeTarget(t *testing.T) {
+	q, err := parseQuarantine(strings.NewReader(testQuarantine))
+	require.NoError(t, err)
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/core:core_test", ""))
+	target.AddTestResults(core.TestSuite{
+		TestCases: []core.TestCase{{Name: "TestAnything", Executions: []core.TestExecution{quarantineFailure}}, {Name: "TestPass", Executions: []core.TestExecution{{}}}},
+	})
+	q.Apply(target)
+	assert.True(t, target.Results.TestCases.AllSucceeded())
+	assert.Equal(t, 1, target.Results.Quarantined())
+	assert.Equal(t, "1 test passed. 1 quarantined", testSuccessDescription(&target.Results))
+}
+
+func TestWriteFlakyTests(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:results_test", ""))
+	target.IsTest = true
+	target.Results.TestCases = []core.TestCase{
+		{Name: "TestStable", Executions: []core.TestExecution{{}}},
+		{Name: "TestFlaky", Executions: []core.TestExecution{quarantineFailure, {}}},
+		{ClassName: "ResultsTest", Name: "testFlaky", Executions: []core.TestExecution{quarantineFailure, {}}},
+		{Name: "TestBroken", Executions: []core.TestExecution{quarantineFailure}},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, writeFlakyTests(&buf, []*core.BuildTarget{target}))
+	assert.Equal(t, "//src/test:results_test ResultsTest.testFlaky\n//src/test:results_test TestFlaky\n", buf.String())
+
+	// The output should be readable as a quarantine file.
+	q, err := parseQuarantine(&buf)
+	require.NoError(t, err)
+	assert.True(t, q.cases[target.Label]["TestFlaky"])
+	assert.True(t, q.cases[target.Label]["ResultsTest.testFlaky"])
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/thought-machine/please/src/cli"
 	"github.com/thought-machine/please/src/core"
 	"github.com/thought-machine/please/src/fs"
 )
@@ -43,6 +44,10 @@ func parseTestResultDatum(data []byte) (core.TestSuite, error) {
 			testSuite.Collapse(suite)
 		}
 		return testSuite, err
+	} else if looksLikeTAPTestResults(data) {
+		return parseTAPTestResults(data)
+	} else if looksLikeTest2JSONTestResults(data) {
+		return parseTest2JSONTestResults(data)
 	} else {
 		return parseGoTestResults(data)
 	}
@@ -67,10 +72,16 @@ func readTestResultsDir(outputDir string) ([][]byte, error) {
 }
 
 // LoadPreviousFailures loads any failed tests from the given results file.
-// It returns the set of targets that should be run and any arguments for them.
-func LoadPreviousFailures(filename string) ([]core.BuildLabel, []string) {
+// Tests that failed the last time they ran according to the test history are included too,
+// so earlier failures aren't forgotten if other tests have been run since.
+// It returns the set of targets that should be run and the test cases to run for each of them.
+func LoadPreviousFailures(filename string) ([]core.BuildLabel, map[core.BuildLabel][]string) {
+	labels, args := loadHistoricalFailures(HistoryFile)
 	f, err := os.Open(filename)
 	if err != nil {
+		if len(labels) > 0 {
+			return labels, args
+		}
 		log.Fatalf("Failed to read previous test results: %s", err)
 	}
 	defer f.Close()
@@ -80,15 +91,23 @@ func LoadPreviousFailures(filename string) ([]core.BuildLabel, []string) {
 	if err := xml.NewDecoder(f).Decode(&junit); err != nil {
 		log.Fatalf("Failed to read previous test results: %s", err)
 	}
-	labels := []core.BuildLabel{}
-	args := []string{}
+	if args == nil {
+		args = map[core.BuildLabel][]string{}
+	}
+	seenLabels := map[core.BuildLabel]bool{}
+	for _, label := range labels {
+		seenLabels[label] = true
+	}
 	for _, suite := range junit.TestSuites {
 		if suite.Failures > 0 {
-			labels = append(labels, core.NewBuildLabel(
-				strings.Replace(suite.Package, ".", "/", -1), suite.Name))
+			label := core.NewBuildLabel(strings.Replace(suite.Package, ".", "/", -1), suite.Name)
+			if !seenLabels[label] {
+				labels = append(labels, label)
+				seenLabels[label] = true
+			}
 			for _, c := range suite.TestCases {
-				if c.Failure != nil || c.Error != nil {
-					args = append(args, c.Name)
+				if (c.Failure != nil || c.Error != nil) && !cli.ContainsString(c.Name, args[label]) {
+					args[label] = append(args[label], c.Name)
 				}
 			}
 		}
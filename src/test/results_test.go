@@ -2,6 +2,7 @@ package test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -186,3 +187,85 @@ func TestParseGoFileWithLogging(t *testing.T) {
 	assert.Equal(t, 3, results.Passes())
 	assert.Equal(t, 0, results.Failures())
 }
+
+func TestTAP13(t *testing.T) {
+	results, err := parseTestResultsFile("src/test/test_data/tap_13.txt")
+	require.NoError(t, err)
+	assert.Equal(t, 6, len(results.TestCases))
+	assert.Equal(t, 2, results.Passes())
+	assert.Equal(t, 2, results.Failures())
+	assert.Equal(t, 2, results.Skips())
+	assert.Equal(t, "parses the file", results.TestCases[1].Name)
+	assert.Contains(t, results.TestCases[1].Executions[0].Failure.Traceback, "Failed test 'parses the file'")
+	assert.Equal(t, "no locale support", results.TestCases[2].Executions[0].Skip.Message)
+	assert.Equal(t, "TODO widgets not written yet", results.TestCases[3].Executions[0].Skip.Message)
+	assert.Equal(t, 12500*time.Microsecond, *results.TestCases[4].Executions[0].Duration)
+	assert.Equal(t, "temporary directory still exists", results.TestCases[5].Executions[0].Failure.Message)
+}
+
+func TestTAP14Subtests(t *testing.T) {
+	results, err := parseTestResultsFile("src/test/test_data/tap_14_subtests.txt")
+	require.NoError(t, err)
+	names := make([]string, len(results.TestCases))
+	for i, tc := range results.TestCases {
+		names[i] = tc.Name
+	}
+	assert.Equal(t, []string{
+		"parser/parses numbers",
+		"parser/parses strings",
+		"parser",
+		"writer/writes numbers",
+		"writer/strings/escapes quotes",
+		"writer/strings",
+		"writer",
+	}, names)
+	assert.Equal(t, 4, results.Passes())
+	assert.Equal(t, 3, results.Failures())
+}
+
+func TestTAPBailOut(t *testing.T) {
+	results, err := parseTestResultsFile("src/test/test_data/tap_bailout.txt")
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(results.TestCases))
+	assert.Equal(t, 1, results.Passes())
+	assert.Equal(t, 1, results.Errors())
+	assert.Equal(t, "Couldn't create the test table", results.TestCases[1].Executions[0].Error.Message)
+}
+
+func TestTAPSkipAll(t *testing.T) {
+	results, err := parseTestResultsFile("src/test/test_data/tap_skip_all.txt")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(results.TestCases))
+	assert.Equal(t, 1, results.Skips())
+	assert.Equal(t, "no network access", results.TestCases[0].Executions[0].Skip.Message)
+}
+
+func TestTAPPlanMismatch(t *testing.T) {
+	results, err := parseTestResultDatum([]byte("1..3\nok 1\nok 2\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(results.TestCases))
+	assert.Equal(t, 2, results.Passes())
+	assert.Equal(t, 1, results.Errors())
+}
+
+func TestLooksLikeTAP(t *testing.T) {
+	assert.True(t, looksLikeTAPTestResults([]byte("TAP version 13\nok\n")))
+	assert.True(t, looksLikeTAPTestResults([]byte("1..2\nok 1\nok 2\n")))
+	assert.True(t, looksLikeTAPTestResults([]byte("not ok 1 - fails\n")))
+	assert.False(t, looksLikeTAPTestResults([]byte("ok  \tgithub.com/thought-machine/please/src/test\t0.123s\n")))
+	assert.False(t, looksLikeTAPTestResults([]byte("ok\n")))
+}
+
+func TestGoTest2JSON(t *testing.T) {
+	results, err := parseTestResultsFile("src/test/test_data/go_test2json.json")
+	require.NoError(t, err)
+	assert.Equal(t, 6, len(results.TestCases))
+	assert.Equal(t, 4, results.Passes())
+	assert.Equal(t, 1, results.Failures())
+	assert.Equal(t, 1, results.Skips())
+	assert.Equal(t, "    my_test.go:6: some logging\n", results.TestCases[0].Executions[0].Stdout)
+	assert.Equal(t, 20*time.Millisecond, *results.TestCases[0].Executions[0].Duration)
+	assert.Equal(t, "    my_test.go:10: This test is going to fail.", results.TestCases[1].Executions[0].Failure.Traceback)
+	assert.Equal(t, "my_test.go:14: This test is skipped", results.TestCases[2].Executions[0].Skip.Message)
+	assert.Equal(t, "TestSubtests/first", results.TestCases[3].Name)
+}
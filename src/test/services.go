@@ -0,0 +1,152 @@
+// Support for services that are started alongside tests.
+//
+// Services are binary targets that plz runs in the background before the test command and
+// stops again afterwards. They're started from the same shell as the test so they share its
+// sandbox (and hence its network namespace) when the test is sandboxed.
+// Each one runs in its own directory alongside its runtime files, as it would under plz run.
+
+package test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// serviceDir is the directory within the test directory that services are set up in.
+const serviceDir = "test_services"
+
+// serviceStartTimeout is how long we wait for a service to become ready.
+const serviceStartTimeout = 1 * time.Minute
+
+// serviceStopTimeout is how long we give services to exit after asking them to.
+const serviceStopTimeout = 2 * time.Second
+
+// A testService is a single service that's started for a test.
+type testService struct {
+	Name    string // Unique name of the service, derived from its label
+	Binary  string // Path to the binary, relative to the service's directory
+	LogFile string // Path of the file its output is written to, relative to the test directory
+	Port    int
+}
+
+// envPrefix returns the prefix of the environment variables we export for this service.
+func (s *testService) envPrefix() string {
+	return strings.ToUpper(s.Name)
+}
+
+// Dir returns the directory that this service runs in, relative to the test directory.
+func (s *testService) Dir() string {
+	return path.Join(serviceDir, s.Name)
+}
+
+// ReadyFile returns the path of the file that the service can create to indicate it's ready.
+func (s *testService) ReadyFile() string {
+	return path.Join(serviceDir, s.Name+".ready")
+}
+
+// prepareTestServices copies the binaries and runtime data for a test's services into its
+// test directory and allocates each of them a port.
+func prepareTestServices(graph *core.BuildGraph, target *core.BuildTarget, run int) ([]*testService, error) {
+	services := make([]*testService, 0, len(target.TestServices))
+	for _, label := range target.TestServices {
+		svc := graph.TargetOrDie(label)
+		if !svc.IsBinary || len(svc.Outputs()) != 1 {
+			return nil, fmt.Errorf("test service %s must be a binary rule with a single output", label)
+		}
+		port, err := freePort()
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate a port for test service %s: %s", label, err)
+		}
+		s := &testService{
+			Name:    core.TestServiceName(label),
+			Binary:  svc.Outputs()[0],
+			LogFile: target.TestServiceLogFile(label),
+			Port:    port,
+		}
+		dir := path.Join(target.TestDir(run), s.Dir())
+		for file := range core.IterRuntimeFiles(graph, svc, false, run) {
+			file.Tmp = path.Join(dir, file.Tmp)
+			if err := core.PrepareSourcePair(file); err != nil {
+				return nil, err
+			}
+		}
+		if err := os.MkdirAll(path.Join(target.TestDir(run), path.Dir(s.LogFile)), core.DirPermissions); err != nil {
+			return nil, err
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// freePort returns a port that is currently free on the local machine.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// serviceCommand wraps the given test command in a script that starts the given services,
+// waits for them to be ready, and stops them once the test is done.
+// Each service is passed PORT and READY_FILE; it counts as ready once something is listening
+// on that port or once it creates that file.
+func serviceCommand(services []*testService, cmd string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `_plz_test_dir="$PWD"
+_plz_service_pids=""
+_plz_stop_services() {
+    for pid in $_plz_service_pids; do kill -TERM $pid 2>/dev/null || true; done
+    for i in $(seq %d); do
+        _plz_running=""
+        for pid in $_plz_service_pids; do
+            if kill -0 $pid 2>/dev/null; then _plz_running="$_plz_running $pid"; fi
+        done
+        if [ -z "$_plz_running" ]; then return 0; fi
+        sleep 0.1
+    done
+    for pid in $_plz_running; do kill -KILL $pid 2>/dev/null || true; done
+}
+_plz_wait_for_service() {
+    for i in $(seq %d); do
+        if [ -e "$3" ] || (echo > /dev/tcp/127.0.0.1/$2) 2>/dev/null; then return 0; fi
+        if ! kill -0 $4 2>/dev/null; then
+            echo "Test service $1 exited before it was ready, see $5" >&2
+            return 1
+        fi
+        sleep 0.1
+    done
+    echo "Timed out waiting for test service $1 to be ready, see $5" >&2
+    return 1
+}
+trap _plz_stop_services EXIT
+`, serviceStopTimeout/(100*time.Millisecond), serviceStartTimeout/(100*time.Millisecond))
+	for _, s := range services {
+		fmt.Fprintf(&b, "(cd %s && export PORT=%d READY_FILE=\"$_plz_test_dir/%s\" && exec ./%s) > %s 2>&1 &\n", s.Dir(), s.Port, s.ReadyFile(), s.Binary, s.LogFile)
+		b.WriteString("_plz_service_pids=\"$_plz_service_pids $!\"\n")
+		fmt.Fprintf(&b, "_plz_wait_for_service %s %d %s $! %s\n", s.Name, s.Port, s.ReadyFile(), s.LogFile)
+	}
+	b.WriteString("unset -f _plz_wait_for_service\nunset _plz_test_dir\n")
+	b.WriteString(cmd)
+	return b.String()
+}
+
+// serviceEnv returns the environment variables that tell the test where to find its services.
+func serviceEnv(services []*testService) []string {
+	env := make([]string, 0, 2*len(services))
+	for _, s := range services {
+		prefix := s.envPrefix()
+		env = append(env,
+			fmt.Sprintf("%s_ADDR=127.0.0.1:%d", prefix, s.Port),
+			fmt.Sprintf("%s_PORT=%d", prefix, s.Port),
+		)
+	}
+	return env
+}
@@ -0,0 +1,124 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+const fakeService = `#!/bin/bash
+echo "listening on $PORT"
+touch $READY_FILE
+exec sleep 60
+`
+
+const brokenService = `#!/bin/bash
+echo "can't start"
+exit 1
+`
+
+func TestServiceEnv(t *testing.T) {
+	services := []*testService{
+		{Name: core.TestServiceName(core.ParseBuildLabel("//:fake_server", "")), Port: 1234},
+		{Name: core.TestServiceName(core.ParseBuildLabel("//a:db-1", "")), Port: 4321},
+		{Name: core.TestServiceName(core.ParseBuildLabel("//b:db-1", "")), Port: 5432},
+	}
+	assert.Equal(t, []string{
+		"FAKE_SERVER_ADDR=127.0.0.1:1234",
+		"FAKE_SERVER_PORT=1234",
+		"A_DB_1_ADDR=127.0.0.1:4321",
+		"A_DB_1_PORT=4321",
+		"B_DB_1_ADDR=127.0.0.1:5432",
+		"B_DB_1_PORT=5432",
+	}, serviceEnv(services))
+}
+
+func TestPrepareTestServices(t *testing.T) {
+	graph := core.NewGraph()
+	data := core.NewBuildTarget(core.ParseBuildLabel("//services_test/db:schema", ""))
+	data.AddOutput("schema.sql")
+	graph.AddTarget(data)
+	db := core.NewBuildTarget(core.ParseBuildLabel("//services_test/db:db", ""))
+	db.IsBinary = true
+	db.AddOutput("db.sh")
+	db.AddDatum(data.Label)
+	graph.AddTarget(db)
+	target := core.NewBuildTarget(core.ParseBuildLabel("//services_test:client_test", ""))
+	target.IsTest = true
+	target.AddTestService(db.Label)
+	graph.AddTarget(target)
+	defer os.RemoveAll(data.OutDir())
+	defer os.RemoveAll(db.OutDir())
+	defer os.RemoveAll(target.TestDir(1))
+	require.NoError(t, os.MkdirAll(data.OutDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(data.OutDir(), "schema.sql"), []byte("CREATE TABLE x;"), 0644))
+	require.NoError(t, os.MkdirAll(db.OutDir(), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(db.OutDir(), "db.sh"), []byte(fakeService), 0755))
+
+	services, err := prepareTestServices(graph, target, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(services))
+	s := services[0]
+	assert.Equal(t, "services_test_db_db", s.Name)
+	assert.Equal(t, "db.sh", s.Binary)
+	// The service's log is one of the test's outputs.
+	assert.Equal(t, "client_test.test_services/services_test_db_db.log", s.LogFile)
+	assert.Equal(t, []string{s.LogFile}, target.TestOutputs)
+	// Its data is staged alongside it, as it would be for plz run.
+	dir := path.Join(target.TestDir(1), s.Dir())
+	assert.True(t, core.PathExists(path.Join(dir, "db.sh")))
+	assert.True(t, core.PathExists(path.Join(dir, "services_test/db/schema.sql")))
+}
+
+func TestServiceCommand(t *testing.T) {
+	dir, services := setUpServices(t, fakeService)
+	defer os.RemoveAll(dir)
+	start := time.Now()
+	out, err := runServiceCommand(dir, services, `grep -q "listening on $FAKE_PORT" fake.log`)
+	assert.NoError(t, err, string(out))
+	// The service should have been stopped, rather than left running until it exits of its own accord.
+	assert.True(t, time.Since(start) < 30*time.Second)
+}
+
+func TestServiceCommandFailedTest(t *testing.T) {
+	dir, services := setUpServices(t, fakeService)
+	defer os.RemoveAll(dir)
+	_, err := runServiceCommand(dir, services, "false")
+	assert.Error(t, err)
+}
+
+func TestServiceCommandBrokenService(t *testing.T) {
+	dir, services := setUpServices(t, brokenService)
+	defer os.RemoveAll(dir)
+	out, err := runServiceCommand(dir, services, "touch ran")
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "Test service fake exited before it was ready")
+	_, err = os.Stat(path.Join(dir, "ran"))
+	assert.True(t, os.IsNotExist(err), "test command should not have run")
+}
+
+func setUpServices(t *testing.T, script string) (string, []*testService) {
+	dir, err := ioutil.TempDir("", "services_test")
+	require.NoError(t, err)
+	s := &testService{Name: "fake", Binary: "fake.sh", LogFile: "fake.log"}
+	s.Port, err = freePort()
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(path.Join(dir, s.Dir()), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, s.Dir(), s.Binary), []byte(script), 0755))
+	return dir, []*testService{s}
+}
+
+func runServiceCommand(dir string, services []*testService, cmd string) ([]byte, error) {
+	c := exec.Command("bash", "--noprofile", "--norc", "-e", "-u", "-o", "pipefail", "-c", serviceCommand(services, cmd))
+	c.Dir = dir
+	c.Env = append(os.Environ(), serviceEnv(services)...)
+	return c.CombinedOutput()
+}
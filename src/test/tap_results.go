@@ -0,0 +1,188 @@
+// Parser for the Test Anything Protocol (TAP), versions 13 and 14.
+//
+// See https://testanything.org/tap-version-14-specification.html for the full details.
+// We are fairly lenient about what we accept; unknown lines are ignored as the spec requires.
+
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+var tapVersion = regexp.MustCompile(`^TAP version 1[34]$`)
+var tapPlan = regexp.MustCompile(`^1\.\.([0-9]+)(?:\s*#\s*(?i:skip)\S*\s*(.*))?$`)
+var tapTestPoint = regexp.MustCompile(`^(not )?ok\b\s*([0-9]+)?\s*(?:- )?([^#]*?)\s*(?:#\s*(.*))?$`)
+var tapNumberedTestPoint = regexp.MustCompile(`^(not )?ok [0-9]+(\s|$)`)
+var tapDirective = regexp.MustCompile(`^(?i:(skip|todo))\S*\s*(.*)$`)
+var tapTime = regexp.MustCompile(`^time=([0-9.]+)(ms|s)?$`)
+var tapSubtest = regexp.MustCompile(`^#\s*Subtest:\s*(.*)$`)
+var tapBailOut = regexp.MustCompile(`^Bail out!\s*(.*)$`)
+var tapYAMLMessage = regexp.MustCompile(`^\s*message:\s*['"]?(.*?)['"]?$`)
+var tapYAMLDuration = regexp.MustCompile(`^\s*duration_ms:\s*([0-9.]+)$`)
+
+// tapIndent is the indentation that TAP 14 uses for each level of subtests.
+const tapIndent = 4
+
+// looksLikeTAPTestResults returns true if the given data appears to be TAP output.
+// Test points are only recognised here if they're numbered, since otherwise they are easily
+// confused with other formats (notably the summary lines of go test, e.g. "ok  \tpkg\t0.1s").
+func looksLikeTAPTestResults(b []byte) bool {
+	line := firstLine(b)
+	return tapVersion.Match(line) || tapPlan.Match(line) || tapNumberedTestPoint.Match(line) || tapSubtest.Match(line)
+}
+
+// firstLine returns the first non-blank line of the given data, without surrounding whitespace.
+func firstLine(b []byte) []byte {
+	b = bytes.TrimSpace(b)
+	if idx := bytes.IndexByte(b, '\n'); idx != -1 {
+		return bytes.TrimSpace(b[:idx])
+	}
+	return b
+}
+
+func parseTAPTestResults(data []byte) (core.TestSuite, error) {
+	results := core.TestSuite{}
+	lines := strings.Split(string(data), "\n")
+	subtests := []string{} // Names of the subtests we are currently within
+	planned := -1
+	seen := 0
+	var last *core.TestExecution // The execution of the most recent test point, which diagnostics apply to.
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		depth := (len(line) - len(trimmed)) / tapIndent
+		if matches := tapTestPoint.FindStringSubmatch(trimmed); matches != nil {
+			if depth < len(subtests) {
+				subtests = subtests[:depth]
+			}
+			name := matches[3]
+			if name == "" {
+				name = matches[2]
+			}
+			if len(subtests) > 0 {
+				name = strings.Join(subtests, "/") + "/" + name
+			}
+			var duration time.Duration
+			execution := core.TestExecution{Duration: &duration}
+			directive, reason := "", ""
+			if d := tapDirective.FindStringSubmatch(matches[4]); d != nil {
+				directive, reason = strings.ToLower(d[1]), d[2]
+			} else if t := tapTime.FindStringSubmatch(matches[4]); t != nil {
+				// Not part of the spec, but node-tap reports durations like this.
+				f, _ := strconv.ParseFloat(t[1], 64)
+				if t[2] == "s" {
+					duration = time.Duration(f * float64(time.Second))
+				} else {
+					duration = time.Duration(f * float64(time.Millisecond))
+				}
+			}
+			if directive == "skip" {
+				execution.Skip = &core.TestResultSkip{Message: reason}
+			} else if directive == "todo" && matches[1] != "" {
+				// Failing TODO tests are expected to fail so aren't counted as failures.
+				execution.Skip = &core.TestResultSkip{Message: "TODO " + reason}
+			} else if matches[1] != "" {
+				execution.Failure = &core.TestResultFailure{Message: "not ok"}
+			}
+			results.TestCases = append(results.TestCases, core.TestCase{
+				Name:       name,
+				Executions: []core.TestExecution{execution},
+			})
+			last = &results.TestCases[len(results.TestCases)-1].Executions[0]
+			if depth == 0 {
+				seen++
+			}
+		} else if matches := tapSubtest.FindStringSubmatch(trimmed); matches != nil {
+			// Subtest headers are at the level of the parent test.
+			if depth < len(subtests) {
+				subtests = subtests[:depth]
+			}
+			subtests = append(subtests, matches[1])
+		} else if trimmed == "---" && last != nil {
+			// A YAML diagnostic block for the preceding test point.
+			block := []string{}
+			for i++; i < len(lines) && strings.TrimSpace(lines[i]) != "..."; i++ {
+				block = append(block, lines[i])
+			}
+			applyTAPDiagnostics(last, block)
+		} else if strings.HasPrefix(trimmed, "#") && last != nil {
+			appendTAPOutput(last, strings.TrimSpace(strings.TrimPrefix(trimmed, "#")))
+		} else if matches := tapBailOut.FindStringSubmatch(trimmed); matches != nil {
+			results.TestCases = append(results.TestCases, core.TestCase{
+				Name: "Bail out!",
+				Executions: []core.TestExecution{{
+					Error: &core.TestResultFailure{
+						Type:    "BailOut",
+						Message: matches[1],
+					},
+				}},
+			})
+			return results, nil
+		} else if matches := tapPlan.FindStringSubmatch(trimmed); matches != nil && depth == 0 {
+			planned, _ = strconv.Atoi(matches[1])
+			if planned == 0 && matches[2] != "" {
+				// The whole suite was skipped.
+				results.TestCases = append(results.TestCases, core.TestCase{
+					Name: "all",
+					Executions: []core.TestExecution{{
+						Skip: &core.TestResultSkip{Message: matches[2]},
+					}},
+				})
+			}
+		}
+	}
+	if planned > seen {
+		results.TestCases = append(results.TestCases, core.TestCase{
+			Name: "plan",
+			Executions: []core.TestExecution{{
+				Error: &core.TestResultFailure{
+					Type:    "PlanMismatch",
+					Message: fmt.Sprintf("Planned %d tests but only %d ran", planned, seen),
+				},
+			}},
+		})
+	}
+	for _, tc := range results.TestCases {
+		if d := tc.Executions[0].Duration; d != nil {
+			results.Duration += *d
+		}
+	}
+	return results, nil
+}
+
+// applyTAPDiagnostics applies a YAML diagnostic block to a test execution.
+// We don't fully parse the YAML, we only care about a couple of well-known fields.
+func applyTAPDiagnostics(execution *core.TestExecution, block []string) {
+	for _, line := range block {
+		if matches := tapYAMLDuration.FindStringSubmatch(line); matches != nil {
+			ms, _ := strconv.ParseFloat(matches[1], 64)
+			*execution.Duration = time.Duration(ms * float64(time.Millisecond))
+		} else if matches := tapYAMLMessage.FindStringSubmatch(line); matches != nil && execution.Failure != nil {
+			execution.Failure.Message = matches[1]
+		}
+	}
+	appendTAPOutput(execution, strings.Join(block, "\n"))
+}
+
+// appendTAPOutput adds some diagnostic output to a test execution.
+func appendTAPOutput(execution *core.TestExecution, output string) {
+	if execution.Failure != nil {
+		execution.Failure.Traceback = joinOutput(execution.Failure.Traceback, output)
+	} else {
+		execution.Stdout = joinOutput(execution.Stdout, output)
+	}
+}
+
+func joinOutput(existing, output string) string {
+	if existing == "" {
+		return output
+	}
+	return existing + "\n" + output
+}
@@ -0,0 +1,95 @@
+// Parser for the JSON output of `go tool test2json` (or `go test -json`).
+//
+// This is a lot more robust than scraping the text output of `go test -v`, which has changed
+// in various subtle ways between Go versions.
+
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A test2jsonEvent is a single event emitted by test2json.
+// See `go doc cmd/test2json` for the full description.
+type test2jsonEvent struct {
+	Time    time.Time
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64 // seconds
+	Output  string
+}
+
+// looksLikeTest2JSONTestResults returns true if the given data appears to be test2json output.
+func looksLikeTest2JSONTestResults(b []byte) bool {
+	line := firstLine(b)
+	return bytes.HasPrefix(line, []byte{'{'}) && bytes.Contains(line, []byte(`"Action":`))
+}
+
+func parseTest2JSONTestResults(data []byte) (core.TestSuite, error) {
+	results := core.TestSuite{}
+	output := map[string][]string{}
+	failed := false
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		event := test2jsonEvent{}
+		if err := json.Unmarshal(line, &event); err != nil {
+			log.Debug("Ignoring invalid test2json line %s: %s", line, err)
+			continue
+		}
+		switch event.Action {
+		case "output":
+			if event.Test != "" && !isGoTestFramingLine(event.Output) {
+				output[event.Test] = append(output[event.Test], event.Output)
+			}
+		case "pass", "fail", "skip":
+			if event.Test == "" {
+				// This is the result for the whole package.
+				failed = failed || event.Action == "fail"
+				results.Duration += time.Duration(event.Elapsed * float64(time.Second))
+				continue
+			}
+			duration := time.Duration(event.Elapsed * float64(time.Second))
+			testOutput := output[event.Test]
+			delete(output, event.Test)
+			execution := core.TestExecution{Duration: &duration}
+			if event.Action == "pass" {
+				execution.Stdout = strings.Join(testOutput, "")
+			} else if event.Action == "skip" {
+				// As with the text output, the skip message is the last thing the test logged.
+				message := ""
+				if len(testOutput) > 0 {
+					message = strings.TrimSpace(testOutput[len(testOutput)-1])
+				}
+				execution.Skip = &core.TestResultSkip{Message: message}
+			} else {
+				execution.Failure = &core.TestResultFailure{
+					Traceback: strings.TrimRight(strings.Join(testOutput, ""), "\n"),
+				}
+			}
+			results.TestCases = append(results.TestCases, core.TestCase{
+				Name:       event.Test,
+				Executions: []core.TestExecution{execution},
+			})
+		}
+	}
+	if failed && results.Failures() == 0 {
+		return results, fmt.Errorf("Test indicated final failure but no failures found yet")
+	}
+	return results, nil
+}
+
+// isGoTestFramingLine returns true if the given line of output is one that go test uses
+// to mark the start or end of a test, as opposed to something the test itself logged.
+func isGoTestFramingLine(line string) bool {
+	line = strings.TrimSpace(line)
+	return strings.HasPrefix(line, "=== ") || strings.HasPrefix(line, "--- PASS") || strings.HasPrefix(line, "--- FAIL") || strings.HasPrefix(line, "--- SKIP")
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -101,7 +102,7 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 
 	moveAndCacheOutputFiles := func(results *core.TestSuite, coverage *core.TestCoverage) bool {
 		// Never cache test results when given arguments; the results may be incomplete.
-		if len(state.TestArgs) > 0 {
+		if len(state.TestArgsFor(label)) > 0 {
 			log.Debug("Not caching results for %s, we passed it arguments", label)
 			return true
 		}
@@ -187,10 +188,12 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 	coverage := &core.TestCoverage{}
 	if state.NumTestRuns == 1 {
 		var results core.TestSuite
-		results, coverage = doFlakeRun(tid, state, target, runRemotely)
+		var partial bool
+		results, coverage, partial = doFlakeRun(tid, state, target, runRemotely)
 		target.AddTestResults(results)
+		recordHistory(target.Label, &results, hash)
 
-		if target.Results.TestCases.AllSucceeded() {
+		if target.Results.TestCases.AllSucceeded() && !partial {
 			// Success, store in cache
 			moveAndCacheOutputFiles(&target.Results, coverage)
 		}
@@ -200,44 +203,126 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 			var results core.TestSuite
 			results, coverage = doTest(tid, state, target, runRemotely, 1) // Sequential tests re-use run 1's test dir
 			target.AddTestResults(results)
+			recordHistory(target.Label, &results, hash)
 		}
 	} else {
 		state.LogBuildResult(tid, target.Label, core.TargetTesting, getRunStatus(run, state.NumTestRuns))
 		var results core.TestSuite
 		results, coverage = doTest(tid, state, target, runRemotely, run)
 		target.AddTestResults(results)
+		recordHistory(target.Label, &results, hash)
 	}
 
+	if q := getQuarantine(state.Config); q != nil {
+		q.Apply(target)
+	}
 	logTargetResults(tid, state, target, coverage, run)
 }
 
-// doFlakeRun runs a test repeatably until it succeeds or exceeds the max number of flakes for the test
-func doFlakeRun(tid int, state *core.BuildState, target *core.BuildTarget, runRemotely bool) (core.TestSuite, *core.TestCoverage) {
+// doFlakeRun runs a test repeatably until it succeeds or exceeds the max number of flakes for the test.
+// Where possible, retries only run the test cases that failed rather than the whole target; the
+// returned bool is true if that happened, in which case the outputs of the final attempt don't
+// represent the whole test and so shouldn't be cached.
+func doFlakeRun(tid int, state *core.BuildState, target *core.BuildTarget, runRemotely bool) (core.TestSuite, *core.TestCoverage, bool) {
 	coverage := &core.TestCoverage{}
 	results := core.TestSuite{}
+	var selectors []string
+	partial := false
 
 	// New group of test cases for each group of flaky runs
 	for flakes := 1; flakes <= target.Flakiness; flakes++ {
 		state.LogBuildResult(tid, target.Label, core.TargetTesting, getFlakeStatus(flakes, target.Flakiness))
 
-		testSuite, cov := doTest(tid, state, target, runRemotely, 1) // If we're running flakes, numRuns must be 1
+		testState := state
+		if selectors != nil {
+			log.Debug("Retrying %d failed test cases of %s", len(selectors), target.Label)
+			testState = state.WithTestArgs(selectors)
+			partial = true
+		}
+		testSuite, cov := doTest(tid, testState, target, runRemotely, 1) // If we're running flakes, numRuns must be 1
 
 		results.TimedOut = results.TimedOut || testSuite.TimedOut
 		results.Properties = testSuite.Properties
 		results.Duration += testSuite.Duration
 		// Each set of executions is treated as a group
 		// So if a test flakes three times, three executions will be part of one test case.
-		results.Add(testSuite.TestCases...)
+		addRetriedTestCases(&results, testSuite.TestCases)
 		coverage.Aggregate(cov)
 
 		// If execution succeeded, we can break out of the flake loop
-		if testSuite.TestCases.AllSucceeded() {
+		if results.TestCases.AllSucceeded() {
 			results.Cached = testSuite.Cached
 			break
 		}
+		selectors = retrySelectors(state, target, runRemotely, selectors, &results, &testSuite)
+	}
+
+	return results, coverage, partial
+}
+
+// addRetriedTestCases adds the test cases from a retry to the existing results.
+// Test cases that have already succeeded aren't updated; some runners don't support selecting
+// individual tests so will have rerun them, but counting those as flaky would be misleading.
+func addRetriedTestCases(results *core.TestSuite, testCases core.TestCases) {
+	for _, testCase := range testCases {
+		if idx := findTestCase(results.TestCases, testCase); idx == -1 || (results.TestCases[idx].Success() == nil && results.TestCases[idx].Skip() == nil) {
+			results.Add(testCase)
+		}
 	}
+}
 
-	return results, coverage
+func findTestCase(testCases core.TestCases, testCase core.TestCase) int {
+	for i, tc := range testCases {
+		if tc.Name == testCase.Name && tc.ClassName == testCase.ClassName {
+			return i
+		}
+	}
+	return -1
+}
+
+// selectableTestName matches test case names that are safe to pass to a test on the command line.
+var selectableTestName = regexp.MustCompile(`^[\w./:-]+$`)
+
+// retrySelectors returns the names of the test cases to retry after a failed attempt, in the
+// same way that --failed passes them, or nil if the whole target should be rerun instead.
+func retrySelectors(state *core.BuildState, target *core.BuildTarget, runRemotely bool, lastSelectors []string, results, lastAttempt *core.TestSuite) []string {
+	// Remote tests are run with the arguments from the client's state, and if the user has
+	// given us arguments then they've already selected what they want to run.
+	// Arbitrary test commands (e.g. sh_test) may not understand test names at all.
+	if !target.HasLabel(core.TestSelectionLabel) || runRemotely || len(state.TestArgsFor(target.Label)) > 0 || target.NoTestOutput || lastAttempt.TimedOut {
+		return nil
+	}
+	// If we asked for particular test cases last time and didn't get results for all of them,
+	// the test presumably doesn't support selecting them.
+	for _, name := range lastSelectors {
+		if !hasTestCaseNamed(lastAttempt.TestCases, name) {
+			return nil
+		}
+	}
+	names := []string{}
+	for _, testCase := range results.TestCases {
+		if testCase.Success() != nil || testCase.Skip() != nil {
+			continue
+		} else if testCase.Name == target.Results.Name || !selectableTestName.MatchString(testCase.Name) {
+			// Either a synthetic failure for the whole target (e.g. it crashed) or something
+			// we can't sensibly pass through as an argument.
+			return nil
+		}
+		names = append(names, testCase.Name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return names
+}
+
+func hasTestCaseNamed(testCases core.TestCases, name string) bool {
+	for _, testCase := range testCases {
+		if testCase.Name == name {
+			return true
+		}
+	}
+	return false
 }
 
 func getFlakeStatus(flake int, flakes int) string {
@@ -289,15 +374,25 @@ func logTargetResults(tid int, state *core.BuildState, target *core.BuildTarget,
 }
 
 func logTestSuccess(state *core.BuildState, tid int, label core.BuildLabel, results *core.TestSuite, coverage *core.TestCoverage) {
-	var description string
-	tests := pluralise("test", results.Tests())
-	if results.Skips() != 0 {
-		description = fmt.Sprintf("%d %s passed. %d skipped",
-			results.Tests(), tests, results.Skips())
-	} else {
-		description = fmt.Sprintf("%d %s passed.", len(results.TestCases), tests)
+	state.LogTestResult(tid, label, core.TargetTested, results, coverage, nil, testSuccessDescription(results))
+}
+
+// testSuccessDescription returns the summary shown for a successful test target.
+// Quarantined tests didn't pass so they're reported separately rather than counted among the passes.
+func testSuccessDescription(results *core.TestSuite) string {
+	passed := results.Tests() - results.Quarantined()
+	description := fmt.Sprintf("%d %s passed.", passed, pluralise("test", passed))
+	var others []string
+	if skips := results.Skips(); skips != 0 {
+		others = append(others, fmt.Sprintf("%d skipped", skips))
+	}
+	if quarantined := results.Quarantined(); quarantined != 0 {
+		others = append(others, fmt.Sprintf("%d quarantined", quarantined))
+	}
+	if len(others) != 0 {
+		description += " " + strings.Join(others, ", ")
 	}
-	state.LogTestResult(tid, label, core.TargetTested, results, coverage, nil, description)
+	return description
 }
 
 func pluralise(word string, quantity int) string {
@@ -326,19 +421,23 @@ func prepareTestDir(graph *core.BuildGraph, target *core.BuildTarget, run int) e
 func testCommandAndEnv(state *core.BuildState, target *core.BuildTarget, run int) (string, []string, error) {
 	replacedCmd, err := core.ReplaceTestSequences(state, target, target.GetTestCommand(state))
 	env := core.TestEnvironment(state, target, path.Join(core.RepoRoot, target.TestDir(run)))
-	if len(state.TestArgs) > 0 {
-		args := strings.Join(state.TestArgs, " ")
+	if testArgs := state.TestArgsFor(target.Label); len(testArgs) > 0 {
+		args := strings.Join(testArgs, " ")
 		replacedCmd += " " + args
 		env = append(env, "TESTS="+args)
 	}
 	return replacedCmd, env, err
 }
 
-func runTest(state *core.BuildState, target *core.BuildTarget, run int) ([]byte, error) {
+func runTest(state *core.BuildState, target *core.BuildTarget, run int, services []*testService) ([]byte, error) {
 	replacedCmd, env, err := testCommandAndEnv(state, target, run)
 	if err != nil {
 		return nil, err
 	}
+	if len(services) > 0 {
+		replacedCmd = serviceCommand(services, replacedCmd)
+		env = append(env, serviceEnv(services)...)
+	}
 	log.Debugf("Running test %s#%d\nENVIRONMENT:\n%s\n%s", target.Label, run, strings.Join(env, "\n"), replacedCmd)
 	_, stderr, err := state.ProcessExecutor.ExecWithTimeoutShellStdStreams(target, target.TestDir(run), env, target.TestTimeout, state.ShowAllOutput, replacedCmd, target.TestSandbox, state.DebugTests)
 	return stderr, err
@@ -364,7 +463,10 @@ func doTestResults(tid int, state *core.BuildState, target *core.BuildTarget, ru
 	var err error
 	var metadata *core.BuildMetadata
 
-	if runRemotely {
+	if runRemotely && len(target.TestServices) > 0 {
+		metadata = new(core.BuildMetadata)
+		err = fmt.Errorf("test_services aren't supported with remote execution")
+	} else if runRemotely {
 		metadata, err = state.RemoteClient.Test(tid, target, run)
 		if metadata == nil {
 			metadata = new(core.BuildMetadata)
@@ -399,7 +501,15 @@ func prepareAndRunTest(tid int, state *core.BuildState, target *core.BuildTarget
 		state.LogBuildError(tid, target.Label, core.TargetTestFailed, err, "Failed to prepare test directory for %s: %s", target.Label, err)
 		return []byte{}, err
 	}
-	return runTest(state, target, run)
+	if len(target.TestServices) == 0 {
+		return runTest(state, target, run, nil)
+	}
+	services, err := prepareTestServices(state.Graph, target, run)
+	if err != nil {
+		state.LogBuildError(tid, target.Label, core.TargetTestFailed, err, "Failed to prepare test services for %s: %s", target.Label, err)
+		return []byte{}, err
+	}
+	return runTest(state, target, run, services)
 }
 
 func parseTestOutput(stdout string, stderr string, runError error, duration time.Duration, target *core.BuildTarget, resultsData [][]byte) core.TestSuite {
@@ -0,0 +1,82 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// retryFailure is a failed execution of a test case.
+var retryFailure = core.TestExecution{Failure: &core.TestResultFailure{Message: "it broke"}}
+
+func TestRetrySelectors(t *testing.T) {
+	state, target := newFlakyTarget()
+	results := &core.TestSuite{
+		TestCases: []core.TestCase{
+			{Name: "TestPass", Executions: []core.TestExecution{{}}},
+			{Name: "TestFail", Executions: []core.TestExecution{retryFailure}},
+			{Name: "TestAlsoFail", Executions: []core.TestExecution{retryFailure}},
+		},
+	}
+	assert.Equal(t, []string{"TestFail", "TestAlsoFail"}, retrySelectors(state, target, false, nil, results, results))
+	// Can't select tests when they're running remotely.
+	assert.Nil(t, retrySelectors(state, target, true, nil, results, results))
+}
+
+func TestRetrySelectorsUnlabelled(t *testing.T) {
+	state, _ := newFlakyTarget()
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:sh_test", ""))
+	target.IsTest = true
+	target.StartTestSuite()
+	results := &core.TestSuite{TestCases: []core.TestCase{{Name: "TestFail", Executions: []core.TestExecution{retryFailure}}}}
+	assert.Nil(t, retrySelectors(state, target, false, nil, results, results))
+}
+
+func TestRetrySelectorsUserArgs(t *testing.T) {
+	state, target := newFlakyTarget()
+	results := &core.TestSuite{TestCases: []core.TestCase{{Name: "TestFail", Executions: []core.TestExecution{retryFailure}}}}
+	state.TestArgs = []string{"TestFail"}
+	assert.Nil(t, retrySelectors(state, target, false, nil, results, results))
+}
+
+func TestRetrySelectorsWholeTargetFailure(t *testing.T) {
+	state, target := newFlakyTarget()
+	// This is what we get when the test crashes without writing results.
+	results := &core.TestSuite{TestCases: []core.TestCase{{Name: target.Results.Name, Executions: []core.TestExecution{retryFailure}}}}
+	assert.Nil(t, retrySelectors(state, target, false, nil, results, results))
+	results = &core.TestSuite{TestCases: []core.TestCase{{Name: "test_thing[a b]", Executions: []core.TestExecution{retryFailure}}}}
+	assert.Nil(t, retrySelectors(state, target, false, nil, results, results))
+}
+
+func TestRetrySelectorsUnsupported(t *testing.T) {
+	state, target := newFlakyTarget()
+	results := &core.TestSuite{TestCases: []core.TestCase{{Name: "TestFail", Executions: []core.TestExecution{retryFailure}}}}
+	// The last attempt asked for TestFail but didn't get it, so selection doesn't work for this test.
+	lastAttempt := &core.TestSuite{TestCases: []core.TestCase{{Name: "TestSomethingElse", Executions: []core.TestExecution{retryFailure}}}}
+	assert.Nil(t, retrySelectors(state, target, false, []string{"TestFail"}, results, lastAttempt))
+	lastAttempt = &core.TestSuite{TestCases: []core.TestCase{{Name: "TestFail", Executions: []core.TestExecution{retryFailure}}}}
+	assert.Equal(t, []string{"TestFail"}, retrySelectors(state, target, false, []string{"TestFail"}, results, lastAttempt))
+}
+
+func TestAddRetriedTestCases(t *testing.T) {
+	results := &core.TestSuite{}
+	addRetriedTestCases(results, core.TestCases{{Name: "TestPass", Executions: []core.TestExecution{{}}}, {Name: "TestFlaky", Executions: []core.TestExecution{retryFailure}}})
+	// A runner that can't select tests will run everything again.
+	addRetriedTestCases(results, core.TestCases{{Name: "TestPass", Executions: []core.TestExecution{{}}}, {Name: "TestFlaky", Executions: []core.TestExecution{{}}}})
+	assert.Equal(t, 2, len(results.TestCases))
+	assert.Equal(t, 1, len(results.TestCases[0].Executions))
+	assert.Equal(t, 2, len(results.TestCases[1].Executions))
+	assert.Equal(t, 1, results.FlakyPasses())
+	assert.True(t, results.TestCases.AllSucceeded())
+}
+
+func newFlakyTarget() (*core.BuildState, *core.BuildTarget) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:flaky_test", ""))
+	target.IsTest = true
+	target.Flakiness = 3
+	target.AddLabel(core.TestSelectionLabel)
+	target.StartTestSuite()
+	return &core.BuildState{}, target
+}
@@ -4,6 +4,7 @@ package test
 
 import (
 	"encoding/xml"
+	"fmt"
 	"math"
 	"path"
 	"strings"
@@ -23,6 +24,12 @@ func parseXMLCoverageResults(target *core.BuildTarget, coverage *core.TestCovera
 			filename := strings.TrimPrefix(cls.Filename, core.RepoRoot)
 			// There can be multiple classes per file so we must merge here, not overwrite.
 			coverage.Files[filename] = core.MergeCoverageLines(coverage.Files[filename], parseXMLLines(cls.Lines.Line))
+			if branches := parseXMLBranches(cls.Lines.Line); len(branches) > 0 {
+				coverage.Branches[filename] = core.MergeBranchCoverage(coverage.Branches[filename], branches)
+			}
+			if functions := parseXMLMethods(cls.Methods.Method); len(functions) > 0 {
+				coverage.Functions[filename] = core.MergeFunctionCoverage(coverage.Functions[filename], functions)
+			}
 		}
 	}
 	coverage.Tests[target.Label] = coverage.Files
@@ -44,11 +51,50 @@ func parseXMLLines(lines []xmlCoverageLine) []core.LineCoverage {
 	return ret
 }
 
+// parseXMLBranches extracts branch coverage from the given lines.
+// We only get a count of branches taken for each line, so we assume that they were the first ones.
+func parseXMLBranches(lines []xmlCoverageLine) []core.BranchCoverage {
+	ret := []core.BranchCoverage{}
+	for _, line := range lines {
+		if !line.Branch {
+			continue
+		}
+		var covered, total int
+		if idx := strings.IndexByte(line.ConditionCoverage, '('); idx == -1 {
+			continue
+		} else if _, err := fmt.Sscanf(line.ConditionCoverage[idx:], "(%d/%d)", &covered, &total); err != nil {
+			continue
+		}
+		for i := 0; i < total; i++ {
+			ret = append(ret, core.BranchCoverage{Line: line.Number, Branch: i, Taken: i < covered})
+		}
+	}
+	return ret
+}
+
+// parseXMLMethods extracts function coverage from the given methods.
+func parseXMLMethods(methods []xmlCoverageMethod) []core.FunctionCoverage {
+	ret := make([]core.FunctionCoverage, 0, len(methods))
+	for _, method := range methods {
+		f := core.FunctionCoverage{Name: method.Name}
+		for _, line := range method.Lines.Line {
+			if f.Line == 0 || line.Number < f.Line {
+				f.Line = line.Number
+			}
+			f.Called = f.Called || line.Hits > 0
+		}
+		ret = append(ret, f)
+	}
+	return ret
+}
+
 // Covert the Coverage result to XML bytes, ready to be write to file
-func coverageResultToXML(sources []core.BuildLabel, coverage core.TestCoverage) []byte {
+func coverageResultToXML(sources []core.BuildLabel, allCoverage core.TestCoverage) []byte {
 	linesValid := 0
 	linesCovered := 0
-	validFiles := coverage.OrderedFiles()
+	branchesValid := 0
+	branchesCovered := 0
+	validFiles := allCoverage.OrderedFiles()
 
 	// get the string representative of sources
 	sourcesAsStr := make([]string, len(sources))
@@ -58,35 +104,45 @@ func coverageResultToXML(sources []core.BuildLabel, coverage core.TestCoverage)
 
 	// Get the list of packages for <package> tag in the coverage xml file
 	var packages []pkg
-	for label, coverage := range coverage.Tests {
+	for label, coverage := range allCoverage.Tests {
 		packageName := label.String()
 
 		// Get the list of classes for <class> tag in the coverage xml file
 		var classes []class
 		classLineRateTotal := 0.0
+		pkgBranchesCovered := 0
+		pkgBranchesValid := 0
 		for className, lineCover := range coverage {
 			// Do not include files in coverage report if its not valid
 			if !cli.ContainsString(className, validFiles) {
 				continue
 			}
 
-			lines, covered, total := getLineCoverageInfo(lineCover)
+			lines, covered, total := getLineCoverageInfo(lineCover, allCoverage.Branches[className])
 			classLineRate := float64(covered) / float64(total)
+			branchesTaken, branchesTotal := CountBranchCoverage(allCoverage.Branches[className])
 
 			cls := class{Name: className, Filename: className,
-				Lines: lines, LineRate: formatFloatPrecision(classLineRate, 4)}
+				Lines: lines, LineRate: formatFloatPrecision(classLineRate, 4),
+				BranchRate: branchRate(branchesTaken, branchesTotal),
+				Methods:    getMethodCoverageInfo(allCoverage.Functions[className])}
 
 			classes = append(classes, cls)
 			classLineRateTotal += classLineRate
 			linesValid += total
 			linesCovered += covered
+			pkgBranchesCovered += branchesTaken
+			pkgBranchesValid += branchesTotal
 		}
 
 		pkgLineRate := classLineRateTotal / float64(len(classes))
 
 		if len(classes) != 0 {
-			pkg := pkg{Name: packageName, Classes: classes, LineRate: formatFloatPrecision(pkgLineRate, 4)}
+			pkg := pkg{Name: packageName, Classes: classes, LineRate: formatFloatPrecision(pkgLineRate, 4),
+				BranchRate: branchRate(pkgBranchesCovered, pkgBranchesValid)}
 			packages = append(packages, pkg)
+			branchesCovered += pkgBranchesCovered
+			branchesValid += pkgBranchesValid
 		}
 	}
 
@@ -94,10 +150,13 @@ func coverageResultToXML(sources []core.BuildLabel, coverage core.TestCoverage)
 
 	// Create the coverage object based on the data collected
 	coverageObj := coverageType{Packages: packages, LineRate: formatFloatPrecision(topLevelLineRate, 4),
-		LinesCovered: linesCovered,
-		LinesValid:   linesValid,
-		Timestamp:    int(time.Now().UnixNano()) / int(time.Millisecond),
-		Sources:      sourcesAsStr}
+		LinesCovered:    linesCovered,
+		LinesValid:      linesValid,
+		BranchRate:      branchRate(branchesCovered, branchesValid),
+		BranchesCovered: branchesCovered,
+		BranchesValid:   branchesValid,
+		Timestamp:       int(time.Now().UnixNano()) / int(time.Millisecond),
+		Sources:         sourcesAsStr}
 
 	// Serialise struct to xml bytes
 	xmlBytes, err := xml.MarshalIndent(coverageObj, "", "	")
@@ -109,19 +168,25 @@ func coverageResultToXML(sources []core.BuildLabel, coverage core.TestCoverage)
 }
 
 // Get the line coverage info, returns: list of lines covered, num of covered lines, and total valid lines
-func getLineCoverageInfo(lineCover []core.LineCoverage) ([]line, int, int) {
+func getLineCoverageInfo(lineCover []core.LineCoverage, branches []core.BranchCoverage) ([]line, int, int) {
 	var lines []line
 	covered := 0
 	total := 0
 
+	branchesByLine := map[int][]core.BranchCoverage{}
+	for _, branch := range branches {
+		branchesByLine[branch.Line] = append(branchesByLine[branch.Line], branch)
+	}
 	for index, status := range lineCover {
 		if status == core.Covered {
 			line := line{Hits: 1, Number: index}
+			line.setBranches(branchesByLine[index+1])
 			lines = append(lines, line)
 			covered++
 			total++
 		} else if status == core.Uncovered {
 			line := line{Hits: 0, Number: index}
+			line.setBranches(branchesByLine[index+1])
 			lines = append(lines, line)
 			total++
 		}
@@ -130,6 +195,35 @@ func getLineCoverageInfo(lineCover []core.LineCoverage) ([]line, int, int) {
 	return lines, covered, total
 }
 
+// setBranches sets the branch coverage of this line from the given branches.
+func (l *line) setBranches(branches []core.BranchCoverage) {
+	if taken, total := CountBranchCoverage(branches); total > 0 {
+		l.Branch = true
+		l.ConditionCoverage = fmt.Sprintf("%d%% (%d/%d)", 100*taken/total, taken, total)
+	}
+}
+
+// Get the method coverage info from a set of function coverage.
+func getMethodCoverageInfo(functions []core.FunctionCoverage) []method {
+	methods := make([]method, len(functions))
+	for i, f := range functions {
+		hits := 0
+		if f.Called {
+			hits = 1
+		}
+		methods[i] = method{Name: f.Name, LineRate: float64(hits), Lines: []line{{Number: f.Line, Hits: hits}}}
+	}
+	return methods
+}
+
+// branchRate returns the proportion of branches taken, or 0 if we don't know about any.
+func branchRate(taken, total int) float64 {
+	if total == 0 {
+		return 0.0
+	}
+	return formatFloatPrecision(float64(taken)/float64(total), 4)
+}
+
 // format the float64 numbers to a specific precision
 func formatFloatPrecision(val float64, precision int) float64 {
 	unit := math.Pow10(precision)
@@ -146,7 +240,10 @@ type xmlCoverage struct {
 					LineRate float64 `xml:"line-rate,attr"`
 					Filename string  `xml:"filename,attr"`
 					Name     string  `xml:"name,attr"`
-					Lines    struct {
+					Methods  struct {
+						Method []xmlCoverageMethod `xml:"method"`
+					} `xml:"methods"`
+					Lines struct {
 						Line []xmlCoverageLine `xml:"line"`
 					} `xml:"lines"`
 				} `xml:"class"`
@@ -155,9 +252,18 @@ type xmlCoverage struct {
 	} `xml:"packages"`
 }
 
+type xmlCoverageMethod struct {
+	Name  string `xml:"name,attr"`
+	Lines struct {
+		Line []xmlCoverageLine `xml:"line"`
+	} `xml:"lines"`
+}
+
 type xmlCoverageLine struct {
-	Hits   int `xml:"hits,attr"`
-	Number int `xml:"number,attr"`
+	Hits              int    `xml:"hits,attr"`
+	Number            int    `xml:"number,attr"`
+	Branch            bool   `xml:"branch,attr"`
+	ConditionCoverage string `xml:"condition-coverage,attr"`
 }
 
 // Coverage struct for writing to xml file
@@ -208,6 +314,8 @@ type method struct {
 }
 
 type line struct {
-	Number int `xml:"number,attr"`
-	Hits   int `xml:"hits,attr"`
+	Number            int    `xml:"number,attr"`
+	Hits              int    `xml:"hits,attr"`
+	Branch            bool   `xml:"branch,attr,omitempty"`
+	ConditionCoverage string `xml:"condition-coverage,attr,omitempty"`
 }
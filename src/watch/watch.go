@@ -108,6 +108,11 @@ func startWatching(watcher *fsnotify.Watcher, state *core.BuildState, labels []c
 		for _, subinclude := range pkg.Subincludes {
 			startWatch(state.Graph.TargetOrDie(subinclude))
 		}
+		// Files read while parsing the package affect it too.
+		for _, read := range pkg.Reads {
+			files.Set(read.Filename, struct{}{})
+			addDir(watcher, path.Dir(read.Filename), dirs)
+		}
 	}
 
 	for _, label := range labels {
@@ -129,13 +134,7 @@ func addSource(watcher *fsnotify.Watcher, state *core.BuildState, source core.Bu
 				if !isDir {
 					dir = path.Dir(src)
 				}
-				if _, present := dirs[dir]; !present {
-					log.Notice("Adding watch on %s", dir)
-					dirs[dir] = struct{}{}
-					if err := watcher.Add(dir); err != nil {
-						log.Error("Failed to add watch on %s: %s", src, err)
-					}
-				}
+				addDir(watcher, dir, dirs)
 				return nil
 			}); err != nil {
 				log.Error("Failed to add watch on %s: %s", src, err)
@@ -144,6 +143,17 @@ func addSource(watcher *fsnotify.Watcher, state *core.BuildState, source core.Bu
 	}
 }
 
+// addDir adds a watch on a directory, if there isn't one already.
+func addDir(watcher *fsnotify.Watcher, dir string, dirs map[string]struct{}) {
+	if _, present := dirs[dir]; !present {
+		log.Notice("Adding watch on %s", dir)
+		dirs[dir] = struct{}{}
+		if err := watcher.Add(dir); err != nil {
+			log.Error("Failed to add watch on %s: %s", dir, err)
+		}
+	}
+}
+
 // anyTests returns true if any of the given labels refer to tests.
 func anyTests(state *core.BuildState, labels []core.BuildLabel) bool {
 	for _, l := range labels {